@@ -0,0 +1,97 @@
+// Package cli holds the logging and terminal helpers and the option parsing
+// shared by the command-line tools.
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// StatusLine renders a single self-updating status line on stderr. It stays
+// silent when stderr is not a terminal, so that logs remain parseable, and
+// it is used as the log output so log lines never mix with it.
+type StatusLine struct {
+	mutex   sync.Mutex
+	enabled bool
+	width   int
+}
+
+// Progress is the status line of the running tool.
+var Progress = NewStatusLine()
+
+func NewStatusLine() *StatusLine {
+	fi, err := os.Stderr.Stat()
+	return &StatusLine{enabled: err == nil && fi.Mode()&os.ModeCharDevice != 0}
+}
+
+func (p *StatusLine) Update(format string, args ...interface{}) {
+	if !p.enabled {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "\r%-*s", p.width, line)
+	p.width = len(line)
+}
+
+// Done clears the status line.
+func (p *StatusLine) Done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+}
+
+func (p *StatusLine) clear() {
+	if p.width > 0 {
+		fmt.Fprintf(os.Stderr, "\r%*s\r", p.width, "")
+		p.width = 0
+	}
+}
+
+func (p *StatusLine) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	return os.Stderr.Write(b)
+}
+
+// SetupLogger installs the default slog logger, writing to stderr through
+// Progress. Empty values fall back to the LOG_FORMAT and LOG_LEVEL
+// environment variables.
+func SetupLogger(format, level string) error {
+	if format == "" {
+		format = os.Getenv("LOG_FORMAT")
+	}
+	if level == "" {
+		level = os.Getenv("LOG_LEVEL")
+	}
+	if level == "" {
+		level = "info"
+	}
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "", "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(Progress, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(Progress, opts)))
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	return nil
+}
+
+// Fatal logs an error and exits with code 1.
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchFolder(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"INBOX", "INBOX", true},
+		{"INBOX", "INBOX/Sub", false},
+		{"Lists/*", "Lists/go/nuts", true},
+		{"Lists/*", "Lists", false},
+		{"*/Archive", "2023/Archive", true},
+		{"A*B*C", "AxxBxxC", true},
+		{"A*B*C", "AxxCxxB", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		if got := MatchFolder(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchFolder(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFolderList(t *testing.T) {
+	got := ParseFolderList(" INBOX, Lists/* ,,Sent Items")
+	if want := []string{"INBOX", "Lists/*", "Sent Items"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseFolderList() = %q, want %q", got, want)
+	}
+	if got := ParseFolderList(""); got != nil {
+		t.Errorf("ParseFolderList(\"\") = %q, want nil", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{"0": 0, "512": 512, "16M": 16 << 20, "1GB": 1 << 30, " 2 kib ": 2048} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "12T", "M"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) did not fail", s)
+		}
+	}
+}
+
+func TestParseGrace(t *testing.T) {
+	for s, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "0d": 0, "72h": 72 * time.Hour, "90m": 90 * time.Minute} {
+		if got, err := ParseGrace(s); err != nil || got != want {
+			t.Errorf("ParseGrace(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1d", "xd", "30"} {
+		if _, err := ParseGrace(s); err == nil {
+			t.Errorf("ParseGrace(%q) did not fail", s)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Package htmlsafe prepares the HTML bodies of backed up messages for
+// display by the web UI, the HTML archive and the thread export.
+package htmlsafe
+
+import "regexp"
+
+var (
+	unsafeElements   = regexp.MustCompile(`(?is)<(script|iframe|object|applet|noscript)\b.*?</(script|iframe|object|applet|noscript)\s*>`)
+	unsafeTags       = regexp.MustCompile(`(?is)</?(script|iframe|object|applet|embed|form|base|meta|link|frame|frameset)\b[^>]*>`)
+	eventAttributes  = regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	scriptURLs       = regexp.MustCompile(`(?i)(href|src|action|background)\s*=\s*(["']?)\s*(javascript|vbscript|data):`)
+	remoteReferences = regexp.MustCompile(`(?i)(src|background)\s*=\s*(["']?)\s*(https?:)?//`)
+)
+
+// Sanitize removes scripts, active content and remote resources from an
+// HTML body. The result is meant to be rendered in a sandboxed iframe, and
+// starts with a restrictive content security policy of its own.
+func Sanitize(body string) string {
+	body = unsafeElements.ReplaceAllString(body, "")
+	body = unsafeTags.ReplaceAllString(body, "")
+	body = eventAttributes.ReplaceAllString(body, "")
+	body = scriptURLs.ReplaceAllString(body, "$1=$2#blocked:")
+	body = remoteReferences.ReplaceAllString(body, "data-blocked-$1=$2//")
+	return `<meta http-equiv="Content-Security-Policy" content="default-src 'none'; style-src 'unsafe-inline'; img-src data:">` + body
+}
@@ -0,0 +1,42 @@
+package htmlsafe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		removed []string
+		kept    []string
+	}{
+		{"script", `<p>Hi</p><script type="text/javascript">alert(1)</script>`, []string{"alert", "<script"}, []string{"<p>Hi</p>"}},
+		{"unclosed tags", `<iframe src="x"><form action="/post"><base href="http://evil/">`, []string{"<iframe", "<form", "<base"}, nil},
+		{"meta of the message", `<META http-equiv="refresh" content="0;url=http://evil/">text`, []string{"refresh"}, []string{"text"}},
+		{"event attributes", `<img src="cid:1" onerror="alert(1)"><body ONLOAD=go()>`, []string{"onerror", "ONLOAD", "alert"}, []string{`<img src="cid:1">`}},
+		{"script urls", `<a href="javascript:alert(1)">x</a><a href=' data:text/html,x'>y</a>`, []string{`href="javascript:`, "href=' data:"}, []string{`href="#blocked:alert(1)"`}},
+		{"remote images", `<img src="https://tracker.example/p.gif"><td background=//cdn.example/bg.png>`, []string{`src="https:`, " background=//"}, []string{`data-blocked-src="//tracker.example/p.gif"`}},
+		{"links", `<a href="https://example.com/">site</a>`, nil, []string{`<a href="https://example.com/">site</a>`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sanitize(tt.body)
+			if !strings.HasPrefix(got, `<meta http-equiv="Content-Security-Policy"`) {
+				t.Errorf("Sanitize() = %q does not start with a content security policy", got)
+			}
+			body := strings.SplitN(got, ">", 2)[1]
+			for _, s := range tt.removed {
+				if strings.Contains(body, s) {
+					t.Errorf("Sanitize() = %q still contains %q", body, s)
+				}
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(body, s) {
+					t.Errorf("Sanitize() = %q lost %q", body, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package imapext holds the IMAP extensions go-imap has no support for,
+// and the detection of special-use mailboxes shared by the tools.
+package imapext
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// RawCommand sends a hand-built command, for extensions go-imap has no
+// support for.
+type RawCommand struct {
+	Cmd *imap.Command
+}
+
+func (r *RawCommand) Command() *imap.Command {
+	return r.Cmd
+}
+
+// SpecialUseAttrs are the RFC 6154 attributes giving the role of a mailbox.
+var SpecialUseAttrs = []string{imap.AllAttr, imap.ArchiveAttr, imap.DraftsAttr, imap.JunkAttr, imap.SentAttr, imap.TrashAttr}
+
+// specialUseNames are the usual names of special-use mailboxes, for servers
+// that send no special-use attributes at all. They are matched against the
+// whole lower-cased name, so that "Bin Invoices" is not taken for a trash.
+var specialUseNames = map[string]string{
+	"[gmail]/all mail":        imap.AllAttr,
+	"[google mail]/all mail":  imap.AllAttr,
+	"archive":                 imap.ArchiveAttr,
+	"archives":                imap.ArchiveAttr,
+	"drafts":                  imap.DraftsAttr,
+	"brouillons":              imap.DraftsAttr,
+	"[gmail]/drafts":          imap.DraftsAttr,
+	"[google mail]/drafts":    imap.DraftsAttr,
+	"junk":                    imap.JunkAttr,
+	"junk e-mail":             imap.JunkAttr,
+	"spam":                    imap.JunkAttr,
+	"courrier indésirable":    imap.JunkAttr,
+	"[gmail]/spam":            imap.JunkAttr,
+	"[google mail]/spam":      imap.JunkAttr,
+	"sent":                    imap.SentAttr,
+	"sent items":              imap.SentAttr,
+	"sent messages":           imap.SentAttr,
+	"sent mail":               imap.SentAttr,
+	"éléments envoyés":        imap.SentAttr,
+	"[gmail]/sent mail":       imap.SentAttr,
+	"[google mail]/sent mail": imap.SentAttr,
+	"trash":                   imap.TrashAttr,
+	"bin":                     imap.TrashAttr,
+	"deleted items":           imap.TrashAttr,
+	"deleted messages":        imap.TrashAttr,
+	"corbeille":               imap.TrashAttr,
+	"éléments supprimés":      imap.TrashAttr,
+	"[gmail]/trash":           imap.TrashAttr,
+	"[gmail]/bin":             imap.TrashAttr,
+	"[google mail]/trash":     imap.TrashAttr,
+	"[google mail]/bin":       imap.TrashAttr,
+}
+
+// SpecialUse returns the special-use attribute of a mailbox, or "".
+func SpecialUse(info *imap.MailboxInfo) string {
+	for _, attr := range info.Attributes {
+		for _, use := range SpecialUseAttrs {
+			if strings.EqualFold(attr, use) {
+				return use
+			}
+		}
+	}
+	return ""
+}
+
+// DetectSpecialUse returns the special use of each listed mailbox. Names
+// are only looked at when the server sent no special-use attribute, so a
+// server that has them always has the last word.
+func DetectSpecialUse(infos []*imap.MailboxInfo) map[string]string {
+	uses := make(map[string]string)
+	for _, info := range infos {
+		if use := SpecialUse(info); use != "" {
+			uses[info.Name] = use
+		}
+	}
+	if len(uses) > 0 {
+		return uses
+	}
+	for _, info := range infos {
+		name := strings.ToLower(info.Name)
+		if info.Delimiter != "" {
+			// Courier-style servers keep every folder under INBOX.
+			name = strings.TrimPrefix(name, "inbox"+strings.ToLower(info.Delimiter))
+		}
+		if use, ok := specialUseNames[name]; ok {
+			uses[info.Name] = use
+		}
+	}
+	return uses
+}
+
+// ParseSpecialUse parses a comma-separated list of special uses such as
+// "trash,junk" into attributes.
+func ParseSpecialUse(v string) ([]string, error) {
+	var attrs []string
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), `\`)
+		if part == "" {
+			continue
+		}
+		found := false
+		for _, use := range SpecialUseAttrs {
+			if strings.EqualFold(part, use[1:]) {
+				attrs = append(attrs, use)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown special use %q (expected all, archive, drafts, junk, sent or trash)", part)
+		}
+	}
+	return attrs, nil
+}
+
+// ListMailboxes lists all mailboxes. Servers announcing SPECIAL-USE are
+// asked with "RETURN (SPECIAL-USE)", since RFC 6154 allows them to leave
+// the attributes out of a plain LIST.
+func ListMailboxes(c *client.Client) ([]*imap.MailboxInfo, error) {
+	var infos []*imap.MailboxInfo
+	if ok, _ := c.Support("SPECIAL-USE"); !ok {
+		mailboxes := make(chan *imap.MailboxInfo)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.List("", "*", mailboxes)
+		}()
+		for m := range mailboxes {
+			infos = append(infos, m)
+		}
+		return infos, <-done
+	}
+
+	cmd := (&commands.List{Reference: "", Mailbox: "*"}).Command()
+	cmd.Arguments = append(cmd.Arguments, imap.RawString("RETURN"), []interface{}{imap.RawString("SPECIAL-USE")})
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != "LIST" {
+			return responses.ErrUnhandled
+		}
+		info := &imap.MailboxInfo{}
+		if err := info.Parse(fields); err != nil {
+			return err
+		}
+		infos = append(infos, info)
+		return nil
+	})
+	status, err := c.Execute(&RawCommand{cmd}, handler)
+	if err == nil {
+		err = status.Err()
+	}
+	return infos, err
+}
@@ -0,0 +1,56 @@
+package imapext
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestDetectSpecialUse(t *testing.T) {
+	tests := []struct {
+		name  string
+		infos []*imap.MailboxInfo
+		want  map[string]string
+	}{
+		{
+			name: "attributes",
+			infos: []*imap.MailboxInfo{
+				{Name: "INBOX"},
+				{Name: "Papierkorb", Attributes: []string{`\HasNoChildren`, `\trash`}},
+				{Name: "Trash"},
+			},
+			want: map[string]string{"Papierkorb": imap.TrashAttr},
+		},
+		{
+			name: "names",
+			infos: []*imap.MailboxInfo{
+				{Name: "INBOX", Delimiter: "."},
+				{Name: "INBOX.Sent Items", Delimiter: "."},
+				{Name: "[Gmail]/All Mail", Delimiter: "/"},
+				{Name: "Bin Invoices", Delimiter: "/"},
+			},
+			want: map[string]string{"INBOX.Sent Items": imap.SentAttr, "[Gmail]/All Mail": imap.AllAttr},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectSpecialUse(tt.infos); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DetectSpecialUse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSpecialUse(t *testing.T) {
+	got, err := ParseSpecialUse(`trash, \Junk,,all`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{imap.TrashAttr, imap.JunkAttr, imap.AllAttr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSpecialUse() = %q, want %q", got, want)
+	}
+	if _, err := ParseSpecialUse("inbox"); err == nil {
+		t.Error("ParseSpecialUse(inbox) did not fail")
+	}
+}
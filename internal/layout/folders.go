@@ -0,0 +1,341 @@
+package layout
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// FolderMapFile records the local directory of every backed up mailbox.
+	// Directory names are derived from mailbox names, but shortened or
+	// suffixed when needed to stay unique, so the mapping is stored and
+	// never recomputed.
+	FolderMapFile = ".folders.json"
+	// MailboxFile is written in each mailbox directory and records the
+	// mailbox name and what has been backed up from the server.
+	MailboxFile = ".mailbox.json"
+	// AttachmentsDir holds the attachments extracted from backed up
+	// messages.
+	AttachmentsDir = "_attachments"
+	// TombstonesDir holds the messages a mirror removed from its mailboxes.
+	TombstonesDir = "_tombstones"
+)
+
+// SkippedDirs are the directories of a backup that do not contain
+// mailboxes. A leading underscore is always encoded in mailbox names, so
+// they cannot clash with one.
+var SkippedDirs = []string{AttachmentsDir, TombstonesDir}
+
+// IsSkippedDir reports whether name is one of SkippedDirs.
+func IsSkippedDir(name string) bool {
+	for _, dir := range SkippedDirs {
+		if name == dir {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// maxPathPart is the longest encoded directory name kept as is, below
+	// the 255 byte limit of common file systems.
+	maxPathPart = 200
+	// maxDirLength bounds the directory of a mailbox relative to the
+	// backup directory, leaving room for the backup directory itself and
+	// file names below Windows' 260 character limit.
+	maxDirLength = 200
+	// minPathPart is the shortest a directory name is cut to, which still
+	// leaves a few characters of the name before the hash.
+	minPathPart = 24
+	// collisionMark separates a suffix added to a directory name to keep it
+	// unique. It is always encoded in mailbox names.
+	collisionMark = "~"
+)
+
+// windowsReservedNames are device names Windows refuses as file names,
+// even with an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// EncodePathPart turns one level of a mailbox name into a directory name
+// that is valid on Linux, macOS and Windows. The name is normalized to NFC,
+// then characters that are invalid or special in file names are written as
+// %XX. This covers <>:"/\|?*, %, ~, control characters, a leading dot or
+// underscore (which would clash with the backup's own files), trailing dots
+// and spaces, and Windows device names. DecodePathPart reverses it.
+func EncodePathPart(part string) string {
+	part = norm.NFC.String(part)
+	if part == "" {
+		return "_"
+	}
+
+	var sb strings.Builder
+	escape := func(s string) {
+		for _, c := range []byte(s) {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	base, _, _ := strings.Cut(part, ".")
+	reserved := windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+	for i, r := range part {
+		last := i+utf8.RuneLen(r) == len(part)
+		switch {
+		case r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*%~`, r),
+			i == 0 && (r == '.' || r == '_' || reserved),
+			last && (r == '.' || r == ' '):
+			escape(string(r))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// DecodePathPart returns the mailbox name level of a directory name made by
+// EncodePathPart, ignoring any collision suffix. The name of a shortened
+// directory is cut short; Names has the full one.
+func DecodePathPart(name string) string {
+	name, _, _ = strings.Cut(name, collisionMark)
+	if name == "_" {
+		return ""
+	}
+	var out []byte
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			if b, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, name[i])
+	}
+	return string(out)
+}
+
+// ShortenPathPart cuts an encoded directory name that is too long for file
+// systems, keeping it unique with a hash of the full name.
+func ShortenPathPart(encoded, part string) string {
+	return shortenPathPart(encoded, part, maxPathPart)
+}
+
+func shortenPathPart(encoded, part string, max int) string {
+	if len(encoded) <= max {
+		return encoded
+	}
+	cut := max - 10
+	// Do not split a %XX escape or a UTF-8 sequence.
+	for cut > 0 && (strings.LastIndexByte(encoded[:cut], '%') >= cut-2 || !utf8.RuneStart(encoded[cut])) {
+		cut--
+	}
+	sum := sha256.Sum256([]byte(part))
+	return encoded[:cut] + collisionMark + hex.EncodeToString(sum[:4])
+}
+
+// FolderMap maps mailbox names to slash-separated directories relative to
+// the backup directory.
+type FolderMap struct {
+	Folders map[string]string `json:"folders"`
+	// Delimiter is the hierarchy delimiter of the mailbox names, for the
+	// folders whose directory has no MailboxFile recording it.
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// LoadFolderMap reads the folder map of a backup directory. A missing map
+// is empty.
+func LoadFolderMap(backupDir string) (*FolderMap, error) {
+	m := &FolderMap{Folders: make(map[string]string)}
+	path := filepath.Join(backupDir, FolderMapFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading folder map: %v", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if m.Folders == nil {
+		m.Folders = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Save writes the map atomically.
+func (m *FolderMap) Save(backupDir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(backupDir, FolderMapFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing folder map: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Assign returns the directory of a mailbox, choosing a new one if needed.
+// Subfolders go below the directory of their parent when it has one.
+// Directories are compared case-insensitively, as macOS and Windows do.
+func (m *FolderMap) Assign(backupDir, name, delimiter string) string {
+	if dir, ok := m.Folders[name]; ok {
+		return dir
+	}
+	if m.Delimiter == "" {
+		m.Delimiter = delimiter
+	}
+
+	var parts []string
+	if delimiter == "" {
+		parts = []string{name}
+	} else {
+		parts = strings.Split(name, delimiter)
+	}
+
+	taken := make(map[string]bool, len(m.Folders))
+	for _, dir := range m.Folders {
+		taken[strings.ToLower(norm.NFC.String(dir))] = true
+	}
+
+	// Keep the directory of a backup made before the folder map existed.
+	legacy := make([]string, len(parts))
+	for i, part := range parts {
+		legacy[i] = SanitizePath(part)
+	}
+	legacyDir := path.Join(legacy...)
+	if recorded, _ := recordedMailbox(filepath.Join(backupDir, filepath.FromSlash(legacyDir))); recorded == name && !taken[strings.ToLower(legacyDir)] {
+		m.Folders[name] = legacyDir
+		return legacyDir
+	}
+
+	// The parent may have been given a shortened or suffixed directory.
+	parent, levels := "", parts
+	for i := len(parts) - 1; i > 0; i-- {
+		if dir, ok := m.Folders[strings.Join(parts[:i], delimiter)]; ok {
+			parent, levels = dir, parts[i:]
+			break
+		}
+	}
+
+	encoded := make([]string, len(levels))
+	for i, level := range levels {
+		encoded[i] = shortenPathPart(EncodePathPart(level), level, maxPathPart)
+	}
+	join := func() string {
+		return path.Join(append([]string{parent}, encoded...)...)
+	}
+	dir := join()
+	if len(dir) > maxDirLength {
+		// Share what is left of maxDirLength between the new levels.
+		max := (maxDirLength-len(parent))/len(levels) - 1
+		if max < minPathPart {
+			max = minPathPart
+		}
+		for i, level := range levels {
+			encoded[i] = shortenPathPart(encoded[i], level, max)
+		}
+		dir = join()
+	}
+	last := encoded[len(encoded)-1]
+	for n := 2; taken[strings.ToLower(dir)]; n++ {
+		encoded[len(encoded)-1] = last + collisionMark + strconv.Itoa(n)
+		dir = join()
+	}
+	m.Folders[name] = dir
+	return dir
+}
+
+// recordedMailbox returns the mailbox name and delimiter recorded in the
+// MailboxFile of a directory.
+func recordedMailbox(dir string) (string, string) {
+	data, err := os.ReadFile(filepath.Join(dir, MailboxFile))
+	if err != nil {
+		return "", ""
+	}
+	var meta struct {
+		Mailbox   string `json:"mailbox"`
+		Delimiter string `json:"delimiter"`
+	}
+	if json.Unmarshal(data, &meta) != nil {
+		return "", ""
+	}
+	return meta.Mailbox, meta.Delimiter
+}
+
+// Names holds the mailbox name level of the directories of a backup, by
+// slash-separated path relative to the backup directory. Tools reading a
+// backup use it rather than decoding directory names, which may have been
+// shortened.
+type Names map[string]string
+
+// LoadNames reads the names of a backup from its folder map and from the
+// delimiters recorded in each mailbox directory.
+func LoadNames(backupDir string) (Names, error) {
+	m, err := LoadFolderMap(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(Names)
+	for name, dir := range m.Folders {
+		recorded, delimiter := recordedMailbox(filepath.Join(backupDir, filepath.FromSlash(dir)))
+		if recorded != name || delimiter == "" {
+			delimiter = m.Delimiter
+		}
+		levels := []string{name}
+		if delimiter != "" {
+			levels = strings.Split(name, delimiter)
+		}
+		dirs := strings.Split(dir, "/")
+		if len(levels) != len(dirs) {
+			// Not laid out by Assign, e.g. an mbox tree.
+			continue
+		}
+		for i := range dirs {
+			names[strings.Join(dirs[:i+1], "/")] = levels[i]
+		}
+	}
+	return names, nil
+}
+
+// Levels returns the mailbox name levels of a directory, decoding the
+// directory names the backup has no name for.
+func (n Names) Levels(dir string) []string {
+	dirs := strings.Split(dir, "/")
+	levels := make([]string, len(dirs))
+	for i, d := range dirs {
+		if name, ok := n[strings.Join(dirs[:i+1], "/")]; ok {
+			levels[i] = name
+		} else {
+			levels[i] = DecodePathPart(d)
+		}
+	}
+	return levels
+}
+
+// Level returns the last mailbox name level of a directory.
+func (n Names) Level(dir string) string {
+	levels := n.Levels(dir)
+	return levels[len(levels)-1]
+}
+
+// Mailbox returns the mailbox name of a directory, with "/" as hierarchy
+// delimiter.
+func (n Names) Mailbox(dir string) string {
+	return strings.Join(n.Levels(dir), "/")
+}
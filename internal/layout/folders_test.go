@@ -0,0 +1,95 @@
+package layout
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodePathPart(t *testing.T) {
+	for _, name := range []string{"INBOX", "a/b:c", "100%", ".hidden", "_x", "CON", "trailing. ", "~tilde", ""} {
+		encoded := EncodePathPart(name)
+		if strings.ContainsAny(encoded, `<>:"/\|?*`) {
+			t.Errorf("EncodePathPart(%q) = %q has invalid characters", name, encoded)
+		}
+		if got := DecodePathPart(encoded); got != name {
+			t.Errorf("DecodePathPart(EncodePathPart(%q)) = %q", name, got)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	dir := t.TempDir()
+	m := &FolderMap{Folders: make(map[string]string)}
+
+	long := strings.Repeat("x", 300)
+	parent := m.Assign(dir, long, ".")
+	if len(parent) > maxPathPart {
+		t.Fatalf("directory of a long name has %d bytes", len(parent))
+	}
+
+	// A child goes below the shortened directory of its parent.
+	child := m.Assign(dir, long+".Child", ".")
+	if want := parent + "/Child"; child != want {
+		t.Errorf("child directory = %q, want %q", child, want)
+	}
+
+	// A case collision gets a suffix.
+	if got := m.Assign(dir, "INBOX", "."); got != "INBOX" {
+		t.Errorf("INBOX directory = %q", got)
+	}
+	if got := m.Assign(dir, "Inbox", "."); got != "Inbox~2" {
+		t.Errorf("Inbox directory = %q, want Inbox~2", got)
+	}
+
+	// Deep hierarchies stay within maxDirLength.
+	levels := make([]string, 6)
+	for i := range levels {
+		levels[i] = strings.Repeat(string(rune('a'+i)), 100)
+	}
+	if got := m.Assign(dir, strings.Join(levels, "/"), "/"); len(got) > maxDirLength {
+		t.Errorf("deep directory has %d bytes, want at most %d", len(got), maxDirLength)
+	}
+
+	// Assigned directories are kept.
+	if got := m.Assign(dir, long+".Child", "."); got != child {
+		t.Errorf("second assignment = %q, want %q", got, child)
+	}
+}
+
+func TestLoadNames(t *testing.T) {
+	dir := t.TempDir()
+	m := &FolderMap{Folders: make(map[string]string)}
+	long := strings.Repeat("é", 150)
+	child := m.Assign(dir, long+".Sub~dir", ".")
+	imported := m.Assign(dir, "Imported/Old", "/")
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Imported folders record another delimiter.
+	if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(imported)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"mailbox": "Imported/Old", "delimiter": "/"}`
+	if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(imported), MailboxFile), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := LoadNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names.Mailbox(child), long+"/Sub~dir"; got != want {
+		t.Errorf("Mailbox(%q) = %q, want %q", child, got, want)
+	}
+	if got := names.Level(child); got != "Sub~dir" {
+		t.Errorf("Level(%q) = %q, want Sub~dir", child, got)
+	}
+	if got := names.Mailbox(imported); got != "Imported/Old" {
+		t.Errorf("Mailbox(%q) = %q, want Imported/Old", imported, got)
+	}
+	if got := names.Mailbox("Not%3Amapped"); got != "Not:mapped" {
+		t.Errorf("Mailbox of an unmapped directory = %q, want Not:mapped", got)
+	}
+}
@@ -0,0 +1,18 @@
+// Package layout holds the conventions of the backup directory layout
+// shared by the tools reading and writing it.
+package layout
+
+import "strings"
+
+// SanitizePath replaces the characters that are invalid in file names on
+// common file systems with "_".
+func SanitizePath(path string) string {
+	invalid := []string{"<", ">", ":", "\"", "/", "\\", "|", "?", "*"}
+	result := path
+
+	for _, char := range invalid {
+		result = strings.ReplaceAll(result, char, "_")
+	}
+
+	return result
+}
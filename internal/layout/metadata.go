@@ -0,0 +1,99 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// FolderMetadata is the synchronization state of one backed up mailbox.
+// It lets later runs fetch only new messages, and follow flag changes and
+// server-side expunges.
+type FolderMetadata struct {
+	Mailbox       string                      `json:"mailbox"`
+	Delimiter     string                      `json:"delimiter"`
+	UidValidity   uint32                      `json:"uid_validity"`
+	UidNext       uint32                      `json:"uid_next"`
+	HighestModSeq uint64                      `json:"highest_modseq,omitempty"`
+	Gmail         bool                        `json:"gmail,omitempty"`
+	SpecialUse    string                      `json:"special_use,omitempty"`
+	LastSync      time.Time                   `json:"last_sync"`
+	Messages      map[uint32]*MessageMetadata `json:"messages"`
+	Expunged      []*MessageMetadata          `json:"expunged,omitempty"`
+}
+
+// MessageMetadata describes one backed up message. File is relative to the
+// mailbox directory.
+type MessageMetadata struct {
+	Uid          uint32    `json:"uid"`
+	File         string    `json:"file"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internal_date"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	// Stored tells what was saved of a message when not all of it was.
+	Stored        string              `json:"stored,omitempty"`
+	BodyStructure *imap.BodyStructure `json:"body_structure,omitempty"`
+	ModSeq        uint64              `json:"modseq,omitempty"`
+	ExpungedAt    *time.Time          `json:"expunged_at,omitempty"`
+	// Tombstone is where a mirror moved the file of an expunged message,
+	// relative to the backup directory.
+	Tombstone string `json:"tombstone,omitempty"`
+
+	GmailLabels   []string `json:"gmail_labels,omitempty"`
+	GmailThreadID uint64   `json:"gmail_thread_id,omitempty"`
+	GmailMsgID    uint64   `json:"gmail_msg_id,omitempty"`
+}
+
+// LoadFolderMetadata reads the MailboxFile of a mailbox directory. A
+// missing file gives empty metadata.
+func LoadFolderMetadata(mailboxPath string) (*FolderMetadata, error) {
+	meta := &FolderMetadata{Messages: make(map[uint32]*MessageMetadata)}
+
+	data, err := os.ReadFile(filepath.Join(mailboxPath, MailboxFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading mailbox metadata: %v", err)
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filepath.Join(mailboxPath, MailboxFile), err)
+	}
+	if meta.Messages == nil {
+		meta.Messages = make(map[uint32]*MessageMetadata)
+	}
+	return meta, nil
+}
+
+// Save writes the metadata atomically.
+func (m *FolderMetadata) Save(mailboxPath string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(mailboxPath, MailboxFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing mailbox metadata: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Expunge moves a message to the list of messages deleted on the server.
+// Its file is kept.
+func (m *FolderMetadata) Expunge(uid uint32) {
+	msg, ok := m.Messages[uid]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	msg.ExpungedAt = &now
+	m.Expunged = append(m.Expunged, msg)
+	delete(m.Messages, uid)
+}
@@ -0,0 +1,31 @@
+package layout
+
+import "testing"
+
+func TestFolderMetadata(t *testing.T) {
+	dir := t.TempDir()
+	meta, err := LoadFolderMetadata(dir)
+	if err != nil || meta.UidValidity != 0 || len(meta.Messages) != 0 {
+		t.Fatalf("LoadFolderMetadata of a new directory = %+v, %v, want empty metadata", meta, err)
+	}
+
+	meta.Mailbox, meta.Delimiter, meta.UidValidity = "Work.Projects", ".", 5
+	meta.Messages[7] = &MessageMetadata{Uid: 7, File: "7.eml", Size: 42}
+	meta.Messages[8] = &MessageMetadata{Uid: 8, File: "8.eml", Size: 10}
+	meta.Expunge(8)
+	meta.Expunge(9)
+	if err := meta.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadFolderMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mailbox != "Work.Projects" || got.UidValidity != 5 || len(got.Messages) != 1 || got.Messages[7].File != "7.eml" {
+		t.Errorf("loaded %+v, want the saved mailbox with message 7", got)
+	}
+	if len(got.Expunged) != 1 || got.Expunged[0].Uid != 8 || got.Expunged[0].ExpungedAt == nil {
+		t.Errorf("expunged %+v, want message 8 with its expunge time", got.Expunged)
+	}
+}
@@ -0,0 +1,257 @@
+// Package metrics is a minimal registry rendering the Prometheus text
+// format, for the /metrics endpoint and node_exporter textfiles. Each tool
+// declares its metrics with Define and records them through the package
+// functions, which use Default.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Def describes a metric: its Prometheus type and help text.
+type Def struct {
+	Kind string
+	Help string
+}
+
+// CommandDuration is the histogram of IMAP command latencies recorded by
+// ObserveCommand. It is declared by every registry.
+const CommandDuration = "imap_command_duration_seconds"
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Registry holds the values of a set of metrics. Only declared metrics are
+// rendered.
+type Registry struct {
+	mutex      sync.Mutex
+	defs       map[string]Def
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// Default is the registry of the running tool.
+var Default = New(nil)
+
+func New(defs map[string]Def) *Registry {
+	r := &Registry{
+		defs:       map[string]Def{CommandDuration: {"histogram", "Latency of IMAP commands."}},
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+	r.Define(defs)
+	return r
+}
+
+// Define declares metrics of the registry.
+func (r *Registry) Define(defs map[string]Def) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, def := range defs {
+		r.defs[name] = def
+	}
+}
+
+// formatLabels turns key/value pairs into a Prometheus label set.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], escaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *Registry) Add(name string, value float64, labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.values[name] == nil {
+		r.values[name] = make(map[string]float64)
+	}
+	r.values[name][formatLabels(labels)] += value
+}
+
+func (r *Registry) Set(name string, value float64, labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.values[name] == nil {
+		r.values[name] = make(map[string]float64)
+	}
+	r.values[name][formatLabels(labels)] = value
+}
+
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.histograms[name] == nil {
+		r.histograms[name] = make(map[string]*histogram)
+	}
+	key := formatLabels(labels)
+	h := r.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		r.histograms[name][key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveCommand records the latency of an IMAP command started at start.
+func (r *Registry) ObserveCommand(account, command string, start time.Time) {
+	r.Observe(CommandDuration, time.Since(start).Seconds(), "account", account, "command", command)
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var buf strings.Builder
+	for _, name := range sortedKeys(r.defs) {
+		def := r.defs[name]
+		if len(r.values[name]) == 0 && len(r.histograms[name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, def.Help, name, def.Kind)
+
+		for _, key := range sortedKeys(r.values[name]) {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, key, strconv.FormatFloat(r.values[name][key], 'f', -1, 64))
+		}
+
+		for _, key := range sortedKeys(r.histograms[name]) {
+			h := r.histograms[name][key]
+			labels := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+			if labels != "" {
+				labels += ","
+			}
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(&buf, "%s_bucket{%sle=\"%v\"} %d\n", name, labels, bound, h.counts[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, key, strconv.FormatFloat(h.sum, 'f', -1, 64))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+
+	n, err := io.WriteString(w, buf.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// WriteTextfile writes the metrics for the node_exporter textfile
+// collector. The file is replaced atomically so it is never read half
+// written.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return fmt.Errorf("error creating metrics file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing metrics file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing metrics file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore reads back the given metrics from a textfile written by a previous
+// run, keeping the values set by this one. A failed one-shot run must not
+// lose when the last successful one ended. A missing file is not an error.
+func (r *Registry) Restore(path string, names ...string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading metrics file: %v", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, name := range names {
+			rest, ok := strings.CutPrefix(line, name)
+			if !ok || !strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, " ") {
+				continue
+			}
+			i := strings.LastIndexByte(rest, ' ')
+			value, err := strconv.ParseFloat(rest[i+1:], 64)
+			if err != nil {
+				continue
+			}
+			key := rest[:i]
+			if r.values[name] == nil {
+				r.values[name] = make(map[string]float64)
+			}
+			if _, ok := r.values[name][key]; !ok {
+				r.values[name][key] = value
+			}
+		}
+	}
+	return nil
+}
+
+// ListenAndServe exposes the metrics on addr at /metrics.
+func (r *Registry) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return http.ListenAndServe(addr, mux)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Define declares metrics of Default.
+func Define(defs map[string]Def) { Default.Define(defs) }
+
+func Add(name string, value float64, labels ...string) { Default.Add(name, value, labels...) }
+
+func Set(name string, value float64, labels ...string) { Default.Set(name, value, labels...) }
+
+func ObserveCommand(account, command string, start time.Time) {
+	Default.ObserveCommand(account, command, start)
+}
+
+func WriteTextfile(path string) error { return Default.WriteTextfile(path) }
+
+func Restore(path string, names ...string) error { return Default.Restore(path, names...) }
+
+func ListenAndServe(addr string) error { return Default.ListenAndServe(addr) }
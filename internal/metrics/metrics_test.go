@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := New(map[string]Def{"test_total": {Kind: "counter", Help: "Test things."}})
+	r.Add("test_total", 2, "mailbox", `a"b`)
+	r.Add("test_total", 1, "mailbox", `a"b`)
+	r.Add("undeclared_total", 1)
+	r.ObserveCommand("user", "fetch", time.Now())
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{mailbox="a\"b"} 3` + "\n",
+		`imap_command_duration_seconds_bucket{account="user",command="fetch",le="+Inf"} 1` + "\n",
+		`imap_command_duration_seconds_count{account="user",command="fetch"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "undeclared_total") {
+		t.Errorf("undeclared metric rendered:\n%s", out.String())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	defs := map[string]Def{"last_success": {Kind: "gauge", Help: "Last success."}, "runs_total": {Kind: "counter", Help: "Runs."}}
+	path := filepath.Join(t.TempDir(), "tool.prom")
+	previous := New(defs)
+	previous.Set("last_success", 100, "account", "a")
+	previous.Set("last_success", 200, "account", "b")
+	previous.Add("runs_total", 5)
+	if err := previous.WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(defs)
+	r.Set("last_success", 300, "account", "b")
+	if err := r.Restore(path, "last_success"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	r.WriteTo(&out)
+	for _, want := range []string{`last_success{account="a"} 100`, `last_success{account="b"} 300`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "runs_total") {
+		t.Errorf("metric not asked for was restored:\n%s", out.String())
+	}
+
+	if err := r.Restore(filepath.Join(t.TempDir(), "missing.prom"), "last_success"); err != nil {
+		t.Errorf("Restore of a missing file: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package runreport implements the machine-readable summary the tools write
+// at the end of a run. Each tool embeds Run and Folder in its own report,
+// next to the counters it keeps.
+package runreport
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Exit codes, so that wrappers can tell a partial run from a failed one.
+const (
+	ExitSuccess        = 0
+	ExitFailure        = 1
+	ExitPartialFailure = 3
+)
+
+// Folder holds the outcome of a run for one mailbox.
+type Folder struct {
+	Name            string   `json:"name"`
+	Errors          []string `json:"errors,omitempty"`
+	DurationSeconds float64  `json:"duration_seconds"`
+
+	started time.Time
+}
+
+// NewFolder starts the report of a mailbox.
+func NewFolder(name string) Folder {
+	return Folder{Name: name, started: time.Now()}
+}
+
+// Base returns f, so that the reports embedding it implement FolderReport.
+func (f *Folder) Base() *Folder {
+	return f
+}
+
+func (f *Folder) AddError(err error) {
+	f.Errors = append(f.Errors, err.Error())
+}
+
+// Start restarts the clock of the folder, for work done after it was
+// reported on.
+func (f *Folder) Start() {
+	f.started = time.Now()
+}
+
+func (f *Folder) Finish() {
+	f.DurationSeconds = time.Since(f.started).Seconds()
+}
+
+// FolderReport is implemented by the folder reports of the tools, through
+// the Folder they embed.
+type FolderReport interface {
+	Base() *Folder
+}
+
+// Run is the part of a run report common to all tools.
+type Run[F FolderReport] struct {
+	Command         string    `json:"command"`
+	Account         string    `json:"account"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ErrorCount      int       `json:"error_count"`
+	Errors          []string  `json:"errors,omitempty"`
+	Folders         []F       `json:"folders"`
+
+	newFolder func(name string) F
+}
+
+// New starts a run report. newFolder creates the report of a mailbox the
+// first time it is asked for.
+func New[F FolderReport](command, account string, newFolder func(name string) F) Run[F] {
+	return Run[F]{
+		Command:   command,
+		Account:   account,
+		StartedAt: time.Now(),
+		Folders:   []F{},
+		newFolder: newFolder,
+	}
+}
+
+// Folder returns the report of a mailbox, starting it on first use.
+func (r *Run[F]) Folder(name string) F {
+	for _, f := range r.Folders {
+		if f.Base().Name == name {
+			return f
+		}
+	}
+	f := r.newFolder(name)
+	r.Folders = append(r.Folders, f)
+	return f
+}
+
+// Fail records an error that stopped the run.
+func (r *Run[F]) Fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *Run[F]) HasErrors() bool {
+	if len(r.Errors) > 0 {
+		return true
+	}
+	for _, f := range r.Folders {
+		if len(f.Base().Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Finish computes the duration, error count and status of the run and
+// returns the process exit code. Tools sum their own counters before
+// calling it.
+func (r *Run[F]) Finish() int {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+
+	r.ErrorCount = len(r.Errors)
+	for _, f := range r.Folders {
+		r.ErrorCount += len(f.Base().Errors)
+	}
+
+	switch {
+	case len(r.Errors) > 0:
+		r.Status = "failed"
+		return ExitFailure
+	case r.ErrorCount > 0:
+		r.Status = "partial"
+		return ExitPartialFailure
+	default:
+		r.Status = "success"
+		return ExitSuccess
+	}
+}
+
+// Write writes report as JSON to path, to stdout if path is "-", or to
+// stderr if path is empty, so that it doesn't mix with the output of
+// commands printing to stdout unless asked to.
+func Write(report interface{}, path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	switch path {
+	case "":
+		_, err = os.Stderr.Write(data)
+		return err
+	case "-":
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,304 @@
+// Package threading groups messages into conversations, following the
+// algorithm described in https://www.jwz.org/doc/threading.html.
+package threading
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header holds what threading needs to know of a message.
+type Header struct {
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Subject    string
+	Date       time.Time
+}
+
+// Message is a message to thread.
+type Message interface {
+	ThreadHeader() Header
+}
+
+// Container is a node of the thread tree. A container without a message
+// stands for a message that is referenced but was not found.
+type Container struct {
+	ID      string
+	Message Message
+	// Copies are other messages with the same Message-ID, such as the same
+	// message stored in several folders.
+	Copies   []Message
+	Parent   *Container
+	Children []*Container
+}
+
+func (c *Container) hasDescendant(other *Container) bool {
+	if c == other {
+		return true
+	}
+	for _, child := range c.Children {
+		if child.hasDescendant(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Container) removeChild(child *Container) {
+	for i, ch := range c.Children {
+		if ch == child {
+			c.Children = append(c.Children[:i], c.Children[i+1:]...)
+			break
+		}
+	}
+	child.Parent = nil
+}
+
+func (c *Container) addChild(child *Container) {
+	if child.Parent != nil {
+		child.Parent.removeChild(child)
+	}
+	child.Parent = c
+	c.Children = append(c.Children, child)
+}
+
+// Date returns the date of the first message found in the subtree.
+func (c *Container) Date() time.Time {
+	if c.Message != nil {
+		return c.Message.ThreadHeader().Date
+	}
+	for _, child := range c.Children {
+		if d := child.Date(); !d.IsZero() {
+			return d
+		}
+	}
+	return time.Time{}
+}
+
+// Subject returns the subject of the first message found in the subtree.
+func (c *Container) Subject() string {
+	if c.Message != nil {
+		return c.Message.ThreadHeader().Subject
+	}
+	for _, child := range c.Children {
+		if s := child.Subject(); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// Walk calls fn for every container of the subtree holding a message, in
+// thread order. depth counts the messages above it.
+func (c *Container) Walk(depth int, fn func(c *Container, depth int)) {
+	if c.Message != nil {
+		fn(c, depth)
+		depth++
+	}
+	for _, child := range c.Children {
+		child.Walk(depth, fn)
+	}
+}
+
+// Forest is the result of threading a set of messages.
+type Forest struct {
+	// Roots are the top containers of the threads, oldest first.
+	Roots      []*Container
+	containers map[string]*Container
+}
+
+func (f *Forest) container(id string) *Container {
+	c, ok := f.containers[id]
+	if !ok {
+		c = &Container{ID: id}
+		f.containers[id] = c
+	}
+	return c
+}
+
+// Root returns the root of the thread containing the message with the given
+// Message-ID, without angle brackets, or nil if there is none.
+func (f *Forest) Root(messageID string) *Container {
+	c, ok := f.containers[messageID]
+	if !ok || c.Message == nil {
+		return nil
+	}
+	for c.Parent != nil {
+		c = c.Parent
+	}
+	return c
+}
+
+// Build threads messages by their References and In-Reply-To headers, then
+// by subject for threads whose links are missing.
+func Build(messages []Message) *Forest {
+	f := &Forest{containers: make(map[string]*Container)}
+
+	for i, msg := range messages {
+		h := msg.ThreadHeader()
+		id := h.MessageID
+		if id == "" {
+			// Messages without an ID still need a container of their own.
+			id = "\x00" + strconv.Itoa(i)
+		}
+		c := f.container(id)
+		if c.Message != nil {
+			c.Copies = append(c.Copies, msg)
+			continue
+		}
+		c.Message = msg
+
+		var refs []string
+		for _, ref := range h.References {
+			if ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+		if h.InReplyTo != "" && (len(refs) == 0 || refs[len(refs)-1] != h.InReplyTo) {
+			refs = append(refs, h.InReplyTo)
+		}
+
+		var prev *Container
+		for _, ref := range refs {
+			rc := f.container(ref)
+			if prev != nil && rc.Parent == nil && !rc.hasDescendant(prev) {
+				prev.addChild(rc)
+			}
+			prev = rc
+		}
+
+		if c.Parent != nil {
+			c.Parent.removeChild(c)
+		}
+		if prev != nil && !c.hasDescendant(prev) {
+			prev.addChild(c)
+		}
+	}
+
+	// Map order is random: sort the roots so that the same messages always
+	// give the same threads, in the same order.
+	var roots []*Container
+	for _, c := range f.containers {
+		if c.Parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].ID < roots[j].ID })
+
+	var pruned []*Container
+	for _, root := range roots {
+		pruned = append(pruned, prune(root, true)...)
+	}
+
+	f.Roots = groupBySubject(pruned)
+	for _, root := range f.Roots {
+		sortContainers(root.Children)
+	}
+	return f
+}
+
+// prune removes empty containers, promoting their children. At the root
+// level an empty container is only kept if it groups several children.
+func prune(c *Container, isRoot bool) []*Container {
+	var children []*Container
+	for _, child := range c.Children {
+		children = append(children, prune(child, false)...)
+	}
+	c.Children = nil
+	for _, child := range children {
+		child.Parent = c
+		c.Children = append(c.Children, child)
+	}
+
+	if c.Message != nil {
+		return []*Container{c}
+	}
+	if len(c.Children) == 0 {
+		return nil
+	}
+	if !isRoot || len(c.Children) == 1 {
+		for _, child := range c.Children {
+			child.Parent = nil
+		}
+		return c.Children
+	}
+	return []*Container{c}
+}
+
+var subjectPrefix = regexp.MustCompile(`(?i)^\s*((re|fwd?|tr|aw|wg|sv)(\[\d+\])?\s*:\s*)+`)
+
+// BaseSubject returns a subject without its reply and forward prefixes,
+// lower-cased.
+func BaseSubject(s string) string {
+	return strings.ToLower(strings.TrimSpace(subjectPrefix.ReplaceAllString(s, "")))
+}
+
+// groupBySubject merges root threads that share the same base subject, when
+// the references needed to link them are missing.
+func groupBySubject(roots []*Container) []*Container {
+	sortContainers(roots)
+
+	bySubject := make(map[string]*Container)
+	var result []*Container
+	for _, root := range roots {
+		subject := BaseSubject(root.Subject())
+		existing, ok := bySubject[subject]
+		if subject == "" || !ok {
+			bySubject[subject] = root
+			result = append(result, root)
+			continue
+		}
+
+		isReply := root.Message != nil && subjectPrefix.MatchString(root.Message.ThreadHeader().Subject)
+		existingIsReply := existing.Message != nil && subjectPrefix.MatchString(existing.Message.ThreadHeader().Subject)
+		switch {
+		case existing.Message == nil && root.Message == nil:
+			for _, child := range append([]*Container{}, root.Children...) {
+				existing.addChild(child)
+			}
+		case existing.Message == nil:
+			existing.addChild(root)
+		case isReply && !existingIsReply:
+			existing.addChild(root)
+		default:
+			group := &Container{}
+			for i, r := range result {
+				if r == existing {
+					result[i] = group
+				}
+			}
+			group.addChild(existing)
+			group.addChild(root)
+			bySubject[subject] = group
+		}
+	}
+	return result
+}
+
+// key returns the ID of the container, or of its first child for the
+// containers grouping threads by subject, which have none.
+func (c *Container) key() string {
+	if c.ID == "" && len(c.Children) > 0 {
+		return c.Children[0].key()
+	}
+	return c.ID
+}
+
+// sortContainers sorts by date, then by Message-ID for messages sent at the
+// same time.
+func sortContainers(list []*Container) {
+	sort.SliceStable(list, func(i, j int) bool {
+		di, dj := list[i].Date(), list[j].Date()
+		if !di.Equal(dj) {
+			return di.Before(dj)
+		}
+		return list[i].key() < list[j].key()
+	})
+	for _, c := range list {
+		sortContainers(c.Children)
+	}
+}
@@ -0,0 +1,76 @@
+package threading
+
+import (
+	"testing"
+	"time"
+)
+
+type testMessage Header
+
+func (m *testMessage) ThreadHeader() Header { return Header(*m) }
+
+func ids(roots []*Container) []string {
+	var result []string
+	for _, root := range roots {
+		root.Walk(0, func(c *Container, depth int) {
+			result = append(result, c.ID)
+		})
+	}
+	return result
+}
+
+func TestBuildReplies(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	messages := []Message{
+		&testMessage{MessageID: "c", InReplyTo: "b", References: []string{"a", "b"}, Subject: "Re: hello", Date: date.Add(2 * time.Hour)},
+		&testMessage{MessageID: "a", Subject: "hello", Date: date},
+		&testMessage{MessageID: "b", InReplyTo: "a", Subject: "Re: hello", Date: date.Add(time.Hour)},
+		&testMessage{MessageID: "a", Subject: "hello", Date: date},
+	}
+
+	f := Build(messages)
+	if len(f.Roots) != 1 {
+		t.Fatalf("got %d threads, want 1", len(f.Roots))
+	}
+	if got := ids(f.Roots); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("got thread %v, want [a b c]", got)
+	}
+	if copies := f.Root("a").Copies; len(copies) != 1 {
+		t.Errorf("got %d copies of a, want 1", len(copies))
+	}
+	if f.Root("c") != f.Root("a") {
+		t.Errorf("c is not in the thread of a")
+	}
+}
+
+func TestBuildSameDateOrder(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var messages []Message
+	for _, id := range []string{"e", "b", "d", "a", "c"} {
+		messages = append(messages, &testMessage{MessageID: id, Subject: "subject " + id, Date: date})
+	}
+
+	want := "abcde"
+	for i := 0; i < 20; i++ {
+		got := ""
+		for _, id := range ids(Build(messages).Roots) {
+			got += id
+		}
+		if got != want {
+			t.Fatalf("got roots %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	for in, want := range map[string]string{
+		"Re: Fwd: Hello":  "hello",
+		"RE[2]: hello ":   "hello",
+		"Hello: world":    "hello: world",
+		"  aw:  sv: Test": "test",
+	} {
+		if got := BaseSubject(in); got != want {
+			t.Errorf("BaseSubject(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,233 +1,6771 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
+	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
 	"github.com/joho/godotenv"
+
+	"imap-backup/internal/cli"
+	"imap-backup/internal/htmlsafe"
+	"imap-backup/internal/imapext"
+	"imap-backup/internal/layout"
+	"imap-backup/internal/metrics"
+	"imap-backup/internal/runreport"
+)
+
+// Backup modes. An archive never deletes anything locally; a mirror moves
+// messages expunged on the server into a dated tombstone directory and
+// purges it after a grace period.
+const (
+	modeArchive = "archive"
+	modeMirror  = "mirror"
+)
+
+const defaultTombstoneGrace = 30 * 24 * time.Hour
+
+// What was saved of a message, when not all of it was. Backups made
+// before messages above the size limit kept their header record them as
+// "none", without a file.
+const storedHeaders = "headers"
+
+// defaultMaxMessageMemory is the largest part of a message fetched at once.
+const defaultMaxMessageMemory = 16 << 20
+
+// Exit codes, so that wrappers can tell a partial backup from a failed one.
+const (
+	exitSuccess        = runreport.ExitSuccess
+	exitFailure        = runreport.ExitFailure
+	exitPartialFailure = runreport.ExitPartialFailure
 )
 
 type ImapConfig struct {
-	Host      string
-	Port      string
-	User      string
-	Password  string
-	BackupDir string
+	Host               string
+	Port               string
+	User               string
+	Password           string
+	BackupDir          string
+	ExtractAttachments bool
+	Mode               string
+	TombstoneGrace     time.Duration
+	// Gmail backs up [Gmail]/All Mail only, recording the labels of each
+	// message instead of downloading it once per label folder.
+	Gmail bool
+	// ExcludeSpecialUse lists special-use attributes (e.g. \Trash) of
+	// mailboxes that are not backed up.
+	ExcludeSpecialUse []string
+	// MaxMessageSize skips messages larger than this, 0 for no limit.
+	// FolderSizeLimits override it for matching mailboxes, and mailboxes
+	// matching HeadersOnly only get their headers and MIME structure saved.
+	MaxMessageSize   int64
+	FolderSizeLimits []FolderSizeLimit
+	HeadersOnly      []string
+	// MaxMessageMemory caps the bytes of a message held in memory. Larger
+	// messages are fetched in chunks of this size. 0 disables the cap.
+	MaxMessageMemory int64
 }
 
+// tlsConfig is used to connect to IMAP servers. nil verifies them with the
+// system roots; tests set it to trust their own server.
+var tlsConfig *tls.Config
+
 type Backup struct {
-	config    ImapConfig
-	client    *client.Client
-	delimiter string
-	mutex     sync.Mutex
+	config      ImapConfig
+	client      *client.Client
+	delimiter   string
+	mutex       sync.Mutex
+	attachments *AttachmentExtractor
+	report      *RunReport
+	logger      *slog.Logger
+
+	// Server extensions used to follow flag changes and expunges cheaply.
+	condstore bool
+	qresync   bool
+	gmail     bool
+
+	// specialUse maps mailbox names to their RFC 6154 special use.
+	specialUse map[string]string
+	// listed holds every mailbox on the server, backed up or not.
+	listed map[string]bool
+	// transfer is set when messages are only fetched for migrate or sync,
+	// which are not backups and leave the backup metrics alone.
+	transfer bool
 }
 
 func NewBackup(config ImapConfig) *Backup {
 	return &Backup{
 		config: config,
+		report: NewRunReport("backup", config.User),
+		logger: slog.Default().With("account", config.User),
 	}
 }
 
-func (b *Backup) Start() error {
-	log.Println("Starting IMAP backup...")
+// Report returns the summary of the last run.
+func (b *Backup) Report() *RunReport {
+	return b.report
+}
 
+// connect dials the server and logs in.
+func (b *Backup) connect() error {
 	addr := fmt.Sprintf("%s:%s", b.config.Host, b.config.Port)
-	log.Printf("Connecting to %s...", addr)
+	b.logger.Info("Connecting", "op", "connect", "addr", addr)
 
-	c, err := client.DialTLS(addr, nil)
+	c, err := client.DialTLS(addr, tlsConfig)
 	if err != nil {
+		b.recordError("connect")
 		return fmt.Errorf("connection error: %v", err)
 	}
 	b.client = c
-	defer b.client.Logout()
 
-	log.Printf("Connected to IMAP server")
+	b.logger.Debug("Connected to IMAP server", "op", "connect", "addr", addr)
 
-	log.Printf("Logging in as %s...", b.config.User)
-	if err := b.client.Login(b.config.User, b.config.Password); err != nil {
+	start := time.Now()
+	err = b.client.Login(b.config.User, b.config.Password)
+	metrics.ObserveCommand(b.config.User, "login", start)
+	if err != nil {
+		b.client.Logout()
+		b.recordError("login")
 		return fmt.Errorf("login error: %v", err)
 	}
-	log.Println("Login successful")
+	b.logger.Info("Login successful", "op", "login")
+
+	b.condstore, _ = b.client.Support("CONDSTORE")
+	b.qresync, _ = b.client.Support("QRESYNC")
+	if b.config.Gmail {
+		if ok, _ := b.client.Support("X-GM-EXT-1"); !ok {
+			b.client.Logout()
+			return fmt.Errorf("gmail mode: server does not advertise X-GM-EXT-1")
+		}
+		b.gmail = true
+	}
+	return nil
+}
+
+func (b *Backup) Start() error {
+	b.logger.Info("Starting IMAP backup")
+
+	if err := b.connect(); err != nil {
+		return err
+	}
+	defer b.client.Logout()
+
+	if b.qresync {
+		if _, err := b.client.Enable([]string{"QRESYNC"}); err != nil {
+			b.logger.Warn("Could not enable QRESYNC", "op", "enable", "error", err)
+			b.qresync = false
+		}
+	}
+	b.logger.Debug("Server extensions", "condstore", b.condstore, "qresync", b.qresync, "gmail", b.gmail)
+	if ok, _ := b.client.Support("X-GM-EXT-1"); ok && !b.gmail {
+		b.logger.Info("Server supports Gmail extensions, --gmail would avoid downloading messages once per label")
+	}
 
 	if err := os.MkdirAll(b.config.BackupDir, 0755); err != nil {
+		b.recordError("filesystem")
 		return fmt.Errorf("error creating directory: %v", err)
 	}
-	log.Printf("Using backup directory: %s", b.config.BackupDir)
+	b.logger.Info("Using backup directory", "dir", b.config.BackupDir, "mode", b.config.Mode)
 
-	log.Println("Getting mailbox list...")
-	mailboxes := make(chan *imap.MailboxInfo)
-	done := make(chan error, 1)
-	go func() {
-		done <- b.client.List("", "*", mailboxes)
-	}()
+	if b.config.Mode == modeMirror {
+		b.purgeTombstones()
+	}
+
+	if b.config.ExtractAttachments {
+		extractor, err := NewAttachmentExtractor(b.config.BackupDir)
+		if err != nil {
+			return err
+		}
+		b.attachments = extractor
+		defer func() {
+			if err := extractor.Save(); err != nil {
+				b.logger.Error("Error writing attachments manifest", "op", "extract", "error", err)
+			}
+		}()
+	}
+
+	boxes, err := b.folders()
+	if err != nil {
+		return err
+	}
+
+	for _, mailboxName := range boxes {
+		folder := b.report.Folder(mailboxName)
+		err := b.backupMailbox(mailboxName, folder)
+		folder.Finish()
+		if err != nil {
+			folder.AddError(err)
+			b.logger.Error("Error backing up mailbox", "mailbox", mailboxName, "error", err)
+			continue
+		}
+	}
+	if b.config.Mode == modeMirror {
+		b.tombstoneDeletedMailboxes()
+	}
+
+	if b.report.HasErrors() {
+		b.logger.Warn("Backup completed with errors")
+	} else {
+		b.logger.Info("Backup completed")
+	}
+	return nil
+}
+
+// folders lists the mailboxes to work on, leaving out excluded special-use
+// mailboxes and, in Gmail mode, everything but All Mail.
+func (b *Backup) folders() ([]string, error) {
+	b.logger.Debug("Getting mailbox list", "op", "list")
+	infos, err := b.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
 
 	var boxes []string
-	for mbox := range mailboxes {
+	allMail := ""
+	b.listed = make(map[string]bool)
+	for _, mbox := range infos {
+		b.listed[mbox.Name] = true
 		if b.delimiter == "" && mbox.Delimiter != "" {
 			b.delimiter = mbox.Delimiter
 		}
+		use := b.specialUse[mbox.Name]
+		if use == imap.AllAttr {
+			allMail = mbox.Name
+		}
+		if use != "" && containsFold(b.config.ExcludeSpecialUse, use) {
+			b.logger.Info("Excluding folder", "op", "list", "mailbox", mbox.Name, "special_use", use)
+			continue
+		}
 		boxes = append(boxes, mbox.Name)
 	}
 
-	if err := <-done; err != nil {
-		return fmt.Errorf("listing error: %v", err)
+	if b.config.Gmail {
+		if allMail == "" {
+			return nil, fmt.Errorf("gmail mode: no All Mail folder found")
+		}
+		b.logger.Info("Gmail mode, backing up All Mail only", "op", "list", "mailbox", allMail)
+		boxes = []string{allMail}
 	}
 
-	log.Println("\nFound folder structure:")
+	b.logger.Info("Found folder structure", "op", "list", "mailboxes", len(boxes))
 	for _, name := range boxes {
-		log.Printf("- %s", name)
+		b.logger.Debug("Found mailbox", "op", "list", "mailbox", name)
 	}
+	return boxes, nil
+}
 
-	for _, mailboxName := range boxes {
-		if err := b.backupMailbox(mailboxName); err != nil {
-			log.Printf("Error backing up %s: %v", mailboxName, err)
-			continue
+func (b *Backup) backupMailbox(mailboxName string, folder *FolderReport) error {
+	logger := b.logger.With("mailbox", mailboxName)
+	logger.Info("Processing mailbox")
+
+	mailboxPath, err := b.mailboxPath(mailboxName)
+	if err != nil {
+		return err
+	}
+	// A watcher only holds the lock while it saves new messages.
+	lock, err := lockMailbox(mailboxPath, time.Minute)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	meta, err := layout.LoadFolderMetadata(mailboxPath)
+	if err != nil {
+		b.recordError("filesystem")
+		return err
+	}
+	meta.Mailbox = mailboxName
+	meta.Delimiter = b.delimiter
+	meta.Gmail = b.gmail
+	meta.SpecialUse = b.specialUse[mailboxName]
+
+	// HIGHESTMODSEQ is read before selecting, so that changes made while the
+	// mailbox is synchronized are seen again by the next run.
+	var highestModSeq uint64
+	if b.condstore {
+		start := time.Now()
+		status, err := b.client.Status(mailboxName, []imap.StatusItem{statusHighestModSeq})
+		metrics.ObserveCommand(b.config.User, "status", start)
+		if err != nil {
+			b.recordError("status")
+			return fmt.Errorf("error reading mailbox status: %v", err)
+		}
+		highestModSeq = parseUint64(status.Items[statusHighestModSeq])
+	}
+
+	start := time.Now()
+	mbox, err := b.client.Select(mailboxName, true)
+	metrics.ObserveCommand(b.config.User, "select", start)
+	if err != nil {
+		b.recordError("select")
+		return fmt.Errorf("error selecting mailbox: %v", err)
+	}
+
+	if meta.UidValidity != mbox.UidValidity && len(meta.Messages) > 0 {
+		logger.Warn("UIDVALIDITY changed, backing up the whole mailbox again", "op", "select",
+			"old", meta.UidValidity, "new", mbox.UidValidity)
+		for uid := range meta.Messages {
+			meta.Expunge(uid)
+		}
+		meta.UidNext, meta.HighestModSeq = 0, 0
+	}
+	meta.UidValidity = mbox.UidValidity
+
+	errorsBefore := len(folder.Errors)
+	if err := b.syncChanges(mailboxName, mbox, meta, folder); err != nil {
+		return err
+	}
+	if b.config.Mode == modeMirror {
+		b.tombstoneExpunged(mailboxName, mailboxPath, meta, folder)
+	}
+
+	newUids, err := b.newMessages(mbox, meta)
+	if err != nil {
+		b.recordError("search")
+		return err
+	}
+	logger.Info("Found messages", "op", "select", "messages", mbox.Messages, "new", len(newUids))
+	if meta.UidNext == 0 && len(meta.Messages) == 0 && len(newUids) > 0 {
+		if newUids, err = b.adoptLegacyFiles(mailboxName, mailboxPath, newUids, meta); err != nil {
+			return err
+		}
+	}
+	if refetch := b.refetchable(mailboxName, meta); len(refetch) > 0 {
+		logger.Info("Backing up messages skipped under earlier settings", "op", "fetch", "messages", len(refetch))
+		newUids = append(refetch, newUids...)
+	}
+
+	if len(newUids) > 0 {
+		defer cli.Progress.Done()
+	}
+	const batchSize = 100
+	for i := 0; i < len(newUids); i += batchSize {
+		end := i + batchSize
+		if end > len(newUids) {
+			end = len(newUids)
+		}
+
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(newUids[i:end]...)
+		err := b.backupUids(mailboxName, mailboxPath, seqSet, folder, meta)
+		if saveErr := meta.Save(mailboxPath); saveErr != nil {
+			b.recordError("filesystem")
+			return saveErr
+		}
+		if err != nil {
+			b.recordError("fetch")
+			return fmt.Errorf("error backing up UIDs %d-%d: %v", newUids[i], newUids[end-1], err)
 		}
 	}
 
-	log.Println("Backup completed!")
+	// The sync position only moves forward once everything up to it is
+	// safely stored, so failed messages are retried by the next run.
+	if len(folder.Errors) == errorsBefore {
+		meta.UidNext = mbox.UidNext
+		meta.HighestModSeq = highestModSeq
+	}
+	meta.LastSync = time.Now()
+	if err := meta.Save(mailboxPath); err != nil {
+		b.recordError("filesystem")
+		return err
+	}
 	return nil
 }
 
-func (b *Backup) backupMailbox(mailboxName string) error {
-	log.Printf("\nProcessing mailbox: %s", mailboxName)
+// adoptLegacyFiles links messages to the files of a backup made before
+// layout.MailboxFile existed, instead of downloading them again. Files are
+// matched by Message-ID, size and Date header. It returns the UIDs that are
+// still to be downloaded.
+func (b *Backup) adoptLegacyFiles(mailboxName, mailboxPath string, uids []uint32, meta *layout.FolderMetadata) ([]uint32, error) {
+	entries, err := os.ReadDir(mailboxPath)
+	if err != nil {
+		b.recordError("filesystem")
+		return nil, err
+	}
+	legacy := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".eml") {
+			continue
+		}
+		if key := legacyFileKey(filepath.Join(mailboxPath, entry.Name())); key != "" {
+			legacy[key] = append(legacy[key], entry.Name())
+		}
+	}
+	if len(legacy) == 0 {
+		return uids, nil
+	}
 
-	relativePath := strings.Split(mailboxName, b.delimiter)
-	safePath := make([]string, len(relativePath))
-	for i, part := range relativePath {
-		safePath[i] = sanitizePath(part)
+	logger := b.logger.With("mailbox", mailboxName)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchFlags, imap.FetchInternalDate}
+	if b.gmail {
+		items = append(items, gmailFetchItems...)
 	}
 
-	mailboxPath := filepath.Join(append([]string{b.config.BackupDir}, safePath...)...)
-	if err := os.MkdirAll(mailboxPath, 0755); err != nil {
-		return fmt.Errorf("error creating directory %s: %v", mailboxPath, err)
+	var remaining []uint32
+	adopted := 0
+	const batchSize = 500
+	for i := 0; i < len(uids); i += batchSize {
+		end := i + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids[i:end]...)
+
+		found := make(map[uint32]bool)
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			done <- b.client.UidFetch(seqSet, items, messages)
+		}()
+		for msg := range messages {
+			if msg.Envelope == nil {
+				continue
+			}
+			id := strings.Trim(strings.TrimSpace(msg.Envelope.MessageId), "<>")
+			key := legacyKey(id, int64(msg.Size), msg.Envelope.Date)
+			files := legacy[key]
+			if id == "" || len(files) == 0 {
+				continue
+			}
+			legacy[key] = files[1:]
+
+			path := filepath.Join(mailboxPath, files[0])
+			sum, err := fileSHA256(path)
+			if err != nil {
+				logger.Warn("Error reading backed up message", "op", "adopt", "file", files[0], "error", err)
+				continue
+			}
+			meta.Messages[msg.Uid] = &layout.MessageMetadata{
+				Uid:          msg.Uid,
+				File:         files[0],
+				Flags:        msg.Flags,
+				InternalDate: msg.InternalDate,
+				Size:         int64(msg.Size),
+				SHA256:       sum,
+			}
+			if b.gmail {
+				setGmailAttributes(meta.Messages[msg.Uid], msg)
+			}
+			found[msg.Uid] = true
+			adopted++
+		}
+		err := <-done
+		metrics.ObserveCommand(b.config.User, "fetch", start)
+		if err != nil {
+			b.recordError("fetch")
+			return nil, fmt.Errorf("error fetching envelopes: %v", err)
+		}
+
+		for _, uid := range uids[i:end] {
+			if !found[uid] {
+				remaining = append(remaining, uid)
+			}
+		}
 	}
 
-	mbox, err := b.client.Select(mailboxName, true)
+	if adopted > 0 {
+		logger.Info("Adopted messages of an earlier backup", "op", "adopt", "messages", adopted, "to_download", len(remaining))
+	}
+	return remaining, nil
+}
+
+// legacyFileKey returns the key a stored message is adopted by, or "" for
+// messages without a Message-ID.
+func legacyFileKey(path string) string {
+	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("error selecting mailbox: %v", err)
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+
+	h, err := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ""
+	}
+	header := mail.HeaderFromMap(h)
+	id, _ := header.MessageID()
+	if id == "" {
+		return ""
+	}
+	date, _ := header.Date()
+	return legacyKey(id, info.Size(), date)
+}
+
+func legacyKey(id string, size int64, date time.Time) string {
+	if date.IsZero() {
+		return fmt.Sprintf("%s/%d", id, size)
+	}
+	return fmt.Sprintf("%s/%d/%d", id, size, date.Unix())
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
+// newMessages returns the UIDs of the mailbox that are not backed up yet.
+func (b *Backup) newMessages(mbox *imap.MailboxStatus, meta *layout.FolderMetadata) ([]uint32, error) {
 	if mbox.Messages == 0 {
-		log.Printf("Empty folder: %s", mailboxName)
+		return nil, nil
+	}
+
+	from := meta.UidNext
+	if from == 0 {
+		from = 1
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(from, 0)
+
+	start := time.Now()
+	uids, err := b.client.UidSearch(criteria)
+	metrics.ObserveCommand(b.config.User, "search", start)
+	if err != nil {
+		return nil, fmt.Errorf("search error: %v", err)
+	}
+
+	// "n:*" always matches the last message, even below n, and messages
+	// saved by watch mode may already be known.
+	var result []uint32
+	for _, uid := range uids {
+		if _, known := meta.Messages[uid]; uid >= from && !known {
+			result = append(result, uid)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+// syncChanges updates the stored flags of known messages and records the
+// ones expunged on the server. With QRESYNC both come from a single
+// CHANGEDSINCE fetch, with CONDSTORE expunges need a UID search, and
+// otherwise the flags of every message are fetched.
+func (b *Backup) syncChanges(mailboxName string, mbox *imap.MailboxStatus, meta *layout.FolderMetadata, folder *FolderReport) error {
+	if len(meta.Messages) == 0 {
 		return nil
 	}
+	logger := b.logger.With("mailbox", mailboxName)
 
-	log.Printf("Found %d messages in %s", mbox.Messages, mailboxName)
+	var (
+		changed []*imap.Message
+		present map[uint32]bool
+		err     error
+	)
+	switch {
+	case mbox.Messages == 0:
+		present = map[uint32]bool{}
+	case b.condstore && meta.HighestModSeq > 0:
+		var vanished *imap.SeqSet
+		logger.Debug("Fetching changes", "op", "sync", "changedsince", meta.HighestModSeq, "qresync", b.qresync)
+		changed, vanished, err = b.fetchChangedSince(meta, b.qresync, b.gmail)
+		if err != nil {
+			b.recordError("fetch")
+			return fmt.Errorf("error fetching changes: %v", err)
+		}
+		if b.qresync {
+			for uid := range meta.Messages {
+				if vanished.Contains(uid) {
+					b.expunged(mailboxName, meta, uid, folder)
+				}
+			}
+			break
+		}
 
-	const batchSize = 100
-	for i := uint32(1); i <= mbox.Messages; i += batchSize {
-		end := i + batchSize - 1
-		if end > mbox.Messages {
-			end = mbox.Messages
+		start := time.Now()
+		uids, err := b.client.UidSearch(imap.NewSearchCriteria())
+		metrics.ObserveCommand(b.config.User, "search", start)
+		if err != nil {
+			b.recordError("search")
+			return fmt.Errorf("search error: %v", err)
+		}
+		present = make(map[uint32]bool, len(uids))
+		for _, uid := range uids {
+			present[uid] = true
 		}
+	default:
+		logger.Debug("Scanning flags of all messages", "op", "sync")
+		seqSet := new(imap.SeqSet)
+		seqSet.AddRange(1, 0)
+		messages := make(chan *imap.Message, 100)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+			if b.gmail {
+				items = append(items, gmailLabelsItem)
+			}
+			done <- b.client.UidFetch(seqSet, items, messages)
+		}()
+		present = make(map[uint32]bool)
+		for msg := range messages {
+			present[msg.Uid] = true
+			changed = append(changed, msg)
+		}
+		err := <-done
+		metrics.ObserveCommand(b.config.User, "fetch", start)
+		if err != nil {
+			b.recordError("fetch")
+			return fmt.Errorf("error fetching flags: %v", err)
+		}
+	}
 
-		if err := b.backupMessageBatch(mailboxName, mailboxPath, i, end); err != nil {
-			return fmt.Errorf("error backing up batch %d-%d: %v", i, end, err)
+	for _, msg := range changed {
+		m, ok := meta.Messages[msg.Uid]
+		if !ok {
+			continue
 		}
+		labels := parseGmailLabels(msg.Items[gmailLabelsItem])
+		flagsChanged := !sameFlags(m.Flags, msg.Flags)
+		labelsChanged := b.gmail && !sameFlags(m.GmailLabels, labels)
+		if !flagsChanged && !labelsChanged {
+			continue
+		}
+		logger.Debug("Flags changed", "op", "sync", "uid", msg.Uid, "flags", strings.Join(msg.Flags, " "))
+		m.Flags = msg.Flags
+		if labelsChanged {
+			m.GmailLabels = labels
+		}
+		if modSeq := parseUint64(msg.Items[fetchModSeq]); modSeq > 0 {
+			m.ModSeq = modSeq
+		}
+		folder.FlagsUpdated++
+		metrics.Add("imap_backup_flag_changes_total", 1, "account", b.config.User, "mailbox", mailboxName)
 	}
 
+	if present != nil {
+		for uid := range meta.Messages {
+			if !present[uid] {
+				b.expunged(mailboxName, meta, uid, folder)
+			}
+		}
+	}
 	return nil
 }
 
-func (b *Backup) backupMessageBatch(mailboxName, mailboxPath string, start, end uint32) error {
-	seqSet := new(imap.SeqSet)
-	seqSet.AddRange(start, end)
-
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{section.FetchItem()}
-
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
+func (b *Backup) expunged(mailboxName string, meta *layout.FolderMetadata, uid uint32, folder *FolderReport) {
+	b.logger.Debug("Message expunged on server", "mailbox", mailboxName, "op", "sync", "uid", uid)
+	meta.Expunge(uid)
+	folder.Expunged++
+	metrics.Add("imap_backup_expunged_total", 1, "account", b.config.User, "mailbox", mailboxName)
+}
 
-	go func() {
-		done <- b.client.Fetch(seqSet, items, messages)
-	}()
+// tombstoneExpunged moves the files of expunged messages into
+// _tombstones/<date>/<mailbox path>, and forgets the ones whose tombstone
+// has already been purged.
+func (b *Backup) tombstoneExpunged(mailboxName, mailboxPath string, meta *layout.FolderMetadata, folder *FolderReport) {
+	rel, err := filepath.Rel(b.config.BackupDir, mailboxPath)
+	if err != nil {
+		folder.AddError(err)
+		return
+	}
+	dir := filepath.Join(layout.TombstonesDir, time.Now().Format("2006-01-02"), rel)
 
-	for msg := range messages {
-		r := msg.GetBody(section)
-		if r == nil {
-			log.Printf("Warning: no body for message %d in %s", msg.SeqNum, mailboxName)
+	kept := meta.Expunged[:0]
+	moved := 0
+	for _, msg := range meta.Expunged {
+		if msg.Tombstone != "" {
+			if _, err := os.Stat(filepath.Join(b.config.BackupDir, msg.Tombstone)); err == nil {
+				kept = append(kept, msg)
+			}
 			continue
 		}
 
-		if err := b.saveMessage(r, mailboxPath, int(msg.SeqNum)); err != nil {
-			log.Printf("Error saving message %d: %v", msg.SeqNum, err)
+		if msg.File == "" {
+			// Skipped messages have nothing to keep.
 			continue
 		}
-
-		log.Printf("\rProgress: %d/%d in %s", msg.SeqNum, end, mailboxName)
+		if err := os.MkdirAll(filepath.Join(b.config.BackupDir, dir), 0755); err != nil {
+			b.recordError("filesystem")
+			folder.AddError(fmt.Errorf("error creating tombstone directory: %v", err))
+			kept = append(kept, msg)
+			continue
+		}
+		target := filepath.Join(dir, msg.File)
+		err := os.Rename(filepath.Join(mailboxPath, msg.File), filepath.Join(b.config.BackupDir, target))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			b.recordError("filesystem")
+			folder.AddError(fmt.Errorf("UID %d: error moving to tombstones: %v", msg.Uid, err))
+			kept = append(kept, msg)
+			continue
+		}
+		msg.Tombstone = target
+		kept = append(kept, msg)
+		moved++
 	}
+	meta.Expunged = kept
 
-	return <-done
+	if moved > 0 {
+		b.logger.Info("Moved expunged messages to tombstones", "mailbox", mailboxName, "op", "tombstone", "messages", moved, "dir", dir)
+	}
 }
 
-func (b *Backup) saveMessage(r io.Reader, mailboxPath string, seqNum int) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+// tombstoneDeletedMailboxes moves the files of mailboxes that are no longer
+// on the server into _tombstones/<date>/<mailbox path>, like those of
+// expunged messages. Subfolders are left alone, as their mailboxes may still
+// exist, and so are folders that were imported rather than backed up.
+func (b *Backup) tombstoneDeletedMailboxes() {
+	folders, err := loadBackupFolders(b.config.BackupDir)
+	if err != nil {
+		b.recordError("filesystem")
+		b.report.Folder(layout.TombstonesDir).AddError(err)
+		return
+	}
 
-	filename := fmt.Sprintf("%d_%d.eml", time.Now().UnixNano(), seqNum)
-	filepath := filepath.Join(mailboxPath, filename)
+	for _, f := range folders {
+		if b.listed[f.Meta.Mailbox] || f.Meta.UidValidity == 0 {
+			continue
+		}
+		folder := b.report.Folder(f.Meta.Mailbox)
+		if err := b.tombstoneMailbox(f); err != nil {
+			b.recordError("filesystem")
+			b.logger.Error("Error moving deleted mailbox to tombstones", "mailbox", f.Meta.Mailbox, "op", "tombstone", "error", err)
+			folder.AddError(err)
+		}
+		folder.Finish()
+	}
+}
 
-	f, err := os.Create(filepath)
+func (b *Backup) tombstoneMailbox(f BackupFolder) error {
+	lock, err := lockMailbox(f.Dir, 0)
 	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+		return err
 	}
-	defer f.Close()
+	rel, err := filepath.Rel(b.config.BackupDir, f.Dir)
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+	dir := filepath.Join(b.config.BackupDir, layout.TombstonesDir, time.Now().Format("2006-01-02"), rel)
 
-	buf := make([]byte, 32*1024)
-	_, err = io.CopyBuffer(f, r, buf)
+	entries, err := os.ReadDir(f.Dir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	moved := 0
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		if entry.IsDir() || entry.Name() == mailboxLockFile {
+			continue
+		}
+		err = os.Rename(filepath.Join(f.Dir, entry.Name()), filepath.Join(dir, entry.Name()))
+		if strings.HasSuffix(entry.Name(), ".eml") && err == nil {
+			moved++
+		}
+	}
+	lock.Unlock()
 	if err != nil {
-		return fmt.Errorf("error writing message: %v", err)
+		return fmt.Errorf("error moving to tombstones: %v", err)
 	}
+	// Only removed when no subfolder is left in it.
+	os.Remove(f.Dir)
 
+	b.report.Folder(f.Meta.Mailbox).Expunged += moved
+	metrics.Add("imap_backup_expunged_total", float64(moved), "account", b.config.User, "mailbox", f.Meta.Mailbox)
+	b.logger.Info("Moved mailbox deleted on the server to tombstones", "mailbox", f.Meta.Mailbox, "op", "tombstone", "messages", moved, "dir", dir)
 	return nil
 }
 
-func sanitizePath(path string) string {
-	invalid := []string{"<", ">", ":", "\"", "/", "\\", "|", "?", "*"}
-	result := path
+// purgeTombstones removes the dated tombstone directories older than the
+// grace period. Failures are reported under the _tombstones folder, as they
+// don't affect the backup itself.
+func (b *Backup) purgeTombstones() {
+	root := filepath.Join(b.config.BackupDir, layout.TombstonesDir)
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		b.recordError("filesystem")
+		b.logger.Error("Error purging tombstones", "op", "purge", "error", err)
+		b.report.Folder(layout.TombstonesDir).AddError(err)
+		return
+	}
+
+	cutoff := time.Now().Add(-b.config.TombstoneGrace)
+	for _, entry := range entries {
+		day, err := time.ParseInLocation("2006-01-02", entry.Name(), time.Local)
+		if !entry.IsDir() || err != nil || !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+
+		dir := filepath.Join(root, entry.Name())
+		purged := 0
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.HasSuffix(d.Name(), ".eml") {
+				purged++
+			}
+			return nil
+		})
+		if err := os.RemoveAll(dir); err != nil {
+			b.recordError("filesystem")
+			b.logger.Error("Error purging tombstones", "op", "purge", "dir", dir, "error", err)
+			b.report.Folder(layout.TombstonesDir).AddError(err)
+			continue
+		}
+		b.report.TombstonesPurged += purged
+		metrics.Add("imap_backup_tombstones_purged_total", float64(purged), "account", b.config.User)
+		b.logger.Info("Purged tombstones", "op", "purge", "dir", dir, "messages", purged)
+	}
+}
+
+// fetchChangedSince runs "UID FETCH 1:<last known> (UID FLAGS MODSEQ)
+// (CHANGEDSINCE <modseq> [VANISHED])" and returns the changed messages and,
+// with QRESYNC, the UIDs expunged since then.
+func (b *Backup) fetchChangedSince(meta *layout.FolderMetadata, vanished, gmail bool) ([]*imap.Message, *imap.SeqSet, error) {
+	var maxUid uint32
+	for uid := range meta.Messages {
+		if uid > maxUid {
+			maxUid = uid
+		}
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, maxUid)
 
-	for _, char := range invalid {
-		result = strings.ReplaceAll(result, char, "_")
+	fetch := &commands.Fetch{SeqSet: seqSet, Items: []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModSeq}}
+	if gmail {
+		fetch.Items = append(fetch.Items, gmailLabelsItem)
 	}
+	cmd := (&commands.Uid{Cmd: fetch}).Command()
+	modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(meta.HighestModSeq, 10))}
+	if vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	cmd.Arguments = append(cmd.Arguments, modifiers)
 
-	return result
+	var changed []*imap.Message
+	expunged := new(imap.SeqSet)
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok {
+			return responses.ErrUnhandled
+		}
+		switch {
+		case name == "FETCH" && len(fields) >= 2:
+			msgFields, _ := fields[1].([]interface{})
+			msg := &imap.Message{}
+			if err := msg.Parse(msgFields); err != nil {
+				return err
+			}
+			if msg.Uid == 0 {
+				return responses.ErrUnhandled
+			}
+			changed = append(changed, msg)
+		case name == "VANISHED" && len(fields) >= 1:
+			uids, err := imap.ParseSeqSet(fmt.Sprint(fields[len(fields)-1]))
+			if err != nil {
+				return err
+			}
+			expunged.AddSet(uids)
+		default:
+			return responses.ErrUnhandled
+		}
+		return nil
+	})
+
+	start := time.Now()
+	status, err := b.client.Execute(&imapext.RawCommand{Cmd: cmd}, handler)
+	metrics.ObserveCommand(b.config.User, "fetch", start)
+	if err == nil {
+		err = status.Err()
+	}
+	return changed, expunged, err
 }
 
-func main() {
-	log.SetFlags(log.Ltime)
-	log.Println("Starting IMAP backup tool...")
+const (
+	statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+	fetchModSeq         imap.FetchItem  = "MODSEQ"
+)
 
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+// parseUint64 reads a 64-bit value such as MODSEQ, HIGHESTMODSEQ or
+// X-GM-THRID, which may come as a number or a parenthesized list holding one.
+func parseUint64(v interface{}) uint64 {
+	if list, ok := v.([]interface{}); ok && len(list) > 0 {
+		v = list[0]
+	}
+	if v == nil {
+		return 0
 	}
-	log.Println("Environment loaded")
+	n, _ := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	return n
+}
 
-	config := ImapConfig{
-		Host:      os.Getenv("IMAP_HOST"),
-		Port:      os.Getenv("IMAP_PORT"),
-		User:      os.Getenv("IMAP_USER"),
-		Password:  os.Getenv("IMAP_PASSWORD"),
-		BackupDir: os.Getenv("BACKUP_DIR"),
+// Gmail IMAP extensions, see
+// https://developers.google.com/gmail/imap/imap-extensions
+const (
+	gmailLabelsItem   imap.FetchItem = "X-GM-LABELS"
+	gmailThreadIDItem imap.FetchItem = "X-GM-THRID"
+	gmailMsgIDItem    imap.FetchItem = "X-GM-MSGID"
+)
+
+var gmailFetchItems = []imap.FetchItem{gmailLabelsItem, gmailThreadIDItem, gmailMsgIDItem}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
 	}
+	return false
+}
 
-	if config.BackupDir == "" {
-		config.BackupDir = "email_backup"
+// listMailboxes lists all mailboxes and detects their special use.
+func (b *Backup) listMailboxes() ([]*imap.MailboxInfo, error) {
+	start := time.Now()
+	infos, err := imapext.ListMailboxes(b.client)
+	metrics.ObserveCommand(b.config.User, "list", start)
+	if err != nil {
+		b.recordError("list")
+		return nil, fmt.Errorf("listing error: %v", err)
 	}
 
-	log.Printf("Will backup emails from %s to %s", config.User, config.BackupDir)
+	b.specialUse = imapext.DetectSpecialUse(infos)
+	for name, use := range b.specialUse {
+		b.logger.Debug("Special-use mailbox", "op", "list", "mailbox", name, "special_use", use)
+	}
+	return infos, nil
+}
 
-	backup := NewBackup(config)
-	if err := backup.Start(); err != nil {
-		log.Fatal(err)
+// parseGmailLabels decodes an X-GM-LABELS list. Labels are sent in the
+// same modified UTF-7 as mailbox names.
+func parseGmailLabels(v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	labels := make([]string, 0, len(list))
+	for _, item := range list {
+		label := fmt.Sprint(item)
+		if decoded, err := utf7.Encoding.NewDecoder().String(label); err == nil {
+			label = decoded
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+func setGmailAttributes(m *layout.MessageMetadata, msg *imap.Message) {
+	m.GmailLabels = parseGmailLabels(msg.Items[gmailLabelsItem])
+	m.GmailThreadID = parseUint64(msg.Items[gmailThreadIDItem])
+	m.GmailMsgID = parseUint64(msg.Items[gmailMsgIDItem])
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, f := range a {
+		seen[strings.ToLower(f)] = true
+	}
+	for _, f := range b {
+		if !seen[strings.ToLower(f)] {
+			return false
+		}
+	}
+	return true
+}
+
+// mailboxPath returns the local directory of a mailbox, creating it if needed.
+func (b *Backup) mailboxPath(mailboxName string) (string, error) {
+	folderMapMutex.Lock()
+	defer folderMapMutex.Unlock()
+
+	folders, err := folderMap(b.config.BackupDir)
+	if err != nil {
+		b.recordError("filesystem")
+		return "", err
+	}
+	dir, known := folders.Folders[mailboxName]
+	if !known {
+		dir = folders.Assign(b.config.BackupDir, mailboxName, b.delimiter)
+		if err := folders.save(b.config.BackupDir); err != nil {
+			b.recordError("filesystem")
+			return "", err
+		}
+		b.logger.Debug("Assigned mailbox directory", "op", "save", "mailbox", mailboxName, "dir", dir)
+	}
+
+	mailboxPath := filepath.Join(b.config.BackupDir, filepath.FromSlash(dir))
+	if err := os.MkdirAll(mailboxPath, 0755); err != nil {
+		b.recordError("filesystem")
+		return "", fmt.Errorf("error creating directory %s: %v", mailboxPath, err)
+	}
+	return mailboxPath, nil
+}
+
+// backupMessageBatch saves the messages of seqSet, which holds UIDs when uid
+// is set and sequence numbers otherwise, and records them in meta.
+func (b *Backup) backupMessageBatch(mailboxName, mailboxPath string, seqSet *imap.SeqSet, uid bool, folder *FolderReport, meta *layout.FolderMetadata) error {
+	// Messages are fetched in partial chunks of at most MaxMessageMemory
+	// bytes, since go-imap holds every literal in memory.
+	limit := b.config.MaxMessageMemory
+	section := &imap.BodySectionName{Peek: true}
+	if limit > 0 {
+		section.Partial = []int{0, int(limit)}
+	}
+	items := append(b.fetchItems(), section.FetchItem())
+	logger := b.logger.With("mailbox", mailboxName)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	fetchStart := time.Now()
+	go func() {
+		if uid {
+			done <- b.client.UidFetch(seqSet, items, messages)
+		} else {
+			done <- b.client.Fetch(seqSet, items, messages)
+		}
+	}()
+
+	// Messages larger than the limit are completed once the batch is
+	// fetched, as no other command can run in the meantime.
+	var partial []*partialMessage
+	for msg := range messages {
+		r := msg.GetBody(section)
+		if r == nil {
+			logger.Warn("No body for message", "op", "fetch", "uid", msg.Uid, "seq", msg.SeqNum)
+			b.recordError("fetch")
+			folder.Skipped++
+			continue
+		}
+
+		h := sha256.New()
+		path, size, err := b.saveMessage(r, mailboxPath, int(msg.SeqNum), h)
+		if err != nil {
+			logger.Error("Error saving message", "op", "save", "uid", msg.Uid, "error", err)
+			b.recordError("save")
+			folder.AddError(fmt.Errorf("UID %d: %v", msg.Uid, err))
+			continue
+		}
+		if limit > 0 && size == limit {
+			// Only the attributes are needed from now on; do not keep the
+			// chunk in memory until the batch is done.
+			msg.Body = nil
+			partial = append(partial, &partialMessage{msg: msg, path: path, size: size, hash: h})
+			continue
+		}
+		b.recordMessage(mailboxName, msg, path, size, h, folder, meta)
+	}
+
+	err := <-done
+	metrics.ObserveCommand(b.config.User, "fetch", fetchStart)
+
+	for _, p := range partial {
+		logger.Debug("Fetching large message in chunks", "op", "fetch", "uid", p.msg.Uid, "bytes", p.msg.Size)
+		if err := b.fetchRest(p); err != nil {
+			logger.Error("Error fetching large message", "op", "fetch", "uid", p.msg.Uid, "error", err)
+			b.recordError("fetch")
+			folder.AddError(fmt.Errorf("UID %d: %v", p.msg.Uid, err))
+			os.Remove(p.path)
+			continue
+		}
+		b.recordMessage(mailboxName, p.msg, p.path, p.size, p.hash, folder, meta)
+	}
+	return err
+}
+
+// backupUids backs up the messages of a UID set, applying the size limit
+// or headers-only setting of the mailbox.
+func (b *Backup) backupUids(mailboxName, mailboxPath string, uids *imap.SeqSet, folder *FolderReport, meta *layout.FolderMetadata) error {
+	maxSize, headersOnly := b.config.folderLimits(mailboxName)
+	switch {
+	case headersOnly:
+		return b.backupHeadersBatch(mailboxName, mailboxPath, uids, folder, meta)
+	case maxSize > 0:
+		return b.backupBatchWithLimit(mailboxName, mailboxPath, uids, maxSize, folder, meta)
+	default:
+		return b.backupMessageBatch(mailboxName, mailboxPath, uids, true, folder, meta)
+	}
+}
+
+// fetchItems returns the items fetched for every message besides its
+// content.
+func (b *Backup) fetchItems() []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size}
+	if b.condstore {
+		items = append(items, fetchModSeq)
+	}
+	if b.gmail {
+		items = append(items, gmailFetchItems...)
+	}
+	return items
+}
+
+// backupBatchWithLimit backs up the messages of a UID set that are not
+// larger than maxSize, and only the header of the others, so that the
+// backup still shows they existed.
+func (b *Backup) backupBatchWithLimit(mailboxName, mailboxPath string, uids *imap.SeqSet, maxSize int64, folder *FolderReport, meta *layout.FolderMetadata) error {
+	logger := b.logger.With("mailbox", mailboxName)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- b.client.UidFetch(uids, b.fetchItems(), messages)
+	}()
+
+	small, large := new(imap.SeqSet), new(imap.SeqSet)
+	for msg := range messages {
+		if int64(msg.Size) <= maxSize {
+			small.AddNum(msg.Uid)
+			continue
+		}
+		logger.Info("Saving only the header of message above size limit", "op", "fetch", "uid", msg.Uid, "bytes", msg.Size, "limit", maxSize)
+		large.AddNum(msg.Uid)
+		metrics.Add("imap_backup_skipped_total", 1, "account", b.config.User, "mailbox", mailboxName, "reason", "size")
+	}
+	err := <-done
+	metrics.ObserveCommand(b.config.User, "fetch", start)
+	if err != nil {
+		return err
+	}
+
+	if !small.Empty() {
+		if err := b.backupMessageBatch(mailboxName, mailboxPath, small, true, folder, meta); err != nil {
+			return err
+		}
+	}
+	if large.Empty() {
+		return nil
+	}
+	return b.backupHeadersBatch(mailboxName, mailboxPath, large, folder, meta)
+}
+
+// backupHeadersBatch saves only the header of the messages of a UID set,
+// and records their MIME structure.
+func (b *Backup) backupHeadersBatch(mailboxName, mailboxPath string, uids *imap.SeqSet, folder *FolderReport, meta *layout.FolderMetadata) error {
+	logger := b.logger.With("mailbox", mailboxName)
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	items := append(b.fetchItems(), section.FetchItem(), imap.FetchBodyStructure)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- b.client.UidFetch(uids, items, messages)
+	}()
+
+	for msg := range messages {
+		r := msg.GetBody(section)
+		if r == nil {
+			logger.Warn("No header for message", "op", "fetch", "uid", msg.Uid)
+			b.recordError("fetch")
+			folder.Skipped++
+			continue
+		}
+		path, size, err := b.saveMessage(r, mailboxPath, int(msg.SeqNum), sha256.New())
+		if err != nil {
+			logger.Error("Error saving message", "op", "save", "uid", msg.Uid, "error", err)
+			b.recordError("save")
+			folder.AddError(fmt.Errorf("UID %d: %v", msg.Uid, err))
+			continue
+		}
+		// Header copies are only counted as such, not as backed up
+		// messages.
+		m := b.storeMetadata(msg, path, int64(msg.Size), meta)
+		m.Stored = storedHeaders
+		m.BodyStructure = msg.BodyStructure
+		folder.HeadersOnly++
+		logger.Debug("Saved message header", "op", "save", "uid", msg.Uid, "bytes", size)
+		cli.Progress.Update("Progress: %d/%d in %s", msg.SeqNum, b.client.Mailbox().Messages, mailboxName)
+	}
+	err := <-done
+	metrics.ObserveCommand(b.config.User, "fetch", start)
+	return err
+}
+
+// refetchable returns the UIDs of messages that were skipped or saved
+// without body under earlier settings and can now be backed up in full.
+func (b *Backup) refetchable(mailboxName string, meta *layout.FolderMetadata) []uint32 {
+	maxSize, headersOnly := b.config.folderLimits(mailboxName)
+	if headersOnly {
+		return nil
+	}
+	var uids []uint32
+	for uid, msg := range meta.Messages {
+		if msg.Stored != "" && (maxSize == 0 || msg.Size <= maxSize) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// partialMessage is a message whose first chunk has been saved. msg holds
+// its attributes, without the body.
+type partialMessage struct {
+	msg  *imap.Message
+	path string
+	size int64
+	hash hash.Hash
+}
+
+// fetchRest appends the rest of a partially saved message to its file, one
+// BODY.PEEK[]<offset.length> chunk at a time.
+func (b *Backup) fetchRest(p *partialMessage) error {
+	limit := b.config.MaxMessageMemory
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(p.msg.Uid)
+
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	for {
+		section := &imap.BodySectionName{Peek: true, Partial: []int{int(p.size), int(limit)}}
+		messages := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			done <- b.client.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages)
+		}()
+
+		var n int64
+		var copyErr error
+		for msg := range messages {
+			if r := msg.GetBody(section); r != nil && copyErr == nil {
+				n, copyErr = io.Copy(io.MultiWriter(f, p.hash), r)
+			}
+		}
+		err := <-done
+		metrics.ObserveCommand(b.config.User, "fetch", start)
+		if err != nil {
+			return err
+		}
+		if copyErr != nil {
+			return fmt.Errorf("error writing message: %v", copyErr)
+		}
+
+		p.size += n
+		if n < limit {
+			break
+		}
+		cli.Progress.Update("Fetched %d of %d bytes of UID %d", p.size, p.msg.Size, p.msg.Uid)
+	}
+	if p.msg.Size > 0 && p.size != int64(p.msg.Size) {
+		return fmt.Errorf("got %d bytes, RFC822.SIZE is %d", p.size, p.msg.Size)
+	}
+	return nil
+}
+
+// recordMessage records a saved message in the folder metadata and report.
+// h is the hash of the whole message.
+func (b *Backup) recordMessage(mailboxName string, msg *imap.Message, path string, size int64, h hash.Hash, folder *FolderReport, meta *layout.FolderMetadata) {
+	logger := b.logger.With("mailbox", mailboxName)
+	b.storeMetadata(msg, path, size, meta).SHA256 = hex.EncodeToString(h.Sum(nil))
+	folder.Messages++
+	folder.Bytes += size
+	if !b.transfer {
+		metrics.Add("imap_backup_messages_total", 1, "account", b.config.User, "mailbox", mailboxName)
+		metrics.Add("imap_backup_bytes_total", float64(size), "account", b.config.User, "mailbox", mailboxName)
+	}
+
+	if b.attachments != nil {
+		if err := b.attachments.ExtractFile(mailboxName, path); err != nil {
+			logger.Error("Error extracting attachments", "op", "extract", "uid", msg.Uid, "error", err)
+			b.recordError("extract")
+		}
+	}
+
+	logger.Debug("Saved message", "op", "save", "uid", msg.Uid, "bytes", size)
+	cli.Progress.Update("Progress: %d/%d in %s", msg.SeqNum, b.client.Mailbox().Messages, mailboxName)
+}
+
+func (b *Backup) recordError(op string) {
+	metrics.Add("imap_backup_errors_total", 1, "account", b.config.User, "type", op)
+}
+
+// storeMetadata records the file of a saved message in the folder
+// metadata, replacing the file of an earlier copy.
+func (b *Backup) storeMetadata(msg *imap.Message, path string, size int64, meta *layout.FolderMetadata) *layout.MessageMetadata {
+	if old, ok := meta.Messages[msg.Uid]; ok && old.File != "" {
+		// The message was saved without body under earlier settings.
+		os.Remove(filepath.Join(filepath.Dir(path), old.File))
+	}
+	m := &layout.MessageMetadata{
+		Uid:          msg.Uid,
+		File:         filepath.Base(path),
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		Size:         size,
+		ModSeq:       parseUint64(msg.Items[fetchModSeq]),
+	}
+	if b.gmail {
+		setGmailAttributes(m, msg)
+	}
+	meta.Messages[msg.Uid] = m
+	return m
+}
+
+// saveMessage writes a message to a new file of the mailbox directory,
+// hashing it on the way.
+func (b *Backup) saveMessage(r io.Reader, mailboxPath string, seqNum int, h hash.Hash) (string, int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	filename := fmt.Sprintf("%d_%d.eml", time.Now().UnixNano(), seqNum)
+	filepath := filepath.Join(mailboxPath, filename)
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating file: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32*1024)
+	n, err := io.CopyBuffer(io.MultiWriter(f, h), r, buf)
+	if err != nil {
+		return "", n, fmt.Errorf("error writing message: %v", err)
+	}
+
+	return filepath, n, nil
+}
+
+// folderMapMutex serializes updates of folder maps, since watch mode backs
+// up several mailboxes at once.
+var folderMapMutex sync.Mutex
+
+// folderMaps caches the folder map of each backup directory, with the
+// modification time of its file, so that it is only read again when
+// another process changed it.
+var folderMaps = make(map[string]*cachedFolderMap)
+
+type cachedFolderMap struct {
+	*layout.FolderMap
+	modTime time.Time
+}
+
+// folderMap returns the folder map of a backup directory. folderMapMutex
+// must be held.
+func folderMap(backupDir string) (*cachedFolderMap, error) {
+	var modTime time.Time
+	if info, err := os.Stat(filepath.Join(backupDir, layout.FolderMapFile)); err == nil {
+		modTime = info.ModTime()
+	}
+	if cached, ok := folderMaps[backupDir]; ok && cached.modTime.Equal(modTime) {
+		return cached, nil
+	}
+	m, err := layout.LoadFolderMap(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedFolderMap{FolderMap: m, modTime: modTime}
+	folderMaps[backupDir] = cached
+	return cached, nil
+}
+
+// save writes the map and remembers the time of the file written.
+func (c *cachedFolderMap) save(backupDir string) error {
+	if err := c.Save(backupDir); err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(backupDir, layout.FolderMapFile)); err == nil {
+		c.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// mailboxLockFile guards the read-modify-write of layout.MailboxFile
+// against other processes, such as watch mode and a scheduled backup of the
+// same mailbox.
+const mailboxLockFile = ".mailbox.lock"
+
+// mailboxLockStale is how long a lock file may go without being refreshed
+// before it is considered left behind by a crashed process.
+const mailboxLockStale = 5 * time.Minute
+
+var errMailboxLocked = errors.New("mailbox is locked by another process")
+
+// mailboxLock is a lock file created exclusively, which works on every
+// platform the tool is built for. It is refreshed while held.
+type mailboxLock struct {
+	path string
+	done chan struct{}
+}
+
+// lockMailbox takes the lock of a mailbox directory, waiting up to wait for
+// another process to release it.
+func lockMailbox(mailboxPath string, wait time.Duration) (*mailboxLock, error) {
+	path := filepath.Join(mailboxPath, mailboxLockFile)
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			l := &mailboxLock{path: path, done: make(chan struct{})}
+			go l.refresh()
+			return l, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("error creating lock file: %v", err)
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > mailboxLockStale {
+			slog.Warn("Removing stale mailbox lock", "file", path, "modified", info.ModTime())
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errMailboxLocked
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (l *mailboxLock) refresh() {
+	ticker := time.NewTicker(mailboxLockStale / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+func (l *mailboxLock) Unlock() {
+	close(l.done)
+	os.Remove(l.path)
+}
+
+// FolderReport holds the outcome of a run for one mailbox.
+type FolderReport struct {
+	runreport.Folder
+	Messages        int   `json:"messages"`
+	Bytes           int64 `json:"bytes"`
+	Skipped         int   `json:"skipped"`
+	HeadersOnly     int   `json:"headers_only,omitempty"`
+	FlagsUpdated    int   `json:"flags_updated,omitempty"`
+	Expunged        int   `json:"expunged,omitempty"`
+	Uploaded        int   `json:"uploaded,omitempty"`
+	DeletedOnServer int   `json:"deleted_on_server,omitempty"`
+}
+
+// RunReport is the machine-readable summary written at the end of a run.
+type RunReport struct {
+	runreport.Run[*FolderReport]
+	Messages         int   `json:"messages"`
+	Bytes            int64 `json:"bytes"`
+	Skipped          int   `json:"skipped"`
+	HeadersOnly      int   `json:"headers_only,omitempty"`
+	FlagsUpdated     int   `json:"flags_updated,omitempty"`
+	Expunged         int   `json:"expunged,omitempty"`
+	Uploaded         int   `json:"uploaded,omitempty"`
+	DeletedOnServer  int   `json:"deleted_on_server,omitempty"`
+	TombstonesPurged int   `json:"tombstones_purged,omitempty"`
+}
+
+func NewRunReport(command, account string) *RunReport {
+	return &RunReport{Run: runreport.New(command, account, func(name string) *FolderReport {
+		return &FolderReport{Folder: runreport.NewFolder(name)}
+	})}
+}
+
+// Finish computes totals and status and returns the process exit code.
+func (r *RunReport) Finish() int {
+	r.Messages, r.Bytes, r.Skipped = 0, 0, 0
+	r.FlagsUpdated, r.Expunged, r.HeadersOnly = 0, 0, 0
+	r.Uploaded, r.DeletedOnServer = 0, 0
+	for _, f := range r.Folders {
+		r.Messages += f.Messages
+		r.Bytes += f.Bytes
+		r.Skipped += f.Skipped
+		r.HeadersOnly += f.HeadersOnly
+		r.FlagsUpdated += f.FlagsUpdated
+		r.Expunged += f.Expunged
+		r.Uploaded += f.Uploaded
+		r.DeletedOnServer += f.DeletedOnServer
+	}
+	return r.Run.Finish()
+}
+
+// Write writes the report as JSON to path, to stdout if path is "-", or to
+// stderr if path is empty.
+func (r *RunReport) Write(path string) error {
+	return runreport.Write(r, path)
+}
+
+// metricDefs lists every metric exposed by this tool.
+var metricDefs = map[string]metrics.Def{
+	"imap_backup_messages_total":                 {Kind: "counter", Help: "Messages backed up."},
+	"imap_backup_bytes_total":                    {Kind: "counter", Help: "Bytes of messages backed up."},
+	"imap_backup_skipped_total":                  {Kind: "counter", Help: "Messages not backed up in full, by reason."},
+	"imap_backup_flag_changes_total":             {Kind: "counter", Help: "Flag changes of backed up messages picked up from the server."},
+	"imap_backup_expunged_total":                 {Kind: "counter", Help: "Backed up messages found expunged on the server."},
+	"imap_backup_tombstones_purged_total":        {Kind: "counter", Help: "Expunged messages purged from the tombstones of a mirror."},
+	"imap_backup_errors_total":                   {Kind: "counter", Help: "Errors by operation type."},
+	"imap_backup_last_run_timestamp_seconds":     {Kind: "gauge", Help: "Unix time of the end of the last run."},
+	"imap_backup_last_run_duration_seconds":      {Kind: "gauge", Help: "Duration of the last run."},
+	"imap_backup_last_success_timestamp_seconds": {Kind: "gauge", Help: "Unix time of the end of the last fully successful run."},
+	"imap_backup_running":                        {Kind: "gauge", Help: "1 while a scheduled backup of the account is running."},
+	"imap_backup_next_run_timestamp_seconds":     {Kind: "gauge", Help: "Unix time of the next scheduled backup."},
+}
+
+func init() {
+	metrics.Define(metricDefs)
+}
+
+// recordRunMetrics publishes the outcome of a finished run.
+func recordRunMetrics(r *RunReport) {
+	metrics.Set("imap_backup_last_run_timestamp_seconds", float64(r.FinishedAt.Unix()), "account", r.Account)
+	metrics.Set("imap_backup_last_run_duration_seconds", r.DurationSeconds, "account", r.Account)
+	if r.Status == "success" {
+		metrics.Set("imap_backup_last_success_timestamp_seconds", float64(r.FinishedAt.Unix()), "account", r.Account)
+	}
+}
+
+// AttachmentRecord links one extracted attachment to the message it came from.
+type AttachmentRecord struct {
+	Message     string `json:"message"`
+	Mailbox     string `json:"mailbox"`
+	MessageID   string `json:"message_id"`
+	Subject     string `json:"subject"`
+	From        string `json:"from"`
+	Date        string `json:"date"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Path        string `json:"path"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// AttachmentExtractor writes attachments of backed up messages into a
+// per-message directory tree and keeps a manifest of everything extracted.
+// Identical attachments are stored once and hard-linked where possible.
+type AttachmentExtractor struct {
+	mutex     sync.Mutex
+	backupDir string
+	outputDir string
+	records   []AttachmentRecord
+	byHash    map[string]string
+	seen      map[string]bool
+}
+
+func NewAttachmentExtractor(backupDir string) (*AttachmentExtractor, error) {
+	e := &AttachmentExtractor{
+		backupDir: backupDir,
+		outputDir: filepath.Join(backupDir, layout.AttachmentsDir),
+		byHash:    make(map[string]string),
+		seen:      make(map[string]bool),
+	}
+
+	if err := os.MkdirAll(e.outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %v", e.outputDir, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(e.outputDir, "manifest.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading attachments manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &e.records); err != nil {
+		return nil, fmt.Errorf("error parsing attachments manifest: %v", err)
+	}
+
+	for _, rec := range e.records {
+		e.seen[rec.Message] = true
+		if rec.DuplicateOf == "" {
+			e.byHash[rec.SHA256] = rec.Path
+		}
+	}
+
+	return e, nil
+}
+
+// ExtractFile extracts all attachments of the .eml file at emlPath. Messages
+// already present in the manifest are skipped. The attachments of a message
+// enter the manifest together once all of them are written, so that a
+// message failing halfway is extracted again in full by the next run.
+func (e *AttachmentExtractor) ExtractFile(mailboxName, emlPath string) (err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	relMessage, err := filepath.Rel(e.backupDir, emlPath)
+	if err != nil {
+		return err
+	}
+	if e.seen[relMessage] {
+		return nil
+	}
+
+	f, err := os.Open(emlPath)
+	if err != nil {
+		return fmt.Errorf("error opening message: %v", err)
+	}
+	defer f.Close()
+
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return fmt.Errorf("error parsing message: %v", err)
+	}
+	defer mr.Close()
+
+	base := AttachmentRecord{Message: relMessage, Mailbox: mailboxName}
+	base.MessageID, _ = mr.Header.MessageID()
+	base.Subject, _ = mr.Header.Subject()
+	if from, err := mr.Header.AddressList("From"); err == nil && len(from) > 0 {
+		base.From = from[0].Address
+	}
+	if date, err := mr.Header.Date(); err == nil {
+		base.Date = date.Format(time.RFC3339)
+	}
+
+	messageDir := filepath.Join(e.outputDir, strings.TrimSuffix(relMessage, filepath.Ext(relMessage)))
+	used := make(map[string]bool)
+	index := 0
+
+	var records []AttachmentRecord
+	defer func() {
+		if err != nil {
+			e.discard(records)
+		}
+	}()
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading message part: %v", err)
+		}
+
+		var filename, contentType string
+		switch h := p.Header.(type) {
+		case *mail.AttachmentHeader:
+			filename, _ = h.Filename()
+			contentType, _, _ = h.ContentType()
+		case *mail.InlineHeader:
+			_, params, _ := h.ContentDisposition()
+			if params["filename"] == "" {
+				continue
+			}
+			filename = params["filename"]
+			contentType, _, _ = h.ContentType()
+		}
+
+		index++
+		filename = attachmentFilename(filename, contentType, index, used)
+
+		rec := base
+		rec.Filename = filename
+		rec.ContentType = contentType
+		if err := e.writeAttachment(&rec, messageDir, p.Body); err != nil {
+			return err
+		}
+		records = append(records, rec)
+	}
+
+	e.records = append(e.records, records...)
+	e.seen[relMessage] = true
+	return nil
+}
+
+// discard removes the attachments written for a message that failed, so
+// that later messages do not link to files missing from the manifest.
+func (e *AttachmentExtractor) discard(records []AttachmentRecord) {
+	for _, rec := range records {
+		if rec.DuplicateOf == "" {
+			delete(e.byHash, rec.SHA256)
+		}
+		if rec.DuplicateOf == "" || rec.Path != rec.DuplicateOf {
+			os.Remove(filepath.Join(e.outputDir, rec.Path))
+		}
+	}
+}
+
+func (e *AttachmentExtractor) writeAttachment(rec *AttachmentRecord, messageDir string, body io.Reader) error {
+	if err := os.MkdirAll(messageDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", messageDir, err)
+	}
+
+	tmp, err := os.CreateTemp(messageDir, ".attachment-*")
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing attachment %s: %v", rec.Filename, err)
+	}
+
+	rec.Size = size
+	rec.SHA256 = hex.EncodeToString(h.Sum(nil))
+	target := filepath.Join(messageDir, rec.Filename)
+	rec.Path, _ = filepath.Rel(e.outputDir, target)
+
+	if existing, ok := e.byHash[rec.SHA256]; ok {
+		rec.DuplicateOf = existing
+		if err := os.Link(filepath.Join(e.outputDir, existing), target); err != nil {
+			// No hard links on this filesystem: the manifest still points to the stored copy.
+			rec.Path = existing
+		}
+		return nil
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("error writing attachment %s: %v", rec.Filename, err)
+	}
+	e.byHash[rec.SHA256] = rec.Path
+	return nil
+}
+
+// Save writes the manifest as both manifest.json and manifest.csv.
+func (e *AttachmentExtractor) Save() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Both manifests are written to a temporary file and renamed, so that
+	// an interrupted run leaves the previous ones intact.
+	data, err := json.MarshalIndent(e.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.outputDir, "manifest.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	path = filepath.Join(e.outputDir, "manifest.csv")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"message", "mailbox", "message_id", "subject", "from", "date",
+		"filename", "content_type", "size", "sha256", "path", "duplicate_of"})
+	for _, r := range e.records {
+		w.Write([]string{r.Message, r.Mailbox, r.MessageID, r.Subject, r.From, r.Date,
+			r.Filename, r.ContentType, strconv.FormatInt(r.Size, 10), r.SHA256, r.Path, r.DuplicateOf})
+	}
+	w.Flush()
+	err = w.Error()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	return nil
+}
+
+// ExtractAll walks an existing backup directory and extracts attachments
+// from every .eml file found, without contacting the server.
+func (e *AttachmentExtractor) ExtractAll() error {
+	var files []string
+	err := filepath.WalkDir(e.backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (path == e.outputDir || path == filepath.Join(e.backupDir, layout.TombstonesDir)) {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".eml") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error walking backup directory: %v", err)
+	}
+	sort.Strings(files)
+
+	slog.Info("Found messages", "op", "extract", "dir", e.backupDir, "messages", len(files))
+	mailboxes := make(map[string]string)
+	for i, path := range files {
+		dir := filepath.Dir(path)
+		mailbox, ok := mailboxes[dir]
+		if !ok {
+			mailbox = e.mailboxName(dir)
+			mailboxes[dir] = mailbox
+		}
+		if err := e.ExtractFile(mailbox, path); err != nil {
+			slog.Error("Error extracting attachments", "op", "extract", "file", path, "error", err)
+			continue
+		}
+		cli.Progress.Update("Progress: %d/%d", i+1, len(files))
+	}
+	cli.Progress.Done()
+
+	return e.Save()
+}
+
+// mailboxName returns the IMAP name of the mailbox backed up in dir, as
+// recorded in its metadata, or the directory path for backups without it.
+func (e *AttachmentExtractor) mailboxName(dir string) string {
+	if meta, err := layout.LoadFolderMetadata(dir); err == nil && meta.Mailbox != "" {
+		return meta.Mailbox
+	}
+	rel, _ := filepath.Rel(e.backupDir, dir)
+	return filepath.ToSlash(rel)
+}
+
+func attachmentFilename(name, contentType string, index int, used map[string]bool) string {
+	name = layout.SanitizePath(filepath.Base(strings.TrimSpace(name)))
+	if name == "" || name == "." || name == ".." {
+		name = fmt.Sprintf("attachment-%d", index)
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	candidate := name
+	ext := filepath.Ext(name)
+	for i := 1; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// Schedule is a parsed cron expression: five fields (minute, hour, day of
+// month, month, day of week), one of the @hourly/@daily/@weekly/@monthly
+// shortcuts, or "@every <duration>".
+type Schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+	every                         time.Duration
+}
+
+var scheduleShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	s := &Schedule{spec: spec}
+
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || every < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q: @every needs a duration of at least 1m", spec)
+		}
+		s.every = every
+		return s, nil
+	}
+	expr := spec
+	if full, ok := scheduleShortcuts[spec]; ok {
+		expr = full
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, field := range fields {
+		bits, err := parseScheduleField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		*sets[i] = bits
+	}
+	// Sunday can be written as 0 or 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseScheduleField parses a comma-separated list of "*", "n", "a-b",
+// each optionally followed by "/step", into a bit set.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first scheduled time strictly after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows cron semantics: when both day of month and day of week
+// are restricted, either one matching is enough.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Account is one mailbox backed up by the daemon.
+type Account struct {
+	Name     string
+	Config   ImapConfig
+	Schedule *Schedule
+}
+
+// loadConfig reads the IMAP settings of an account from the environment.
+// Variables are looked up with the account prefix first (WORK_IMAP_HOST),
+// then, with inherit, without it (IMAP_HOST).
+func loadConfig(prefix, defaultDir string, inherit bool) (ImapConfig, error) {
+	env := func(key string) string {
+		if v := os.Getenv(prefix + key); v != "" || !inherit {
+			return v
+		}
+		return os.Getenv(key)
+	}
+
+	config := ImapConfig{
+		Host:     env("IMAP_HOST"),
+		Port:     env("IMAP_PORT"),
+		User:     env("IMAP_USER"),
+		Password: env("IMAP_PASSWORD"),
+	}
+	config.BackupDir = os.Getenv(prefix + "BACKUP_DIR")
+	if config.BackupDir == "" {
+		config.BackupDir = defaultDir
+	}
+
+	config.Mode = env("BACKUP_MODE")
+	if config.Mode == "" {
+		config.Mode = modeArchive
+	}
+	if config.Mode != modeArchive && config.Mode != modeMirror {
+		return config, fmt.Errorf("%sBACKUP_MODE must be %q or %q", prefix, modeArchive, modeMirror)
+	}
+
+	config.TombstoneGrace = defaultTombstoneGrace
+	if v := env("TOMBSTONE_GRACE"); v != "" {
+		grace, err := cli.ParseGrace(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %sTOMBSTONE_GRACE: %v", prefix, err)
+		}
+		config.TombstoneGrace = grace
+	}
+
+	if v := env("GMAIL_MODE"); v != "" {
+		gmail, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %sGMAIL_MODE: %v", prefix, err)
+		}
+		config.Gmail = gmail
+	}
+
+	config.MaxMessageMemory = defaultMaxMessageMemory
+	if v := env("MAX_MESSAGE_MEMORY"); v != "" {
+		size, err := cli.ParseSize(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %sMAX_MESSAGE_MEMORY: %v", prefix, err)
+		}
+		config.MaxMessageMemory = size
+	}
+
+	if v := env("MAX_MESSAGE_SIZE"); v != "" {
+		size, err := cli.ParseSize(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %sMAX_MESSAGE_SIZE: %v", prefix, err)
+		}
+		config.MaxMessageSize = size
+	}
+	limits, err := parseFolderSizeLimits(env("FOLDER_MAX_SIZE"))
+	if err != nil {
+		return config, fmt.Errorf("invalid %sFOLDER_MAX_SIZE: %v", prefix, err)
+	}
+	config.FolderSizeLimits = limits
+	config.HeadersOnly = cli.ParseFolderList(env("HEADERS_ONLY"))
+
+	exclude, err := imapext.ParseSpecialUse(env("EXCLUDE_SPECIAL_USE"))
+	if err != nil {
+		return config, fmt.Errorf("invalid %sEXCLUDE_SPECIAL_USE: %v", prefix, err)
+	}
+	config.ExcludeSpecialUse = exclude
+	return config, nil
+}
+
+// FolderSizeLimit is the size above which messages of the mailboxes
+// matching Pattern are not backed up.
+type FolderSizeLimit struct {
+	Pattern string
+	MaxSize int64
+}
+
+// folderLimits returns the size limit (0 for none) and whether only
+// headers are backed up for a mailbox.
+func (c ImapConfig) folderLimits(name string) (int64, bool) {
+	for _, pattern := range c.HeadersOnly {
+		if cli.MatchFolder(pattern, name) {
+			return 0, true
+		}
+	}
+	for _, limit := range c.FolderSizeLimits {
+		if cli.MatchFolder(limit.Pattern, name) {
+			return limit.MaxSize, false
+		}
+	}
+	return c.MaxMessageSize, false
+}
+
+// parseFolderSizeLimits parses a comma-separated list of pattern=size
+// pairs, such as "Notifications=1M,Lists/*=5M".
+func parseFolderSizeLimits(v string) ([]FolderSizeLimit, error) {
+	var limits []FolderSizeLimit
+	for _, item := range cli.ParseFolderList(v) {
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected folder=size, got %q", item)
+		}
+		size, err := cli.ParseSize(item[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, FolderSizeLimit{Pattern: strings.TrimSpace(item[:i]), MaxSize: size})
+	}
+	return limits, nil
+}
+
+// loadAccounts returns the accounts listed in ACCOUNTS (e.g. "work,personal"),
+// or the single unprefixed account when ACCOUNTS is not set. configure
+// applies command-line overrides to each of them.
+func loadAccounts(baseDir string, configure func(*ImapConfig)) ([]Account, error) {
+	names := strings.Split(os.Getenv("ACCOUNTS"), ",")
+	multi := strings.TrimSpace(os.Getenv("ACCOUNTS")) != ""
+
+	var accounts []Account
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if multi && name == "" {
+			continue
+		}
+
+		prefix, dir := "", baseDir
+		if multi {
+			prefix = strings.ToUpper(strings.Map(func(r rune) rune {
+				if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+					return r
+				}
+				return '_'
+			}, name)) + "_"
+			dir = filepath.Join(baseDir, layout.SanitizePath(name))
+		}
+
+		config, err := loadConfig(prefix, dir, true)
+		if err != nil {
+			return nil, err
+		}
+		configure(&config)
+		if name == "" {
+			name = config.User
+		}
+		if config.Host == "" || config.User == "" {
+			return nil, fmt.Errorf("account %q: %sIMAP_HOST and %sIMAP_USER are required", name, prefix, prefix)
+		}
+
+		spec := os.Getenv(prefix + "SCHEDULE")
+		if spec == "" {
+			spec = os.Getenv("SCHEDULE")
+		}
+		if spec == "" {
+			spec = "@daily"
+		}
+		schedule, err := ParseSchedule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %v", name, err)
+		}
+
+		accounts = append(accounts, Account{Name: name, Config: config, Schedule: schedule})
+	}
+	return accounts, nil
+}
+
+// AccountState is the persisted status of an account's scheduled runs.
+type AccountState struct {
+	Account     string    `json:"account"`
+	Schedule    string    `json:"schedule"`
+	Status      string    `json:"status"`
+	LastStart   time.Time `json:"last_start"`
+	LastFinish  time.Time `json:"last_finish"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	Messages    int       `json:"messages"`
+	Bytes       int64     `json:"bytes"`
+	ErrorCount  int       `json:"error_count"`
+	NextRun     time.Time `json:"next_run"`
+}
+
+// Daemon runs the backup of each account on its schedule. Runs of the same
+// account never overlap: a run that lasts past the next scheduled time
+// makes that occurrence be skipped.
+type Daemon struct {
+	accounts        []Account
+	statePath       string
+	jitter          time.Duration
+	reportPath      string
+	metricsTextfile string
+
+	mutex sync.Mutex
+	state map[string]*AccountState
+}
+
+func NewDaemon(accounts []Account, statePath string, jitter time.Duration) *Daemon {
+	return &Daemon{
+		accounts:  accounts,
+		statePath: statePath,
+		jitter:    jitter,
+		state:     make(map[string]*AccountState),
+	}
+}
+
+// loadState restores the status persisted by a previous daemon, so that
+// last-success metrics survive restarts.
+func (d *Daemon) loadState() error {
+	data, err := os.ReadFile(d.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &d.state); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", d.statePath, err)
+	}
+
+	for name, st := range d.state {
+		if st.Status == "running" {
+			slog.Warn("Previous run was interrupted", "account", name, "started", st.LastStart)
+			st.Status = "interrupted"
+		}
+		if !st.LastFinish.IsZero() {
+			metrics.Set("imap_backup_last_run_timestamp_seconds", float64(st.LastFinish.Unix()), "account", st.Account)
+		}
+		if !st.LastSuccess.IsZero() {
+			metrics.Set("imap_backup_last_success_timestamp_seconds", float64(st.LastSuccess.Unix()), "account", st.Account)
+		}
+	}
+	return nil
+}
+
+// saveState writes the state file atomically. Callers hold d.mutex.
+func (d *Daemon) saveState() {
+	data, err := json.MarshalIndent(d.state, "", "  ")
+	if err != nil {
+		slog.Error("Error encoding daemon state", "error", err)
+		return
+	}
+	tmp := d.statePath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		slog.Error("Error writing daemon state", "file", d.statePath, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, d.statePath); err != nil {
+		slog.Error("Error writing daemon state", "file", d.statePath, "error", err)
+	}
+}
+
+func (d *Daemon) update(account Account, fn func(st *AccountState)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	st, ok := d.state[account.Name]
+	if !ok {
+		st = &AccountState{}
+		d.state[account.Name] = st
+	}
+	st.Account = account.Config.User
+	st.Schedule = account.Schedule.String()
+	fn(st)
+	d.saveState()
+}
+
+// Run schedules every account until ctx is cancelled, then waits for
+// backups in progress to finish.
+func (d *Daemon) Run(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0755); err != nil {
+		return err
+	}
+	if err := d.loadState(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, account := range d.accounts {
+		wg.Add(1)
+		go func(account Account) {
+			defer wg.Done()
+			d.schedule(ctx, account)
+		}(account)
+	}
+
+	<-ctx.Done()
+	slog.Info("Shutting down, waiting for running backups (interrupt again to abort)")
+	wg.Wait()
+	return nil
+}
+
+func (d *Daemon) schedule(ctx context.Context, account Account) {
+	logger := slog.Default().With("account", account.Config.User, "schedule", account.Schedule.String())
+
+	for {
+		next := account.Schedule.Next(time.Now())
+		if next.IsZero() {
+			logger.Error("Schedule never fires, account disabled")
+			return
+		}
+		at := next.Add(d.jitterFor(account.Schedule, next))
+
+		d.update(account, func(st *AccountState) {
+			st.NextRun = at
+			if st.Status == "" {
+				st.Status = "scheduled"
+			}
+		})
+		metrics.Set("imap_backup_next_run_timestamp_seconds", float64(at.Unix()), "account", account.Config.User)
+		logger.Info("Next backup scheduled", "at", at.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		d.runOnce(account, logger)
+
+		if missed := account.Schedule.Next(at); time.Now().After(missed) {
+			logger.Warn("Backup ran past its next scheduled time, skipping missed runs", "missed", missed.Format(time.RFC3339))
+		}
+	}
+}
+
+// jitterFor returns a random delay of up to d.jitter, capped to half of the
+// schedule interval so that frequent schedules keep their rhythm.
+func (d *Daemon) jitterFor(schedule *Schedule, next time.Time) time.Duration {
+	max := d.jitter
+	if interval := schedule.Next(next).Sub(next); max > interval/2 {
+		max = interval / 2
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (d *Daemon) runOnce(account Account, logger *slog.Logger) {
+	d.update(account, func(st *AccountState) {
+		st.Status = "running"
+		st.LastStart = time.Now()
+	})
+	metrics.Set("imap_backup_running", 1, "account", account.Config.User)
+	logger.Info("Starting scheduled backup")
+
+	backup := NewBackup(account.Config)
+	if err := backup.Start(); err != nil {
+		logger.Error("Backup failed", "error", err)
+		backup.Report().Fail(err)
+	}
+	report := backup.Report()
+	report.Finish()
+
+	metrics.Set("imap_backup_running", 0, "account", account.Config.User)
+	recordRunMetrics(report)
+	if d.metricsTextfile != "" {
+		if err := metrics.WriteTextfile(d.metricsTextfile); err != nil {
+			logger.Error("Error writing metrics textfile", "file", d.metricsTextfile, "error", err)
+		}
+	}
+	// Unlike one-shot runs, the daemon only writes reports when asked to: the
+	// state file already records every run.
+	if d.reportPath != "" {
+		if err := report.Write(d.reportPath); err != nil {
+			logger.Error("Error writing report", "error", err)
+		}
+	}
+
+	d.update(account, func(st *AccountState) {
+		st.Status = report.Status
+		st.LastFinish = report.FinishedAt
+		st.Messages = report.Messages
+		st.Bytes = report.Bytes
+		st.ErrorCount = report.ErrorCount
+		st.LastError = ""
+		if len(report.Errors) > 0 {
+			st.LastError = report.Errors[0]
+		}
+		if report.Status == "success" {
+			st.LastSuccess = report.FinishedAt
+		}
+	})
+	logger.Info("Scheduled backup finished", "status", report.Status, "messages", report.Messages, "errors", report.ErrorCount)
+}
+
+// watchRescanInterval bounds how long a message can go unnoticed when the
+// server fails to send an EXISTS notification.
+const watchRescanInterval = 10 * time.Minute
+
+// defaultWatchConnections is the number of connections a watcher opens by
+// default, below the per-account limit of common servers.
+const defaultWatchConnections = 10
+
+// WatchState is the last UID backed up in a watched mailbox, so that a
+// restarted watcher catches up on messages that arrived while it was down.
+// Retry lists messages at or below LastUid that could not be saved.
+type WatchState struct {
+	UidValidity uint32   `json:"uid_validity"`
+	LastUid     uint32   `json:"last_uid"`
+	Retry       []uint32 `json:"retry,omitempty"`
+}
+
+// Watcher keeps one connection per mailbox open in IDLE (or NOOP polling
+// when the server lacks IDLE) and backs up new messages as soon as the
+// server announces them.
+type Watcher struct {
+	config         ImapConfig
+	mailboxes      []string
+	pollInterval   time.Duration
+	maxConnections int
+	statePath      string
+	attachments    *AttachmentExtractor
+	report         *RunReport
+
+	mutex sync.Mutex
+	state map[string]*WatchState
+}
+
+func NewWatcher(config ImapConfig, mailboxes []string, pollInterval time.Duration, maxConnections int) *Watcher {
+	return &Watcher{
+		config:         config,
+		mailboxes:      mailboxes,
+		pollInterval:   pollInterval,
+		maxConnections: maxConnections,
+		statePath:      filepath.Join(config.BackupDir, "watch-state.json"),
+		report:         NewRunReport("watch", config.User),
+		state:          make(map[string]*WatchState),
+	}
+}
+
+// Report returns the summary of everything saved since the watcher started.
+func (w *Watcher) Report() *RunReport {
+	return w.report
+}
+
+// Run watches every mailbox until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := os.MkdirAll(w.config.BackupDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	data, err := os.ReadFile(w.statePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &w.state); err != nil {
+			return fmt.Errorf("invalid state file %s: %v", w.statePath, err)
+		}
+	}
+
+	if w.config.ExtractAttachments {
+		if w.attachments, err = NewAttachmentExtractor(w.config.BackupDir); err != nil {
+			return err
+		}
+	}
+
+	// Each mailbox idles on a connection of its own, up to the connection
+	// limit. The mailboxes beyond it share one connection and are polled.
+	idle, polled := w.mailboxes, []string(nil)
+	if max := w.maxConnections; len(idle) > max {
+		idle, polled = w.mailboxes[:max-1], w.mailboxes[max-1:]
+		slog.Warn("More folders than connections, polling the remaining ones", "account", w.config.User,
+			"max_connections", max, "polled", strings.Join(polled, ","), "interval", w.pollInterval)
+	}
+
+	folders := make(map[string]*FolderReport)
+	for _, name := range w.mailboxes {
+		folders[name] = w.report.Folder(name)
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range idle {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			logger := slog.Default().With("account", w.config.User, "mailbox", name)
+			w.reconnect(ctx, logger, func() (*FolderReport, error) {
+				return folders[name], w.session(ctx, name, folders[name])
+			})
+			folders[name].Finish()
+		}(name)
+	}
+	if len(polled) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := slog.Default().With("account", w.config.User, "mailboxes", strings.Join(polled, ","))
+			w.reconnect(ctx, logger, func() (*FolderReport, error) {
+				name, err := w.pollSession(ctx, polled, folders)
+				return folders[name], err
+			})
+			for _, name := range polled {
+				folders[name].Finish()
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// reconnect runs watch sessions until ctx is cancelled, reconnecting with
+// exponential backoff when the connection drops. session returns the report
+// of the mailbox the error is about.
+func (w *Watcher) reconnect(ctx context.Context, logger *slog.Logger, session func() (*FolderReport, error)) {
+	backoff := 5 * time.Second
+
+	for {
+		started := time.Now()
+		folder, err := session()
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > 5*time.Minute {
+			backoff = 5 * time.Second
+		}
+
+		logger.Error("Watch connection lost, reconnecting", "op", "idle", "error", err, "retry_in", backoff)
+		folder.AddError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+}
+
+// session connects, catches up on messages newer than the stored state and
+// then idles, backing up new messages on every EXISTS notification.
+func (w *Watcher) session(ctx context.Context, name string, folder *FolderReport) error {
+	b := NewBackup(w.config)
+	b.attachments = w.attachments
+	logger := b.logger.With("mailbox", name)
+
+	updates := make(chan client.Update, 16)
+	if err := b.connect(); err != nil {
+		return err
+	}
+	defer b.client.Logout()
+	b.client.Updates = updates
+
+	// Updates must be drained even while fetching, so they are only turned
+	// into a "something changed" signal here.
+	newMail := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); ok {
+					select {
+					case newMail <- struct{}{}:
+					default:
+					}
+				}
+			case <-b.client.LoggedOut():
+				return
+			}
+		}
+	}()
+
+	mailboxPath, st, err := w.open(b, name)
+	if err != nil {
+		return err
+	}
+	logger.Info("Watching mailbox", "op", "idle", "last_uid", st.LastUid)
+
+	for {
+		if err := w.catchUp(b, name, mailboxPath, st, folder); err != nil {
+			return err
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- b.client.Idle(stop, &client.IdleOptions{PollInterval: w.pollInterval})
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-done
+			return nil
+		case <-newMail:
+			close(stop)
+			if err := <-done; err != nil {
+				return fmt.Errorf("idle error: %v", err)
+			}
+		case <-time.After(watchRescanInterval):
+			close(stop)
+			if err := <-done; err != nil {
+				return fmt.Errorf("idle error: %v", err)
+			}
+		case err := <-done:
+			return fmt.Errorf("idle error: %v", err)
+		}
+	}
+}
+
+// pollSession backs up new messages of several mailboxes over a single
+// connection, selecting them in turn every poll interval. On error, it
+// returns the mailbox being polled.
+func (w *Watcher) pollSession(ctx context.Context, names []string, folders map[string]*FolderReport) (string, error) {
+	b := NewBackup(w.config)
+	b.attachments = w.attachments
+	if err := b.connect(); err != nil {
+		return names[0], err
+	}
+	defer b.client.Logout()
+
+	for {
+		for _, name := range names {
+			mailboxPath, st, err := w.open(b, name)
+			if err != nil {
+				return name, err
+			}
+			if err := w.catchUp(b, name, mailboxPath, st, folders[name]); err != nil {
+				return name, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", nil
+		case <-time.After(w.pollInterval):
+		}
+	}
+}
+
+// open selects a watched mailbox and returns its backup directory and
+// state.
+func (w *Watcher) open(b *Backup, name string) (string, *WatchState, error) {
+	infos := make(chan *imap.MailboxInfo, 1)
+	if err := b.client.List("", name, infos); err != nil {
+		b.recordError("list")
+		return "", nil, fmt.Errorf("listing error: %v", err)
+	}
+	for info := range infos {
+		b.delimiter = info.Delimiter
+	}
+	mailboxPath, err := b.mailboxPath(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	start := time.Now()
+	mbox, err := b.client.Select(name, true)
+	metrics.ObserveCommand(w.config.User, "select", start)
+	if err != nil {
+		b.recordError("select")
+		return "", nil, fmt.Errorf("error selecting mailbox %s: %v", name, err)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	st, ok := w.state[name]
+	if !ok || st.UidValidity != mbox.UidValidity {
+		// Without a usable state, only messages arriving from now on are
+		// watched; the regular backup takes care of existing ones.
+		st = &WatchState{UidValidity: mbox.UidValidity, LastUid: mbox.UidNext - 1}
+		if mbox.UidNext == 0 {
+			st.LastUid = 0
+		}
+		w.state[name] = st
+	}
+	return mailboxPath, st, nil
+}
+
+// catchUp backs up every message with a UID above st.LastUid, and the ones
+// that failed before, and persists the new position. The position moves past
+// messages that could not be saved, which are remembered in st.Retry, so
+// that one failure doesn't make every later notification fetch the whole
+// tail again.
+func (w *Watcher) catchUp(b *Backup, name, mailboxPath string, st *WatchState, folder *FolderReport) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(st.LastUid+1, 0)
+	criteria.Uid.AddNum(st.Retry...)
+
+	start := time.Now()
+	uids, err := b.client.UidSearch(criteria)
+	metrics.ObserveCommand(w.config.User, "search", start)
+	if err != nil {
+		b.recordError("search")
+		return fmt.Errorf("search error: %v", err)
+	}
+
+	// While a scheduled backup works on the mailbox, it saves the new
+	// messages itself; they are picked up again on the next notification
+	// otherwise.
+	lock, err := lockMailbox(mailboxPath, 0)
+	if errors.Is(err, errMailboxLocked) {
+		b.logger.Debug("Mailbox locked by a backup, catching up later", "mailbox", name, "op", "save")
+		return nil
+	}
+	if err != nil {
+		b.recordError("filesystem")
+		return err
+	}
+	defer lock.Unlock()
+
+	// The mailbox metadata is reloaded every time, since a scheduled
+	// backup may have updated it in the meantime.
+	meta, err := layout.LoadFolderMetadata(mailboxPath)
+	if err != nil {
+		b.recordError("filesystem")
+		return err
+	}
+	if meta.UidValidity == 0 {
+		meta.Mailbox, meta.Delimiter, meta.UidValidity = name, b.delimiter, st.UidValidity
+	}
+	if meta.UidValidity != st.UidValidity {
+		// The backup holds messages of another UIDVALIDITY, whose UIDs mean
+		// nothing now. Saving new messages next to them without metadata
+		// would leave files the backup downloads again, so the scheduled
+		// backup, which starts the mailbox over, takes care of them.
+		b.logger.Warn("UIDVALIDITY of the backup differs, leaving new messages to the scheduled backup", "mailbox", name, "op", "save",
+			"backup_uid_validity", meta.UidValidity, "uid_validity", st.UidValidity)
+		return nil
+	}
+
+	// "n:*" always matches the last message, even below n. Messages that a
+	// backup already saved are skipped, and retried messages that are gone
+	// from the server are dropped.
+	retry := make(map[uint32]bool)
+	for _, uid := range st.Retry {
+		retry[uid] = true
+	}
+	seqSet := new(imap.SeqSet)
+	var wanted []uint32
+	last := st.LastUid
+	for _, uid := range uids {
+		if uid <= st.LastUid && !retry[uid] {
+			continue
+		}
+		if uid > last {
+			last = uid
+		}
+		if _, known := meta.Messages[uid]; !known {
+			seqSet.AddNum(uid)
+			wanted = append(wanted, uid)
+		}
+	}
+	if seqSet.Empty() {
+		if last > st.LastUid || len(st.Retry) > 0 {
+			w.advance(st, last, nil)
+		}
+		return nil
+	}
+
+	err = b.backupUids(name, mailboxPath, seqSet, folder, meta)
+	if err := meta.Save(mailboxPath); err != nil {
+		b.recordError("filesystem")
+		return err
+	}
+	if err != nil {
+		b.recordError("fetch")
+		return fmt.Errorf("error backing up new messages: %v", err)
+	}
+	cli.Progress.Done()
+	b.logger.Info("Backed up new messages", "mailbox", name, "op", "save", "last_uid", last)
+
+	if w.attachments != nil {
+		if err := w.attachments.Save(); err != nil {
+			b.logger.Error("Error writing attachments manifest", "op", "extract", "error", err)
+		}
+	}
+	// Whatever is not in the metadata now failed, whether it was reported
+	// as an error or skipped, e.g. for coming without a body.
+	var failed []uint32
+	for _, uid := range wanted {
+		if _, saved := meta.Messages[uid]; !saved {
+			failed = append(failed, uid)
+		}
+	}
+	if len(failed) > 0 {
+		b.logger.Warn("Some new messages could not be saved, retrying them on the next notification", "mailbox", name, "op", "save", "failed", len(failed))
+	}
+	w.advance(st, last, failed)
+	return nil
+}
+
+func (w *Watcher) advance(st *WatchState, lastUid uint32, retry []uint32) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	st.LastUid = lastUid
+	st.Retry = retry
+	w.saveState()
+}
+
+// saveState writes the state file atomically. Callers hold w.mutex.
+func (w *Watcher) saveState() {
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		slog.Error("Error encoding watch state", "error", err)
+		return
+	}
+	tmp := w.statePath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		slog.Error("Error writing watch state", "file", w.statePath, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, w.statePath); err != nil {
+		slog.Error("Error writing watch state", "file", w.statePath, "error", err)
+	}
+}
+
+// BackupFolder is a mailbox directory of a backup with its metadata.
+type BackupFolder struct {
+	Dir  string
+	Meta *layout.FolderMetadata
+}
+
+// loadBackupFolders finds every mailbox directory with metadata in a backup.
+func loadBackupFolders(backupDir string) ([]BackupFolder, error) {
+	var folders []BackupFolder
+	var names layout.Names
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && layout.IsSkippedDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || d.Name() != layout.MailboxFile {
+			return nil
+		}
+		meta, err := layout.LoadFolderMetadata(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if meta.Mailbox == "" {
+			// Name it after the directory, as the backup did not record
+			// the mailbox.
+			rel, err := filepath.Rel(backupDir, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			if names == nil {
+				if names, err = layout.LoadNames(backupDir); err != nil {
+					return err
+				}
+			}
+			meta.Mailbox, meta.Delimiter = names.Mailbox(filepath.ToSlash(rel)), "/"
+		}
+		folders = append(folders, BackupFolder{Dir: filepath.Dir(path), Meta: meta})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking backup directory: %v", err)
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Meta.Mailbox < folders[j].Meta.Mailbox })
+	return folders, nil
+}
+
+// gmailSpecialUse maps Gmail system labels to the special use of the folder
+// a restore puts the message in.
+var gmailSpecialUse = map[string]string{
+	`\Sent`:  imap.SentAttr,
+	`\Draft`: imap.DraftsAttr,
+	`\Trash`: imap.TrashAttr,
+	`\Spam`:  imap.JunkAttr,
+}
+
+// specialUseFolders are the folders a restore creates for special uses the
+// destination has no mailbox for.
+var specialUseFolders = map[string]string{
+	imap.ArchiveAttr: "Archive",
+	imap.DraftsAttr:  "Drafts",
+	imap.JunkAttr:    "Junk",
+	imap.SentAttr:    "Sent",
+	imap.TrashAttr:   "Trash",
+}
+
+// Restorer uploads a backup to an IMAP account, recreating the folders and
+// keeping flags and INTERNALDATE. Messages of a Gmail mode backup are put
+// in one folder per label.
+type Restorer struct {
+	config    ImapConfig
+	sourceDir string
+	dryRun    bool
+
+	FolderMapping
+	backup *Backup
+	// present holds the keys of the messages in each destination folder,
+	// so that running a restore again does not duplicate them.
+	present map[string]map[string]bool
+	report  *RunReport
+	logger  *slog.Logger
+}
+
+func NewRestorer(config ImapConfig, sourceDir string, dryRun bool) *Restorer {
+	return &Restorer{
+		config:    config,
+		sourceDir: sourceDir,
+		dryRun:    dryRun,
+		report:    NewRunReport("restore", config.User),
+		logger:    slog.Default().With("account", config.User),
+	}
+}
+
+// Report returns the summary of the last run.
+func (r *Restorer) Report() *RunReport {
+	return r.report
+}
+
+func (r *Restorer) Run() error {
+	folders, err := loadBackupFolders(r.sourceDir)
+	if err != nil {
+		return err
+	}
+	if len(folders) == 0 {
+		return fmt.Errorf("no %s found in %s, run a backup first", layout.MailboxFile, r.sourceDir)
+	}
+	return r.restore(folders)
+}
+
+// RunSelected restores only some messages, given by UID for each mailbox
+// directory relative to the backup.
+func (r *Restorer) RunSelected(selected map[string][]uint32) error {
+	folders, err := loadBackupFolders(r.sourceDir)
+	if err != nil {
+		return err
+	}
+
+	var chosen []BackupFolder
+	for _, f := range folders {
+		rel, err := filepath.Rel(r.sourceDir, f.Dir)
+		if err != nil {
+			continue
+		}
+		uids := selected[filepath.ToSlash(rel)]
+		if len(uids) == 0 {
+			continue
+		}
+		messages := make(map[uint32]*layout.MessageMetadata)
+		for _, uid := range uids {
+			if msg, ok := f.Meta.Messages[uid]; ok {
+				messages[uid] = msg
+			}
+		}
+		meta := *f.Meta
+		meta.Messages = messages
+		chosen = append(chosen, BackupFolder{Dir: f.Dir, Meta: &meta})
+	}
+	if len(chosen) == 0 {
+		return fmt.Errorf("none of the selected messages is in the backup")
+	}
+	return r.restore(chosen)
+}
+
+// restore uploads the messages of backed up mailboxes.
+func (r *Restorer) restore(folders []BackupFolder) error {
+	r.backup = NewBackup(r.config)
+	if err := r.backup.connect(); err != nil {
+		return err
+	}
+	defer r.backup.client.Logout()
+
+	infos, err := r.backup.listMailboxes()
+	if err != nil {
+		return err
+	}
+	r.FolderMapping = NewFolderMapping(infos, r.backup.specialUse)
+	r.present = make(map[string]map[string]bool)
+
+	for _, f := range folders {
+		uids := make([]uint32, 0, len(f.Meta.Messages))
+		for uid := range f.Meta.Messages {
+			uids = append(uids, uid)
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+		r.logger.Info("Restoring mailbox", "mailbox", f.Meta.Mailbox, "messages", len(uids), "dry_run", r.dryRun)
+		for _, uid := range uids {
+			msg := f.Meta.Messages[uid]
+			if msg.Stored != "" {
+				// Only part of the message, or nothing, was backed up.
+				r.report.Folder(r.sourceFolder(f.Meta)).Skipped++
+				continue
+			}
+			targets, flags := r.targets(f.Meta, msg)
+			for _, target := range targets {
+				folder := r.report.Folder(target)
+				if err := r.restoreMessage(f.Dir, msg, target, flags, folder); err != nil {
+					r.logger.Error("Error restoring message", "op", "append", "mailbox", target, "uid", uid, "error", err)
+					folder.AddError(fmt.Errorf("%s UID %d: %v", f.Meta.Mailbox, uid, err))
+				}
+			}
+		}
+	}
+	for _, folder := range r.report.Folders {
+		folder.Finish()
+	}
+	cli.Progress.Done()
+	return nil
+}
+
+// FolderMapping maps source mailboxes and Gmail labels to the folders of a
+// destination account, converting hierarchy delimiters and matching
+// special-use folders.
+type FolderMapping struct {
+	delimiter string
+	existing  map[string]bool
+	special   map[string]string
+}
+
+// NewFolderMapping builds the mapping to an account from its mailbox list
+// and special-use folders.
+func NewFolderMapping(infos []*imap.MailboxInfo, specialUse map[string]string) FolderMapping {
+	r := FolderMapping{existing: make(map[string]bool), special: make(map[string]string)}
+	for _, mbox := range infos {
+		if r.delimiter == "" && mbox.Delimiter != "" {
+			r.delimiter = mbox.Delimiter
+		}
+		r.existing[mbox.Name] = true
+	}
+	for name, use := range specialUse {
+		if _, ok := r.special[use]; !ok {
+			r.special[use] = name
+		}
+	}
+	if r.delimiter == "" {
+		r.delimiter = "/"
+	}
+	return r
+}
+
+// targets returns the destination folders and flags of a message.
+func (r *FolderMapping) targets(meta *layout.FolderMetadata, msg *layout.MessageMetadata) ([]string, []string) {
+	var flags []string
+	for _, flag := range msg.Flags {
+		if flag != imap.RecentFlag {
+			flags = append(flags, flag)
+		}
+	}
+
+	if !meta.Gmail || len(msg.GmailLabels) == 0 {
+		return []string{r.sourceFolder(meta)}, flags
+	}
+
+	var targets []string
+	for _, label := range msg.GmailLabels {
+		switch {
+		case label == `\Inbox`:
+			targets = append(targets, "INBOX")
+		case label == `\Starred` && !containsFold(flags, imap.FlaggedFlag):
+			flags = append(flags, imap.FlaggedFlag)
+		case gmailSpecialUse[label] != "":
+			targets = append(targets, r.specialFolder(gmailSpecialUse[label]))
+		case strings.HasPrefix(label, `\`):
+			// Other system labels such as \Important have no folder.
+		default:
+			targets = append(targets, r.destName(label, "/"))
+		}
+	}
+	// Archived messages only had system labels without a folder.
+	if len(targets) == 0 {
+		targets = append(targets, r.sourceFolder(meta))
+	}
+	return targets, flags
+}
+
+// sourceFolder returns the destination of a backed up mailbox: the
+// destination's mailbox with the same special use, or the same name.
+func (r *FolderMapping) sourceFolder(meta *layout.FolderMetadata) string {
+	if meta.SpecialUse != "" {
+		if folder := r.specialFolder(meta.SpecialUse); folder != "" {
+			return folder
+		}
+	}
+	return r.destName(meta.Mailbox, meta.Delimiter)
+}
+
+// specialFolder returns the destination mailbox with a special use, or the
+// folder to create for it. All Mail falls back to the archive, since
+// appending there is how Gmail archives a message.
+func (r *FolderMapping) specialFolder(use string) string {
+	if name, ok := r.special[use]; ok {
+		return name
+	}
+	if use == imap.AllAttr {
+		return r.specialFolder(imap.ArchiveAttr)
+	}
+	return specialUseFolders[use]
+}
+
+// destName converts a folder name to the destination's hierarchy delimiter.
+func (r *FolderMapping) destName(name, delimiter string) string {
+	if delimiter == "" || delimiter == r.delimiter {
+		return name
+	}
+	return strings.Join(strings.Split(name, delimiter), r.delimiter)
+}
+
+// create creates a destination folder unless it exists.
+func (r *FolderMapping) create(b *Backup, name string) error {
+	if r.existing[name] {
+		return nil
+	}
+	if err := b.client.Create(name); err != nil {
+		b.recordError("create")
+		return fmt.Errorf("error creating mailbox: %v", err)
+	}
+	r.existing[name] = true
+	b.logger.Info("Created mailbox", "op", "create", "mailbox", name)
+	return nil
+}
+
+// restoreMessage appends a backed up message to a destination folder,
+// unless a message with the same key is already there.
+func (r *Restorer) restoreMessage(dir string, msg *layout.MessageMetadata, target string, flags []string, folder *FolderReport) error {
+	path := filepath.Join(dir, msg.File)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = info.ModTime()
+	}
+
+	present, err := r.presentIn(target)
+	if err != nil {
+		return err
+	}
+	key := messageKey(f, date, uint32(info.Size()))
+	if present[key] {
+		r.logger.Debug("Message already present", "mailbox", target, "file", msg.File)
+		folder.Skipped++
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if r.dryRun {
+		fmt.Printf("Would restore %s to %s (%s)\n", path, target, strings.Join(flags, " "))
+	} else {
+		if err := r.create(r.backup, target); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err := r.backup.client.Append(target, flags, date, &fileLiteral{File: f, size: int(info.Size())})
+		metrics.ObserveCommand(r.config.User, "append", start)
+		if err != nil {
+			r.backup.recordError("append")
+			return err
+		}
+	}
+	present[key] = true
+
+	folder.Messages++
+	folder.Bytes += info.Size()
+	cli.Progress.Update("Restored %d messages to %s", folder.Messages, target)
+	return nil
+}
+
+// presentIn returns the keys of the messages in a destination folder,
+// fetching them the first time the folder is used.
+func (r *Restorer) presentIn(target string) (map[string]bool, error) {
+	if present, ok := r.present[target]; ok {
+		return present, nil
+	}
+	present := make(map[string]bool)
+	if r.existing[target] {
+		var err error
+		if present, err = r.backup.messageKeys(target); err != nil {
+			return nil, err
+		}
+	}
+	r.present[target] = present
+	return present, nil
+}
+
+// webIndexInterval is how old the message index of the web UI may get
+// before it is refreshed with what later backups saved.
+const webIndexInterval = time.Minute
+
+// webPageSize is the number of messages per page of a folder or search.
+const webPageSize = 100
+
+// WebMessage is a backed up message as listed by the web UI.
+type WebMessage struct {
+	Dir       string
+	Mailbox   string
+	Uid       uint32
+	Subject   string
+	From      string
+	To        string
+	Date      time.Time
+	MessageID string
+	Size      int64
+	Flags     []string
+	Stored    string
+
+	path string
+}
+
+// WebFolder is a backed up mailbox of the web UI.
+type WebFolder struct {
+	Dir      string
+	Mailbox  string
+	Depth    int
+	Messages []*WebMessage
+}
+
+// WebServer is the web UI of the serve command. It browses and searches a
+// backup and restores selected messages to the RESTORE_ account. Pages use
+// no scripts, and message HTML is sanitized and shown in a sandboxed frame.
+type WebServer struct {
+	backupDir string
+	restore   ImapConfig
+	username  string
+	password  string
+	// token is sent with the restore form, so that other sites cannot make
+	// a logged in browser restore messages.
+	token string
+
+	mutex   sync.Mutex
+	folders []*WebFolder
+	byDir   map[string]*WebFolder
+	cache   map[string]*WebMessage
+	loaded  time.Time
+}
+
+func NewWebServer(backupDir string, restore ImapConfig, username, password string) (*WebServer, error) {
+	token := make([]byte, 16)
+	if _, err := cryptorand.Read(token); err != nil {
+		return nil, err
+	}
+	return &WebServer{
+		backupDir: backupDir,
+		restore:   restore,
+		username:  username,
+		password:  password,
+		token:     hex.EncodeToString(token),
+		cache:     make(map[string]*WebMessage),
+	}, nil
+}
+
+func (s *WebServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/folder", s.handleFolder)
+	mux.HandleFunc("/search", s.handleSearch)
+	mux.HandleFunc("/message", s.handleMessage)
+	mux.HandleFunc("/attachment", s.handleAttachment)
+	mux.HandleFunc("/restore", s.handleRestore)
+	return s.authenticate(mux)
+}
+
+// authenticate requires the SERVE_USER and SERVE_PASSWORD credentials and
+// sets the security headers of every response.
+func (s *WebServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="imap-backup"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; form-action 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refresh indexes the messages of the backup, parsing only the headers of
+// files not seen before. Handlers keep using the messages of the previous
+// index after releasing the mutex, so they are never changed: the cache
+// only holds parsed headers, and every index gets its own copies.
+func (s *WebServer) refresh() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Since(s.loaded) < webIndexInterval {
+		return nil
+	}
+
+	backupFolders, err := loadBackupFolders(s.backupDir)
+	if err != nil {
+		return err
+	}
+	folders := make([]*WebFolder, 0, len(backupFolders))
+	byDir := make(map[string]*WebFolder, len(backupFolders))
+	cache := make(map[string]*WebMessage, len(s.cache))
+	messages := 0
+	for _, bf := range backupFolders {
+		rel, err := filepath.Rel(s.backupDir, bf.Dir)
+		if err != nil {
+			continue
+		}
+		f := &WebFolder{Dir: filepath.ToSlash(rel), Mailbox: bf.Meta.Mailbox}
+		if bf.Meta.Delimiter != "" {
+			f.Depth = strings.Count(f.Mailbox, bf.Meta.Delimiter)
+		}
+		for uid, meta := range bf.Meta.Messages {
+			if meta.File == "" {
+				continue
+			}
+			p := filepath.Join(bf.Dir, meta.File)
+			parsed, ok := s.cache[p]
+			if !ok {
+				parsed = parseWebMessage(p)
+			}
+			cache[p] = parsed
+			msg := *parsed
+			msg.Dir, msg.Mailbox, msg.Uid, msg.path = f.Dir, f.Mailbox, uid, p
+			msg.Flags, msg.Size, msg.Stored = meta.Flags, meta.Size, meta.Stored
+			if msg.Date.IsZero() {
+				msg.Date = meta.InternalDate
+			}
+			f.Messages = append(f.Messages, &msg)
+			messages++
+		}
+		sort.Slice(f.Messages, func(i, j int) bool { return f.Messages[i].Date.After(f.Messages[j].Date) })
+		folders = append(folders, f)
+		byDir[f.Dir] = f
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Mailbox < folders[j].Mailbox })
+
+	s.folders, s.byDir, s.cache, s.loaded = folders, byDir, cache, time.Now()
+	slog.Debug("Indexed backup", "op", "scan", "dir", s.backupDir, "messages", messages)
+	return nil
+}
+
+// parseWebMessage reads the header fields listed by the web UI.
+func parseWebMessage(path string) *WebMessage {
+	msg := &WebMessage{}
+	f, err := os.Open(path)
+	if err != nil {
+		return msg
+	}
+	defer f.Close()
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return msg
+	}
+	msg.Subject, _ = mr.Header.Subject()
+	msg.From = formatAddresses(&mr.Header, "From")
+	msg.To = formatAddresses(&mr.Header, "To")
+	msg.Date, _ = mr.Header.Date()
+	msg.MessageID, _ = mr.Header.MessageID()
+	return msg
+}
+
+func formatAddresses(h *mail.Header, key string) string {
+	addrs, err := h.AddressList(key)
+	if err != nil || len(addrs) == 0 {
+		return h.Get(key)
+	}
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		if a.Name != "" {
+			parts[i] = fmt.Sprintf("%s <%s>", a.Name, a.Address)
+		} else {
+			parts[i] = a.Address
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// message finds a message of the index from the dir and uid parameters.
+func (s *WebServer) message(r *http.Request) (*WebMessage, bool) {
+	uid, err := strconv.ParseUint(r.FormValue("uid"), 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.byDir[r.FormValue("dir")]
+	if !ok {
+		return nil, false
+	}
+	for _, msg := range f.Messages {
+		if msg.Uid == uint32(uid) {
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+func (s *WebServer) render(w http.ResponseWriter, tmpl *template.Template, data map[string]interface{}) {
+	data["Token"] = s.token
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		slog.Error("Error rendering page", "op", "serve", "error", err)
+	}
+}
+
+func (s *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mutex.Lock()
+	folders := s.folders
+	s.mutex.Unlock()
+	s.render(w, webIndexTemplate, map[string]interface{}{"Title": "Mail backup", "Folders": folders})
+}
+
+func (s *WebServer) handleFolder(w http.ResponseWriter, r *http.Request) {
+	if err := s.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mutex.Lock()
+	f, ok := s.byDir[r.FormValue("dir")]
+	s.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	messages, page := paginate(f.Messages, r)
+	s.render(w, webListTemplate, map[string]interface{}{
+		"Title":    f.Mailbox,
+		"Messages": messages,
+		"Total":    len(f.Messages),
+		"Page":     page,
+		"More":     (page+1)*webPageSize < len(f.Messages),
+		"Query":    url.Values{"dir": {f.Dir}},
+		"Path":     "/folder",
+	})
+}
+
+// handleSearch matches the query against the subject, addresses and
+// Message-ID of every message, or of one folder.
+func (s *WebServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if err := s.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := strings.TrimSpace(r.FormValue("q"))
+	terms := strings.Fields(strings.ToLower(q))
+
+	var found []*WebMessage
+	s.mutex.Lock()
+	for _, f := range s.folders {
+		if dir := r.FormValue("dir"); dir != "" && dir != f.Dir {
+			continue
+		}
+		for _, msg := range f.Messages {
+			text := strings.ToLower(strings.Join([]string{msg.Subject, msg.From, msg.To, msg.MessageID, msg.Date.Format("2006-01-02")}, " "))
+			match := len(terms) > 0
+			for _, term := range terms {
+				if !strings.Contains(text, term) {
+					match = false
+					break
+				}
+			}
+			if match {
+				found = append(found, msg)
+			}
+		}
+	}
+	s.mutex.Unlock()
+	sort.Slice(found, func(i, j int) bool { return found[i].Date.After(found[j].Date) })
+
+	messages, page := paginate(found, r)
+	s.render(w, webListTemplate, map[string]interface{}{
+		"Title":    fmt.Sprintf("Search: %s", q),
+		"Search":   true,
+		"Messages": messages,
+		"Total":    len(found),
+		"Page":     page,
+		"More":     (page+1)*webPageSize < len(found),
+		"Query":    url.Values{"q": {q}, "dir": {r.FormValue("dir")}},
+		"Path":     "/search",
+	})
+}
+
+func paginate(messages []*WebMessage, r *http.Request) ([]*WebMessage, int) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 || page*webPageSize >= len(messages) {
+		page = 0
+	}
+	end := (page + 1) * webPageSize
+	if end > len(messages) {
+		end = len(messages)
+	}
+	return messages[page*webPageSize : end], page
+}
+
+// webPart is the body or an attachment of a displayed message.
+type webPart struct {
+	Index       int
+	Name        string
+	ContentType string
+	Size        int64
+}
+
+// walkParts calls fn for every part of a message, with the number of
+// attachments seen so far for attachments and -1 for inline parts.
+func walkParts(path string, fn func(index int, h mail.PartHeader, body io.Reader) error) (*mail.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	attachments := 0
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return &mr.Header, nil
+		}
+		if err != nil {
+			return &mr.Header, nil
+		}
+		index := -1
+		if _, ok := p.Header.(*mail.AttachmentHeader); ok {
+			index = attachments
+			attachments++
+		}
+		if err := fn(index, p.Header, p.Body); err != nil {
+			return &mr.Header, err
+		}
+	}
+}
+
+func (s *WebServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if err := s.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg, ok := s.message(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var text, html string
+	var attachments []webPart
+	header, err := walkParts(msg.path, func(index int, h mail.PartHeader, body io.Reader) error {
+		if index >= 0 {
+			name, _ := h.(*mail.AttachmentHeader).Filename()
+			contentType, _, _ := h.(*mail.AttachmentHeader).ContentType()
+			n, _ := io.Copy(io.Discard, body)
+			attachments = append(attachments, webPart{Index: index, Name: name, ContentType: contentType, Size: n})
+			return nil
+		}
+		contentType, _, _ := h.(*mail.InlineHeader).ContentType()
+		data, _ := io.ReadAll(body)
+		if contentType == "text/html" && html == "" {
+			html = string(data)
+		} else if strings.HasPrefix(contentType, "text/") && text == "" {
+			text = string(data)
+		}
+		return nil
+	})
+	if err != nil && header == nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.render(w, webMessageTemplate, map[string]interface{}{
+		"Title":       msg.Subject,
+		"Message":     msg,
+		"Cc":          formatAddresses(header, "Cc"),
+		"Text":        text,
+		"HTML":        html,
+		"Attachments": attachments,
+	})
+}
+
+// handleAttachment sends an attachment as a download, never rendered by
+// the browser.
+func (s *WebServer) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.message(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	want, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	found := false
+	_, err = walkParts(msg.path, func(index int, h mail.PartHeader, body io.Reader) error {
+		if index != want {
+			return nil
+		}
+		found = true
+		name, _ := h.(*mail.AttachmentHeader).Filename()
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", index+1)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+		_, err := io.Copy(w, body)
+		return err
+	})
+	if err != nil {
+		slog.Error("Error sending attachment", "op", "serve", "file", msg.path, "error", err)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+	}
+}
+
+// handleRestore appends the selected messages to the restore account.
+// Each selected value is "<mailbox directory>:<uid>".
+func (s *WebServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(s.token)) != 1 {
+		http.Error(w, "Invalid form token, reload the page", http.StatusForbidden)
+		return
+	}
+
+	selected := make(map[string][]uint32)
+	count := 0
+	for _, v := range r.Form["m"] {
+		i := strings.LastIndex(v, ":")
+		if i < 0 {
+			continue
+		}
+		uid, err := strconv.ParseUint(v[i+1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		selected[v[:i]] = append(selected[v[:i]], uint32(uid))
+		count++
+	}
+	if count == 0 {
+		http.Error(w, "No message selected", http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("Restoring messages from the web UI", "op", "restore", "messages", count, "remote", r.RemoteAddr, "account", s.restore.User)
+	restorer := NewRestorer(s.restore, s.backupDir, false)
+	report := restorer.Report()
+	if err := restorer.RunSelected(selected); err != nil {
+		slog.Error("Restore failed", "op", "restore", "error", err)
+		report.Fail(err)
+	}
+	report.Finish()
+	s.render(w, webRestoreTemplate, map[string]interface{}{"Title": "Restore", "Report": report, "Account": s.restore.User})
+}
+
+var webFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	"size": func(size int64) string {
+		switch {
+		case size >= 1024*1024:
+			return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+		case size >= 1024:
+			return fmt.Sprintf("%d KB", size/1024)
+		default:
+			return fmt.Sprintf("%d B", size)
+		}
+	},
+	"indent":   func(depth int) template.CSS { return template.CSS(fmt.Sprintf("padding-left: %dpx", depth*20)) },
+	"sanitize": htmlsafe.Sanitize,
+	"join":     strings.Join,
+	"add":      func(a, b int) int { return a + b },
+	"page": func(q url.Values, page int) string {
+		v := url.Values{}
+		for k, vals := range q {
+			v[k] = vals
+		}
+		v.Set("page", strconv.Itoa(page))
+		return v.Encode()
+	},
+}
+
+const webLayout = `{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+nav { background: #2d3e50; padding: 10px 20px; }
+nav a { color: #fff; margin-right: 20px; text-decoration: none; }
+nav form { display: inline; }
+main { padding: 20px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+tr:hover td { background: #fafafa; }
+ul.folders { list-style: none; padding: 0; }
+.headers { background: #f4f4f4; padding: 10px; margin-bottom: 20px; }
+.headers div { margin: 2px 0; }
+pre { white-space: pre-wrap; word-wrap: break-word; }
+iframe { width: 100%; height: 600px; border: 1px solid #ddd; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<nav><a href="/">Folders</a><form action="/search"><input name="q" placeholder="Subject, address, Message-ID, date" size="40"> <button>Search</button></form></nav>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+</body>
+</html>
+{{end}}
+`
+
+func newWebTemplate(body string) *template.Template {
+	return template.Must(template.New("page").Funcs(webFuncs).Parse(webLayout + body))
+}
+
+var (
+	webIndexTemplate = newWebTemplate(`{{template "header" .}}
+<h1>Mail backup</h1>
+<ul class="folders">{{range .Folders}}
+<li style="{{indent .Depth}}"><a href="/folder?dir={{.Dir}}">{{.Mailbox}}</a> ({{len .Messages}})</li>{{end}}
+</ul>
+{{template "footer" .}}`)
+
+	webListTemplate = newWebTemplate(`{{template "header" .}}
+<h1>{{.Title}}</h1>
+{{if not .Search}}<form action="/search"><input type="hidden" name="dir" value="{{.Query.Get "dir"}}"><input name="q" placeholder="Search this folder" size="40"> <button>Search</button></form>{{end}}
+<p>{{.Total}} messages{{if .Page}} &middot; <a href="{{.Path}}?{{page .Query (add .Page -1)}}">Newer</a>{{end}}{{if .More}} &middot; <a href="{{.Path}}?{{page .Query (add .Page 1)}}">Older</a>{{end}}</p>
+{{if .Messages}}<form method="post" action="/restore">
+<input type="hidden" name="token" value="{{.Token}}">
+<table>
+<tr><th></th><th>Date</th><th>From</th><th>Subject</th>{{if .Search}}<th>Folder</th>{{end}}<th>Size</th></tr>
+{{range .Messages}}<tr>
+<td><input type="checkbox" name="m" value="{{.Dir}}:{{.Uid}}"></td>
+<td>{{date .Date}}</td>
+<td>{{.From}}</td>
+<td><a href="/message?dir={{.Dir}}&amp;uid={{.Uid}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+{{if $.Search}}<td><a href="/folder?dir={{.Dir}}">{{.Mailbox}}</a></td>{{end}}
+<td>{{size .Size}}</td>
+</tr>{{end}}
+</table>
+<p><button>Restore selected messages to the server</button></p>
+</form>{{end}}
+{{template "footer" .}}`)
+
+	webMessageTemplate = newWebTemplate(`{{template "header" .}}
+{{with .Message}}<h1>{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</h1>
+<div class="headers">
+<div><strong>From:</strong> {{.From}}</div>
+<div><strong>To:</strong> {{.To}}</div>
+{{if $.Cc}}<div><strong>Cc:</strong> {{$.Cc}}</div>{{end}}
+<div><strong>Date:</strong> {{date .Date}}</div>
+<div><strong>Folder:</strong> <a href="/folder?dir={{.Dir}}">{{.Mailbox}}</a> (UID {{.Uid}})</div>
+{{if .MessageID}}<div><strong>Message-ID:</strong> {{.MessageID}}</div>{{end}}
+{{if .Flags}}<div><strong>Flags:</strong> {{join .Flags " "}}</div>{{end}}
+{{if .Stored}}<div class="error"><strong>Stored:</strong> {{.Stored}}, the backup does not hold the complete message</div>{{end}}
+</div>
+<form method="post" action="/restore">
+<input type="hidden" name="token" value="{{$.Token}}">
+<input type="hidden" name="m" value="{{.Dir}}:{{.Uid}}">
+<button>Restore this message to the server</button>
+</form>
+{{if $.Attachments}}<h3>Attachments</h3>
+<ul>{{range $.Attachments}}
+<li><a href="/attachment?dir={{$.Message.Dir}}&amp;uid={{$.Message.Uid}}&amp;part={{.Index}}">{{if .Name}}{{.Name}}{{else}}attachment {{add .Index 1}}{{end}}</a> ({{.ContentType}}, {{size .Size}})</li>{{end}}
+</ul>{{end}}
+{{end}}
+{{if .HTML}}<iframe sandbox srcdoc="{{sanitize .HTML}}"></iframe>
+{{else}}<pre>{{.Text}}</pre>{{end}}
+{{template "footer" .}}`)
+
+	webRestoreTemplate = newWebTemplate(`{{template "header" .}}
+<h1>Restore</h1>
+{{with .Report}}<p>{{if eq .Status "success"}}Restored{{else}}Restore finished with errors:{{end}} {{.Messages}} messages to {{$.Account}}{{if .Skipped}}, {{.Skipped}} already present or skipped{{end}}.</p>
+{{range .Errors}}<p class="error">{{.}}</p>{{end}}
+{{range .Folders}}{{range .Errors}}<p class="error">{{.}}</p>{{end}}{{end}}
+<ul>{{range .Folders}}<li>{{.Name}}: {{.Messages}} restored{{if .Skipped}}, {{.Skipped}} skipped{{end}}</li>{{end}}</ul>
+{{end}}
+<p><a href="/">Back to the folders</a></p>
+{{template "footer" .}}`)
+)
+
+// MigrateState is the position of a migration in every source mailbox, so
+// that an interrupted migration resumes where it stopped. It belongs to one
+// pair of accounts.
+type MigrateState struct {
+	Source      string                 `json:"source"`
+	Destination string                 `json:"destination"`
+	Folders     map[string]*WatchState `json:"folders"`
+}
+
+// Migrator copies the mailboxes of one account to another over IMAP,
+// keeping flags and INTERNALDATE. Messages already in the destination
+// folder, matched by Message-ID or by date and size when they have none,
+// are skipped.
+type Migrator struct {
+	source    ImapConfig
+	dest      ImapConfig
+	statePath string
+	dryRun    bool
+
+	FolderMapping
+	src     *Backup
+	dst     *Backup
+	state   *MigrateState
+	present map[string]map[string]bool
+	tmpDir  string
+	report  *RunReport
+	logger  *slog.Logger
+}
+
+func NewMigrator(source, dest ImapConfig, statePath string, dryRun bool) *Migrator {
+	return &Migrator{
+		source:    source,
+		dest:      dest,
+		statePath: statePath,
+		dryRun:    dryRun,
+		present:   make(map[string]map[string]bool),
+		report:    NewRunReport("migrate", source.User),
+		logger:    slog.Default().With("account", source.User, "destination", dest.User),
+	}
+}
+
+// Report returns the summary of the last run.
+func (m *Migrator) Report() *RunReport {
+	return m.report
+}
+
+func (m *Migrator) Run() error {
+	if m.source.Host == m.dest.Host && m.source.Port == m.dest.Port && m.source.User == m.dest.User {
+		return fmt.Errorf("source and destination are the same account, set MIGRATE_IMAP_HOST and MIGRATE_IMAP_USER")
+	}
+	if err := m.loadState(); err != nil {
+		return err
+	}
+
+	m.src = NewBackup(m.source)
+	m.src.transfer = true
+	if err := m.src.connect(); err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	defer m.src.client.Logout()
+	m.dst = NewBackup(m.dest)
+	if err := m.dst.connect(); err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	defer m.dst.client.Logout()
+
+	infos, err := m.dst.listMailboxes()
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	m.FolderMapping = NewFolderMapping(infos, m.dst.specialUse)
+
+	if infos, err = m.src.listMailboxes(); err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	var boxes []*imap.MailboxInfo
+	for _, mbox := range infos {
+		use := m.src.specialUse[mbox.Name]
+		if m.src.gmail && use != imap.AllAttr {
+			continue
+		}
+		if use != "" && containsFold(m.source.ExcludeSpecialUse, use) {
+			m.logger.Info("Excluding folder", "op", "list", "mailbox", mbox.Name, "special_use", use)
+			continue
+		}
+		if containsFold(mbox.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		boxes = append(boxes, mbox)
+	}
+	if m.src.gmail && len(boxes) == 0 {
+		return fmt.Errorf("gmail mode: no All Mail folder found")
+	}
+
+	if !m.dryRun {
+		if m.tmpDir, err = os.MkdirTemp("", "imap-migrate-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(m.tmpDir)
+	}
+
+	for _, mbox := range boxes {
+		meta := &layout.FolderMetadata{
+			Mailbox:    mbox.Name,
+			Delimiter:  mbox.Delimiter,
+			Gmail:      m.src.gmail,
+			SpecialUse: m.src.specialUse[mbox.Name],
+			Messages:   make(map[uint32]*layout.MessageMetadata),
+		}
+		if err := m.migrateMailbox(meta); err != nil {
+			m.logger.Error("Error migrating mailbox", "mailbox", mbox.Name, "error", err)
+			m.report.Folder(m.sourceFolder(meta)).AddError(fmt.Errorf("%s: %v", mbox.Name, err))
+		}
+	}
+	for _, folder := range m.report.Folders {
+		folder.Finish()
+	}
+	cli.Progress.Done()
+	return nil
+}
+
+// migrateMailbox copies the messages of a source mailbox above its last
+// migrated UID, one batch at a time.
+func (m *Migrator) migrateMailbox(meta *layout.FolderMetadata) error {
+	name := meta.Mailbox
+	logger := m.logger.With("mailbox", name)
+
+	start := time.Now()
+	mbox, err := m.src.client.Select(name, true)
+	metrics.ObserveCommand(m.source.User, "select", start)
+	if err != nil {
+		m.src.recordError("select")
+		return fmt.Errorf("error selecting mailbox: %v", err)
+	}
+	meta.UidValidity = mbox.UidValidity
+
+	st, ok := m.state.Folders[name]
+	if !ok || st.UidValidity != mbox.UidValidity {
+		if ok {
+			logger.Warn("UIDVALIDITY changed, checking every message again", "op", "select")
+		}
+		st = &WatchState{UidValidity: mbox.UidValidity}
+		m.state.Folders[name] = st
+	}
+	if mbox.Messages == 0 {
+		return nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(st.LastUid+1, 0)
+	start = time.Now()
+	found, err := m.src.client.UidSearch(criteria)
+	metrics.ObserveCommand(m.source.User, "search", start)
+	if err != nil {
+		m.src.recordError("search")
+		return fmt.Errorf("search error: %v", err)
+	}
+	// "n:*" always matches the last message, even below n.
+	var uids []uint32
+	for _, uid := range found {
+		if uid > st.LastUid {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	logger.Info("Migrating mailbox", "messages", len(uids), "last_uid", st.LastUid, "dry_run", m.dryRun)
+
+	const batchSize = 100
+	for i := 0; i < len(uids); i += batchSize {
+		end := i + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		ok, err := m.migrateBatch(meta, uids[i:end])
+		if err != nil {
+			return err
+		}
+		// A batch with errors is retried by the next run; the messages it
+		// did copy are then found in the destination and skipped.
+		if !ok {
+			return nil
+		}
+		if !m.dryRun {
+			st.LastUid = uids[end-1]
+			if err := m.saveState(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateBatch copies a batch of UIDs of the selected source mailbox to
+// every destination folder that lacks them. It reports false when some
+// message could not be copied.
+func (m *Migrator) migrateBatch(meta *layout.FolderMetadata, uids []uint32) (bool, error) {
+	logger := m.logger.With("mailbox", meta.Mailbox)
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	// The header of the messages tells where they go and whether they are
+	// already there, before any body is downloaded.
+	section := messageIDSection()
+	items := append(m.src.fetchItems(), section.FetchItem())
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- m.src.client.UidFetch(seqSet, items, messages)
+	}()
+	var fetched []*imap.Message
+	for msg := range messages {
+		fetched = append(fetched, msg)
+	}
+	err := <-done
+	metrics.ObserveCommand(m.source.User, "fetch", start)
+	if err != nil {
+		m.src.recordError("fetch")
+		return false, fmt.Errorf("fetch error: %v", err)
+	}
+
+	type pending struct {
+		key     string
+		targets []string
+		flags   []string
+	}
+	copies := make(map[uint32]*pending)
+	toFetch := new(imap.SeqSet)
+	for _, msg := range fetched {
+		info := &layout.MessageMetadata{Uid: msg.Uid, Flags: msg.Flags, InternalDate: msg.InternalDate, Size: int64(msg.Size)}
+		if m.src.gmail {
+			setGmailAttributes(info, msg)
+		}
+		key := messageKey(msg.GetBody(section), msg.InternalDate, msg.Size)
+		targets, flags := m.targets(meta, info)
+
+		p := &pending{key: key, flags: flags}
+		for _, target := range targets {
+			present, err := m.presentIn(target)
+			if err != nil {
+				return false, err
+			}
+			if present[key] {
+				m.report.Folder(target).Skipped++
+				continue
+			}
+			p.targets = append(p.targets, target)
+		}
+		if len(p.targets) == 0 {
+			continue
+		}
+		if m.dryRun {
+			for _, target := range p.targets {
+				fmt.Printf("Would copy %s UID %d to %s (%s)\n", meta.Mailbox, msg.Uid, target, strings.Join(flags, " "))
+				folder := m.report.Folder(target)
+				folder.Messages++
+				folder.Bytes += int64(msg.Size)
+			}
+			continue
+		}
+		copies[msg.Uid] = p
+		toFetch.AddNum(msg.Uid)
+	}
+	if toFetch.Empty() {
+		return true, nil
+	}
+
+	// Bodies go through temporary files, fetched in chunks like a backup,
+	// so that large messages are never held in memory.
+	scratch := &FolderReport{}
+	body := &layout.FolderMetadata{Messages: make(map[uint32]*layout.MessageMetadata)}
+	if err := m.src.backupMessageBatch(meta.Mailbox, m.tmpDir, toFetch, true, scratch, body); err != nil {
+		m.src.recordError("fetch")
+		return false, fmt.Errorf("fetch error: %v", err)
+	}
+
+	ok := true
+	for _, uid := range uids {
+		p, msg := copies[uid], body.Messages[uid]
+		if p == nil {
+			continue
+		}
+		if msg == nil {
+			m.report.Folder(p.targets[0]).AddError(fmt.Errorf("%s UID %d: message could not be fetched", meta.Mailbox, uid))
+			ok = false
+			continue
+		}
+		path := filepath.Join(m.tmpDir, msg.File)
+		for _, target := range p.targets {
+			folder := m.report.Folder(target)
+			if err := m.appendMessage(path, msg, target, p.flags); err != nil {
+				logger.Error("Error copying message", "op", "append", "uid", uid, "target", target, "error", err)
+				folder.AddError(fmt.Errorf("%s UID %d: %v", meta.Mailbox, uid, err))
+				ok = false
+				continue
+			}
+			m.present[target][p.key] = true
+			folder.Messages++
+			folder.Bytes += msg.Size
+			cli.Progress.Update("Copied %d messages to %s", folder.Messages, target)
+		}
+		os.Remove(path)
+	}
+	return ok, nil
+}
+
+// appendMessage uploads a saved message to a destination folder, reading
+// it from its file as the literal is sent.
+func (m *Migrator) appendMessage(path string, msg *layout.MessageMetadata, target string, flags []string) error {
+	if err := m.create(m.dst, target); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	err = m.dst.client.Append(target, flags, msg.InternalDate, &fileLiteral{File: f, size: int(msg.Size)})
+	metrics.ObserveCommand(m.dest.User, "append", start)
+	if err != nil {
+		m.dst.recordError("append")
+	}
+	return err
+}
+
+// presentIn returns the keys of the messages in a destination folder,
+// fetching them the first time the folder is used.
+func (m *Migrator) presentIn(target string) (map[string]bool, error) {
+	if present, ok := m.present[target]; ok {
+		return present, nil
+	}
+	present := make(map[string]bool)
+	if m.existing[target] {
+		var err error
+		if present, err = m.dst.messageKeys(target); err != nil {
+			return nil, fmt.Errorf("destination: %v", err)
+		}
+	}
+	m.present[target] = present
+	return present, nil
+}
+
+// messageKeys returns the messageKey of every message in a mailbox.
+func (b *Backup) messageKeys(mailbox string) (map[string]bool, error) {
+	start := time.Now()
+	mbox, err := b.client.Select(mailbox, true)
+	metrics.ObserveCommand(b.config.User, "select", start)
+	if err != nil {
+		b.recordError("select")
+		return nil, fmt.Errorf("error selecting mailbox %s: %v", mailbox, err)
+	}
+	keys := make(map[string]bool)
+	if mbox.Messages == 0 {
+		return keys, nil
+	}
+
+	section := messageIDSection()
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, mbox.Messages)
+	items := []imap.FetchItem{imap.FetchInternalDate, imap.FetchRFC822Size, section.FetchItem()}
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start = time.Now()
+	go func() {
+		done <- b.client.Fetch(seqSet, items, messages)
+	}()
+	for msg := range messages {
+		keys[messageKey(msg.GetBody(section), msg.InternalDate, msg.Size)] = true
+	}
+	err = <-done
+	metrics.ObserveCommand(b.config.User, "fetch", start)
+	if err != nil {
+		b.recordError("fetch")
+		return nil, fmt.Errorf("fetch error in %s: %v", mailbox, err)
+	}
+	b.logger.Debug("Indexed mailbox", "op", "fetch", "mailbox", mailbox, "messages", len(keys))
+	return keys, nil
+}
+
+// messageIDSection is the Message-ID header of a message, fetched to find
+// it in another account.
+func messageIDSection() *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Message-ID"}},
+		Peek:         true,
+	}
+}
+
+// messageKey identifies a message across accounts by its Message-ID, or by
+// its INTERNALDATE and size when it has none.
+func messageKey(header io.Reader, date time.Time, size uint32) string {
+	if header != nil {
+		h, err := textproto.NewReader(bufio.NewReader(header)).ReadMIMEHeader()
+		if id := strings.TrimSpace(h.Get("Message-Id")); id != "" && (err == nil || errors.Is(err, io.EOF)) {
+			return "id:" + id
+		}
+	}
+	return fmt.Sprintf("date:%d/%d", date.Unix(), size)
+}
+
+// fileLiteral sends a file as an IMAP literal.
+type fileLiteral struct {
+	*os.File
+	size int
+}
+
+func (l *fileLiteral) Len() int {
+	return l.size
+}
+
+func (m *Migrator) account(c ImapConfig) string {
+	return c.User + "@" + c.Host + ":" + c.Port
+}
+
+func (m *Migrator) loadState() error {
+	m.state = &MigrateState{
+		Source:      m.account(m.source),
+		Destination: m.account(m.dest),
+		Folders:     make(map[string]*WatchState),
+	}
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st MigrateState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", m.statePath, err)
+	}
+	if st.Source != m.state.Source || st.Destination != m.state.Destination {
+		return fmt.Errorf("state file %s belongs to the migration of %s to %s, use another --state", m.statePath, st.Source, st.Destination)
+	}
+	if st.Folders != nil {
+		m.state.Folders = st.Folders
+	}
+	m.logger.Info("Resuming migration", "state", m.statePath)
+	return nil
+}
+
+// saveState writes the state file atomically.
+func (m *Migrator) saveState() error {
+	data, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.statePath), 0755); err != nil {
+		return err
+	}
+	tmp := m.statePath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing migration state: %v", err)
+	}
+	return os.Rename(tmp, m.statePath)
+}
+
+// syncStateFile is written at the root of a synced Maildir and records the
+// messages both sides had at the end of the last sync.
+const syncStateFile = ".sync-state.json"
+
+// SyncState is the state of a two-way sync, per mailbox.
+type SyncState struct {
+	Folders map[string]*SyncFolderState `json:"folders"`
+}
+
+type SyncFolderState struct {
+	UidValidity uint32                  `json:"uid_validity"`
+	Messages    map[uint32]*SyncMessage `json:"messages"`
+}
+
+// SyncMessage pairs a server UID with the unique part of a Maildir file
+// name, and the flags both had after the last sync.
+type SyncMessage struct {
+	Key   string   `json:"key"`
+	Flags []string `json:"flags"`
+}
+
+// maildirFlags maps the info letters of Maildir file names to IMAP flags,
+// in the ASCII order the letters must have.
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+// localMessage is a file of a Maildir folder.
+type localMessage struct {
+	key   string
+	path  string
+	flags []string
+	// extra holds info letters without an IMAP flag, such as P (passed).
+	extra string
+}
+
+// Syncer keeps a local Maildir and an IMAP account in step in both
+// directions. Changes are found by comparing each side with the state of
+// the last sync:
+//   - new messages are copied to the other side,
+//   - flags changed on either side are merged, a flag changed on one side
+//     taking precedence over the unchanged other side,
+//   - a message deleted on one side is deleted on the other, unless its
+//     flags were changed there since the last sync, in which case it is
+//     copied back.
+//
+// A message moved between folders is a deletion in one folder and a new
+// message in the other. The first sync of a folder pairs the messages
+// already on both sides by Message-ID, or by date and size.
+//
+// Local deletions are the dangerous direction, so a folder whose Maildir
+// is gone or empty is skipped rather than emptied on the server, and at
+// most maxDeletions messages are deleted on the server in a run.
+type Syncer struct {
+	config       ImapConfig
+	dir          string
+	dryRun       bool
+	maxDeletions int
+	deletions    int
+
+	backup   *Backup
+	folders  *layout.FolderMap
+	state    *SyncState
+	hostname string
+	report   *RunReport
+	logger   *slog.Logger
+}
+
+// defaultMaxDeletions is the number of messages sync deletes on the server
+// in a run unless --max-deletions says otherwise.
+const defaultMaxDeletions = 100
+
+func NewSyncer(config ImapConfig, dir string, maxDeletions int, dryRun bool) *Syncer {
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &Syncer{
+		config:       config,
+		dir:          dir,
+		dryRun:       dryRun,
+		maxDeletions: maxDeletions,
+		hostname:     hostname,
+		report:       NewRunReport("sync", config.User),
+		logger:       slog.Default().With("account", config.User),
+	}
+}
+
+// Report returns the summary of the last run.
+func (s *Syncer) Report() *RunReport {
+	return s.report
+}
+
+func (s *Syncer) Run() error {
+	if s.config.Gmail {
+		return fmt.Errorf("sync does not support gmail mode")
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	var err error
+	if s.folders, err = layout.LoadFolderMap(s.dir); err != nil {
+		return err
+	}
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
+	s.backup = NewBackup(s.config)
+	s.backup.transfer = true
+	if err := s.backup.connect(); err != nil {
+		return err
+	}
+	defer s.backup.client.Logout()
+
+	boxes, err := s.backup.folders()
+	if err != nil {
+		return err
+	}
+	if s.backup.delimiter == "" {
+		s.backup.delimiter = "/"
+	}
+	created, err := s.localFolders()
+	if err != nil {
+		return err
+	}
+	for _, name := range created {
+		if s.dryRun {
+			fmt.Printf("Would create mailbox %s\n", name)
+			continue
+		}
+		if err := s.backup.client.Create(name); err != nil {
+			s.backup.recordError("create")
+			s.report.Folder(name).AddError(fmt.Errorf("error creating mailbox: %v", err))
+			continue
+		}
+		s.logger.Info("Created mailbox", "op", "create", "mailbox", name)
+		boxes = append(boxes, name)
+	}
+
+	for _, name := range boxes {
+		folder := s.report.Folder(name)
+		if err := s.syncMailbox(name, folder); err != nil {
+			s.logger.Error("Error syncing mailbox", "mailbox", name, "error", err)
+			folder.AddError(err)
+		}
+		folder.Finish()
+		if s.dryRun {
+			continue
+		}
+		if err := s.saveState(); err != nil {
+			return err
+		}
+	}
+	cli.Progress.Done()
+	if s.dryRun {
+		return nil
+	}
+	return s.folders.Save(s.dir)
+}
+
+// localFolders finds Maildir folders created locally and assigns them the
+// mailbox name their directory decodes to. Folders deleted on either side
+// are left alone.
+func (s *Syncer) localFolders() ([]string, error) {
+	known := make(map[string]bool, len(s.folders.Folders))
+	for _, dir := range s.folders.Folders {
+		known[dir] = true
+	}
+
+	var created []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(p, "cur")); err != nil || p == s.dir {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if known[rel] {
+			return nil
+		}
+		parts := strings.Split(rel, "/")
+		for i, part := range parts {
+			parts[i] = layout.DecodePathPart(part)
+		}
+		name := strings.Join(parts, s.backup.delimiter)
+		if _, ok := s.folders.Folders[name]; ok {
+			return nil
+		}
+		s.folders.Folders[name] = rel
+		created = append(created, name)
+		return nil
+	})
+	sort.Strings(created)
+	return created, err
+}
+
+// syncMailbox brings one mailbox and its Maildir folder in step.
+func (s *Syncer) syncMailbox(name string, folder *FolderReport) error {
+	logger := s.logger.With("mailbox", name)
+	dir := filepath.Join(s.dir, filepath.FromSlash(s.folders.Assign(s.dir, name, s.backup.delimiter)))
+	if st := s.state.Folders[name]; st != nil && len(st.Messages) > 0 {
+		local, err := scanMaildir(dir)
+		if err != nil {
+			return err
+		}
+		if len(local) == 0 {
+			// Deleting the folder, or emptying it by mistake, must not
+			// delete every message of the mailbox on the server.
+			logger.Warn("Maildir folder is missing or empty but had messages at the last sync, skipping it", "op", "sync", "dir", dir, "messages", len(st.Messages))
+			return nil
+		}
+	}
+	if !s.dryRun {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				return fmt.Errorf("error creating directory: %v", err)
+			}
+		}
+	}
+
+	start := time.Now()
+	mbox, err := s.backup.client.Select(name, s.dryRun)
+	metrics.ObserveCommand(s.config.User, "select", start)
+	if err != nil {
+		s.backup.recordError("select")
+		return fmt.Errorf("error selecting mailbox: %v", err)
+	}
+
+	st := s.state.Folders[name]
+	if st == nil || st.UidValidity != mbox.UidValidity {
+		if st != nil {
+			logger.Warn("UIDVALIDITY changed, pairing messages again", "op", "select")
+		}
+		st = &SyncFolderState{UidValidity: mbox.UidValidity, Messages: make(map[uint32]*SyncMessage)}
+		s.state.Folders[name] = st
+	}
+
+	remote, err := s.remoteFlags(mbox)
+	if err != nil {
+		return err
+	}
+	local, err := scanMaildir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Messages known from the last sync.
+	uids := make([]uint32, 0, len(st.Messages))
+	for uid := range st.Messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	uidPlus, _ := s.backup.client.Support("UIDPLUS")
+	var deleted []uint32
+	held := 0
+	for _, uid := range uids {
+		sm := st.Messages[uid]
+		r, onServer := remote[uid]
+		l, onDisk := local[sm.Key]
+		switch {
+		case !onServer && !onDisk:
+			delete(st.Messages, uid)
+		case !onServer:
+			delete(st.Messages, uid)
+			if !sameFlags(l.flags, sm.Flags) {
+				logger.Info("Message expunged on the server was changed locally, uploading it again", "op", "sync", "uid", uid)
+				continue
+			}
+			delete(local, sm.Key)
+			if s.dryRun {
+				fmt.Printf("Would delete %s (expunged on the server)\n", l.path)
+			} else if err := os.Remove(l.path); err != nil {
+				folder.AddError(fmt.Errorf("UID %d: %v", uid, err))
+				continue
+			}
+			folder.Expunged++
+		case !onDisk:
+			if !sameFlags(r, sm.Flags) {
+				delete(st.Messages, uid)
+				logger.Info("Message deleted locally was changed on the server, downloading it again", "op", "sync", "uid", uid)
+				continue
+			}
+			delete(remote, uid)
+			if !uidPlus && containsFold(r, imap.DeletedFlag) {
+				// Flagged by an earlier run, left for a client to expunge.
+				continue
+			}
+			if s.deletions >= s.maxDeletions {
+				held++
+				continue
+			}
+			s.deletions++
+			deleted = append(deleted, uid)
+		default:
+			delete(local, sm.Key)
+			delete(remote, uid)
+			flags := mergeFlags(sm.Flags, l.flags, r)
+			if err := s.applyFlags(uid, l, r, flags, folder); err != nil {
+				folder.AddError(fmt.Errorf("UID %d: %v", uid, err))
+				continue
+			}
+			sm.Flags = flags
+		}
+	}
+	if len(deleted) > 0 {
+		if err := s.deleteOnServer(deleted, uidPlus, st, folder); err != nil {
+			return err
+		}
+	}
+	if held > 0 {
+		folder.AddError(fmt.Errorf("%d messages deleted locally were left on the server, more than --max-deletions (%d) in one run", held, s.maxDeletions))
+	}
+
+	// What is left on either side is new since the last sync.
+	if err := s.pairAndCopy(name, dir, st, remote, local, folder); err != nil {
+		return err
+	}
+	logger.Info("Synced mailbox", "op", "sync", "messages", len(st.Messages))
+	return nil
+}
+
+// remoteFlags returns the Maildir flags of every message of the selected
+// mailbox, by UID.
+func (s *Syncer) remoteFlags(mbox *imap.MailboxStatus) (map[uint32][]string, error) {
+	remote := make(map[uint32][]string)
+	if mbox.Messages == 0 {
+		return remote, nil
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, mbox.Messages)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- s.backup.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}()
+	for msg := range messages {
+		remote[msg.Uid] = syncFlags(msg.Flags)
+	}
+	err := <-done
+	metrics.ObserveCommand(s.config.User, "fetch", start)
+	if err != nil {
+		s.backup.recordError("fetch")
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+	return remote, nil
+}
+
+// applyFlags sets the merged flags of a known message on the side or sides
+// that do not have them yet.
+func (s *Syncer) applyFlags(uid uint32, l *localMessage, remote, flags []string, folder *FolderReport) error {
+	changed := false
+	if !sameFlags(flags, remote) {
+		changed = true
+		if s.dryRun {
+			fmt.Printf("Would set flags of UID %d to (%s)\n", uid, strings.Join(flags, " "))
+		} else if err := s.storeFlags(uid, remote, flags); err != nil {
+			return err
+		}
+	}
+	if !sameFlags(flags, l.flags) {
+		changed = true
+		if s.dryRun {
+			fmt.Printf("Would set flags of %s to (%s)\n", l.path, strings.Join(flags, " "))
+		} else if err := l.setFlags(flags); err != nil {
+			return err
+		}
+	}
+	if changed {
+		folder.FlagsUpdated++
+	}
+	return nil
+}
+
+// storeFlags adds and removes flags of a message on the server, leaving
+// keywords and other flags alone.
+func (s *Syncer) storeFlags(uid uint32, from, to []string) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	for _, op := range []struct {
+		op    imap.FlagsOp
+		flags []string
+	}{
+		{imap.AddFlags, flagsMissing(to, from)},
+		{imap.RemoveFlags, flagsMissing(from, to)},
+	} {
+		if len(op.flags) == 0 {
+			continue
+		}
+		flags := make([]interface{}, len(op.flags))
+		for i, f := range op.flags {
+			flags[i] = f
+		}
+		start := time.Now()
+		err := s.backup.client.UidStore(seqSet, imap.FormatFlagsOp(op.op, true), flags, nil)
+		metrics.ObserveCommand(s.config.User, "store", start)
+		if err != nil {
+			s.backup.recordError("store")
+			return fmt.Errorf("error storing flags: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteOnServer expunges messages deleted locally and forgets them. Without
+// UIDPLUS they are only flagged \Deleted, since a plain EXPUNGE would also
+// remove the messages other clients flagged, and are kept in the state so
+// that they are not downloaded again.
+func (s *Syncer) deleteOnServer(list []uint32, uidPlus bool, st *SyncFolderState, folder *FolderReport) error {
+	uids := new(imap.SeqSet)
+	uids.AddNum(list...)
+	if s.dryRun {
+		if uidPlus {
+			fmt.Printf("Would expunge UIDs %s (deleted locally)\n", uids)
+		} else {
+			fmt.Printf("Would flag UIDs %s as deleted (deleted locally)\n", uids)
+		}
+		folder.DeletedOnServer += len(list)
+		return nil
+	}
+	start := time.Now()
+	err := s.backup.client.UidStore(uids, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	metrics.ObserveCommand(s.config.User, "store", start)
+	if err != nil {
+		s.backup.recordError("store")
+		return fmt.Errorf("error flagging deleted messages: %v", err)
+	}
+
+	if !uidPlus {
+		s.logger.Warn("Server does not support UIDPLUS, messages deleted locally are only flagged \\Deleted", "op", "store", "mailbox", folder.Name, "messages", len(list))
+		for _, uid := range list {
+			sm := st.Messages[uid]
+			sm.Flags = mergeFlags(nil, sm.Flags, []string{imap.DeletedFlag})
+		}
+		folder.DeletedOnServer += len(list)
+		return nil
+	}
+
+	start = time.Now()
+	cmd := &imap.Command{Name: "UID EXPUNGE", Arguments: []interface{}{imap.RawString(uids.String())}}
+	var status *imap.StatusResp
+	if status, err = s.backup.client.Execute(&imapext.RawCommand{Cmd: cmd}, nil); err == nil {
+		err = status.Err()
+	}
+	metrics.ObserveCommand(s.config.User, "expunge", start)
+	if err != nil {
+		s.backup.recordError("expunge")
+		return fmt.Errorf("error expunging messages: %v", err)
+	}
+	for _, uid := range list {
+		delete(st.Messages, uid)
+	}
+	folder.DeletedOnServer += len(list)
+	return nil
+}
+
+// pairAndCopy handles the messages that are not in the sync state: those
+// on both sides are paired, the others are uploaded or downloaded.
+func (s *Syncer) pairAndCopy(name, dir string, st *SyncFolderState, remote map[uint32][]string, local map[string]*localMessage, folder *FolderReport) error {
+	logger := s.logger.With("mailbox", name)
+	var maxUid uint32
+	for uid := range remote {
+		if uid > maxUid {
+			maxUid = uid
+		}
+	}
+	for uid := range st.Messages {
+		if uid > maxUid {
+			maxUid = uid
+		}
+	}
+
+	remoteKeys, err := s.fetchKeys(remote)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(local))
+	for key := range local {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var uploaded []*localMessage
+	for _, key := range keys {
+		l := local[key]
+		if uid, ok := remoteKeys.take(l.messageKey()); ok {
+			flags := mergeFlags(nil, l.flags, remote[uid])
+			if err := s.applyFlags(uid, l, remote[uid], flags, folder); err != nil {
+				folder.AddError(fmt.Errorf("UID %d: %v", uid, err))
+				continue
+			}
+			st.Messages[uid] = &SyncMessage{Key: l.key, Flags: flags}
+			delete(remote, uid)
+			continue
+		}
+		if err := s.upload(name, l, folder); err != nil {
+			logger.Error("Error uploading message", "op", "append", "file", l.path, "error", err)
+			folder.AddError(fmt.Errorf("%s: %v", l.path, err))
+			continue
+		}
+		uploaded = append(uploaded, l)
+	}
+
+	// The UIDs of uploaded messages are found among the new ones, which
+	// may also hold messages delivered in the meantime.
+	if len(uploaded) > 0 && !s.dryRun {
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(maxUid+1, 0)
+		start := time.Now()
+		found, err := s.backup.client.UidSearch(criteria)
+		metrics.ObserveCommand(s.config.User, "search", start)
+		if err != nil {
+			s.backup.recordError("search")
+			return fmt.Errorf("search error: %v", err)
+		}
+		added := make(map[uint32][]string)
+		for _, uid := range found {
+			if uid > maxUid {
+				added[uid] = nil
+			}
+		}
+		addedKeys, err := s.fetchKeys(added)
+		if err != nil {
+			return err
+		}
+		for _, l := range uploaded {
+			uid, ok := addedKeys.take(l.messageKey())
+			if !ok {
+				logger.Warn("Uploaded message not found on the server, it will be downloaded again", "op", "append", "file", l.path)
+				continue
+			}
+			st.Messages[uid] = &SyncMessage{Key: l.key, Flags: l.flags}
+			delete(added, uid)
+		}
+		for uid, flags := range added {
+			remote[uid] = flags
+		}
+	}
+
+	var download []uint32
+	for uid := range remote {
+		if _, known := st.Messages[uid]; !known {
+			download = append(download, uid)
+		}
+	}
+	sort.Slice(download, func(i, j int) bool { return download[i] < download[j] })
+	const batchSize = 100
+	for i := 0; i < len(download); i += batchSize {
+		end := i + batchSize
+		if end > len(download) {
+			end = len(download)
+		}
+		if err := s.download(name, dir, download[i:end], st, folder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteKeys maps message keys to the UIDs of messages having them.
+type remoteKeys map[string][]uint32
+
+// take returns a UID with the key and forgets it.
+func (k remoteKeys) take(key string) (uint32, bool) {
+	uids := k[key]
+	if len(uids) == 0 {
+		return 0, false
+	}
+	k[key] = uids[1:]
+	return uids[0], true
+}
+
+// fetchKeys fetches the message keys of a set of UIDs, filling in their
+// flags when missing.
+func (s *Syncer) fetchKeys(uids map[uint32][]string) (remoteKeys, error) {
+	keys := make(remoteKeys)
+	if len(uids) == 0 {
+		return keys, nil
+	}
+	seqSet := new(imap.SeqSet)
+	for uid := range uids {
+		seqSet.AddNum(uid)
+	}
+	section := messageIDSection()
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, section.FetchItem()}
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- s.backup.client.UidFetch(seqSet, items, messages)
+	}()
+	var fetched []*imap.Message
+	for msg := range messages {
+		fetched = append(fetched, msg)
+	}
+	err := <-done
+	metrics.ObserveCommand(s.config.User, "fetch", start)
+	if err != nil {
+		s.backup.recordError("fetch")
+		return nil, fmt.Errorf("fetch error: %v", err)
+	}
+
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].Uid < fetched[j].Uid })
+	for _, msg := range fetched {
+		if _, ok := uids[msg.Uid]; !ok {
+			continue
+		}
+		if uids[msg.Uid] == nil {
+			uids[msg.Uid] = syncFlags(msg.Flags)
+		}
+		key := messageKey(msg.GetBody(section), msg.InternalDate, msg.Size)
+		keys[key] = append(keys[key], msg.Uid)
+	}
+	return keys, nil
+}
+
+// upload appends a local message to the server, using the time of its
+// file as INTERNALDATE.
+func (s *Syncer) upload(name string, l *localMessage, folder *FolderReport) error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if s.dryRun {
+		fmt.Printf("Would upload %s to %s (%s)\n", l.path, name, strings.Join(l.flags, " "))
+		folder.Uploaded++
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	err = s.backup.client.Append(name, l.flags, info.ModTime(), &fileLiteral{File: f, size: int(info.Size())})
+	metrics.ObserveCommand(s.config.User, "append", start)
+	if err != nil {
+		s.backup.recordError("append")
+		return err
+	}
+	folder.Uploaded++
+	cli.Progress.Update("Uploaded %d messages to %s", folder.Uploaded, name)
+	return nil
+}
+
+// download saves new server messages into the Maildir folder, through its
+// tmp directory as the Maildir format requires.
+func (s *Syncer) download(name, dir string, uids []uint32, st *SyncFolderState, folder *FolderReport) error {
+	if s.dryRun {
+		for _, uid := range uids {
+			fmt.Printf("Would download %s UID %d\n", name, uid)
+			folder.Messages++
+		}
+		return nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	scratch := &FolderReport{}
+	meta := &layout.FolderMetadata{Messages: make(map[uint32]*layout.MessageMetadata)}
+	tmp := filepath.Join(dir, "tmp")
+	if err := s.backup.backupMessageBatch(name, tmp, seqSet, true, scratch, meta); err != nil {
+		s.backup.recordError("fetch")
+		return fmt.Errorf("fetch error: %v", err)
+	}
+	for _, uid := range uids {
+		msg := meta.Messages[uid]
+		if msg == nil {
+			folder.AddError(fmt.Errorf("UID %d: message could not be fetched", uid))
+			continue
+		}
+		l := &localMessage{
+			key:   strings.TrimSuffix(msg.File, ".eml") + "." + s.hostname,
+			path:  filepath.Join(tmp, msg.File),
+			flags: syncFlags(msg.Flags),
+		}
+		if err := os.Chtimes(l.path, msg.InternalDate, msg.InternalDate); err != nil {
+			folder.AddError(fmt.Errorf("UID %d: %v", uid, err))
+			continue
+		}
+		if err := l.setFlags(l.flags); err != nil {
+			folder.AddError(fmt.Errorf("UID %d: %v", uid, err))
+			continue
+		}
+		st.Messages[uid] = &SyncMessage{Key: l.key, Flags: l.flags}
+		folder.Messages++
+		folder.Bytes += msg.Size
+	}
+	return nil
+}
+
+func (s *Syncer) loadState() error {
+	s.state = &SyncState{Folders: make(map[string]*SyncFolderState)}
+	data, err := os.ReadFile(filepath.Join(s.dir, syncStateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, s.state); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", syncStateFile, err)
+	}
+	if s.state.Folders == nil {
+		s.state.Folders = make(map[string]*SyncFolderState)
+	}
+	return nil
+}
+
+// saveState writes the state file atomically.
+func (s *Syncer) saveState() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, syncStateFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing sync state: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// scanMaildir lists the messages of a Maildir folder by unique name.
+func scanMaildir(dir string) (map[string]*localMessage, error) {
+	local := make(map[string]*localMessage)
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			l := parseMaildirName(entry.Name())
+			if _, ok := local[l.key]; ok {
+				continue
+			}
+			l.path = filepath.Join(dir, sub, entry.Name())
+			local[l.key] = l
+		}
+	}
+	return local, nil
+}
+
+// parseMaildirName splits a Maildir file name into its unique part and the
+// flags of its "2," info.
+func parseMaildirName(name string) *localMessage {
+	l := &localMessage{key: name}
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return l
+	}
+	l.key = name[:i]
+	var extra []byte
+	for _, c := range []byte(name[i+3:]) {
+		known := false
+		for _, f := range maildirFlags {
+			if f.letter == c {
+				l.flags = append(l.flags, f.flag)
+				known = true
+			}
+		}
+		if !known {
+			extra = append(extra, c)
+		}
+	}
+	l.flags = syncFlags(l.flags)
+	l.extra = string(extra)
+	return l
+}
+
+// setFlags renames the file of a message into cur with the given flags.
+func (l *localMessage) setFlags(flags []string) error {
+	var info []byte
+	for _, f := range maildirFlags {
+		if containsFold(flags, f.flag) {
+			info = append(info, f.letter)
+		}
+	}
+	info = append(info, l.extra...)
+	sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+
+	dir := filepath.Dir(filepath.Dir(l.path))
+	path := filepath.Join(dir, "cur", l.key+":2,"+string(info))
+	if path != l.path {
+		if err := os.Rename(l.path, path); err != nil {
+			return err
+		}
+	}
+	l.path, l.flags = path, flags
+	return nil
+}
+
+// messageKey identifies a local message the way the server copy is matched.
+func (l *localMessage) messageKey() string {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	return messageKey(f, info.ModTime(), uint32(info.Size()))
+}
+
+// syncFlags keeps the flags a Maildir file name can hold, sorted.
+func syncFlags(flags []string) []string {
+	result := []string{}
+	for _, f := range maildirFlags {
+		if containsFold(flags, f.flag) {
+			result = append(result, f.flag)
+		}
+	}
+	return result
+}
+
+// mergeFlags merges the flags of both sides against those of the last
+// sync: a flag keeps the value of the side that changed it. Without a last
+// sync, flags set on either side are kept.
+func mergeFlags(base, local, remote []string) []string {
+	result := []string{}
+	for _, f := range maildirFlags {
+		inLocal, inRemote := containsFold(local, f.flag), containsFold(remote, f.flag)
+		set := inRemote
+		if base == nil {
+			set = inLocal || inRemote
+		} else if inLocal != containsFold(base, f.flag) {
+			set = inLocal
+		}
+		if set {
+			result = append(result, f.flag)
+		}
+	}
+	return result
+}
+
+// flagsMissing returns the flags of a that are not in b.
+func flagsMissing(a, b []string) []string {
+	var missing []string
+	for _, f := range a {
+		if !containsFold(b, f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// importRoot is the mailbox below which import puts the folders it finds,
+// unless --import-folder names another one.
+const importRoot = "Imported"
+
+// Kinds of import sources.
+const (
+	importMbox    = "mbox"
+	importMaildir = "maildir"
+	importEml     = "eml"
+)
+
+// maxImportHeader caps the header kept of an imported message to read its
+// Message-ID, date and flags.
+const maxImportHeader = 1 << 20
+
+// Importer adds mail exported by other programs to a backup: mbox files
+// such as Google Takeout archives and Thunderbird local folders, Maildir
+// folders and loose .eml files. Every source folder becomes a mailbox below
+// the import root, stored and indexed like a backed up mailbox with UIDs
+// numbered from 1. Messages the backup already holds, with the same content
+// or the same Message-ID, are skipped, so overlapping exports can be
+// imported one after the other.
+type Importer struct {
+	config ImapConfig
+	root   string
+	dryRun bool
+	// keepDuplicates imports every message, as convert does.
+	keepDuplicates bool
+
+	backup *Backup
+	// known holds the content hash and Message-ID of every stored message.
+	known  map[string]bool
+	report *RunReport
+	logger *slog.Logger
+}
+
+// importSource is a folder of an import source.
+type importSource struct {
+	mailbox string
+	kind    string
+	paths   []string
+}
+
+func NewImporter(config ImapConfig, root string, dryRun bool) *Importer {
+	backup := NewBackup(config)
+	backup.delimiter = "/"
+	return &Importer{
+		config: config,
+		root:   strings.Trim(root, "/"),
+		dryRun: dryRun,
+		backup: backup,
+		report: NewRunReport("import", config.User),
+		logger: slog.Default().With("account", config.User),
+	}
+}
+
+// Report returns the summary of the last run.
+func (i *Importer) Report() *RunReport {
+	return i.report
+}
+
+func (i *Importer) Run(sources []string) error {
+	var found []*importSource
+	for _, source := range sources {
+		s, err := i.scan(source)
+		if err != nil {
+			return err
+		}
+		found = append(found, s...)
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no mbox, Maildir or .eml messages found in %s", strings.Join(sources, ", "))
+	}
+
+	if err := os.MkdirAll(i.config.BackupDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	i.known = make(map[string]bool)
+	if !i.keepDuplicates {
+		if err := i.index(); err != nil {
+			return err
+		}
+		i.logger.Info("Indexed backup", "op", "scan", "dir", i.config.BackupDir, "keys", len(i.known))
+	}
+
+	if i.config.ExtractAttachments && !i.dryRun {
+		extractor, err := NewAttachmentExtractor(i.config.BackupDir)
+		if err != nil {
+			return err
+		}
+		i.backup.attachments = extractor
+		defer func() {
+			if err := extractor.Save(); err != nil {
+				i.logger.Error("Error writing attachments manifest", "op", "extract", "error", err)
+			}
+		}()
+	}
+
+	defer cli.Progress.Done()
+	for _, s := range found {
+		folder := i.report.Folder(s.mailbox)
+		err := i.importFolder(s, folder)
+		folder.Finish()
+		if err != nil {
+			folder.AddError(err)
+			i.logger.Error("Error importing folder", "mailbox", s.mailbox, "error", err)
+		}
+	}
+
+	if i.report.HasErrors() {
+		i.logger.Warn("Import completed with errors")
+	} else {
+		i.logger.Info("Import completed")
+	}
+	return nil
+}
+
+// scan finds the folders of an import source. A file is an mbox or an .eml
+// file. In a directory, every Maildir folder, mbox file and directory of
+// .eml files is a folder, named after its path. Thunderbird's ".sbd"
+// subfolder directories and Maildir++ ".Parent.Child" folders are followed.
+func (i *Importer) scan(source string) ([]*importSource, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		switch importKind(source) {
+		case importMbox:
+			name := strings.TrimSuffix(filepath.Base(source), ".mbox")
+			return []*importSource{{mailbox: i.mailbox(name), kind: importMbox, paths: []string{source}}}, nil
+		case importEml:
+			return []*importSource{{mailbox: i.mailbox(), kind: importEml, paths: []string{source}}}, nil
+		}
+		return nil, fmt.Errorf("%s is neither an mbox nor an .eml file", source)
+	}
+
+	// A Maildir written by sync or convert has encoded folder names,
+	// recorded in its folder map.
+	var names layout.Names
+	if _, err := os.Stat(filepath.Join(source, layout.FolderMapFile)); err == nil {
+		if names, err = layout.LoadNames(source); err != nil {
+			return nil, err
+		}
+	}
+
+	var found []*importSource
+	emls := make(map[string]*importSource)
+	err = filepath.WalkDir(source, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case "cur", "new", "tmp":
+				return filepath.SkipDir
+			}
+			maildir := isMaildir(p)
+			if p != source && strings.HasPrefix(d.Name(), ".") && !maildir {
+				return filepath.SkipDir
+			}
+			if maildir {
+				mailbox := i.folderName(source, p, names)
+				if p == source {
+					// The top of a Maildir++ tree is the inbox.
+					mailbox = i.mailbox("INBOX")
+				}
+				found = append(found, &importSource{mailbox: mailbox, kind: importMaildir, paths: []string{p}})
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		switch importKind(p) {
+		case importMbox:
+			found = append(found, &importSource{mailbox: i.folderName(source, strings.TrimSuffix(p, ".mbox"), names), kind: importMbox, paths: []string{p}})
+		case importEml:
+			dir := filepath.Dir(p)
+			s, ok := emls[dir]
+			if !ok {
+				s = &importSource{mailbox: i.folderName(source, dir, names), kind: importEml}
+				emls[dir] = s
+				found = append(found, s)
+			}
+			s.paths = append(s.paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %v", source, err)
+	}
+	return found, nil
+}
+
+// folderName returns the mailbox of a folder found in a source directory.
+func (i *Importer) folderName(source, p string, names layout.Names) string {
+	rel, err := filepath.Rel(source, p)
+	if err != nil || rel == "." {
+		return i.mailbox()
+	}
+	var parts []string
+	dirs := strings.Split(filepath.ToSlash(rel), "/")
+	for j, part := range dirs {
+		if name, ok := names[path.Join(dirs[:j+1]...)]; ok {
+			parts = append(parts, name)
+			continue
+		}
+		part = strings.TrimSuffix(part, ".sbd")
+		switch {
+		case names != nil:
+			parts = append(parts, layout.DecodePathPart(part))
+		case strings.HasPrefix(part, "."):
+			parts = append(parts, strings.Split(part[1:], ".")...)
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return i.mailbox(parts...)
+}
+
+// mailbox names a folder below the import root. Without a root, messages
+// outside any folder go to INBOX.
+func (i *Importer) mailbox(parts ...string) string {
+	name := strings.Trim(strings.Join(append([]string{i.root}, parts...), "/"), "/")
+	if name == "" {
+		return "INBOX"
+	}
+	return name
+}
+
+// importKind tells whether a file is an .eml file, an mbox file, which
+// starts with a "From " line whatever its name, or neither. An empty file
+// without extension is the mbox of an empty Thunderbird folder.
+func importKind(p string) string {
+	if strings.EqualFold(filepath.Ext(p), ".eml") {
+		return importEml
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	start := make([]byte, 5)
+	n, err := io.ReadFull(f, start)
+	if n == 0 && err == io.EOF && filepath.Ext(p) == "" {
+		return importMbox
+	}
+	if err != nil || string(start) != "From " {
+		return ""
+	}
+	return importMbox
+}
+
+func isMaildir(p string) bool {
+	info, err := os.Stat(filepath.Join(p, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// index records the content hash and Message-ID of every message of the
+// backup, hashing the files of backups that did not record it.
+func (i *Importer) index() error {
+	folders, err := loadBackupFolders(i.config.BackupDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range folders {
+		messages := append([]*layout.MessageMetadata{}, f.Meta.Expunged...)
+		for _, msg := range f.Meta.Messages {
+			messages = append(messages, msg)
+		}
+		for _, msg := range messages {
+			if msg.File == "" {
+				continue
+			}
+			if msg.SHA256 != "" {
+				i.known["sha256:"+msg.SHA256] = true
+			}
+			p := filepath.Join(f.Dir, msg.File)
+			if msg.Tombstone != "" {
+				p = filepath.Join(i.config.BackupDir, msg.Tombstone)
+			}
+			for _, key := range storedKeys(p, msg.SHA256 == "" && msg.Stored == "") {
+				i.known[key] = true
+			}
+		}
+		cli.Progress.Update("Indexed %s", f.Meta.Mailbox)
+	}
+	cli.Progress.Done()
+	return nil
+}
+
+// storedKeys returns the Message-ID key of a stored message, and its
+// content hash when hash is set.
+func storedKeys(p string, hash bool) []string {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var keys []string
+	h := sha256.New()
+	r := bufio.NewReader(io.TeeReader(f, h))
+	header, _ := textproto.NewReader(r).ReadMIMEHeader()
+	if id := strings.TrimSpace(header.Get("Message-Id")); id != "" {
+		keys = append(keys, "id:"+id)
+	}
+	if hash {
+		if _, err := io.Copy(io.Discard, r); err == nil {
+			keys = append(keys, "sha256:"+hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+	return keys
+}
+
+// importFolder imports the messages of one source folder.
+func (i *Importer) importFolder(s *importSource, folder *FolderReport) error {
+	logger := i.logger.With("mailbox", s.mailbox)
+	source := s.paths[0]
+	if s.kind == importEml {
+		source = filepath.Dir(source)
+	}
+	logger.Info("Importing folder", "op", "import", "kind", s.kind, "source", source)
+
+	mailboxPath, meta, err := i.openFolder(s.mailbox)
+	if err != nil {
+		return err
+	}
+	if mailboxPath != "" {
+		lock, err := lockMailbox(mailboxPath, time.Minute)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		// Read again now that no other process can change it.
+		if meta, err = layout.LoadFolderMetadata(mailboxPath); err != nil {
+			return err
+		}
+	}
+	if meta.UidValidity != 0 {
+		return fmt.Errorf("mailbox is backed up from the server, import into another folder with --import-folder")
+	}
+	meta.Mailbox, meta.Delimiter = s.mailbox, "/"
+
+	uid := meta.UidNext
+	for u := range meta.Messages {
+		if u >= uid {
+			uid = u + 1
+		}
+	}
+	for _, msg := range meta.Expunged {
+		if msg.Uid >= uid {
+			uid = msg.Uid + 1
+		}
+	}
+	if uid == 0 {
+		uid = 1
+	}
+
+	imported := 0
+	add := func(copy func(w *importWriter) error, date, fallback time.Time, flags []string) error {
+		ok, err := i.add(meta, mailboxPath, uid, copy, date, fallback, flags, folder)
+		if err != nil {
+			return err
+		}
+		if ok {
+			uid++
+			meta.UidNext = uid
+			imported++
+			// Save as the backup does between batches, so an interrupted
+			// import leaves no unrecorded files behind.
+			if imported%100 == 0 && !i.dryRun {
+				return meta.Save(mailboxPath)
+			}
+		}
+		return nil
+	}
+
+	switch s.kind {
+	case importMbox:
+		err = i.importMbox(s.paths[0], add)
+	case importMaildir:
+		err = i.importMaildir(s.paths[0], add)
+	case importEml:
+		err = i.importEml(s.paths, add)
+	}
+
+	meta.LastSync = time.Now()
+	if !i.dryRun {
+		if saveErr := meta.Save(mailboxPath); saveErr != nil {
+			return saveErr
+		}
+	}
+	logger.Info("Imported folder", "op", "import", "messages", folder.Messages, "skipped", folder.Skipped, "dry_run", i.dryRun)
+	return err
+}
+
+// openFolder returns the directory and metadata of an import mailbox,
+// creating the directory unless this is a dry run.
+func (i *Importer) openFolder(mailbox string) (string, *layout.FolderMetadata, error) {
+	if !i.dryRun {
+		mailboxPath, err := i.backup.mailboxPath(mailbox)
+		if err != nil {
+			return "", nil, err
+		}
+		meta, err := layout.LoadFolderMetadata(mailboxPath)
+		return mailboxPath, meta, err
+	}
+
+	folderMapMutex.Lock()
+	folders, err := folderMap(i.config.BackupDir)
+	folderMapMutex.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+	if dir, ok := folders.Folders[mailbox]; ok {
+		meta, err := layout.LoadFolderMetadata(filepath.Join(i.config.BackupDir, filepath.FromSlash(dir)))
+		return "", meta, err
+	}
+	return "", &layout.FolderMetadata{Messages: make(map[uint32]*layout.MessageMetadata)}, nil
+}
+
+// add stores a message written by copy under uid, unless the backup
+// already holds it. date is the INTERNALDATE the source recorded, if any;
+// otherwise the Date header is used, then fallback.
+func (i *Importer) add(meta *layout.FolderMetadata, mailboxPath string, uid uint32, copy func(w *importWriter) error, date, fallback time.Time, flags []string, folder *FolderReport) (bool, error) {
+	w := &importWriter{w: io.Discard, hash: sha256.New()}
+	var path string
+	if !i.dryRun {
+		path = filepath.Join(mailboxPath, fmt.Sprintf("%d_%d.eml", time.Now().UnixNano(), uid))
+		f, err := os.Create(path)
+		if err != nil {
+			i.backup.recordError("filesystem")
+			return false, fmt.Errorf("error creating file: %v", err)
+		}
+		defer f.Close()
+		w.w = f
+	}
+	if err := copy(w); err != nil {
+		os.Remove(path)
+		return false, err
+	}
+	if w.size == 0 {
+		os.Remove(path)
+		return false, nil
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(w.header.Bytes()))
+	if err != nil {
+		// Keep what cannot be parsed, it is still a message of the export.
+		i.logger.Debug("Unreadable header of imported message", "mailbox", meta.Mailbox, "op", "import", "uid", uid, "error", err)
+		mr = &mail.Reader{}
+	}
+	header := mr.Header
+
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+	keys := []string{"sha256:" + sum}
+	if id := strings.TrimSpace(header.Get("Message-Id")); id != "" {
+		keys = append(keys, "id:"+id)
+	}
+	for _, key := range keys {
+		if i.known[key] && !i.keepDuplicates {
+			os.Remove(path)
+			folder.Skipped++
+			i.logger.Debug("Message already in the backup", "mailbox", meta.Mailbox, "op", "import", "key", key)
+			return false, nil
+		}
+	}
+
+	statusFlags, deleted := importFlags(header)
+	labels, labelFlags, gmail := takeoutLabels(header)
+	if deleted {
+		// Thunderbird keeps deleted messages until the folder is compacted.
+		os.Remove(path)
+		folder.Skipped++
+		return false, nil
+	}
+	for _, key := range keys {
+		i.known[key] = true
+	}
+	for _, f := range append(statusFlags, labelFlags...) {
+		if !containsFold(flags, f) {
+			flags = append(flags, f)
+		}
+	}
+
+	if date.IsZero() {
+		date, _ = header.Date()
+	}
+	if date.IsZero() {
+		date = fallback
+	}
+	msg := &layout.MessageMetadata{
+		Uid:          uid,
+		Flags:        flags,
+		InternalDate: date,
+		Size:         w.size,
+		SHA256:       sum,
+	}
+	if path != "" {
+		msg.File = filepath.Base(path)
+	}
+	if gmail {
+		meta.Gmail, meta.SpecialUse = true, imap.AllAttr
+		msg.GmailLabels = labels
+		msg.GmailThreadID, _ = strconv.ParseUint(strings.TrimSpace(header.Get("X-GM-THRID")), 10, 64)
+	}
+	if msg.Flags == nil {
+		msg.Flags = []string{}
+	}
+	meta.Messages[uid] = msg
+	folder.Messages++
+	folder.Bytes += w.size
+
+	if i.backup.attachments != nil {
+		if err := i.backup.attachments.ExtractFile(meta.Mailbox, path); err != nil {
+			i.logger.Error("Error extracting attachments", "mailbox", meta.Mailbox, "op", "extract", "uid", uid, "error", err)
+		}
+	}
+	cli.Progress.Update("Imported %d messages into %s", folder.Messages, meta.Mailbox)
+	return true, nil
+}
+
+// importWriter writes an imported message with CRLF line endings, as IMAP
+// servers send them, so that its hash matches a backed up copy. It hashes
+// the message and keeps its header.
+type importWriter struct {
+	w      io.Writer
+	hash   hash.Hash
+	header bytes.Buffer
+	inBody bool
+	size   int64
+	line   []byte
+	// strip lists header fields, as "name:" in lower case, kept in the
+	// header read for flags but left out of the stored message.
+	strip    []string
+	skipping bool
+}
+
+// writeLine writes one line, or the start of a line too long for the
+// reader's buffer when it does not end with a newline.
+func (w *importWriter) writeLine(line []byte) error {
+	w.line = w.line[:0]
+	if bytes.HasSuffix(line, []byte("\n")) {
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		w.line = append(append(w.line, line...), '\r', '\n')
+		if !w.inBody && len(line) == 0 {
+			w.inBody = true
+		}
+	} else {
+		w.line = append(w.line, line...)
+	}
+	if !w.inBody {
+		if w.header.Len() < maxImportHeader {
+			w.header.Write(w.line)
+		}
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			w.skipping = false
+			for _, name := range w.strip {
+				if len(line) >= len(name) && strings.EqualFold(string(line[:len(name)]), name) {
+					w.skipping = true
+				}
+			}
+		}
+		if w.skipping {
+			return nil
+		}
+	}
+	w.hash.Write(w.line)
+	n, err := w.w.Write(w.line)
+	w.size += int64(n)
+	return err
+}
+
+// copy writes the rest of r.
+func (w *importWriter) copy(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			if err := w.writeLine(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// importMbox imports the messages of an mbox file. Lines starting with
+// "From " separate messages, and ">From " lines are unquoted as mboxrd
+// readers do. The date of the separator line is the INTERNALDATE.
+func (i *Importer) importMbox(p string, add func(func(w *importWriter) error, time.Time, time.Time, []string) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 64*1024)
+
+	from, err := r.ReadSlice('\n')
+	if err == io.EOF && len(from) == 0 {
+		return nil
+	}
+	if err != nil || !bytes.HasPrefix(from, []byte("From ")) {
+		return fmt.Errorf("%s is not an mbox file", p)
+	}
+	next := string(from)
+	for next != "" {
+		date := mboxDate(next)
+		next = ""
+		copy := func(w *importWriter) error {
+			w.strip = mboxStatusHeaders
+			// Blank lines are held back, as the one before the next "From "
+			// line belongs to the separator. A "From " line without one is
+			// part of the message, as some writers do not quote them.
+			blank := 0
+			// start is whether the read begins a line, rather than
+			// continuing one longer than the buffer.
+			start := true
+			for {
+				line, err := r.ReadSlice('\n')
+				if len(line) > 0 {
+					switch {
+					case start && blank > 0 && bytes.HasPrefix(line, []byte("From ")):
+						next = string(line)
+					case start && len(bytes.TrimRight(line, "\r\n")) == 0 && err == nil:
+						blank++
+					default:
+						for ; blank > 0; blank-- {
+							w.writeLine([]byte("\n"))
+						}
+						if unquoted := bytes.TrimLeft(line, ">"); start && len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+							line = line[1:]
+						}
+						if err := w.writeLine(line); err != nil {
+							return err
+						}
+					}
+				}
+				start = err == nil
+				if next != "" || err == io.EOF {
+					for ; blank > 1; blank-- {
+						w.writeLine([]byte("\n"))
+					}
+					return nil
+				}
+				if err != nil && err != bufio.ErrBufferFull {
+					return err
+				}
+			}
+		}
+		if err := add(copy, date, info.ModTime(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mboxStatusHeaders are the header fields mail programs add to messages of
+// mbox files to record their flags. Import reads the flags from them and
+// leaves them out, as IMAP servers with mbox storage do.
+var mboxStatusHeaders = []string{"status:", "x-status:", "x-mozilla-status:", "x-mozilla-status2:", "x-mozilla-keys:"}
+
+// mboxDate parses the date of an mbox "From sender date" line.
+func mboxDate(line string) time.Time {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range []string{"Mon Jan 2 15:04:05 2006", "Mon Jan 2 15:04:05 -0700 2006", "Mon Jan 2 15:04:05 MST 2006", "Mon Jan 2 15:04 2006"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// importMaildir imports the messages of a Maildir folder with the flags of
+// their file names. The modification time of a file is its INTERNALDATE.
+func (i *Importer) importMaildir(dir string, add func(func(w *importWriter) error, time.Time, time.Time, []string) error) error {
+	local, err := scanMaildir(dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(local))
+	for key := range local {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l := local[key]
+		if err := i.importFile(l.path, true, l.flags, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importEml imports loose message files.
+func (i *Importer) importEml(paths []string, add func(func(w *importWriter) error, time.Time, time.Time, []string) error) error {
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := i.importFile(p, false, nil, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importFile imports a file holding one message. Its modification time is
+// the INTERNALDATE when useModTime is set, and the fallback for messages
+// without Date header otherwise.
+func (i *Importer) importFile(p string, useModTime bool, flags []string, add func(func(w *importWriter) error, time.Time, time.Time, []string) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var date time.Time
+	if useModTime {
+		date = info.ModTime()
+	}
+	copy := func(w *importWriter) error {
+		return w.copy(bufio.NewReaderSize(f, 64*1024))
+	}
+	if err := add(copy, date, info.ModTime(), flags); err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	return nil
+}
+
+// importFlags reads the flags mail programs store in message headers:
+// Status and X-Status of mbox files, and X-Mozilla-Status of Thunderbird,
+// which also marks messages deleted but not yet compacted away.
+func importFlags(h mail.Header) ([]string, bool) {
+	var flags []string
+	set := func(f string) {
+		if !containsFold(flags, f) {
+			flags = append(flags, f)
+		}
+	}
+	if strings.Contains(h.Get("Status"), "R") {
+		set(imap.SeenFlag)
+	}
+	for _, c := range h.Get("X-Status") {
+		switch c {
+		case 'A':
+			set(imap.AnsweredFlag)
+		case 'F':
+			set(imap.FlaggedFlag)
+		case 'T':
+			set(imap.DraftFlag)
+		}
+	}
+	deleted := false
+	if v := strings.TrimSpace(h.Get("X-Mozilla-Status")); v != "" {
+		if status, err := strconv.ParseUint(v, 16, 16); err == nil {
+			if status&0x0001 != 0 {
+				set(imap.SeenFlag)
+			}
+			if status&0x0002 != 0 {
+				set(imap.AnsweredFlag)
+			}
+			if status&0x0004 != 0 {
+				set(imap.FlaggedFlag)
+			}
+			deleted = status&0x0008 != 0
+		}
+	}
+	return flags, deleted
+}
+
+// takeoutSystemLabels maps the names Google Takeout writes for Gmail system
+// labels to the labels Gmail mode records, or to "" for the ones without
+// folder or flag meaning.
+var takeoutSystemLabels = map[string]string{
+	"Inbox":     `\Inbox`,
+	"Sent":      `\Sent`,
+	"Drafts":    `\Draft`,
+	"Draft":     `\Draft`,
+	"Spam":      `\Spam`,
+	"Trash":     `\Trash`,
+	"Starred":   `\Starred`,
+	"Important": `\Important`,
+	"Opened":    "",
+	"Unread":    "",
+	"Archived":  "",
+	"Chat":      "",
+}
+
+// takeoutLabels reads the X-Gmail-Labels header of a Google Takeout mbox,
+// in the form Gmail mode records labels, along with the flags the Unread
+// and Starred labels stand for.
+func takeoutLabels(h mail.Header) ([]string, []string, bool) {
+	if !h.Has("X-Gmail-Labels") {
+		return nil, nil, false
+	}
+	value, err := h.Text("X-Gmail-Labels")
+	if err != nil {
+		value = h.Get("X-Gmail-Labels")
+	}
+	r := csv.NewReader(strings.NewReader(value))
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	names, _ := r.Read()
+
+	labels := []string{}
+	seen, starred := true, false
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		label, system := takeoutSystemLabels[name]
+		seen = seen && name != "Unread"
+		starred = starred || name == "Starred"
+		switch {
+		case name == "" || strings.HasPrefix(name, "Category "):
+		case system && label != "":
+			labels = append(labels, label)
+		case !system:
+			labels = append(labels, name)
+		}
+	}
+	var flags []string
+	if seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if starred {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	return labels, flags, true
+}
+
+// Formats convert writes.
+const (
+	formatEml     = "eml"
+	formatMaildir = "maildir"
+	formatMbox    = "mbox"
+)
+
+// Converter rewrites a backup or a mail export in another storage format
+// without contacting the server: the .eml-per-file layout of the backup
+// command, a Maildir tree or a tree of mbox files. Folder hierarchy, flags
+// and INTERNALDATE are kept. Other formats are read like import does, into
+// a temporary backup when the target is not the backup layout.
+type Converter struct {
+	source string
+	dest   string
+	format string
+
+	hostname string
+	report   *RunReport
+	logger   *slog.Logger
+}
+
+func NewConverter(source, dest, format string) *Converter {
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &Converter{
+		source:   source,
+		dest:     dest,
+		format:   format,
+		hostname: hostname,
+		report:   NewRunReport("convert", ""),
+		logger:   slog.Default(),
+	}
+}
+
+// Report returns the summary of the last run.
+func (c *Converter) Report() *RunReport {
+	return c.report
+}
+
+func (c *Converter) Run() error {
+	switch c.format {
+	case formatEml, formatMaildir, formatMbox:
+	default:
+		return fmt.Errorf("unknown format %q (expected eml, maildir or mbox)", c.format)
+	}
+	if entries, err := os.ReadDir(c.dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", c.dest)
+	}
+	if _, err := os.Stat(c.source); err != nil {
+		return err
+	}
+
+	folders, err := loadBackupFolders(c.source)
+	if err != nil {
+		return err
+	}
+	if len(folders) > 0 {
+		if c.format == formatEml {
+			return fmt.Errorf("%s is already a backup", c.source)
+		}
+		return c.export(c.source, folders)
+	}
+
+	backupDir := c.dest
+	if c.format != formatEml {
+		if err := os.MkdirAll(filepath.Dir(filepath.Clean(c.dest)), 0755); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(c.dest)), ".convert-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		backupDir = tmp
+	}
+	importer := NewImporter(ImapConfig{BackupDir: backupDir}, "", false)
+	importer.keepDuplicates = true
+	if c.format == formatEml {
+		importer.report = c.report
+	}
+	if err := importer.Run([]string{c.source}); err != nil {
+		return err
+	}
+	if c.format == formatEml {
+		return nil
+	}
+	for _, f := range importer.Report().Folders {
+		if len(f.Errors) > 0 {
+			folder := c.report.Folder(f.Name)
+			folder.Errors = append(folder.Errors, f.Errors...)
+		}
+	}
+
+	folders, err = loadBackupFolders(backupDir)
+	if err != nil {
+		return err
+	}
+	return c.export(backupDir, folders)
+}
+
+// export writes the folders of a backup in the target format.
+func (c *Converter) export(backupDir string, folders []BackupFolder) error {
+	if err := os.MkdirAll(c.dest, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	// The folder map records the mailbox of every folder, so that sync,
+	// import and convert find the original names again.
+	folderMap, err := layout.LoadFolderMap(c.dest)
+	if err != nil {
+		return err
+	}
+
+	defer cli.Progress.Done()
+	for _, f := range folders {
+		folder := c.report.Folder(f.Meta.Mailbox)
+		var err error
+		if c.format == formatMaildir {
+			err = c.exportMaildir(f, folderMap, folder)
+		} else {
+			err = c.exportMbox(f, folderMap, folder)
+		}
+		folder.Finish()
+		if err != nil {
+			folder.AddError(err)
+			c.logger.Error("Error converting folder", "mailbox", f.Meta.Mailbox, "error", err)
+		}
+	}
+	if err := folderMap.Save(c.dest); err != nil {
+		return err
+	}
+
+	if c.report.HasErrors() {
+		c.logger.Warn("Conversion completed with errors")
+	} else {
+		c.logger.Info("Conversion completed", "dir", c.dest, "format", c.format)
+	}
+	return nil
+}
+
+// messages returns the stored messages of a folder by UID, counting the
+// ones skipped by the backup.
+func (c *Converter) messages(f BackupFolder, folder *FolderReport) []*layout.MessageMetadata {
+	var messages []*layout.MessageMetadata
+	for _, msg := range f.Meta.Messages {
+		if msg.File == "" {
+			folder.Skipped++
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Uid < messages[j].Uid })
+	return messages
+}
+
+// exportMaildir copies the messages of a folder into a Maildir folder named
+// like sync names them, with the flags in the file names and the
+// INTERNALDATE as modification time.
+func (c *Converter) exportMaildir(f BackupFolder, folderMap *layout.FolderMap, folder *FolderReport) error {
+	dir := filepath.Join(c.dest, filepath.FromSlash(folderMap.Assign(c.dest, f.Meta.Mailbox, f.Meta.Delimiter)))
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return fmt.Errorf("error creating directory: %v", err)
+		}
+	}
+	c.logger.Info("Converting folder", "mailbox", f.Meta.Mailbox, "op", "convert", "dir", dir)
+
+	for _, msg := range c.messages(f, folder) {
+		l := &localMessage{
+			key:   strings.TrimSuffix(msg.File, ".eml") + "." + c.hostname,
+			flags: syncFlags(msg.Flags),
+		}
+		l.path = filepath.Join(dir, "tmp", l.key)
+		n, err := copyFile(filepath.Join(f.Dir, msg.File), l.path)
+		if err == nil {
+			err = os.Chtimes(l.path, msg.InternalDate, msg.InternalDate)
+		}
+		if err == nil {
+			err = l.setFlags(l.flags)
+		}
+		if err != nil {
+			os.Remove(l.path)
+			folder.AddError(fmt.Errorf("UID %d: %v", msg.Uid, err))
+			continue
+		}
+		folder.Messages++
+		folder.Bytes += n
+		cli.Progress.Update("Converted %d messages of %s", folder.Messages, f.Meta.Mailbox)
+	}
+	return nil
+}
+
+// exportMbox writes the messages of a folder to an mbox file. Subfolders
+// go to a ".sbd" directory next to it, as Thunderbird lays out local
+// folders. Flags are written to Status and X-Status headers.
+func (c *Converter) exportMbox(f BackupFolder, folderMap *layout.FolderMap, folder *FolderReport) error {
+	parts := []string{f.Meta.Mailbox}
+	if f.Meta.Delimiter != "" {
+		parts = strings.Split(f.Meta.Mailbox, f.Meta.Delimiter)
+	}
+	for i, part := range parts {
+		parts[i] = layout.ShortenPathPart(layout.EncodePathPart(part), part)
+		if i < len(parts)-1 {
+			parts[i] += ".sbd"
+		}
+	}
+	rel := path.Join(parts...)
+	folderMap.Folders[f.Meta.Mailbox] = rel
+	if folderMap.Delimiter == "" {
+		folderMap.Delimiter = f.Meta.Delimiter
+	}
+	p := filepath.Join(c.dest, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	c.logger.Info("Converting folder", "mailbox", f.Meta.Mailbox, "op", "convert", "file", p)
+
+	out, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	for _, msg := range c.messages(f, folder) {
+		n, err := writeMboxMessage(w, filepath.Join(f.Dir, msg.File), msg)
+		if err != nil {
+			folder.AddError(fmt.Errorf("UID %d: %v", msg.Uid, err))
+			continue
+		}
+		folder.Messages++
+		folder.Bytes += n
+		cli.Progress.Update("Converted %d messages of %s", folder.Messages, f.Meta.Mailbox)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeMboxMessage appends a stored message to an mbox file with Unix line
+// endings, quoting "From " lines as mboxrd does.
+func writeMboxMessage(w *bufio.Writer, p string, msg *layout.MessageMetadata) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(w, "From MAILER-DAEMON %s\n", msg.InternalDate.UTC().Format(time.ANSIC))
+	status := "O"
+	if containsFold(msg.Flags, imap.SeenFlag) {
+		status = "RO"
+	}
+	fmt.Fprintf(w, "Status: %s\n", status)
+	var xstatus []byte
+	for _, f := range []struct {
+		letter byte
+		flag   string
+	}{{'A', imap.AnsweredFlag}, {'F', imap.FlaggedFlag}, {'T', imap.DraftFlag}} {
+		if containsFold(msg.Flags, f.flag) {
+			xstatus = append(xstatus, f.letter)
+		}
+	}
+	if len(xstatus) > 0 {
+		fmt.Fprintf(w, "X-Status: %s\n", xstatus)
+	}
+
+	var n int64
+	r := bufio.NewReaderSize(f, 64*1024)
+	newline := true
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			if newline && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				w.WriteByte('>')
+			}
+			n += int64(len(line))
+			newline = bytes.HasSuffix(line, []byte("\n"))
+			if newline {
+				line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+				w.Write(line)
+				w.WriteByte('\n')
+			} else {
+				w.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return n, err
+		}
+	}
+	if !newline {
+		w.WriteByte('\n')
+	}
+	return n, w.WriteByte('\n')
+}
+
+// copyFile copies a file, returning its size.
+func copyFile(from, to string) (int64, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func main() {
+	extractAttachments := flag.Bool("extract-attachments", false, "Extract attachments of backed up messages into BACKUP_DIR/"+layout.AttachmentsDir)
+	reportPath := flag.String("report", "", "Write a JSON run report to this file (\"-\" for stdout, stderr by default)")
+	logFormat := flag.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
+	metricsTextfile := flag.String("metrics-textfile", "", "Write Prometheus metrics to this node_exporter textfile after the run (default $METRICS_TEXTFILE)")
+	metricsListen := flag.String("metrics-listen", "", "Serve Prometheus metrics on this address at /metrics (default $METRICS_LISTEN)")
+	statePath := flag.String("state", "", "State file of daemon (default $DAEMON_STATE_FILE or BACKUP_DIR/daemon-state.json) and migrate (default BACKUP_DIR/migrate-state.json)")
+	// A negative jitter means unset, so that 0 can disable it.
+	jitter := time.Duration(-1)
+	flag.Func("jitter", "Maximum random delay added to each scheduled daemon run, 0 to disable it (default $SCHEDULE_JITTER or 5m)", func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("negative duration")
+		}
+		jitter = d
+		return err
+	})
+	pollInterval := flag.Duration("poll-interval", time.Minute, "NOOP polling interval of watch mode when the server does not support IDLE, and of the folders beyond --max-connections")
+	maxConnections := flag.Int("max-connections", 0, fmt.Sprintf("Maximum IMAP connections of watch mode; further folders are polled over one of them (default $WATCH_MAX_CONNECTIONS or %d)", defaultWatchConnections))
+	mode := flag.String("mode", "", "Backup mode: archive keeps everything, mirror moves messages expunged on the server to tombstones (default $BACKUP_MODE or archive)")
+	tombstoneGrace := flag.String("tombstone-grace", "", "How long a mirror keeps tombstones before purging them, e.g. 30d or 72h (default $TOMBSTONE_GRACE or 30d)")
+	gmail := flag.Bool("gmail", false, "Gmail mode: back up All Mail once and record labels and thread IDs (default $GMAIL_MODE)")
+	excludeSpecialUse := flag.String("exclude-special-use", "", "Comma-separated special-use folders not to back up, e.g. trash,junk (default $EXCLUDE_SPECIAL_USE)")
+	maxMessageMemory := flag.String("max-message-memory", "", "Fetch messages larger than this in chunks of this size, e.g. 16M, 0 to disable (default $MAX_MESSAGE_MEMORY or 16M)")
+	maxMessageSize := flag.String("max-message-size", "", "Skip messages larger than this, e.g. 25M (default $MAX_MESSAGE_SIZE or no limit)")
+	folderMaxSize := flag.String("folder-max-size", "", "Comma-separated folder=size limits overriding --max-message-size, e.g. \"Notifications=1M,Lists/*=5M\" (default $FOLDER_MAX_SIZE)")
+	headersOnly := flag.String("headers-only", "", "Comma-separated folders of which only headers and MIME structure are backed up, e.g. \"Alerts/*\" (default $HEADERS_ONLY)")
+	maxDeletions := flag.Int("max-deletions", -1, fmt.Sprintf("Maximum messages sync deletes on the server in a run (default $SYNC_MAX_DELETIONS or %d)", defaultMaxDeletions))
+	dryRun := flag.Bool("dry-run", false, "Show what restore, migrate, sync or import would change without changing anything")
+	importFolder := flag.String("import-folder", importRoot, "Mailbox below which import puts the imported folders")
+	format := flag.String("format", "", "Format convert writes: eml (the backup layout), maildir or mbox")
+	listen := flag.String("listen", "", "Address of the serve web UI (default $SERVE_LISTEN or 127.0.0.1:8080)")
+	flag.Parse()
+
+	envErr := godotenv.Load()
+	if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+		cli.Fatal("Invalid logging options", "error", err)
+	}
+	if envErr != nil {
+		switch flag.Arg(0) {
+		case "import", "convert", "extract-attachments":
+			// These work on local files only, and need no account.
+			if !errors.Is(envErr, fs.ErrNotExist) {
+				cli.Fatal("Error loading .env file", "error", envErr)
+			}
+			slog.Debug("No .env file, using the environment")
+		default:
+			cli.Fatal("Error loading .env file", "error", envErr)
+		}
+	} else {
+		slog.Debug("Environment loaded")
+	}
+
+	configure := func(c *ImapConfig) {
+		c.ExtractAttachments = *extractAttachments
+		if *mode != "" {
+			if *mode != modeArchive && *mode != modeMirror {
+				cli.Fatal("Invalid --mode (expected archive or mirror)", "mode", *mode)
+			}
+			c.Mode = *mode
+		}
+		if *tombstoneGrace != "" {
+			grace, err := cli.ParseGrace(*tombstoneGrace)
+			if err != nil {
+				cli.Fatal("Invalid --tombstone-grace", "error", err)
+			}
+			c.TombstoneGrace = grace
+		}
+		if *gmail {
+			c.Gmail = true
+		}
+		if *maxMessageSize != "" {
+			size, err := cli.ParseSize(*maxMessageSize)
+			if err != nil {
+				cli.Fatal("Invalid --max-message-size", "error", err)
+			}
+			c.MaxMessageSize = size
+		}
+		if *folderMaxSize != "" {
+			limits, err := parseFolderSizeLimits(*folderMaxSize)
+			if err != nil {
+				cli.Fatal("Invalid --folder-max-size", "error", err)
+			}
+			c.FolderSizeLimits = limits
+		}
+		if *headersOnly != "" {
+			c.HeadersOnly = cli.ParseFolderList(*headersOnly)
+		}
+		if *maxMessageMemory != "" {
+			size, err := cli.ParseSize(*maxMessageMemory)
+			if err != nil {
+				cli.Fatal("Invalid --max-message-memory", "error", err)
+			}
+			c.MaxMessageMemory = size
+		}
+		if *excludeSpecialUse != "" {
+			exclude, err := imapext.ParseSpecialUse(*excludeSpecialUse)
+			if err != nil {
+				cli.Fatal("Invalid --exclude-special-use", "error", err)
+			}
+			c.ExcludeSpecialUse = exclude
+		}
+	}
+
+	config, err := loadConfig("", "email_backup", true)
+	if err != nil {
+		cli.Fatal("Invalid configuration", "error", err)
+	}
+	configure(&config)
+
+	daemon, watch := false, false
+	switch flag.Arg(0) {
+	case "", "backup":
+	case "daemon":
+		daemon = true
+	case "watch":
+		watch = true
+	case "extract-attachments":
+		if flag.NArg() > 1 {
+			config.BackupDir = flag.Arg(1)
+		}
+		slog.Info("Extracting attachments", "op", "extract", "dir", config.BackupDir)
+		extractor, err := NewAttachmentExtractor(config.BackupDir)
+		if err != nil {
+			cli.Fatal("Error opening attachments directory", "op", "extract", "error", err)
+		}
+		if err := extractor.ExtractAll(); err != nil {
+			cli.Fatal("Error extracting attachments", "op", "extract", "error", err)
+		}
+		slog.Info("Attachment extraction completed")
+		return
+	case "restore":
+		sourceDir := config.BackupDir
+		if flag.NArg() > 1 {
+			sourceDir = flag.Arg(1)
+		}
+		dest, err := loadConfig("RESTORE_", sourceDir, true)
+		if err != nil {
+			cli.Fatal("Invalid restore configuration", "error", err)
+		}
+		restorer := NewRestorer(dest, sourceDir, *dryRun)
+		report := restorer.Report()
+		if err := restorer.Run(); err != nil {
+			slog.Error("Restore failed", "op", "restore", "error", err)
+			report.Fail(err)
+		}
+		code := report.Finish()
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing report", "error", err)
+		}
+		os.Exit(code)
+	case "migrate":
+		// Nothing of the source account is inherited, least of all its
+		// password.
+		dest, err := loadConfig("MIGRATE_", config.BackupDir, false)
+		if err != nil {
+			cli.Fatal("Invalid migrate configuration", "error", err)
+		}
+		if dest.Host == "" || dest.User == "" || dest.Password == "" {
+			cli.Fatal("MIGRATE_IMAP_HOST, MIGRATE_IMAP_USER and MIGRATE_IMAP_PASSWORD are required")
+		}
+		if dest.Port == "" {
+			dest.Port = "993"
+		}
+		if *statePath == "" {
+			*statePath = filepath.Join(config.BackupDir, "migrate-state.json")
+		}
+		slog.Info("Will migrate emails", "account", config.User, "destination", dest.User, "state", *statePath)
+		migrator := NewMigrator(config, dest, *statePath, *dryRun)
+		report := migrator.Report()
+		if err := migrator.Run(); err != nil {
+			slog.Error("Migration failed", "op", "migrate", "error", err)
+			report.Fail(err)
+		}
+		code := report.Finish()
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing report", "error", err)
+		}
+		os.Exit(code)
+	case "sync":
+		dir := os.Getenv("SYNC_DIR")
+		if flag.NArg() > 1 {
+			dir = flag.Arg(1)
+		}
+		if dir == "" {
+			dir = "Maildir"
+		}
+		if *maxDeletions < 0 {
+			*maxDeletions = defaultMaxDeletions
+			if v := os.Getenv("SYNC_MAX_DELETIONS"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					cli.Fatal("Invalid SYNC_MAX_DELETIONS", "value", v)
+				}
+				*maxDeletions = n
+			}
+		}
+		slog.Info("Will sync emails", "account", config.User, "dir", dir)
+		syncer := NewSyncer(config, dir, *maxDeletions, *dryRun)
+		report := syncer.Report()
+		if err := syncer.Run(); err != nil {
+			slog.Error("Sync failed", "op", "sync", "error", err)
+			report.Fail(err)
+		}
+		code := report.Finish()
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing report", "error", err)
+		}
+		os.Exit(code)
+	case "import":
+		if flag.NArg() < 2 {
+			cli.Fatal("Usage: import <mbox file, Maildir or directory>...")
+		}
+		slog.Info("Importing messages", "dir", config.BackupDir, "folder", *importFolder)
+		importer := NewImporter(config, *importFolder, *dryRun)
+		report := importer.Report()
+		if err := importer.Run(flag.Args()[1:]); err != nil {
+			slog.Error("Import failed", "op", "import", "error", err)
+			report.Fail(err)
+		}
+		code := report.Finish()
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing report", "error", err)
+		}
+		os.Exit(code)
+	case "convert":
+		if flag.NArg() != 3 || *format == "" {
+			cli.Fatal("Usage: --format eml|maildir|mbox convert <source> <destination>")
+		}
+		slog.Info("Converting", "source", flag.Arg(1), "dir", flag.Arg(2), "format", *format)
+		converter := NewConverter(flag.Arg(1), flag.Arg(2), *format)
+		report := converter.Report()
+		if err := converter.Run(); err != nil {
+			slog.Error("Conversion failed", "op", "convert", "error", err)
+			report.Fail(err)
+		}
+		code := report.Finish()
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing report", "error", err)
+		}
+		os.Exit(code)
+	case "serve":
+		backupDir := config.BackupDir
+		if flag.NArg() > 1 {
+			backupDir = flag.Arg(1)
+		}
+		dest, err := loadConfig("RESTORE_", backupDir, true)
+		if err != nil {
+			cli.Fatal("Invalid restore configuration", "error", err)
+		}
+		if *listen == "" {
+			*listen = os.Getenv("SERVE_LISTEN")
+		}
+		if *listen == "" {
+			*listen = "127.0.0.1:8080"
+		}
+		username := os.Getenv("SERVE_USER")
+		if username == "" {
+			username = "admin"
+		}
+		password := os.Getenv("SERVE_PASSWORD")
+		if password == "" {
+			random := make([]byte, 12)
+			if _, err := cryptorand.Read(random); err != nil {
+				cli.Fatal("Error generating password", "error", err)
+			}
+			password = hex.EncodeToString(random)
+			fmt.Fprintf(os.Stderr, "SERVE_PASSWORD is not set, log in as %q with password %q\n", username, password)
+		}
+		server, err := NewWebServer(backupDir, dest, username, password)
+		if err != nil {
+			cli.Fatal("Error starting web UI", "error", err)
+		}
+		slog.Info("Serving web UI", "op", "serve", "addr", *listen, "dir", backupDir, "restore_account", dest.User)
+		if err := http.ListenAndServe(*listen, server.Handler()); err != nil {
+			cli.Fatal("Web UI stopped", "op", "serve", "error", err)
+		}
+		return
+	default:
+		cli.Fatal("Unknown command (expected backup, daemon, watch, restore, migrate, sync, import, convert, serve or extract-attachments)", "command", flag.Arg(0))
+	}
+
+	if *metricsTextfile == "" {
+		*metricsTextfile = os.Getenv("METRICS_TEXTFILE")
+	}
+	if *metricsListen == "" {
+		*metricsListen = os.Getenv("METRICS_LISTEN")
+	}
+	if *metricsListen != "" {
+		go func() {
+			slog.Info("Serving metrics", "addr", *metricsListen)
+			if err := metrics.ListenAndServe(*metricsListen); err != nil {
+				slog.Error("Metrics endpoint stopped", "addr", *metricsListen, "error", err)
+			}
+		}()
+	}
+
+	if daemon {
+		runDaemon(config.BackupDir, configure, *statePath, jitter, *reportPath, *metricsTextfile)
+		return
+	}
+	if watch {
+		mailboxes := flag.Args()[1:]
+		if len(mailboxes) == 0 && os.Getenv("WATCH_FOLDERS") != "" {
+			for _, name := range strings.Split(os.Getenv("WATCH_FOLDERS"), ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					mailboxes = append(mailboxes, name)
+				}
+			}
+		}
+		if len(mailboxes) == 0 {
+			mailboxes = []string{"INBOX"}
+		}
+		if *maxConnections == 0 {
+			*maxConnections = defaultWatchConnections
+			if v := os.Getenv("WATCH_MAX_CONNECTIONS"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					cli.Fatal("Invalid WATCH_MAX_CONNECTIONS", "value", v, "error", err)
+				}
+				*maxConnections = n
+			}
+		}
+		if *maxConnections < 1 {
+			cli.Fatal("The maximum number of connections must be at least 1", "value", *maxConnections)
+		}
+		os.Exit(runWatch(config, mailboxes, *pollInterval, *maxConnections, *reportPath, *metricsTextfile))
+	}
+
+	slog.Info("Will backup emails", "account", config.User, "dir", config.BackupDir)
+
+	backup := NewBackup(config)
+	if err := backup.Start(); err != nil {
+		slog.Error("Backup failed", "account", config.User, "error", err)
+		backup.Report().Fail(err)
+	}
+
+	code := backup.Report().Finish()
+	if err := backup.Report().Write(*reportPath); err != nil {
+		slog.Error("Error writing report", "error", err)
+	}
+
+	recordRunMetrics(backup.Report())
+	if *metricsTextfile != "" {
+		if err := metrics.Restore(*metricsTextfile, "imap_backup_last_success_timestamp_seconds"); err != nil {
+			slog.Warn("Error reading previous metrics", "file", *metricsTextfile, "error", err)
+		}
+		if err := metrics.WriteTextfile(*metricsTextfile); err != nil {
+			slog.Error("Error writing metrics textfile", "file", *metricsTextfile, "error", err)
+		}
+	}
+	os.Exit(code)
+}
+
+func runDaemon(baseDir string, configure func(*ImapConfig), statePath string, jitter time.Duration, reportPath, metricsTextfile string) {
+	accounts, err := loadAccounts(baseDir, configure)
+	if err != nil {
+		cli.Fatal("Invalid daemon configuration", "error", err)
+	}
+
+	if statePath == "" {
+		statePath = os.Getenv("DAEMON_STATE_FILE")
+	}
+	if statePath == "" {
+		statePath = filepath.Join(baseDir, "daemon-state.json")
+	}
+	if jitter < 0 {
+		jitter = 5 * time.Minute
+		if v := os.Getenv("SCHEDULE_JITTER"); v != "" {
+			if jitter, err = time.ParseDuration(v); err != nil || jitter < 0 {
+				cli.Fatal("Invalid SCHEDULE_JITTER", "value", v, "error", err)
+			}
+		}
+	}
+
+	d := NewDaemon(accounts, statePath, jitter)
+	d.reportPath = reportPath
+	d.metricsTextfile = metricsTextfile
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second signal aborts instead of waiting for running backups.
+		<-ctx.Done()
+		stop()
+	}()
+
+	slog.Info("Starting daemon", "accounts", len(accounts), "state", statePath, "jitter", jitter)
+	if err := d.Run(ctx); err != nil {
+		cli.Fatal("Daemon failed", "error", err)
+	}
+	slog.Info("Daemon stopped")
+}
+
+func runWatch(config ImapConfig, mailboxes []string, pollInterval time.Duration, maxConnections int, reportPath, metricsTextfile string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Starting watch", "account", config.User, "mailboxes", strings.Join(mailboxes, ","), "dir", config.BackupDir)
+	w := NewWatcher(config, mailboxes, pollInterval, maxConnections)
+	if err := w.Run(ctx); err != nil {
+		slog.Error("Watch failed", "account", config.User, "error", err)
+		w.Report().Fail(err)
+	}
+	slog.Info("Watch stopped")
+
+	code := w.Report().Finish()
+	if err := w.Report().Write(reportPath); err != nil {
+		slog.Error("Error writing report", "error", err)
+	}
+	recordRunMetrics(w.Report())
+	if metricsTextfile != "" {
+		if err := metrics.Restore(metricsTextfile, "imap_backup_last_success_timestamp_seconds"); err != nil {
+			slog.Warn("Error reading previous metrics", "file", metricsTextfile, "error", err)
+		}
+		if err := metrics.WriteTextfile(metricsTextfile); err != nil {
+			slog.Error("Error writing metrics textfile", "file", metricsTextfile, "error", err)
+		}
 	}
+	return code
 }
@@ -0,0 +1,886 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+
+	"imap-backup/internal/layout"
+	"imap-backup/internal/metrics"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+)
+
+// startTestServer serves an IMAP backend, such as memory.New() with one
+// account, username/password, whose INBOX holds one message. Connections of
+// the package trust its certificate.
+func startTestServer(t *testing.T, be backend.Backend) ImapConfig {
+	t.Helper()
+	testCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IsCA:         true,
+
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		tlsConfig = &tls.Config{RootCAs: pool}
+	})
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return ImapConfig{Host: "127.0.0.1", Port: port, User: "username", Password: "password"}
+}
+
+// wrapBackend is a memory backend whose mailboxes are wrapped, to change
+// what the server announces or returns.
+type wrapBackend struct {
+	*memory.Backend
+	wrap func(backend.Mailbox) backend.Mailbox
+}
+
+func (be wrapBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return wrapUser{u, be.wrap}, nil
+}
+
+type wrapUser struct {
+	backend.User
+	wrap func(backend.Mailbox) backend.Mailbox
+}
+
+func (u wrapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	boxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range boxes {
+		boxes[i] = u.wrap(mbox)
+	}
+	return boxes, err
+}
+
+func (u wrapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return u.wrap(mbox), nil
+}
+
+// dotBackend returns a memory backend whose hierarchy delimiter is ".".
+func dotBackend() backend.Backend {
+	return wrapBackend{memory.New(), func(mbox backend.Mailbox) backend.Mailbox { return dotMailbox{mbox} }}
+}
+
+type dotMailbox struct {
+	backend.Mailbox
+}
+
+func (m dotMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := m.Mailbox.Info()
+	if info != nil {
+		info.Delimiter = "."
+	}
+	return info, err
+}
+
+// bodylessMailbox leaves out the body of the message whose UID is stored in
+// uid, as servers do for messages they fail to read.
+type bodylessMailbox struct {
+	backend.Mailbox
+	uid *atomic.Uint32
+}
+
+func (m bodylessMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	inner := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Mailbox.ListMessages(uid, seqSet, items, inner)
+	}()
+	for msg := range inner {
+		if msg.Uid == m.uid.Load() {
+			for item := range msg.Items {
+				if _, err := imap.ParseBodySectionName(item); err == nil {
+					delete(msg.Items, item)
+				}
+			}
+			msg.Body = nil
+		}
+		ch <- msg
+	}
+	return <-done
+}
+
+// backupCounters returns the rendered backup message and byte counters.
+func backupCounters(t *testing.T) string {
+	t.Helper()
+	var out strings.Builder
+	if _, err := metrics.Default.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	var counters []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "imap_backup_messages_total") || strings.HasPrefix(line, "imap_backup_bytes_total") {
+			counters = append(counters, line)
+		}
+	}
+	return strings.Join(counters, "\n")
+}
+
+// testMessage is a message with a subject and a Message-ID made of id.
+func testMessage(id string) string {
+	return fmt.Sprintf("From: a@example.com\r\nSubject: %s\r\nMessage-ID: <%s@example.com>\r\n\r\nHello\r\n", id, id)
+}
+
+// appendMessages creates a mailbox unless it exists and appends a message
+// per id to it.
+func appendMessages(t *testing.T, config ImapConfig, mailbox string, ids ...string) {
+	t.Helper()
+	b := NewBackup(config)
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Logout()
+
+	if mailbox != "INBOX" {
+		b.client.Create(mailbox)
+	}
+	for i, id := range ids {
+		date := time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC)
+		if err := b.client.Append(mailbox, nil, date, strings.NewReader(testMessage(id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serverMessages returns the subjects of the messages in a mailbox.
+func serverMessages(t *testing.T, config ImapConfig, mailbox string) []string {
+	t.Helper()
+	b := NewBackup(config)
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Logout()
+
+	mbox, err := b.client.Select(mailbox, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Messages == 0 {
+		return nil
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, mbox.Messages)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.client.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope}, messages)
+	}()
+	var subjects []string
+	for msg := range messages {
+		subjects = append(subjects, msg.Envelope.Subject)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return subjects
+}
+
+// writeTestBackup writes a backed up mailbox with one message per subject.
+func writeTestBackup(t *testing.T, dir, mailbox string, subjects ...string) {
+	t.Helper()
+	path := filepath.Join(dir, mailbox)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta := &layout.FolderMetadata{Mailbox: mailbox, Delimiter: "/", UidValidity: 1, Messages: make(map[uint32]*layout.MessageMetadata)}
+	for i, subject := range subjects {
+		uid := uint32(i + 1)
+		body := testMessage(subject)
+		file := fmt.Sprintf("%d.eml", uid)
+		if err := os.WriteFile(filepath.Join(path, file), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta.Messages[uid] = &layout.MessageMetadata{
+			Uid:          uid,
+			File:         file,
+			Flags:        []string{imap.SeenFlag},
+			InternalDate: time.Date(2024, 1, int(uid), 0, 0, 0, 0, time.UTC),
+			Size:         int64(len(body)),
+		}
+	}
+	if err := meta.Save(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFolderMappingTargets(t *testing.T) {
+	infos := []*imap.MailboxInfo{
+		{Name: "INBOX", Delimiter: "."},
+		{Name: "Sent Items", Delimiter: ".", Attributes: []string{imap.SentAttr}},
+	}
+	mapping := NewFolderMapping(infos, map[string]string{"Sent Items": imap.SentAttr})
+	allMail := &layout.FolderMetadata{Mailbox: "[Gmail]/All Mail", Delimiter: "/", Gmail: true, SpecialUse: imap.AllAttr}
+
+	tests := []struct {
+		name    string
+		meta    *layout.FolderMetadata
+		labels  []string
+		targets []string
+		flags   []string
+	}{
+		{"folder", &layout.FolderMetadata{Mailbox: "Work/Projects", Delimiter: "/"}, nil, []string{"Work.Projects"}, []string{imap.SeenFlag}},
+		{"inbox", allMail, []string{`\Inbox`}, []string{"INBOX"}, []string{imap.SeenFlag}},
+		{"starred", allMail, []string{`\Inbox`, `\Starred`}, []string{"INBOX"}, []string{imap.SeenFlag, imap.FlaggedFlag}},
+		{"sent", allMail, []string{`\Sent`}, []string{"Sent Items"}, []string{imap.SeenFlag}},
+		{"trash", allMail, []string{`\Trash`}, []string{"Trash"}, []string{imap.SeenFlag}},
+		{"labels", allMail, []string{"Work/Projects", `\Important`, "Receipts"}, []string{"Work.Projects", "Receipts"}, []string{imap.SeenFlag}},
+		{"archived", allMail, []string{`\Important`}, []string{"Archive"}, []string{imap.SeenFlag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &layout.MessageMetadata{Flags: []string{imap.SeenFlag, imap.RecentFlag}, GmailLabels: tt.labels}
+			targets, flags := mapping.targets(tt.meta, msg)
+			if !reflect.DeepEqual(targets, tt.targets) {
+				t.Errorf("targets = %q, want %q", targets, tt.targets)
+			}
+			if !reflect.DeepEqual(flags, tt.flags) {
+				t.Errorf("flags = %q, want %q", flags, tt.flags)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	config := startTestServer(t, memory.New())
+	dir := t.TempDir()
+	writeTestBackup(t, dir, "INBOX", "first", "second")
+	writeTestBackup(t, dir, "Archive", "old")
+
+	r := NewRestorer(config, dir, false)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Report().Folder("INBOX").Messages; got != 2 {
+		t.Errorf("restored %d messages to INBOX, want 2", got)
+	}
+
+	// The memory server starts with one message in INBOX.
+	inbox := serverMessages(t, config, "INBOX")
+	if len(inbox) != 3 || inbox[1] != "first" || inbox[2] != "second" {
+		t.Errorf("INBOX = %q, want the existing message, first and second", inbox)
+	}
+	if archive := serverMessages(t, config, "Archive"); strings.Join(archive, ",") != "old" {
+		t.Errorf("Archive = %q, want [old]", archive)
+	}
+}
+
+func TestRestoreTwice(t *testing.T) {
+	config := startTestServer(t, memory.New())
+	dir := t.TempDir()
+	writeTestBackup(t, dir, "INBOX", "first", "second")
+	writeTestBackup(t, dir, "Archive", "old")
+
+	if err := NewRestorer(config, dir, false).Run(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRestorer(config, dir, false)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"INBOX", "Archive"} {
+		folder := r.Report().Folder(name)
+		if folder.Messages != 0 {
+			t.Errorf("second restore appended %d messages to %s", folder.Messages, name)
+		}
+	}
+	if got := r.Report().Folder("INBOX").Skipped; got != 2 {
+		t.Errorf("skipped %d messages in INBOX, want 2", got)
+	}
+	if inbox := serverMessages(t, config, "INBOX"); len(inbox) != 3 {
+		t.Errorf("INBOX has %d messages after two restores, want 3", len(inbox))
+	}
+	if archive := serverMessages(t, config, "Archive"); len(archive) != 1 {
+		t.Errorf("Archive has %d messages after two restores, want 1", len(archive))
+	}
+}
+
+func TestWebRestore(t *testing.T) {
+	config := startTestServer(t, memory.New())
+	dir := t.TempDir()
+	writeTestBackup(t, dir, "Archive", "old", "older")
+	ws, err := NewWebServer(dir, config, "admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func() string {
+		form := url.Values{"token": {ws.token}, "m": {"Archive:1"}}
+		req := httptest.NewRequest(http.MethodPost, "/restore", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("restore returned %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	if body := restore(); !strings.Contains(body, "Restored 1 messages") {
+		t.Errorf("first restore page does not report 1 message: %s", body)
+	}
+	if body := restore(); !strings.Contains(body, "Restored 0 messages") || !strings.Contains(body, "1 already present") {
+		t.Errorf("second restore page does not report the message as present: %s", body)
+	}
+	if got := serverMessages(t, config, "Archive"); len(got) != 1 || got[0] != "old" {
+		t.Errorf("Archive = %q, want [old]", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	source := startTestServer(t, memory.New())
+	dest := startTestServer(t, dotBackend())
+	appendMessages(t, source, "Work/Projects", "plan", "budget")
+	// Already in the destination, under the destination's delimiter.
+	appendMessages(t, dest, "Work.Projects", "plan")
+	statePath := filepath.Join(t.TempDir(), "migrate-state.json")
+	counters := backupCounters(t)
+
+	m := NewMigrator(source, dest, statePath, false)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := backupCounters(t); got != counters {
+		t.Errorf("migration changed the backup counters from %q to %q", counters, got)
+	}
+	report := m.Report()
+	report.Finish()
+	if report.HasErrors() {
+		t.Fatalf("migration failed: %v", report.Errors)
+	}
+
+	projects := report.Folder("Work.Projects")
+	if projects.Messages != 1 || projects.Skipped != 1 {
+		t.Errorf("Work.Projects: copied %d and skipped %d messages, want 1 and 1", projects.Messages, projects.Skipped)
+	}
+	// Both servers start with the same message in INBOX.
+	if inbox := report.Folder("INBOX"); inbox.Messages != 0 || inbox.Skipped != 1 {
+		t.Errorf("INBOX: copied %d and skipped %d messages, want 0 and 1", inbox.Messages, inbox.Skipped)
+	}
+	if got := serverMessages(t, dest, "Work.Projects"); strings.Join(got, ",") != "plan,budget" {
+		t.Errorf("Work.Projects = %q, want [plan budget]", got)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	source := startTestServer(t, memory.New())
+	dest := startTestServer(t, dotBackend())
+	appendMessages(t, source, "Work/Projects", "plan", "budget")
+	statePath := filepath.Join(t.TempDir(), "migrate-state.json")
+
+	if err := NewMigrator(source, dest, statePath, false).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages below the last migrated UID are not looked at again, so
+	// deleting them in the destination shows they are not copied twice.
+	b := NewBackup(dest)
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Delete("Work.Projects"); err != nil {
+		t.Fatal(err)
+	}
+	b.client.Logout()
+	appendMessages(t, source, "Work/Projects", "minutes")
+
+	m := NewMigrator(source, dest, statePath, false)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Report().Folder("Work.Projects").Messages; got != 1 {
+		t.Errorf("resumed migration copied %d messages, want 1", got)
+	}
+	if got := serverMessages(t, dest, "Work.Projects"); strings.Join(got, ",") != "minutes" {
+		t.Errorf("Work.Projects = %q, want [minutes]", got)
+	}
+
+	// The state belongs to this pair of accounts.
+	other := dest
+	other.User = "someone"
+	if err := NewMigrator(source, other, statePath, false).Run(); err == nil {
+		t.Error("migration to another account accepted the state file")
+	}
+}
+
+// serverFlagged returns how many messages of a mailbox have a flag.
+func serverFlagged(t *testing.T, config ImapConfig, mailbox, flag string) int {
+	t.Helper()
+	b := NewBackup(config)
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Logout()
+
+	if _, err := b.client.Select(mailbox, true); err != nil {
+		t.Fatal(err)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{flag}
+	uids, err := b.client.UidSearch(criteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(uids)
+}
+
+func TestSyncLocalDeletions(t *testing.T) {
+	config := startTestServer(t, memory.New())
+	appendMessages(t, config, "Box", "one", "two", "three")
+	dir := t.TempDir()
+	counters := backupCounters(t)
+	if err := NewSyncer(config, dir, 1, false).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := backupCounters(t); got != counters {
+		t.Errorf("sync changed the backup counters from %q to %q", counters, got)
+	}
+	box := filepath.Join(dir, "Box")
+	files, err := filepath.Glob(filepath.Join(box, "cur", "*"))
+	if err != nil || len(files) != 3 {
+		t.Fatalf("Box has %d messages after the first sync, want 3 (%v)", len(files), err)
+	}
+
+	// At most one deletion per run, and without UIDPLUS it is only flagged.
+	for _, f := range files[:2] {
+		if err := os.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewSyncer(config, dir, 1, false)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if folder := s.Report().Folder("Box"); folder.DeletedOnServer != 1 || len(folder.Errors) != 1 {
+		t.Errorf("deleted %d messages with errors %q, want 1 deletion and the limit reported", folder.DeletedOnServer, folder.Errors)
+	}
+	if got := len(serverMessages(t, config, "Box")); got != 3 {
+		t.Errorf("Box has %d messages on the server, want 3", got)
+	}
+	if got := serverFlagged(t, config, "Box", imap.DeletedFlag); got != 1 {
+		t.Errorf("%d messages are flagged deleted, want 1", got)
+	}
+
+	// A flagged message is neither downloaded again nor counted again.
+	s = NewSyncer(config, dir, 1, false)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if folder := s.Report().Folder("Box"); folder.Messages != 0 || folder.DeletedOnServer != 1 {
+		t.Errorf("third sync downloaded %d and deleted %d messages, want 0 and 1", folder.Messages, folder.DeletedOnServer)
+	}
+
+	// A removed folder is not emptied on the server.
+	if err := os.RemoveAll(box); err != nil {
+		t.Fatal(err)
+	}
+	s = NewSyncer(config, dir, 100, false)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serverFlagged(t, config, "Box", imap.DeletedFlag); got != 2 {
+		t.Errorf("%d messages are flagged deleted after removing the folder, want 2", got)
+	}
+	if _, err := os.Stat(box); err == nil {
+		t.Error("removed folder was created again")
+	}
+}
+
+// watchedUids returns the UIDs in the metadata of a backed up mailbox.
+func watchedUids(t *testing.T, mailboxPath string) []uint32 {
+	t.Helper()
+	meta, err := layout.LoadFolderMetadata(mailboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []uint32
+	for uid := range meta.Messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+func TestWatchCatchUp(t *testing.T) {
+	bodyless := new(atomic.Uint32)
+	config := startTestServer(t, wrapBackend{memory.New(), func(mbox backend.Mailbox) backend.Mailbox {
+		return bodylessMailbox{mbox, bodyless}
+	}})
+	config.BackupDir = t.TempDir()
+	appendMessages(t, config, "Box", "one")
+
+	w := NewWatcher(config, []string{"Box"}, time.Minute, 1)
+	b := NewBackup(config)
+	if err := b.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Logout()
+	mailboxPath, st, err := w.open(b, "Box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := w.report.Folder("Box")
+	catchUp := func(wantLast uint32, wantRetry, wantSaved []uint32) {
+		t.Helper()
+		if err := w.catchUp(b, "Box", mailboxPath, st, folder); err != nil {
+			t.Fatal(err)
+		}
+		if st.LastUid != wantLast || !reflect.DeepEqual(st.Retry, wantRetry) {
+			t.Errorf("state is last UID %d retrying %v, want %d retrying %v", st.LastUid, st.Retry, wantLast, wantRetry)
+		}
+		if got := watchedUids(t, mailboxPath); !reflect.DeepEqual(got, wantSaved) {
+			t.Errorf("saved UIDs %v, want %v", got, wantSaved)
+		}
+	}
+	if st.LastUid != 1 {
+		t.Fatalf("watch starts after UID %d, want 1", st.LastUid)
+	}
+
+	// A message coming without a body is retried, not skipped for good.
+	bodyless.Store(3)
+	appendMessages(t, config, "Box", "two", "three")
+	catchUp(3, []uint32{3}, []uint32{2})
+	data, err := os.ReadFile(filepath.Join(config.BackupDir, "watch-state.json"))
+	if err != nil || !strings.Contains(string(data), `"retry": [`) {
+		t.Errorf("state file %q does not hold the retried UID (%v)", data, err)
+	}
+
+	// Nothing is saved while a backup holds the mailbox.
+	bodyless.Store(0)
+	appendMessages(t, config, "Box", "four")
+	lock, err := lockMailbox(mailboxPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catchUp(3, []uint32{3}, []uint32{2})
+	lock.Unlock()
+	catchUp(4, nil, []uint32{2, 3, 4})
+
+	// A retried message that is gone from the server is dropped.
+	bodyless.Store(5)
+	appendMessages(t, config, "Box", "five")
+	catchUp(5, []uint32{5}, []uint32{2, 3, 4})
+	expunger := NewBackup(config)
+	if err := expunger.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer expunger.client.Logout()
+	if _, err := expunger.client.Select("Box", false); err != nil {
+		t.Fatal(err)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(5)
+	if err := expunger.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := expunger.client.Expunge(nil); err != nil {
+		t.Fatal(err)
+	}
+	catchUp(5, nil, []uint32{2, 3, 4})
+
+	// Messages of another UIDVALIDITY are left to the scheduled backup.
+	meta, err := layout.LoadFolderMetadata(mailboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.UidValidity++
+	if err := meta.Save(mailboxPath); err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(t, config, "Box", "six")
+	catchUp(5, nil, []uint32{2, 3, 4})
+	files, err := filepath.Glob(filepath.Join(mailboxPath, "*.eml"))
+	if err != nil || len(files) != 3 {
+		t.Errorf("backup holds %d messages, want 3 (%v)", len(files), err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	config := startTestServer(t, memory.New())
+	config.BackupDir = t.TempDir()
+	config.FolderSizeLimits = []FolderSizeLimit{{Pattern: "Box", MaxSize: 100}}
+	config.HeadersOnly = []string{"Alerts"}
+	large := "large-" + strings.Repeat("x", 40)
+	appendMessages(t, config, "Box", "small", large)
+	appendMessages(t, config, "Alerts", "alert")
+
+	b := NewBackup(config)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if folder := b.Report().Folder("Box"); folder.Messages != 1 || folder.HeadersOnly != 1 {
+		t.Errorf("Box backed up %d messages and %d headers, want 1 and 1", folder.Messages, folder.HeadersOnly)
+	}
+
+	// The message above the limit, and the one of the headers-only
+	// folder, only have their header saved.
+	for _, tc := range []struct {
+		mailbox string
+		uid     uint32
+	}{{"Box", 2}, {"Alerts", 1}} {
+		mailboxPath := filepath.Join(config.BackupDir, tc.mailbox)
+		meta, err := layout.LoadFolderMetadata(mailboxPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := meta.Messages[tc.uid]
+		if msg == nil || msg.Stored != storedHeaders || msg.BodyStructure == nil {
+			t.Fatalf("%s UID %d is recorded as %+v, want its header and structure stored", tc.mailbox, tc.uid, msg)
+		}
+		data, err := os.ReadFile(filepath.Join(mailboxPath, msg.File))
+		if err != nil || !strings.HasSuffix(string(data), "\r\n\r\n") || strings.Contains(string(data), "Hello") {
+			t.Errorf("%s UID %d is saved as %q (%v), want its header only", tc.mailbox, tc.uid, data, err)
+		}
+	}
+
+	// Once the limit is raised, the message is backed up in full.
+	config.FolderSizeLimits = nil
+	b = NewBackup(config)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	box := filepath.Join(config.BackupDir, "Box")
+	meta, err := layout.LoadFolderMetadata(box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := meta.Messages[2]; msg == nil || msg.Stored != "" {
+		t.Errorf("Box UID 2 is recorded as %+v after raising the limit, want it stored in full", msg)
+	}
+	if files, err := filepath.Glob(filepath.Join(box, "*.eml")); err != nil || len(files) != 2 {
+		t.Errorf("Box holds %d files, want the header replaced (%v)", len(files), err)
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "backup")
+	mailboxPath := filepath.Join(source, "Work", "Projects")
+	if err := os.MkdirAll(mailboxPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	messages := map[uint32]*layout.MessageMetadata{
+		1: {Flags: []string{imap.SeenFlag, imap.FlaggedFlag}, InternalDate: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		2: {Flags: []string{}, InternalDate: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)},
+	}
+	bodies := map[uint32]string{
+		1: "From: a@example.com\r\nSubject: one\r\n\r\nQuoted:\r\n>From the start\r\nFrom here on\r\n",
+		2: testMessage("two"),
+	}
+	meta := &layout.FolderMetadata{Mailbox: "Work/Projects", Delimiter: "/", UidValidity: 1, Messages: messages}
+	for uid, msg := range messages {
+		msg.Uid, msg.File, msg.Size = uid, fmt.Sprintf("%d.eml", uid), int64(len(bodies[uid]))
+		if err := os.WriteFile(filepath.Join(mailboxPath, msg.File), []byte(bodies[uid]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := meta.Save(mailboxPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{formatMaildir, formatMbox} {
+		t.Run(format, func(t *testing.T) {
+			converted := filepath.Join(dir, format)
+			if err := NewConverter(source, converted, format).Run(); err != nil {
+				t.Fatal(err)
+			}
+			back := filepath.Join(dir, format+"-eml")
+			if err := NewConverter(converted, back, formatEml).Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			folders, err := loadBackupFolders(back)
+			if err != nil || len(folders) != 1 {
+				t.Fatalf("converted back to %d folders (%v), want 1", len(folders), err)
+			}
+			f := folders[0]
+			if f.Meta.Mailbox != "Work/Projects" || len(f.Meta.Messages) != 2 {
+				t.Fatalf("converted back to %s with %d messages, want Work/Projects with 2", f.Meta.Mailbox, len(f.Meta.Messages))
+			}
+			for _, msg := range f.Meta.Messages {
+				data, err := os.ReadFile(filepath.Join(f.Dir, msg.File))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var orig uint32
+				for uid, body := range bodies {
+					if strings.ReplaceAll(string(data), "\r\n", "\n") == strings.ReplaceAll(body, "\r\n", "\n") {
+						orig = uid
+					}
+				}
+				if orig == 0 {
+					t.Errorf("converted back to an unknown message %q", data)
+					continue
+				}
+				flags := append([]string{}, msg.Flags...)
+				sort.Strings(flags)
+				want := append([]string{}, messages[orig].Flags...)
+				sort.Strings(want)
+				if !reflect.DeepEqual(flags, want) {
+					t.Errorf("message %d has flags %q, want %q", orig, flags, want)
+				}
+				if !msg.InternalDate.Equal(messages[orig].InternalDate) {
+					t.Errorf("message %d has INTERNALDATE %v, want %v", orig, msg.InternalDate, messages[orig].InternalDate)
+				}
+			}
+		})
+	}
+}
+
+func TestAttachmentManifest(t *testing.T) {
+	dir := t.TempDir()
+	inbox := filepath.Join(dir, "INBOX")
+	if err := os.MkdirAll(inbox, 0755); err != nil {
+		t.Fatal(err)
+	}
+	eml := "From: alice@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Message-ID: <report@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"\r\n" +
+		"%PDF-1.4\r\n" +
+		"--b--\r\n"
+	if err := os.WriteFile(filepath.Join(inbox, "1.eml"), []byte(eml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewAttachmentExtractor(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ExtractAll(); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, layout.AttachmentsDir)
+	manifest, err := os.ReadFile(filepath.Join(out, "manifest.csv"))
+	if err != nil || !strings.Contains(string(manifest), "report.pdf") {
+		t.Fatalf("manifest.csv is %q (%v), want report.pdf listed", manifest, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(out, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("temporary files %q left behind", tmp)
+	}
+
+	// A manifest that cannot be written leaves the previous one intact.
+	if err := os.Mkdir(filepath.Join(out, "manifest.csv.tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Save(); err == nil {
+		t.Error("Save succeeded although manifest.csv could not be written")
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "manifest.csv")); err != nil || string(got) != string(manifest) {
+		t.Errorf("manifest.csv changed to %q (%v)", got, err)
+	}
+}
+
+func TestImportMbox(t *testing.T) {
+	dir := t.TempDir()
+	mbox := filepath.Join(dir, "Old.mbox")
+	content := "From alice@example.com Mon Jan  1 10:00:00 2024\n" +
+		"Subject: one\n\n" +
+		"Quoted:\n>From the start\n" +
+		"From here on, an unquoted line\n\n" +
+		"From bob@example.com Tue Jan  2 10:00:00 2024\n" +
+		"Subject: two\n\n" +
+		"Bye\n"
+	if err := os.WriteFile(mbox, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backupDir := filepath.Join(dir, "backup")
+	i := NewImporter(ImapConfig{BackupDir: backupDir}, importRoot, false)
+	if err := i.Run([]string{mbox}); err != nil {
+		t.Fatal(err)
+	}
+	folders, err := loadBackupFolders(backupDir)
+	if err != nil || len(folders) != 1 {
+		t.Fatalf("import made %d folders (%v), want 1", len(folders), err)
+	}
+	f := folders[0]
+	if len(f.Meta.Messages) != 2 {
+		t.Fatalf("imported %d messages, want 2", len(f.Meta.Messages))
+	}
+	msg := f.Meta.Messages[1]
+	data, err := os.ReadFile(filepath.Join(f.Dir, msg.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if want := "Quoted:\nFrom the start\nFrom here on, an unquoted line\n"; !strings.HasSuffix(body, "\n\n"+want) {
+		t.Errorf("first message = %q, want a body of %q", body, want)
+	}
+}
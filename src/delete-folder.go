@@ -4,10 +4,11 @@ import (
     "bufio"
     "flag"
     "fmt"
-    "log"
+    "log/slog"
     "os"
     "sort"
     "strings"
+    "sync"
     "syscall"
     "os/signal"
     "time"
@@ -15,6 +16,10 @@ import (
     "github.com/emersion/go-imap"
     "github.com/emersion/go-imap/client"
     "github.com/joho/godotenv"
+
+    "imap-backup/internal/cli"
+    "imap-backup/internal/imapext"
+    "imap-backup/internal/runreport"
 )
 
 type MessageInfo struct {
@@ -35,6 +40,61 @@ type IMAPManager struct {
     port     string
     user     string
     password string
+    logger   *slog.Logger
+    specialUse map[string]string
+    allowSpecialUse bool
+}
+
+// Exit codes, so that wrappers can tell a partial run from a failed one.
+const (
+    exitSuccess        = runreport.ExitSuccess
+    exitFailure        = runreport.ExitFailure
+    exitPartialFailure = runreport.ExitPartialFailure
+)
+
+// FolderReport holds the outcome of a run for one mailbox.
+type FolderReport struct {
+    runreport.Folder
+    Messages        int      `json:"messages"`
+    Bytes           int64    `json:"bytes"`
+    Deleted         int      `json:"deleted"`
+    Skipped         int      `json:"skipped"`
+    // SkipReason tells why a matching folder was left alone.
+    SkipReason      string   `json:"skip_reason,omitempty"`
+}
+
+// RunReport is the machine-readable summary written at the end of a run.
+type RunReport struct {
+    runreport.Run[*FolderReport]
+    DryRun          bool            `json:"dry_run"`
+    Messages        int             `json:"messages"`
+    Bytes           int64           `json:"bytes"`
+    Deleted         int             `json:"deleted"`
+    Skipped         int             `json:"skipped"`
+}
+
+func NewRunReport(command, account string) *RunReport {
+    return &RunReport{Run: runreport.New(command, account, func(name string) *FolderReport {
+        return &FolderReport{Folder: runreport.NewFolder(name)}
+    })}
+}
+
+// Finish computes totals and status and returns the process exit code.
+func (r *RunReport) Finish() int {
+    r.Messages, r.Bytes, r.Deleted, r.Skipped = 0, 0, 0, 0
+    for _, f := range r.Folders {
+        r.Messages += f.Messages
+        r.Bytes += f.Bytes
+        r.Deleted += f.Deleted
+        r.Skipped += f.Skipped
+    }
+    return r.Run.Finish()
+}
+
+// Write writes the report as JSON to path, to stdout if path is "-", or to
+// stderr if path is empty.
+func (r *RunReport) Write(path string) error {
+    return runreport.Write(r, path)
 }
 
 func connectIMAP() (*IMAPManager, error) {
@@ -43,8 +103,10 @@ func connectIMAP() (*IMAPManager, error) {
     user := os.Getenv("IMAP_USER")
     pass := os.Getenv("IMAP_PASSWORD")
 
+    logger := slog.Default().With("account", user)
+
     addr := fmt.Sprintf("%s:%s", host, port)
-    log.Printf("Connecting to %s...", addr)
+    logger.Info("Connecting", "op", "connect", "addr", addr)
 
     c, err := client.DialTLS(addr, nil)
     if err != nil {
@@ -54,7 +116,7 @@ func connectIMAP() (*IMAPManager, error) {
     if err := c.Login(user, pass); err != nil {
         return nil, fmt.Errorf("login error: %v", err)
     }
-    log.Printf("Connected as %s", user)
+    logger.Info("Login successful", "op", "login")
 
     return &IMAPManager{
         client: c,
@@ -62,6 +124,7 @@ func connectIMAP() (*IMAPManager, error) {
         port: port,
         user: user,
         password: pass,
+        logger: logger,
     }, nil
 }
 
@@ -71,7 +134,7 @@ func (im *IMAPManager) reconnect() error {
     }
 
     addr := fmt.Sprintf("%s:%s", im.host, im.port)
-    log.Printf("Reconnecting to %s...", addr)
+    im.logger.Info("Reconnecting", "op", "connect", "addr", addr)
 
     c, err := client.DialTLS(addr, nil)
     if err != nil {
@@ -83,7 +146,7 @@ func (im *IMAPManager) reconnect() error {
     }
 
     im.client = c
-    log.Printf("Reconnected successfully")
+    im.logger.Info("Reconnected successfully", "op", "connect")
     return nil
 }
 
@@ -94,24 +157,19 @@ func (im *IMAPManager) Close() {
 }
 
 func (im *IMAPManager) listAllMailboxes() ([]string, error) {
-    log.Printf("Listing all mailboxes...")
-    mailboxes := make(chan *imap.MailboxInfo)
-    done := make(chan error, 1)
-
-    go func() {
-        done <- im.client.List("", "*", mailboxes)
-    }()
+    im.logger.Debug("Listing all mailboxes", "op", "list")
+    infos, err := imapext.ListMailboxes(im.client)
+    if err != nil {
+        return nil, fmt.Errorf("error listing mailboxes: %v", err)
+    }
+    im.specialUse = imapext.DetectSpecialUse(infos)
 
     var boxes []string
-    for m := range mailboxes {
+    for _, m := range infos {
         boxes = append(boxes, m.Name)
     }
 
-    if err := <-done; err != nil {
-        return nil, fmt.Errorf("error listing mailboxes: %v", err)
-    }
-
-    log.Printf("Found %d mailboxes in total", len(boxes))
+    im.logger.Info("Found mailboxes", "op", "list", "mailboxes", len(boxes))
     return boxes, nil
 }
 
@@ -150,8 +208,8 @@ func (im *IMAPManager) getMailboxMessages(mailboxName string) ([]MessageInfo, er
     return messagesList, nil
 }
 
-func (im *IMAPManager) findMailboxesForDeletion(prefix string, withMessages bool) ([]MailboxInfo, error) {
-    log.Printf("Looking for mailboxes starting with: %s", prefix)
+func (im *IMAPManager) findMailboxesForDeletion(prefix string, withMessages bool, report *RunReport) ([]MailboxInfo, error) {
+    im.logger.Info("Looking for mailboxes", "op", "list", "prefix", prefix)
 
     allBoxes, err := im.listAllMailboxes()
     if err != nil {
@@ -159,13 +217,23 @@ func (im *IMAPManager) findMailboxesForDeletion(prefix string, withMessages bool
     }
 
     var toDelete []MailboxInfo
+    var skipped []string
     for _, name := range allBoxes {
         if strings.HasPrefix(name, prefix) {
-            log.Printf("Found matching mailbox: %s", name)
+            im.logger.Debug("Found matching mailbox", "op", "list", "mailbox", name)
+
+            // Sent, Trash and the like are needed by mail clients
+            if use := im.specialUse[name]; use != "" && !im.allowSpecialUse {
+                im.logger.Warn("Not deleting special-use mailbox, use --allow-special-use to delete it", "op", "list", "mailbox", name, "special_use", use)
+                report.Folder(name).SkipReason = "special-use " + use
+                skipped = append(skipped, name)
+                continue
+            }
 
             mbox, err := im.client.Select(name, true)
             if err != nil {
-                log.Printf("Error selecting mailbox %s: %v", name, err)
+                im.logger.Error("Error selecting mailbox", "op", "select", "mailbox", name, "error", err)
+                report.Folder(name).AddError(fmt.Errorf("error selecting mailbox: %v", err))
                 continue
             }
 
@@ -177,37 +245,41 @@ func (im *IMAPManager) findMailboxesForDeletion(prefix string, withMessages bool
             if withMessages && mbox.Messages > 0 {
                 messages, err := im.getMailboxMessages(name)
                 if err != nil {
-                    log.Printf("Error getting messages for %s: %v", name, err)
+                    im.logger.Error("Error getting messages", "op", "fetch", "mailbox", name, "error", err)
                 } else {
                     mailboxInfo.MessagesList = messages
                 }
             }
 
             toDelete = append(toDelete, mailboxInfo)
-            log.Printf("- %s (%d messages)", name, mbox.Messages)
+            im.logger.Info("Matching mailbox", "op", "select", "mailbox", name, "messages", mbox.Messages)
         }
     }
 
+    if len(toDelete) == 0 && len(skipped) > 0 {
+        return nil, fmt.Errorf("only special-use mailboxes match %s (%s), use --allow-special-use to delete them", prefix, strings.Join(skipped, ", "))
+    }
     if len(toDelete) == 0 {
         return nil, fmt.Errorf("no mailboxes found matching: %s", prefix)
     }
 
-    log.Printf("Found %d mailboxes to delete", len(toDelete))
+    im.logger.Info("Found mailboxes to delete", "op", "list", "mailboxes", len(toDelete))
     return toDelete, nil
 }
 
 func (im *IMAPManager) deleteMailbox(name string) error {
+    logger := im.logger.With("mailbox", name)
     for attempts := 0; attempts < 3; attempts++ {
         if attempts > 0 {
-            log.Printf("Retry attempt %d for %s", attempts, name)
+            logger.Warn("Retrying", "op", "delete", "attempt", attempts)
             if err := im.reconnect(); err != nil {
-                log.Printf("Reconnection failed: %v", err)
+                logger.Error("Reconnection failed", "op", "connect", "error", err)
                 time.Sleep(time.Second * 2)
                 continue
             }
         }
 
-        log.Printf("Deleting mailbox: %s", name)
+        logger.Info("Deleting mailbox", "op", "delete")
 
         mbox, err := im.client.Select(name, false)
         if err != nil {
@@ -219,7 +291,7 @@ func (im *IMAPManager) deleteMailbox(name string) error {
         }
 
         if mbox.Messages > 0 {
-            log.Printf("Marking %d messages for deletion", mbox.Messages)
+            logger.Debug("Marking messages for deletion", "op", "store", "messages", mbox.Messages)
             seqSet := new(imap.SeqSet)
             seqSet.AddRange(1, mbox.Messages)
 
@@ -233,7 +305,7 @@ func (im *IMAPManager) deleteMailbox(name string) error {
                 return fmt.Errorf("error marking messages as deleted: %v", err)
             }
 
-            log.Printf("Expunging messages...")
+            logger.Debug("Expunging messages", "op", "expunge")
             if err := im.client.Expunge(nil); err != nil {
                 if strings.Contains(err.Error(), "Not logged in") {
                     time.Sleep(time.Second * 2)
@@ -243,7 +315,7 @@ func (im *IMAPManager) deleteMailbox(name string) error {
             }
         }
 
-        log.Printf("Deleting the mailbox itself...")
+        logger.Debug("Deleting the mailbox itself", "op", "delete")
         if err := im.client.Delete(name); err != nil {
             if strings.Contains(err.Error(), "Not logged in") {
                 time.Sleep(time.Second * 2)
@@ -269,30 +341,30 @@ func sortMailboxesByDepth(mailboxes []MailboxInfo) []MailboxInfo {
 }
 
 func showMessagesDetails(mailboxes []MailboxInfo) {
-    fmt.Println("\n=== Detailed Messages List ===")
+    fmt.Fprintln(os.Stderr, "\n=== Detailed Messages List ===")
     for _, m := range mailboxes {
-        fmt.Printf("\nFolder: %s (%d messages)\n", m.Name, m.Messages)
+        fmt.Fprintf(os.Stderr, "\nFolder: %s (%d messages)\n", m.Name, m.Messages)
         if len(m.MessagesList) > 0 {
             for i, msg := range m.MessagesList {
-                fmt.Printf("%d) [%s] %s\n", i+1, msg.Date, msg.Subject)
+                fmt.Fprintf(os.Stderr, "%d) [%s] %s\n", i+1, msg.Date, msg.Subject)
             }
         }
-        fmt.Println(strings.Repeat("-", 50))
+        fmt.Fprintln(os.Stderr, strings.Repeat("-", 50))
     }
 }
 
 func confirmDeletion(mailboxes []MailboxInfo, folderName string) bool {
-    fmt.Printf("\n=== Folders to be deleted ===\n")
-    fmt.Printf("Base folder: %s\n\n", folderName)
+    fmt.Fprintf(os.Stderr, "\n=== Folders to be deleted ===\n")
+    fmt.Fprintf(os.Stderr, "Base folder: %s\n\n", folderName)
 
     var totalMessages uint32
     for _, m := range mailboxes {
-        fmt.Printf("- %s (%d messages)\n", m.Name, m.Messages)
+        fmt.Fprintf(os.Stderr, "- %s (%d messages)\n", m.Name, m.Messages)
         totalMessages += m.Messages
     }
 
-    fmt.Printf("\nTotal: %d folders, %d messages\n", len(mailboxes), totalMessages)
-    fmt.Print("\nDo you want to proceed with deletion? (yes/no): ")
+    fmt.Fprintf(os.Stderr, "\nTotal: %d folders, %d messages\n", len(mailboxes), totalMessages)
+    fmt.Fprint(os.Stderr, "\nDo you want to proceed with deletion? (yes/no): ")
 
     reader := bufio.NewReader(os.Stdin)
     input, _ := reader.ReadString('\n')
@@ -300,7 +372,7 @@ func confirmDeletion(mailboxes []MailboxInfo, folderName string) bool {
 }
 
 func askShowDetails() bool {
-    fmt.Print("\nWould you like to see the detailed list of all messages? (yes/no): ")
+    fmt.Fprint(os.Stderr, "\nWould you like to see the detailed list of all messages? (yes/no): ")
     reader := bufio.NewReader(os.Stdin)
     input, _ := reader.ReadString('\n')
     return strings.TrimSpace(strings.ToLower(input)) == "yes"
@@ -308,67 +380,123 @@ func askShowDetails() bool {
 
 func main() {
     dryRun := flag.Bool("dry-run", false, "Show what would be deleted without making changes")
+    allowSpecialUse := flag.Bool("allow-special-use", false, "Also delete matching special-use folders (Sent, Trash, Junk...)")
+    reportPath := flag.String("report", "", "Write a JSON run report to this file (\"-\" for stdout, stderr by default)")
+    logFormat := flag.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+    logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
     flag.Parse()
 
+    envErr := godotenv.Load()
+    if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+        cli.Fatal("Invalid logging options", "error", err)
+    }
+
     if flag.NArg() != 1 {
-        log.Fatal("Usage: delete-folder [--dry-run] folder_name")
+        cli.Fatal("Usage: delete-folder [--dry-run] [--allow-special-use] [--report file] [--log-format text|json] [--log-level level] folder_name")
     }
     folderName := flag.Arg(0)
 
     if *dryRun {
-        log.Println("Running in dry-run mode - no changes will be made")
+        slog.Info("Running in dry-run mode - no changes will be made")
     }
 
-    if err := godotenv.Load(); err != nil {
-        log.Fatal("Error loading .env file")
+    if envErr != nil {
+        cli.Fatal("Error loading .env file", "error", envErr)
+    }
+
+    report := NewRunReport("delete", os.Getenv("IMAP_USER"))
+    report.DryRun = *dryRun
+
+    // finish writes the report and exits, once, whether the run ended or
+    // was interrupted.
+    var once sync.Once
+    finish := func() {
+        once.Do(func() {
+            code := report.Finish()
+            if err := report.Write(*reportPath); err != nil {
+                slog.Error("Error writing report", "error", err)
+            }
+            os.Exit(code)
+        })
     }
 
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
     go func() {
-        <-sigChan
-        fmt.Println("\nInterrupted. Exiting safely...")
-        os.Exit(0)
+        sig := <-sigChan
+        slog.Warn("Interrupted, writing the report of the folders deleted so far", "signal", sig.String())
+        report.Fail(fmt.Errorf("interrupted: %v", sig))
+        finish()
     }()
 
+    if err := runDelete(report, folderName, *dryRun, *allowSpecialUse); err != nil {
+        slog.Error("Folder deletion failed", "account", os.Getenv("IMAP_USER"), "error", err)
+        report.Fail(err)
+    }
+
+    finish()
+}
+
+func runDelete(report *RunReport, folderName string, dryRun, allowSpecialUse bool) error {
     imap, err := connectIMAP()
     if err != nil {
-        log.Fatalf("Failed to connect to IMAP: %v", err)
+        return fmt.Errorf("failed to connect to IMAP: %v", err)
     }
     defer imap.Close()
+    imap.allowSpecialUse = allowSpecialUse
 
-    mailboxes, err := imap.findMailboxesForDeletion(folderName, *dryRun)
+    mailboxes, err := imap.findMailboxesForDeletion(folderName, dryRun, report)
     if err != nil {
-        log.Fatalf("Error finding mailboxes: %v", err)
+        return fmt.Errorf("error finding mailboxes: %v", err)
     }
 
-    if *dryRun {
-        log.Println("\n=== Dry Run - Would delete ===")
+    for _, m := range mailboxes {
+        report.Folder(m.Name).Messages = int(m.Messages)
+    }
+
+    if dryRun {
+        fmt.Fprintln(os.Stderr, "\n=== Dry Run - Would delete ===")
         for _, m := range mailboxes {
-            log.Printf("Would delete: %s (%d messages)", m.Name, m.Messages)
+            fmt.Fprintf(os.Stderr, "Would delete: %s (%d messages)\n", m.Name, m.Messages)
         }
 
         if askShowDetails() {
             showMessagesDetails(mailboxes)
         }
-        return
+        return nil
     }
 
     if !confirmDeletion(mailboxes, folderName) {
-        fmt.Println("Operation cancelled")
-        return
+        fmt.Fprintln(os.Stderr, "Operation cancelled")
+        for _, m := range mailboxes {
+            report.Folder(m.Name).Skipped = int(m.Messages)
+        }
+        return nil
     }
 
     sortedMailboxes := sortMailboxesByDepth(mailboxes)
 
-    fmt.Println("\nDeleting folders...")
+    imap.logger.Info("Deleting folders", "op", "delete", "mailboxes", len(sortedMailboxes))
     for i, m := range sortedMailboxes {
-        fmt.Printf("\rProgress: %d/%d - Deleting %s", i+1, len(sortedMailboxes), m.Name)
-        if err := imap.deleteMailbox(m.Name); err != nil {
-            log.Printf("\nError deleting %s: %v\n", m.Name, err)
+        cli.Progress.Update("Progress: %d/%d - Deleting %s", i+1, len(sortedMailboxes), m.Name)
+        folder := report.Folder(m.Name)
+        folder.Start()
+        err := imap.deleteMailbox(m.Name)
+        folder.Finish()
+        if err != nil {
+            imap.logger.Error("Error deleting mailbox", "op", "delete", "mailbox", m.Name, "error", err)
+            folder.AddError(err)
             continue
         }
+        folder.Deleted = int(m.Messages)
     }
 
-    fmt.Println("\nAll folders deleted successfully!")
+    cli.Progress.Done()
+
+    if report.HasErrors() {
+        imap.logger.Warn("Deletion completed with errors")
+    } else {
+        imap.logger.Info("All folders deleted successfully")
+    }
+    return nil
 }
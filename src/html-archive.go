@@ -0,0 +1,614 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/joho/godotenv"
+
+	"imap-backup/internal/cli"
+	"imap-backup/internal/htmlsafe"
+	"imap-backup/internal/layout"
+	"imap-backup/internal/threading"
+)
+
+type ArchiveAttachment struct {
+	Name string
+	Href string
+	Size int64
+}
+
+type ArchiveMessage struct {
+	ID          string
+	Folder      string
+	Subject     string
+	From        string
+	To          string
+	Cc          string
+	Date        time.Time
+	MessageID   string
+	InReplyTo   string
+	References  []string
+	Text        string
+	HTML        string
+	Attachments []ArchiveAttachment
+	Thread      *ArchiveThread
+}
+
+// ThreadHeader returns the headers the message is threaded by.
+func (m *ArchiveMessage) ThreadHeader() threading.Header {
+	return threading.Header{
+		MessageID:  m.MessageID,
+		InReplyTo:  m.InReplyTo,
+		References: m.References,
+		Subject:    m.Subject,
+		Date:       m.Date,
+	}
+}
+
+type ArchiveThread struct {
+	Index    int
+	Subject  string
+	Messages []*ArchiveMessage
+	Last     time.Time
+}
+
+type ArchiveFolder struct {
+	Path     string
+	Name     string
+	Messages []*ArchiveMessage
+	Children []*ArchiveFolder
+}
+
+type ArchiveGenerator struct {
+	backupDir string
+	outputDir string
+	messages  []*ArchiveMessage
+	folders   map[string]*ArchiveFolder
+	threads   []*ArchiveThread
+}
+
+// archiveNames holds the folder names of the backup being archived, for
+// the "folder" template function.
+var archiveNames layout.Names
+
+func NewArchiveGenerator(backupDir, outputDir string) *ArchiveGenerator {
+	return &ArchiveGenerator{
+		backupDir: backupDir,
+		outputDir: outputDir,
+		folders:   map[string]*ArchiveFolder{"": {Name: "All folders"}},
+	}
+}
+
+func (g *ArchiveGenerator) Generate() error {
+	if err := os.MkdirAll(g.outputDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", g.outputDir, err)
+	}
+
+	names, err := layout.LoadNames(g.backupDir)
+	if err != nil {
+		return err
+	}
+	archiveNames = names
+
+	files, err := g.findMessages()
+	if err != nil {
+		return err
+	}
+	slog.Info("Found messages", "op", "scan", "dir", g.backupDir, "messages", len(files))
+
+	for i, file := range files {
+		msg, err := g.loadMessage(file)
+		if err != nil {
+			slog.Error("Error reading message", "op", "read", "file", file, "error", err)
+			continue
+		}
+		g.messages = append(g.messages, msg)
+		g.folder(msg.Folder).Messages = append(g.folder(msg.Folder).Messages, msg)
+		cli.Progress.Update("Progress: %d/%d", i+1, len(files))
+	}
+	cli.Progress.Done()
+
+	g.buildThreads()
+
+	slog.Info("Writing pages", "op", "write")
+	if err := g.writeIndex(); err != nil {
+		return err
+	}
+	for p, f := range g.folders {
+		if p == "" {
+			continue
+		}
+		if err := g.writeFolder(f); err != nil {
+			return err
+		}
+	}
+	for _, msg := range g.messages {
+		if err := g.writeMessage(msg); err != nil {
+			return err
+		}
+	}
+	if err := g.writeThreads(); err != nil {
+		return err
+	}
+
+	slog.Info("Archive written", "op", "write", "dir", g.outputDir, "messages", len(g.messages), "threads", len(g.threads))
+	return nil
+}
+
+func (g *ArchiveGenerator) findMessages() ([]string, error) {
+	absOutput, _ := filepath.Abs(g.outputDir)
+
+	var files []string
+	err := filepath.WalkDir(g.backupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(p); abs == absOutput {
+				return filepath.SkipDir
+			}
+			if layout.IsSkippedDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".eml") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking backup directory: %v", err)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// folder returns the folder for a slash separated path, creating it and its
+// parents as needed.
+func (g *ArchiveGenerator) folder(p string) *ArchiveFolder {
+	if f, ok := g.folders[p]; ok {
+		return f
+	}
+
+	f := &ArchiveFolder{Path: p, Name: archiveNames.Level(p)}
+	g.folders[p] = f
+
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+	g.folder(parent).Children = append(g.folder(parent).Children, f)
+	return f
+}
+
+func (g *ArchiveGenerator) loadMessage(file string) (*ArchiveMessage, error) {
+	rel, err := filepath.Rel(g.backupDir, file)
+	if err != nil {
+		return nil, err
+	}
+	rel = filepath.ToSlash(rel)
+
+	msg := &ArchiveMessage{
+		ID:     strings.TrimSuffix(rel, ".eml"),
+		Folder: path.Dir(rel),
+	}
+	if msg.Folder == "." {
+		msg.Folder = ""
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	msg.Subject, _ = mr.Header.Subject()
+	if msg.Subject == "" {
+		msg.Subject = "(no subject)"
+	}
+	msg.From = formatArchiveAddresses(&mr.Header, "From")
+	msg.To = formatArchiveAddresses(&mr.Header, "To")
+	msg.Cc = formatArchiveAddresses(&mr.Header, "Cc")
+	msg.Date, _ = mr.Header.Date()
+	msg.MessageID, _ = mr.Header.MessageID()
+	if ids, _ := mr.Header.MsgIDList("In-Reply-To"); len(ids) > 0 {
+		msg.InReplyTo = ids[0]
+	}
+	msg.References, _ = mr.Header.MsgIDList("References")
+
+	used := make(map[string]bool)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep the parts read so far of a malformed message.
+			slog.Warn("Error reading message part", "op", "read", "file", file, "error", err)
+			break
+		}
+
+		var name string
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			// Inline parts with a file name, such as pictures shown in
+			// the body, are listed with the attachments.
+			_, params, _ := h.ContentDisposition()
+			if name = params["filename"]; name != "" {
+				break
+			}
+			contentType, _, _ := h.ContentType()
+			body, err := io.ReadAll(p.Body)
+			if err != nil {
+				slog.Warn("Error reading message part", "op", "read", "file", file, "error", err)
+			}
+			if contentType == "text/html" && msg.HTML == "" {
+				msg.HTML = string(body)
+			} else if strings.HasPrefix(contentType, "text/") && msg.Text == "" {
+				msg.Text = string(body)
+			}
+			continue
+		case *mail.AttachmentHeader:
+			name, _ = h.Filename()
+		}
+
+		att, err := g.writeAttachment(msg, name, p.Body, used)
+		if err != nil {
+			return nil, err
+		}
+		msg.Attachments = append(msg.Attachments, att)
+	}
+
+	return msg, nil
+}
+
+func (g *ArchiveGenerator) writeAttachment(msg *ArchiveMessage, name string, body io.Reader, used map[string]bool) (ArchiveAttachment, error) {
+	name = layout.SanitizePath(strings.TrimSpace(filepath.Base(name)))
+	if name == "" || name == "." || name == ".." {
+		name = fmt.Sprintf("attachment-%d", len(used)+1)
+	}
+	for base, i := name, 1; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, filepath.Ext(base)), i, filepath.Ext(base))
+	}
+	used[name] = true
+
+	dir := filepath.Join(g.outputDir, "messages", filepath.FromSlash(msg.ID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ArchiveAttachment{}, fmt.Errorf("error creating directory %s: %v", dir, err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return ArchiveAttachment{}, fmt.Errorf("error creating attachment: %v", err)
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, body)
+	if err != nil {
+		return ArchiveAttachment{}, fmt.Errorf("error writing attachment: %v", err)
+	}
+
+	return ArchiveAttachment{
+		Name: name,
+		Href: "messages/" + msg.ID + "/" + name,
+		Size: size,
+	}, nil
+}
+
+// buildThreads groups messages into conversations like the threads command,
+// so replies end up with the message they answer, whatever folder they are
+// in. Copies of a message in several folders are shown once in a thread.
+func (g *ArchiveGenerator) buildThreads() {
+	messages := make([]threading.Message, len(g.messages))
+	for i, msg := range g.messages {
+		messages[i] = msg
+	}
+
+	for _, root := range threading.Build(messages).Roots {
+		thread := &ArchiveThread{Subject: root.Subject()}
+		root.Walk(0, func(c *threading.Container, depth int) {
+			msg := c.Message.(*ArchiveMessage)
+			thread.Messages = append(thread.Messages, msg)
+			if msg.Date.After(thread.Last) {
+				thread.Last = msg.Date
+			}
+			msg.Thread = thread
+			for _, dup := range c.Copies {
+				dup.(*ArchiveMessage).Thread = thread
+			}
+		})
+		g.threads = append(g.threads, thread)
+	}
+
+	// The roots come in a fixed order, which a stable sort keeps for threads
+	// ending at the same time, so thread numbers are the same on every run.
+	sort.SliceStable(g.threads, func(i, j int) bool { return g.threads[i].Last.After(g.threads[j].Last) })
+	for i, thread := range g.threads {
+		thread.Index = i + 1
+	}
+}
+
+func (g *ArchiveGenerator) writeIndex() error {
+	return g.writePage("index.html", archiveIndexTemplate, map[string]interface{}{
+		"Title":   "Mail archive",
+		"Root":    g.folders[""],
+		"Total":   len(g.messages),
+		"Threads": len(g.threads),
+	})
+}
+
+func (g *ArchiveGenerator) writeFolder(f *ArchiveFolder) error {
+	sort.SliceStable(f.Messages, func(i, j int) bool { return f.Messages[i].Date.After(f.Messages[j].Date) })
+	return g.writePage(path.Join("folders", f.Path, "index.html"), archiveFolderTemplate, map[string]interface{}{
+		"Title":  archiveNames.Mailbox(f.Path),
+		"Folder": f,
+	})
+}
+
+func (g *ArchiveGenerator) writeMessage(msg *ArchiveMessage) error {
+	return g.writePage(path.Join("messages", msg.ID+".html"), archiveMessageTemplate, map[string]interface{}{
+		"Title":   msg.Subject,
+		"Message": msg,
+	})
+}
+
+func (g *ArchiveGenerator) writeThreads() error {
+	if err := g.writePage("threads.html", archiveThreadsTemplate, map[string]interface{}{
+		"Title":   "Threads",
+		"Threads": g.threads,
+	}); err != nil {
+		return err
+	}
+
+	for _, t := range g.threads {
+		if err := g.writePage(fmt.Sprintf("threads/%d.html", t.Index), archiveThreadTemplate, map[string]interface{}{
+			"Title":  t.Subject,
+			"Thread": t,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePage renders a template to a slash separated path relative to the
+// output directory. Links in templates are made relative with the "root"
+// value so the archive can be opened straight from disk.
+func (g *ArchiveGenerator) writePage(rel string, tmpl *template.Template, data map[string]interface{}) error {
+	data["RootPath"] = strings.Repeat("../", strings.Count(rel, "/"))
+
+	file := filepath.Join(g.outputDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("error creating page %s: %v", rel, err)
+	}
+	defer f.Close()
+
+	if err := tmpl.Execute(f, data); err != nil {
+		return fmt.Errorf("error rendering page %s: %v", rel, err)
+	}
+	return nil
+}
+
+func formatArchiveAddresses(h *mail.Header, key string) string {
+	addrs, err := h.AddressList(key)
+	if err != nil || len(addrs) == 0 {
+		return h.Get(key)
+	}
+
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		if a.Name != "" {
+			parts[i] = fmt.Sprintf("%s <%s>", a.Name, a.Address)
+		} else {
+			parts[i] = a.Address
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%d KB", size/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+var archiveFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	"sortkey":  func(t time.Time) int64 { return t.Unix() },
+	"size":     formatSize,
+	"sanitize": htmlsafe.Sanitize,
+	"folder":   func(dir string) string { return archiveNames.Mailbox(dir) },
+	// urlpath escapes each element of a slash separated path, so that
+	// encoded directory names such as "A%3AB" are not decoded by browsers.
+	"urlpath": func(p string) string {
+		parts := strings.Split(p, "/")
+		for i, part := range parts {
+			parts[i] = url.PathEscape(part)
+		}
+		return strings.Join(parts, "/")
+	},
+	"page": func(root string, msg *ArchiveMessage) map[string]interface{} {
+		return map[string]interface{}{"RootPath": root, "Message": msg}
+	},
+}
+
+const archiveLayout = `{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+nav { background: #2d3e50; padding: 10px 20px; }
+nav a { color: #fff; margin-right: 20px; text-decoration: none; }
+main { padding: 20px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #ddd; }
+th { cursor: pointer; background: #f4f4f4; }
+tr:hover td { background: #fafafa; }
+ul.tree { list-style: none; padding-left: 20px; }
+.headers { background: #f4f4f4; padding: 10px; margin-bottom: 20px; }
+.headers div { margin: 2px 0; }
+pre { white-space: pre-wrap; word-wrap: break-word; }
+iframe { width: 100%; height: 600px; border: 1px solid #ddd; }
+.message { border-top: 2px solid #2d3e50; margin-top: 30px; }
+</style>
+</head>
+<body>
+<nav><a href="{{.RootPath}}index.html">Folders</a><a href="{{.RootPath}}threads.html">Threads</a></nav>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th, column) {
+  th.addEventListener("click", function () {
+    var tbody = th.closest("table").querySelector("tbody");
+    var desc = th.dataset.order !== "desc";
+    th.dataset.order = desc ? "desc" : "asc";
+    Array.from(tbody.rows).sort(function (a, b) {
+      var x = a.cells[column].dataset.sort || a.cells[column].textContent.toLowerCase();
+      var y = b.cells[column].dataset.sort || b.cells[column].textContent.toLowerCase();
+      if (!isNaN(x) && !isNaN(y)) { x = Number(x); y = Number(y); }
+      return (x < y ? -1 : x > y ? 1 : 0) * (desc ? -1 : 1);
+    }).forEach(function (row) { tbody.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+{{end}}
+
+{{define "body"}}{{with .Message}}{{if .HTML}}<iframe sandbox srcdoc="{{sanitize .HTML}}"></iframe>{{else}}<pre>{{.Text}}</pre>{{end}}
+{{if .Attachments}}<h3>Attachments</h3><ul>{{range .Attachments}}
+<li><a href="{{$.RootPath}}{{urlpath .Href}}" download>{{.Name}}</a> ({{size .Size}})</li>{{end}}
+</ul>{{end}}{{end}}{{end}}
+`
+
+func newArchiveTemplate(body string) *template.Template {
+	return template.Must(template.New("page").Funcs(archiveFuncs).Parse(archiveLayout + body))
+}
+
+var (
+	archiveIndexTemplate = newArchiveTemplate(`{{template "header" .}}
+<h1>Mail archive</h1>
+<p>{{.Total}} messages, <a href="threads.html">{{.Threads}} threads</a></p>
+{{define "node"}}<ul class="tree">{{range .}}
+<li>{{if .Messages}}<a href="folders/{{urlpath .Path}}/index.html">{{.Name}}</a> ({{len .Messages}}){{else}}{{.Name}}{{end}}
+{{if .Children}}{{template "node" .Children}}{{end}}</li>{{end}}
+</ul>{{end}}
+{{template "node" .Root.Children}}
+{{template "footer" .}}`)
+
+	archiveFolderTemplate = newArchiveTemplate(`{{template "header" .}}
+<h1>{{folder .Folder.Path}}</h1>
+<table class="sortable">
+<thead><tr><th>Date</th><th>From</th><th>Subject</th><th>Attachments</th></tr></thead>
+<tbody>{{range .Folder.Messages}}
+<tr><td data-sort="{{sortkey .Date}}">{{date .Date}}</td><td>{{.From}}</td><td><a href="{{$.RootPath}}messages/{{urlpath .ID}}.html">{{.Subject}}</a></td><td data-sort="{{len .Attachments}}">{{if .Attachments}}{{len .Attachments}}{{end}}</td></tr>{{end}}
+</tbody>
+</table>
+{{template "footer" .}}`)
+
+	archiveMessageTemplate = newArchiveTemplate(`{{template "header" .}}
+{{with .Message}}<h1>{{.Subject}}</h1>
+<div class="headers">
+<div><b>From:</b> {{.From}}</div>
+<div><b>To:</b> {{.To}}</div>{{if .Cc}}
+<div><b>Cc:</b> {{.Cc}}</div>{{end}}
+<div><b>Date:</b> {{date .Date}}</div>
+<div><b>Folder:</b> <a href="{{$.RootPath}}folders/{{urlpath .Folder}}/index.html">{{folder .Folder}}</a></div>{{if gt (len .Thread.Messages) 1}}
+<div><b>Thread:</b> <a href="{{$.RootPath}}threads/{{.Thread.Index}}.html">{{len .Thread.Messages}} messages</a></div>{{end}}
+</div>
+{{template "body" (page $.RootPath .)}}{{end}}
+{{template "footer" .}}`)
+
+	archiveThreadsTemplate = newArchiveTemplate(`{{template "header" .}}
+<h1>Threads</h1>
+<table class="sortable">
+<thead><tr><th>Last message</th><th>Subject</th><th>Messages</th></tr></thead>
+<tbody>{{range .Threads}}
+<tr><td data-sort="{{sortkey .Last}}">{{date .Last}}</td><td><a href="threads/{{.Index}}.html">{{.Subject}}</a></td><td>{{len .Messages}}</td></tr>{{end}}
+</tbody>
+</table>
+{{template "footer" .}}`)
+
+	archiveThreadTemplate = newArchiveTemplate(`{{template "header" .}}
+<h1>{{.Thread.Subject}}</h1>
+{{range .Thread.Messages}}<div class="message">
+<div class="headers">
+<div><b>From:</b> {{.From}}</div>
+<div><b>To:</b> {{.To}}</div>
+<div><b>Date:</b> {{date .Date}}</div>
+<div><b>Folder:</b> {{folder .Folder}} — <a href="{{$.RootPath}}messages/{{urlpath .ID}}.html">{{.Subject}}</a></div>
+</div>
+{{template "body" (page $.RootPath .)}}
+</div>{{end}}
+{{template "footer" .}}`)
+)
+
+func main() {
+	output := flag.String("out", "html_archive", "Directory where the static archive is written")
+	logFormat := flag.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
+	flag.Parse()
+
+	envErr := godotenv.Load()
+	if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+		cli.Fatal("Invalid logging options", "error", err)
+	}
+	if envErr != nil {
+		slog.Debug("No .env file found, using defaults")
+	}
+
+	backupDir := os.Getenv("BACKUP_DIR")
+	if flag.NArg() > 0 {
+		backupDir = flag.Arg(0)
+	}
+	if backupDir == "" {
+		backupDir = "email_backup"
+	}
+
+	slog.Info("Generating HTML archive", "dir", backupDir, "out", *output)
+
+	if err := NewArchiveGenerator(backupDir, *output).Generate(); err != nil {
+		cli.Fatal("Error generating archive", "error", err)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/joho/godotenv"
+
+	"imap-backup/internal/cli"
+	"imap-backup/internal/layout"
+)
+
+// archiveDelimiter is the hierarchy delimiter of the served mailboxes,
+// whatever the delimiter of the backed up server was.
+const archiveDelimiter = "/"
+
+// errReadOnly is returned for every command that would change the backup.
+var errReadOnly = errors.New("backup archive is read-only")
+
+// ArchiveBackend serves a backup directory over IMAP. The backup is read
+// again on every login, so that a running server shows the latest backup.
+type ArchiveBackend struct {
+	backupDir string
+	username  string
+	password  string
+}
+
+func NewArchiveBackend(backupDir, username, password string) *ArchiveBackend {
+	return &ArchiveBackend{backupDir: backupDir, username: username, password: password}
+}
+
+func (b *ArchiveBackend) Login(conn *imap.ConnInfo, username, password string) (backend.User, error) {
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(b.username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(b.password)) == 1
+	if !userOk || !passOk {
+		slog.Warn("Login failed", "op", "login", "user", username, "remote", conn.RemoteAddr)
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	mailboxes, err := loadArchiveMailboxes(b.backupDir)
+	if err != nil {
+		slog.Error("Error reading backup", "op", "read", "dir", b.backupDir, "error", err)
+		return nil, err
+	}
+	slog.Info("Login successful", "op", "login", "user", username, "remote", conn.RemoteAddr, "mailboxes", len(mailboxes))
+	return &ArchiveUser{username: username, mailboxes: mailboxes}, nil
+}
+
+// loadArchiveMailboxes reads the metadata of every mailbox of a backup. The
+// parents of nested mailboxes are listed as \Noselect when they were not
+// backed up themselves.
+func loadArchiveMailboxes(backupDir string) (map[string]*ArchiveMailbox, error) {
+	names, err := layout.LoadNames(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make(map[string]*ArchiveMailbox)
+	err = filepath.WalkDir(backupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if layout.IsSkippedDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != layout.MailboxFile {
+			return nil
+		}
+
+		dir := filepath.Dir(p)
+		meta, err := layout.LoadFolderMetadata(dir)
+		if err != nil {
+			return err
+		}
+
+		name := meta.Mailbox
+		if name == "" {
+			rel, _ := filepath.Rel(backupDir, dir)
+			name = names.Mailbox(filepath.ToSlash(rel))
+		} else if meta.Delimiter != "" && meta.Delimiter != archiveDelimiter {
+			name = strings.ReplaceAll(name, meta.Delimiter, archiveDelimiter)
+		}
+		if strings.EqualFold(name, "INBOX") {
+			name = "INBOX"
+		}
+
+		mbox := newArchiveMailbox(name, dir, meta)
+		mailboxes[name] = mbox
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range mailboxes {
+		for i := strings.LastIndex(name, archiveDelimiter); i > 0; i = strings.LastIndex(name, archiveDelimiter) {
+			name = name[:i]
+			if _, ok := mailboxes[name]; !ok {
+				mailboxes[name] = &ArchiveMailbox{name: name, attributes: []string{imap.NoSelectAttr}, uidValidity: 1}
+			}
+		}
+	}
+	return mailboxes, nil
+}
+
+// ArchiveUser is a logged in session over a snapshot of the backup.
+type ArchiveUser struct {
+	username  string
+	mailboxes map[string]*ArchiveMailbox
+}
+
+func (u *ArchiveUser) Username() string {
+	return u.username
+}
+
+func (u *ArchiveUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	names := make([]string, 0, len(u.mailboxes))
+	for name := range u.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]backend.Mailbox, 0, len(names))
+	for _, name := range names {
+		list = append(list, u.mailboxes[name])
+	}
+	return list, nil
+}
+
+func (u *ArchiveUser) GetMailbox(name string) (backend.Mailbox, error) {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	mbox, ok := u.mailboxes[name]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+func (u *ArchiveUser) CreateMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *ArchiveUser) DeleteMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *ArchiveUser) RenameMailbox(existingName, newName string) error {
+	return errReadOnly
+}
+
+func (u *ArchiveUser) Logout() error {
+	return nil
+}
+
+// ArchiveMailbox is a backed up mailbox. Its messages keep the UIDs,
+// flags and INTERNALDATE recorded by the backup.
+type ArchiveMailbox struct {
+	name        string
+	dir         string
+	attributes  []string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*archiveMessage
+}
+
+// archiveMessage is a message file of the backup.
+type archiveMessage struct {
+	uid   uint32
+	path  string
+	flags []string
+	date  time.Time
+	size  int64
+	// partial is set when only the header was backed up, so the size of
+	// the file is not that of the original message.
+	partial bool
+}
+
+func newArchiveMailbox(name, dir string, meta *layout.FolderMetadata) *ArchiveMailbox {
+	mbox := &ArchiveMailbox{name: name, dir: dir, uidValidity: meta.UidValidity, uidNext: meta.UidNext}
+	if meta.SpecialUse != "" {
+		mbox.attributes = append(mbox.attributes, meta.SpecialUse)
+	}
+	if mbox.uidValidity == 0 {
+		mbox.uidValidity = 1
+	}
+
+	for uid, msg := range meta.Messages {
+		if msg.File == "" {
+			// Skipped for its size, nothing was saved.
+			continue
+		}
+		var flags []string
+		for _, flag := range msg.Flags {
+			if flag != imap.RecentFlag {
+				flags = append(flags, flag)
+			}
+		}
+		mbox.messages = append(mbox.messages, &archiveMessage{
+			uid:     uid,
+			path:    filepath.Join(dir, msg.File),
+			flags:   flags,
+			date:    msg.InternalDate,
+			size:    msg.Size,
+			partial: msg.Stored != "",
+		})
+		if uid >= mbox.uidNext {
+			mbox.uidNext = uid + 1
+		}
+	}
+	sort.Slice(mbox.messages, func(i, j int) bool { return mbox.messages[i].uid < mbox.messages[j].uid })
+	if mbox.uidNext == 0 {
+		mbox.uidNext = 1
+	}
+	return mbox
+}
+
+func (m *ArchiveMailbox) Name() string {
+	return m.name
+}
+
+func (m *ArchiveMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Attributes: m.attributes, Delimiter: archiveDelimiter, Name: m.name}, nil
+}
+
+func (m *ArchiveMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(m.name, items)
+	status.ReadOnly = true
+	status.PermanentFlags = []string{}
+
+	flags := make(map[string]bool)
+	var unseen uint32
+	for i, msg := range m.messages {
+		seen := false
+		for _, flag := range msg.flags {
+			flags[flag] = true
+			seen = seen || flag == imap.SeenFlag
+		}
+		if !seen {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+	}
+	for flag := range flags {
+		status.Flags = append(status.Flags, flag)
+	}
+	sort.Strings(status.Flags)
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = m.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func (m *ArchiveMailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *ArchiveMailbox) Check() error {
+	return nil
+}
+
+func (m *ArchiveMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		fetched, err := msg.fetch(seqNum, items)
+		if err != nil {
+			slog.Error("Error reading message", "op", "fetch", "mailbox", m.name, "uid", msg.uid, "file", msg.path, "error", err)
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+func (m *ArchiveMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		ok, err := msg.match(seqNum, criteria)
+		if err != nil {
+			slog.Error("Error reading message", "op", "search", "mailbox", m.name, "uid", msg.uid, "file", msg.path, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (m *ArchiveMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errReadOnly
+}
+
+func (m *ArchiveMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	return errReadOnly
+}
+
+func (m *ArchiveMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return errReadOnly
+}
+
+func (m *ArchiveMailbox) Expunge() error {
+	return errReadOnly
+}
+
+// open returns the header and the rest of the message file.
+func (msg *archiveMessage) open() (textproto.Header, *bufio.Reader, *os.File, error) {
+	f, err := os.Open(msg.path)
+	if err != nil {
+		return textproto.Header{}, nil, nil, err
+	}
+	body := bufio.NewReader(f)
+	hdr, err := textproto.ReadHeader(body)
+	if err != nil {
+		f.Close()
+		return textproto.Header{}, nil, nil, err
+	}
+	return hdr, body, f, nil
+}
+
+func (msg *archiveMessage) fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, f, err := msg.open()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+			f.Close()
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, f, err := msg.open()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+			f.Close()
+		case imap.FetchFlags:
+			fetched.Flags = msg.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.date
+		case imap.FetchRFC822Size:
+			size, err := msg.fileSize()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Size = uint32(size)
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, body, f, err := msg.open()
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			f.Close()
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+// fileSize is the size of what is served, which for a message backed up
+// without body is that of its header.
+func (msg *archiveMessage) fileSize() (int64, error) {
+	if !msg.partial && msg.size > 0 {
+		return msg.size, nil
+	}
+	info, err := os.Stat(msg.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (msg *archiveMessage) match(seqNum uint32, criteria *imap.SearchCriteria) (bool, error) {
+	f, err := os.Open(msg.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	e, err := message.Read(bufio.NewReader(f))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return false, err
+	}
+	return backendutil.Match(e, seqNum, msg.uid, msg.date, msg.flags, criteria)
+}
+
+// isLoopback tells whether a listen address only accepts local clients.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func main() {
+	listen := flag.String("listen", "", "Address to listen on (default $ARCHIVE_IMAP_LISTEN or 127.0.0.1:1143)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves IMAPS when set (default $ARCHIVE_IMAP_TLS_CERT)")
+	tlsKey := flag.String("tls-key", "", "TLS key file (default $ARCHIVE_IMAP_TLS_KEY)")
+	logFormat := flag.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
+	flag.Parse()
+
+	envErr := godotenv.Load()
+	if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+		cli.Fatal("Invalid logging options", "error", err)
+	}
+	if envErr != nil {
+		slog.Debug("No .env file found, using defaults")
+	}
+
+	backupDir := os.Getenv("BACKUP_DIR")
+	if flag.NArg() > 0 {
+		backupDir = flag.Arg(0)
+	}
+	if backupDir == "" {
+		backupDir = "email_backup"
+	}
+	if _, err := os.Stat(backupDir); err != nil {
+		cli.Fatal("Backup directory not found", "dir", backupDir, "error", err)
+	}
+
+	if *listen == "" {
+		*listen = os.Getenv("ARCHIVE_IMAP_LISTEN")
+	}
+	if *listen == "" {
+		*listen = "127.0.0.1:1143"
+	}
+	if *tlsCert == "" {
+		*tlsCert = os.Getenv("ARCHIVE_IMAP_TLS_CERT")
+	}
+	if *tlsKey == "" {
+		*tlsKey = os.Getenv("ARCHIVE_IMAP_TLS_KEY")
+	}
+
+	username := os.Getenv("ARCHIVE_IMAP_USER")
+	if username == "" {
+		username = "archive"
+	}
+	password := os.Getenv("ARCHIVE_IMAP_PASSWORD")
+	if password == "" {
+		random := make([]byte, 12)
+		if _, err := rand.Read(random); err != nil {
+			cli.Fatal("Error generating password", "error", err)
+		}
+		password = hex.EncodeToString(random)
+		fmt.Fprintf(os.Stderr, "ARCHIVE_IMAP_PASSWORD is not set, log in as %q with password %q\n", username, password)
+	}
+
+	s := server.New(NewArchiveBackend(backupDir, username, password))
+	s.Addr = *listen
+	s.ErrorLog = log.New(os.Stderr, "imap/server: ", log.LstdFlags)
+
+	slog.Info("Serving backup over IMAP", "dir", backupDir, "addr", *listen, "user", username, "tls", *tlsCert != "")
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			cli.Fatal("Error loading TLS certificate", "error", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if err := s.ListenAndServeTLS(); err != nil {
+			cli.Fatal("Server stopped", "error", err)
+		}
+		return
+	}
+
+	// Passwords travel in clear without TLS, which is only acceptable
+	// on the local machine.
+	s.AllowInsecureAuth = true
+	if !isLoopback(*listen) {
+		slog.Warn("Serving without TLS on a non-loopback address, passwords are sent in clear", "addr", *listen)
+	}
+	if err := s.ListenAndServe(); err != nil {
+		cli.Fatal("Server stopped", "error", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+
+	"imap-backup/internal/layout"
+)
+
+const archiveTestMessage = "From: alice@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Budget\r\n" +
+	"Message-ID: <budget@example.com>\r\n" +
+	"\r\n" +
+	"Numbers attached.\r\n"
+
+// writeArchiveFixture writes a backup holding one message in a nested
+// mailbox of a server whose delimiter is ".", and an empty INBOX.
+func writeArchiveFixture(t *testing.T, dir string) {
+	t.Helper()
+	mailboxes := map[string]*layout.FolderMetadata{
+		"INBOX": {Mailbox: "INBOX", Delimiter: ".", UidValidity: 3, UidNext: 1},
+		"Work/Projects": {Mailbox: "Work.Projects", Delimiter: ".", UidValidity: 5, UidNext: 8, Messages: map[uint32]*layout.MessageMetadata{
+			7: {
+				Uid:          7,
+				File:         "7.eml",
+				Flags:        []string{imap.SeenFlag},
+				InternalDate: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+				Size:         int64(len(archiveTestMessage)),
+			},
+		}},
+	}
+	for path, meta := range mailboxes {
+		mailboxPath := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(mailboxPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range meta.Messages {
+			if err := os.WriteFile(filepath.Join(mailboxPath, msg.File), []byte(archiveTestMessage), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := meta.Save(mailboxPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Extracted attachments are not a mailbox.
+	if err := os.MkdirAll(filepath.Join(dir, layout.AttachmentsDir, "INBOX"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveBackend(t *testing.T) {
+	dir := t.TempDir()
+	writeArchiveFixture(t, dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(NewArchiveBackend(dir, "reader", "secret"))
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Login("reader", "wrong"); err == nil {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if err := c.Login("reader", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := make(chan *imap.MailboxInfo, 10)
+	if err := c.List("", "*", infos); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	noSelect := make(map[string]bool)
+	for info := range infos {
+		names = append(names, info.Name)
+		for _, attr := range info.Attributes {
+			if attr == imap.NoSelectAttr {
+				noSelect[info.Name] = true
+			}
+		}
+	}
+	sort.Strings(names)
+	if want := []string{"INBOX", "Work", "Work/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+	if !noSelect["Work"] || noSelect["Work/Projects"] {
+		t.Errorf("\\Noselect mailboxes are %v, want only Work", noSelect)
+	}
+
+	mbox, err := c.Select("Work/Projects", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Messages != 1 || mbox.UidValidity != 5 || !mbox.ReadOnly {
+		t.Errorf("selected %d messages with UIDVALIDITY %d, read-only %v, want 1, 5 and read-only", mbox.Messages, mbox.UidValidity, mbox.ReadOnly)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(7)
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}, messages); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	if msg == nil {
+		t.Fatal("no message fetched")
+	}
+	body, err := io.ReadAll(msg.GetBody(section))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != archiveTestMessage {
+		t.Errorf("fetched body %q, want %q", body, archiveTestMessage)
+	}
+	if !reflect.DeepEqual(msg.Flags, []string{imap.SeenFlag}) || !msg.InternalDate.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("fetched flags %q and date %v", msg.Flags, msg.InternalDate)
+	}
+}
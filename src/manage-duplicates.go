@@ -7,17 +7,30 @@ import (
     "encoding/hex"
     "flag"
     "fmt"
-    "log"
+    "hash"
+    "io"
+    "log/slog"
+    "mime"
+    "net/mail"
     "os"
     "os/signal"
+    "sort"
     "strconv"
     "strings"
+    "sync"
     "syscall"
     "time"
 
     "github.com/emersion/go-imap"
     "github.com/emersion/go-imap/client"
+    "github.com/emersion/go-message"
+    _ "github.com/emersion/go-message/charset"
     "github.com/joho/godotenv"
+
+    "imap-backup/internal/cli"
+    "imap-backup/internal/imapext"
+    "imap-backup/internal/metrics"
+    "imap-backup/internal/runreport"
 )
 
 type EmailInfo struct {
@@ -25,62 +38,184 @@ type EmailInfo struct {
     Uid      uint32
     Subject  string
     Date     time.Time
+    // InternalDate is when the server received the message, which orders
+    // copies in different mailboxes, whose UIDs cannot be compared.
+    InternalDate time.Time
     Size     uint32
-    Hash     string
-    Content  string
+    Flags    []string
+    // Key identifies the message under the duplicate strategy.
+    Key      string
+    // Candidate is what copies share in their envelope and size, see
+    // candidateKey.
+    Candidate string
+    Preview  string
 }
 
 type DuplicateGroup struct {
-    Emails []EmailInfo
-    Hash   string
+    Emails   []EmailInfo
+    Key      string
+    Strategy string
 }
 
 type IMAPManager struct {
     client       *client.Client
     targetFolder string
-    excludedFolders []string
+    excludeSpecialUse []string
+    maxMessageMemory int64
+    strategy     string
+    quarantineRoot string
+    delimiter    string
+    moveRefused  bool
+    logger       *slog.Logger
+    account      string
+}
+
+// Exit codes, so that wrappers can tell a partial run from a failed one.
+const (
+    exitSuccess        = runreport.ExitSuccess
+    exitFailure        = runreport.ExitFailure
+    exitPartialFailure = runreport.ExitPartialFailure
+)
+
+// FolderReport holds the outcome of a run for one mailbox.
+type FolderReport struct {
+    runreport.Folder
+    Messages        int      `json:"messages"`
+    Bytes           int64    `json:"bytes"`
+    Downloaded      int      `json:"downloaded"`
+    DownloadedBytes int64    `json:"downloaded_bytes"`
+    Deleted         int      `json:"deleted"`
+    Quarantined     int      `json:"quarantined"`
+    Skipped         int      `json:"skipped"`
+}
+
+// RunReport is the machine-readable summary written at the end of a run.
+type RunReport struct {
+    runreport.Run[*FolderReport]
+    DryRun          bool            `json:"dry_run"`
+    Strategy        string          `json:"strategy,omitempty"`
+    Keep            string          `json:"keep,omitempty"`
+    DuplicateGroups int             `json:"duplicate_groups"`
+    Messages        int             `json:"messages"`
+    Bytes           int64           `json:"bytes"`
+    Downloaded      int             `json:"downloaded"`
+    DownloadedBytes int64           `json:"downloaded_bytes"`
+    Deleted         int             `json:"deleted"`
+    Quarantined     int             `json:"quarantined"`
+    QuarantineFolder string         `json:"quarantine_folder,omitempty"`
+    Skipped         int             `json:"skipped"`
+}
+
+func NewRunReport(command, account string) *RunReport {
+    return &RunReport{Run: runreport.New(command, account, func(name string) *FolderReport {
+        return &FolderReport{Folder: runreport.NewFolder(name)}
+    })}
+}
+
+// Finish computes totals and status and returns the process exit code.
+func (r *RunReport) Finish() int {
+    r.Messages, r.Bytes, r.Deleted, r.Skipped = 0, 0, 0, 0
+    r.Downloaded, r.DownloadedBytes, r.Quarantined = 0, 0, 0
+    for _, f := range r.Folders {
+        r.Messages += f.Messages
+        r.Bytes += f.Bytes
+        r.Downloaded += f.Downloaded
+        r.DownloadedBytes += f.DownloadedBytes
+        r.Deleted += f.Deleted
+        r.Quarantined += f.Quarantined
+        r.Skipped += f.Skipped
+    }
+    return r.Run.Finish()
+}
+
+// Write writes the report as JSON to path, to stdout if path is "-", or to
+// stderr if path is empty.
+func (r *RunReport) Write(path string) error {
+    return runreport.Write(r, path)
+}
+
+// metricDefs lists every metric exposed by this tool.
+var metricDefs = map[string]metrics.Def{
+    "imap_duplicates_scanned_messages_total":         {Kind: "counter", Help: "Messages scanned for duplicates."},
+    "imap_duplicates_scanned_bytes_total":            {Kind: "counter", Help: "Bytes of messages scanned for duplicates."},
+    "imap_duplicates_downloaded_messages_total":      {Kind: "counter", Help: "Messages downloaded because their size and headers collide with another."},
+    "imap_duplicates_downloaded_bytes_total":         {Kind: "counter", Help: "Bytes of messages downloaded to compare their content."},
+    "imap_duplicates_groups":                         {Kind: "gauge", Help: "Duplicate groups found by the last run."},
+    "imap_duplicates_found":                          {Kind: "gauge", Help: "Redundant copies found by the last run."},
+    "imap_duplicates_deleted_total":                  {Kind: "counter", Help: "Duplicate messages deleted."},
+    "imap_duplicates_quarantined_total":              {Kind: "counter", Help: "Duplicate messages moved to the quarantine folder."},
+    "imap_duplicates_errors_total":                   {Kind: "counter", Help: "Errors by operation type."},
+    "imap_duplicates_last_run_timestamp_seconds":     {Kind: "gauge", Help: "Unix time of the end of the last run."},
+    "imap_duplicates_last_run_duration_seconds":      {Kind: "gauge", Help: "Duration of the last run."},
+    "imap_duplicates_last_success_timestamp_seconds": {Kind: "gauge", Help: "Unix time of the end of the last fully successful run."},
 }
 
-func connectIMAP() (*IMAPManager, error) {
+func init() {
+    metrics.Define(metricDefs)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+    keys := make([]string, 0, len(values))
+    for k := range values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// recordRunMetrics publishes the outcome of a finished run.
+func recordRunMetrics(r *RunReport) {
+    metrics.Set("imap_duplicates_last_run_timestamp_seconds", float64(r.FinishedAt.Unix()), "account", r.Account)
+    metrics.Set("imap_duplicates_last_run_duration_seconds", r.DurationSeconds, "account", r.Account)
+    if r.Status == "success" {
+        metrics.Set("imap_duplicates_last_success_timestamp_seconds", float64(r.FinishedAt.Unix()), "account", r.Account)
+    }
+}
+
+func connectIMAP(excludeSpecialUse []string) (*IMAPManager, error) {
     host := os.Getenv("IMAP_HOST")
     port := os.Getenv("IMAP_PORT")
     user := os.Getenv("IMAP_USER")
     pass := os.Getenv("IMAP_PASSWORD")
     targetFolder := os.Getenv("TARGET_FOLDER")
 
+    logger := slog.Default().With("account", user)
+
     addr := fmt.Sprintf("%s:%s", host, port)
-    log.Printf("Connecting to %s...", addr)
+    logger.Info("Connecting", "op", "connect", "addr", addr)
 
     c, err := client.DialTLS(addr, nil)
     if err != nil {
+        metrics.Add("imap_duplicates_errors_total", 1, "account", user, "type", "connect")
         return nil, fmt.Errorf("connection error: %v", err)
     }
 
-    if err := c.Login(user, pass); err != nil {
+    start := time.Now()
+    err = c.Login(user, pass)
+    metrics.ObserveCommand(user, "login", start)
+    if err != nil {
+        metrics.Add("imap_duplicates_errors_total", 1, "account", user, "type", "login")
         return nil, fmt.Errorf("login error: %v", err)
     }
-    log.Printf("Connected as %s", user)
-
-    excludedFolders := []string{
-        "trash", "corbeille", "deleted", "deleted messages",
-        "deleted items", "elements supprimes", "éléments supprimés",
-        "bin", "junk", "spam", "[gmail]/trash",
-        "[google mail]/trash", "[gmail]/corbeille",
-        "[gmail]/spam", "[gmail]/junk",
-    }
+    logger.Info("Login successful", "op", "login")
 
     return &IMAPManager{
         client: c,
         targetFolder: targetFolder,
-        excludedFolders: excludedFolders,
+        excludeSpecialUse: excludeSpecialUse,
+        logger: logger,
+        account: user,
     }, nil
 }
 
-func (im *IMAPManager) isExcludedFolder(name string) bool {
-    nameLower := strings.ToLower(name)
-    for _, excluded := range im.excludedFolders {
-        if strings.Contains(nameLower, excluded) {
-            log.Printf("Excluding folder: %s", name)
+func (im *IMAPManager) recordError(op string) {
+    metrics.Add("imap_duplicates_errors_total", 1, "account", im.account, "type", op)
+}
+
+func (im *IMAPManager) isExcludedFolder(name, use string) bool {
+    for _, excluded := range im.excludeSpecialUse {
+        if use == excluded {
+            im.logger.Info("Excluding folder", "op", "list", "mailbox", name, "special_use", use)
             return true
         }
     }
@@ -92,20 +227,34 @@ func (im *IMAPManager) Close() {
 }
 
 func (im *IMAPManager) listMailboxes() ([]string, error) {
-    mailboxes := make(chan *imap.MailboxInfo)
-    done := make(chan error, 1)
-    go func() {
-        done <- im.client.List("", "*", mailboxes)
-    }()
+    start := time.Now()
+    infos, err := imapext.ListMailboxes(im.client)
+    metrics.ObserveCommand(im.account, "list", start)
+    if err != nil {
+        im.recordError("list")
+        return nil, err
+    }
+    uses := imapext.DetectSpecialUse(infos)
+
+    for _, m := range infos {
+        if m.Delimiter != "" {
+            im.delimiter = m.Delimiter
+            break
+        }
+    }
 
     var boxes []string
-    for m := range mailboxes {
-        // Ignore les dossiers exclus
-        if im.isExcludedFolder(m.Name) {
+    for _, m := range infos {
+        // Skip trash, spam and other excluded special-use folders
+        if im.isExcludedFolder(m.Name, uses[m.Name]) {
+            continue
+        }
+        // Quarantined copies would all look duplicated
+        if im.isQuarantine(m.Name) {
             continue
         }
 
-        // Filtre selon targetFolder si défini
+        // Only keep folders under targetFolder when it is set
         if im.targetFolder != "" {
             if strings.HasPrefix(m.Name, im.targetFolder) {
                 boxes = append(boxes, m.Name)
@@ -115,35 +264,39 @@ func (im *IMAPManager) listMailboxes() ([]string, error) {
         }
     }
 
-    if err := <-done; err != nil {
-        return nil, err
-    }
-
     if im.targetFolder != "" && len(boxes) == 0 {
         return nil, fmt.Errorf("no mailboxes found matching target folder: %s", im.targetFolder)
     }
 
-    log.Printf("Found %d mailboxes to analyze (excluding trash/spam folders)", len(boxes))
+    im.logger.Info("Found mailboxes to analyze (excluding special-use folders)", "op", "list", "mailboxes", len(boxes))
     return boxes, nil
 }
 
-func (im *IMAPManager) scanMailbox(mailboxName string) ([]EmailInfo, error) {
-    log.Printf("Scanning mailbox: %s", mailboxName)
+// scanMailbox lists the messages of a mailbox with their envelope and size,
+// without downloading them. Bodies are fetched later by hashMessages, and
+// only for messages that may have a duplicate.
+func (im *IMAPManager) scanMailbox(mailboxName string, folder *FolderReport) ([]EmailInfo, error) {
+    logger := im.logger.With("mailbox", mailboxName)
+    logger.Info("Scanning mailbox", "op", "scan")
 
+    start := time.Now()
     mbox, err := im.client.Select(mailboxName, true)
+    metrics.ObserveCommand(im.account, "select", start)
     if err != nil {
+        im.recordError("select")
         return nil, fmt.Errorf("error selecting mailbox: %v", err)
     }
 
     if mbox.Messages == 0 {
-        log.Printf("Mailbox %s is empty", mailboxName)
+        logger.Info("Mailbox is empty", "op", "select")
         return nil, nil
     }
 
-    log.Printf("Found %d messages in %s", mbox.Messages, mailboxName)
+    logger.Info("Found messages", "op", "select", "messages", mbox.Messages)
+    defer cli.Progress.Done()
 
     var emails []EmailInfo
-    batchSize := uint32(50)
+    batchSize := uint32(500)
 
     for i := uint32(1); i <= mbox.Messages; i += batchSize {
         from := i
@@ -158,66 +311,584 @@ func (im *IMAPManager) scanMailbox(mailboxName string) ([]EmailInfo, error) {
         messages := make(chan *imap.Message, 10)
         done := make(chan error, 1)
 
+        start := time.Now()
         go func() {
-            done <- im.client.Fetch(seqSet, []imap.FetchItem{imap.FetchRFC822, imap.FetchUid, imap.FetchEnvelope}, messages)
+            done <- im.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchFlags}, messages)
         }()
 
         for msg := range messages {
             if msg == nil {
-                log.Printf("Warning: nil message received")
+                logger.Warn("Nil message received", "op", "fetch")
+                continue
+            }
+            if msg.Size == 0 {
+                logger.Warn("Empty message", "op", "fetch", "uid", msg.Uid)
+                folder.Skipped++
+                continue
+            }
+            if hasFlag(msg.Flags, imap.DeletedFlag) {
+                // Already on its way out, such as an original left by a
+                // quarantine without UIDPLUS.
+                logger.Debug("Message flagged deleted", "op", "fetch", "uid", msg.Uid)
+                folder.Skipped++
                 continue
             }
 
-            var msgData []byte
-            for _, r := range msg.Body {
-                if r == nil {
-                    continue
-                }
-                buf := new(bytes.Buffer)
-                _, err := buf.ReadFrom(r)
-                if err != nil {
-                    log.Printf("Warning: error reading message body: %v", err)
-                    continue
-                }
-                msgData = buf.Bytes()
-                break
+            email := EmailInfo{
+                Mailbox:      mailboxName,
+                Uid:          msg.Uid,
+                InternalDate: msg.InternalDate,
+                Size:         msg.Size,
+                Flags:        msg.Flags,
+            }
+            if msg.Envelope != nil {
+                email.Subject = msg.Envelope.Subject
+                email.Date = msg.Envelope.Date
+            }
+            email.Candidate = candidateKey(im.strategy, msg)
+            if im.strategy == strategyMessageID {
+                email.Key = email.Candidate
             }
+            emails = append(emails, email)
+            folder.Messages++
+            folder.Bytes += int64(msg.Size)
+            metrics.Add("imap_duplicates_scanned_messages_total", 1, "account", im.account, "mailbox", mailboxName)
+            metrics.Add("imap_duplicates_scanned_bytes_total", float64(msg.Size), "account", im.account, "mailbox", mailboxName)
+            cli.Progress.Update("Scanned %d/%d headers in %s", len(emails), mbox.Messages, mailboxName)
+        }
+
+        err := <-done
+        metrics.ObserveCommand(im.account, "fetch", start)
+        if err != nil {
+            im.recordError("fetch")
+            return nil, fmt.Errorf("error fetching messages: %v", err)
+        }
+    }
+
+    cli.Progress.Done()
+    logger.Info("Successfully scanned messages", "op", "scan", "messages", len(emails))
+    return emails, nil
+}
+
+// candidateKey returns what two messages must share, from their envelope and
+// size, to possibly be duplicates under strategy. Copies always share it,
+// so only messages whose candidate key collides need their body downloaded.
+// Under the message-id strategy it is the key itself, and under the body
+// strategy, which ignores headers, it is empty and every message is a
+// candidate.
+func candidateKey(strategy string, msg *imap.Message) string {
+    env := msg.Envelope
+    if env == nil {
+        env = &imap.Envelope{}
+    }
+    var date string
+    if !env.Date.IsZero() {
+        date = strconv.FormatInt(env.Date.Unix(), 10)
+    }
+
+    switch strategy {
+    case strategyMessageID:
+        return strings.TrimSpace(env.MessageId)
+    case strategyHeaders:
+        return date + "\x00" + envelopeAddresses(env.From)
+    case strategyBody:
+        return ""
+    default:
+        return fmt.Sprintf("%d\x00%s\x00%s\x00%s", msg.Size, env.MessageId, date, env.Subject)
+    }
+}
+
+// envelopeAddresses returns the lower-cased addresses of an envelope field,
+// sorted, like normalizedAddresses.
+func envelopeAddresses(list []*imap.Address) string {
+    var addrs []string
+    for _, a := range list {
+        if a != nil {
+            addrs = append(addrs, strings.ToLower(a.Address()))
+        }
+    }
+    sort.Strings(addrs)
+    return strings.Join(addrs, ",")
+}
+
+// selectCandidates returns the messages that need their body downloaded to
+// tell whether they are duplicates: those whose candidate key is shared with
+// another message, or every message under the body strategy.
+func selectCandidates(emails []EmailInfo, strategy string) []EmailInfo {
+    if strategy == strategyBody {
+        return emails
+    }
+    counts := make(map[string]int)
+    for _, email := range emails {
+        if email.Candidate != "" {
+            counts[email.Candidate]++
+        }
+    }
+    var candidates []EmailInfo
+    for _, email := range emails {
+        if counts[email.Candidate] > 1 {
+            candidates = append(candidates, email)
+        }
+    }
+    return candidates
+}
+
+// hashMessages downloads the bodies of the given messages of a mailbox and
+// sets their key and preview. Under the message-id strategy, where the key
+// is already known, only the preview is fetched.
+func (im *IMAPManager) hashMessages(mailboxName string, emails []EmailInfo, folder *FolderReport) ([]EmailInfo, error) {
+    logger := im.logger.With("mailbox", mailboxName)
+    logger.Info("Downloading candidate messages", "op", "fetch", "messages", len(emails))
+
+    start := time.Now()
+    _, err := im.client.Select(mailboxName, true)
+    metrics.ObserveCommand(im.account, "select", start)
+    if err != nil {
+        im.recordError("select")
+        return nil, fmt.Errorf("error selecting mailbox: %v", err)
+    }
+    defer cli.Progress.Done()
+
+    byUid := make(map[uint32]EmailInfo, len(emails))
+    for _, email := range emails {
+        byUid[email.Uid] = email
+    }
+
+    var hashed []EmailInfo
+    batchSize := 50
+    previewOnly := im.strategy == strategyMessageID
+
+    // Bodies are fetched in partial chunks of at most maxMessageMemory
+    // bytes and hashed as they arrive, so large attachments are never held
+    // in memory as a whole.
+    section := &imap.BodySectionName{Peek: true}
+    if previewOnly {
+        section.Partial = []int{0, 100}
+    } else if im.maxMessageMemory > 0 {
+        section.Partial = []int{0, int(im.maxMessageMemory)}
+    }
 
-            if len(msgData) == 0 {
-                log.Printf("Warning: empty message UID %d", msg.Uid)
+    for i := 0; i < len(emails); i += batchSize {
+        batch := emails[i:]
+        if len(batch) > batchSize {
+            batch = batch[:batchSize]
+        }
+
+        seqSet := new(imap.SeqSet)
+        for _, email := range batch {
+            seqSet.AddNum(email.Uid)
+        }
+
+        messages := make(chan *imap.Message, 10)
+        done := make(chan error, 1)
+
+        start := time.Now()
+        go func() {
+            done <- im.client.UidFetch(seqSet, []imap.FetchItem{section.FetchItem(), imap.FetchUid}, messages)
+        }()
+
+        var scanned, partial []*scannedMessage
+        for msg := range messages {
+            if msg == nil {
+                logger.Warn("Nil message received", "op", "fetch")
                 continue
             }
 
-            hash := sha256.Sum256(msgData)
-
-            emailInfo := EmailInfo{
-                Mailbox: mailboxName,
-                Uid:     msg.Uid,
-                Subject: msg.Envelope.Subject,
-                Date:    msg.Envelope.Date,
-                Size:    uint32(len(msgData)),
-                Hash:    hex.EncodeToString(hash[:]),
-                Content: string(msgData[:100]),
+            r := msg.GetBody(section)
+            if r == nil {
+                logger.Warn("Empty message", "op", "fetch", "uid", msg.Uid)
+                folder.Skipped++
+                continue
             }
-            emails = append(emails, emailInfo)
 
-            fmt.Printf("\rProcessed UID %d in %s (%d bytes)", msg.Uid, mailboxName, len(msgData))
+            sm := &scannedMessage{uid: msg.Uid, key: newKeyWriter(im.strategy), preview: &headWriter{max: 100}}
+            n, err := io.Copy(io.MultiWriter(sm.key, sm.preview), r)
+            if err != nil {
+                logger.Warn("Error reading message body", "op", "fetch", "uid", msg.Uid, "error", err)
+                sm.key.Key()
+                folder.Skipped++
+                continue
+            }
+            sm.size = n
+            scanned = append(scanned, sm)
+            if !previewOnly && im.maxMessageMemory > 0 && n == im.maxMessageMemory {
+                partial = append(partial, sm)
+            }
         }
 
-        if err := <-done; err != nil {
+        err := <-done
+        metrics.ObserveCommand(im.account, "fetch", start)
+        if err != nil {
+            for _, sm := range scanned {
+                sm.key.Key()
+            }
+            im.recordError("fetch")
             return nil, fmt.Errorf("error fetching messages: %v", err)
         }
+
+        // The rest of large messages is fetched once the batch is done,
+        // as no other command can run in the meantime.
+        for _, sm := range partial {
+            sm.total = byUid[sm.uid].Size
+            logger.Debug("Fetching large message in chunks", "op", "fetch", "uid", sm.uid, "bytes", sm.total)
+            if err := im.fetchRest(sm); err != nil {
+                for _, sm := range scanned {
+                    sm.key.Key()
+                }
+                im.recordError("fetch")
+                return nil, fmt.Errorf("error fetching UID %d: %v", sm.uid, err)
+            }
+        }
+
+        for _, sm := range scanned {
+            key, err := sm.key.Key()
+            email, ok := byUid[sm.uid]
+            if !ok {
+                continue
+            }
+            if sm.size == 0 {
+                logger.Warn("Empty message", "op", "fetch", "uid", sm.uid)
+                folder.Skipped++
+                continue
+            }
+            if err != nil {
+                logger.Warn("Error computing duplicate key", "op", "scan", "uid", sm.uid, "strategy", im.strategy, "error", err)
+                folder.Skipped++
+                continue
+            }
+
+            if !previewOnly {
+                email.Key = key
+            }
+            email.Preview = string(sm.preview.buf)
+            hashed = append(hashed, email)
+            folder.Downloaded++
+            folder.DownloadedBytes += sm.size
+            metrics.Add("imap_duplicates_downloaded_messages_total", 1, "account", im.account, "mailbox", mailboxName)
+            metrics.Add("imap_duplicates_downloaded_bytes_total", float64(sm.size), "account", im.account, "mailbox", mailboxName)
+
+            logger.Debug("Processed message", "op", "scan", "uid", sm.uid, "bytes", sm.size)
+            cli.Progress.Update("Processed UID %d in %s (%d bytes)", sm.uid, mailboxName, sm.size)
+        }
     }
 
-    log.Printf("\nSuccessfully processed %d messages in %s", len(emails), mailboxName)
-    return emails, nil
+    cli.Progress.Done()
+    logger.Info("Successfully processed messages", "op", "scan", "messages", len(hashed))
+    return hashed, nil
+}
+
+// scannedMessage is a message being hashed. Only its UID is kept, not the
+// fetched chunk.
+type scannedMessage struct {
+    uid     uint32
+    total   uint32
+    size    int64
+    key     keyWriter
+    preview *headWriter
+}
+
+// headWriter keeps the first max bytes written to it.
+type headWriter struct {
+    buf []byte
+    max int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+    if n := w.max - len(w.buf); n > 0 {
+        if n > len(p) {
+            n = len(p)
+        }
+        w.buf = append(w.buf, p[:n]...)
+    }
+    return len(p), nil
+}
+
+// Duplicate strategies, deciding which messages are copies of each other.
+const (
+    // strategyContent matches identical RFC822 bytes.
+    strategyContent = "content"
+    // strategyMessageID matches the Message-ID header.
+    strategyMessageID = "message-id"
+    // strategyHeaders matches From, To, Date and Subject, normalized, and
+    // the body, so that copies delivered with different Received and X-
+    // headers are found.
+    strategyHeaders = "headers"
+    // strategyBody matches the decoded content of every MIME part, whatever
+    // the headers, boundaries and transfer encodings.
+    strategyBody = "body"
+)
+
+// strategyDescriptions are shown with each duplicate group.
+var strategyDescriptions = map[string]string{
+    strategyContent:   "identical content (SHA-256 of the whole message)",
+    strategyMessageID: "same Message-ID",
+    strategyHeaders:   "same From, To, Date, Subject and body",
+    strategyBody:      "same decoded MIME parts, headers ignored",
+}
+
+func parseStrategy(v string) (string, error) {
+    v = strings.ToLower(strings.TrimSpace(v))
+    if _, ok := strategyDescriptions[v]; !ok {
+        return "", fmt.Errorf("unknown strategy %q (expected content, message-id, headers or body)", v)
+    }
+    return v, nil
+}
+
+// maxKeyHeader caps the header kept of a message to compute its key.
+const maxKeyHeader = 1 << 20
+
+// keyWriter computes the duplicate key of a message written to it. Key is
+// called once the whole message has been written, and returns "" for a
+// message the strategy cannot match, such as one without Message-ID.
+type keyWriter interface {
+    io.Writer
+    Key() (string, error)
+}
+
+func newKeyWriter(strategy string) keyWriter {
+    switch strategy {
+    case strategyMessageID:
+        return &messageIDKey{}
+    case strategyHeaders:
+        return &headersKey{body: sha256.New()}
+    case strategyBody:
+        return newBodyKey()
+    default:
+        return &contentKey{sha256.New()}
+    }
+}
+
+type contentKey struct {
+    hash.Hash
+}
+
+func (k *contentKey) Key() (string, error) {
+    return hex.EncodeToString(k.Sum(nil)), nil
+}
+
+// headerSplitter keeps the header of a message and passes its body on.
+type headerSplitter struct {
+    header []byte
+    inBody bool
+    body   io.Writer
+}
+
+func (s *headerSplitter) Write(p []byte) (int, error) {
+    n := len(p)
+    for !s.inBody && len(p) > 0 {
+        if len(s.header) < maxKeyHeader {
+            s.header = append(s.header, p[0])
+        }
+        p = p[1:]
+        s.inBody = bytes.HasSuffix(s.header, []byte("\n\n")) || bytes.HasSuffix(s.header, []byte("\n\r\n"))
+    }
+    if s.inBody && len(p) > 0 && s.body != nil {
+        if _, err := s.body.Write(p); err != nil {
+            return 0, err
+        }
+    }
+    return n, nil
+}
+
+// parsedHeader parses the kept header.
+func (s *headerSplitter) parsedHeader() mail.Header {
+    msg, err := mail.ReadMessage(bytes.NewReader(append(s.header, "\r\n\r\n"...)))
+    if err != nil {
+        return mail.Header{}
+    }
+    return msg.Header
+}
+
+type messageIDKey struct {
+    headerSplitter
+}
+
+func (k *messageIDKey) Key() (string, error) {
+    return strings.TrimSpace(k.parsedHeader().Get("Message-Id")), nil
+}
+
+// headersKey hashes the normalized From, To, Date and Subject with the
+// body. Line endings of the body are ignored.
+type headersKey struct {
+    headerSplitter
+    body hash.Hash
+}
+
+func (k *headersKey) Write(p []byte) (int, error) {
+    k.headerSplitter.body = crStripper{k.body}
+    return k.headerSplitter.Write(p)
+}
+
+func (k *headersKey) Key() (string, error) {
+    h := k.parsedHeader()
+    var date string
+    if t, err := h.Date(); err == nil {
+        date = strconv.FormatInt(t.Unix(), 10)
+    }
+    subject, err := new(mime.WordDecoder).DecodeHeader(h.Get("Subject"))
+    if err != nil {
+        subject = h.Get("Subject")
+    }
+
+    sum := sha256.New()
+    for _, field := range []string{normalizedAddresses(h, "From"), normalizedAddresses(h, "To"), date, strings.Join(strings.Fields(subject), " ")} {
+        fmt.Fprintf(sum, "%s\x00", field)
+    }
+    sum.Write(k.body.Sum(nil))
+    return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// normalizedAddresses returns the lower-cased addresses of a header field,
+// sorted, without display names.
+func normalizedAddresses(h mail.Header, key string) string {
+    list, err := h.AddressList(key)
+    if err != nil {
+        return strings.ToLower(strings.TrimSpace(h.Get(key)))
+    }
+    addrs := make([]string, len(list))
+    for i, a := range list {
+        addrs[i] = strings.ToLower(a.Address)
+    }
+    sort.Strings(addrs)
+    return strings.Join(addrs, ",")
+}
+
+// crStripper drops carriage returns, so that CRLF and LF line endings hash
+// the same.
+type crStripper struct {
+    w io.Writer
+}
+
+func (c crStripper) Write(p []byte) (int, error) {
+    if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\r"), nil)); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// bodyKey hashes the decoded content of every MIME part, in order, with its
+// media type. The message is parsed as it is written, through a pipe.
+type bodyKey struct {
+    pw   *io.PipeWriter
+    done chan struct{}
+    key  string
+    err  error
+}
+
+func newBodyKey() *bodyKey {
+    pr, pw := io.Pipe()
+    k := &bodyKey{pw: pw, done: make(chan struct{})}
+    go func() {
+        defer close(k.done)
+        sum := sha256.New()
+        k.err = hashParts(sum, pr)
+        // Drain what the parser left, so that writers never block.
+        io.Copy(io.Discard, pr)
+        k.key = hex.EncodeToString(sum.Sum(nil))
+    }()
+    return k
+}
+
+func (k *bodyKey) Write(p []byte) (int, error) {
+    return k.pw.Write(p)
+}
+
+func (k *bodyKey) Key() (string, error) {
+    k.pw.Close()
+    <-k.done
+    if k.err != nil {
+        return "", fmt.Errorf("error parsing MIME structure: %v", k.err)
+    }
+    return k.key, nil
+}
+
+// hashParts hashes the leaf parts of a MIME message.
+func hashParts(w io.Writer, r io.Reader) error {
+    entity, err := message.Read(r)
+    if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+        return err
+    }
+    return entity.Walk(func(path []int, part *message.Entity, err error) error {
+        if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+            return err
+        }
+        mediaType, _, _ := part.Header.ContentType()
+        if strings.HasPrefix(mediaType, "multipart/") {
+            return nil
+        }
+        if mediaType == "" {
+            mediaType = "text/plain"
+        }
+        fmt.Fprintf(w, "%s\x00", mediaType)
+        if strings.HasPrefix(mediaType, "text/") {
+            // Line endings and trailing blank lines vary between copies
+            // of the same text.
+            data, err := io.ReadAll(part.Body)
+            if err != nil {
+                return err
+            }
+            data = bytes.TrimRight(bytes.ReplaceAll(data, []byte("\r"), nil), " \t\n")
+            w.Write(data)
+        } else if _, err := io.Copy(w, part.Body); err != nil {
+            return err
+        }
+        _, err = w.Write([]byte{0})
+        return err
+    })
+}
+
+// fetchRest hashes the rest of a large message, one BODY.PEEK[]<offset.length>
+// chunk at a time. A message whose chunks don't add up to its RFC822.SIZE
+// is rejected, as a key computed over part of it could match another.
+func (im *IMAPManager) fetchRest(sm *scannedMessage) error {
+    seqSet := new(imap.SeqSet)
+    seqSet.AddNum(sm.uid)
+
+    for {
+        section := &imap.BodySectionName{Peek: true, Partial: []int{int(sm.size), int(im.maxMessageMemory)}}
+        messages := make(chan *imap.Message, 1)
+        done := make(chan error, 1)
+        start := time.Now()
+        go func() {
+            done <- im.client.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages)
+        }()
+
+        var n int64
+        var copyErr error
+        for msg := range messages {
+            if r := msg.GetBody(section); r != nil && copyErr == nil {
+                n, copyErr = io.Copy(sm.key, r)
+            }
+        }
+        err := <-done
+        metrics.ObserveCommand(im.account, "fetch", start)
+        if err != nil {
+            return err
+        }
+        if copyErr != nil {
+            return copyErr
+        }
+
+        sm.size += n
+        if n < im.maxMessageMemory {
+            if sm.total != 0 && sm.size != int64(sm.total) {
+                return fmt.Errorf("fetched %d bytes, but the message has %d", sm.size, sm.total)
+            }
+            return nil
+        }
+        cli.Progress.Update("Hashed %d of %d bytes of UID %d", sm.size, sm.total, sm.uid)
+    }
 }
 
 func (im *IMAPManager) deleteEmail(email EmailInfo) error {
-    log.Printf("Deleting email [%s] UID %d...", email.Mailbox, email.Uid)
+    logger := im.logger.With("mailbox", email.Mailbox, "uid", email.Uid)
+    logger.Debug("Deleting email", "op", "delete")
 
+    start := time.Now()
     _, err := im.client.Select(email.Mailbox, false)
+    metrics.ObserveCommand(im.account, "select", start)
     if err != nil {
+        im.recordError("select")
         return fmt.Errorf("error selecting mailbox: %v", err)
     }
 
@@ -226,38 +897,348 @@ func (im *IMAPManager) deleteEmail(email EmailInfo) error {
 
     item := imap.FormatFlagsOp(imap.AddFlags, true)
     flags := []interface{}{imap.DeletedFlag}
-    if err := im.client.UidStore(seqSet, item, flags, nil); err != nil {
+    start = time.Now()
+    err = im.client.UidStore(seqSet, item, flags, nil)
+    metrics.ObserveCommand(im.account, "store", start)
+    if err != nil {
+        im.recordError("store")
         return fmt.Errorf("error marking message as deleted: %v", err)
     }
 
-    if err := im.client.Expunge(nil); err != nil {
+    start = time.Now()
+    err = im.client.Expunge(nil)
+    metrics.ObserveCommand(im.account, "expunge", start)
+    if err != nil {
+        im.recordError("expunge")
         return fmt.Errorf("error expunging mailbox: %v", err)
     }
 
-    log.Printf("Successfully deleted email [%s] UID %d", email.Mailbox, email.Uid)
+    logger.Info("Successfully deleted email", "op", "delete")
     return nil
 }
 
-func findDuplicates(emails []EmailInfo) []DuplicateGroup {
-    hashMap := make(map[string][]EmailInfo)
+// isQuarantine reports whether a mailbox is the quarantine folder or one of
+// its dated subfolders, which are never scanned for duplicates.
+func (im *IMAPManager) isQuarantine(name string) bool {
+    if im.quarantineRoot == "" {
+        return false
+    }
+    return name == im.quarantineRoot || strings.HasPrefix(name, im.quarantineRoot+im.separator())
+}
+
+// separator returns the hierarchy delimiter, or "/" on flat servers.
+func (im *IMAPManager) separator() string {
+    if im.delimiter == "" {
+        return "/"
+    }
+    return im.delimiter
+}
+
+// quarantineFolder returns the dated quarantine folder of a day, such as
+// "Duplicates/2026-10-16".
+func (im *IMAPManager) quarantineFolder(day time.Time) string {
+    return im.quarantineRoot + im.separator() + day.Format(quarantineDateLayout)
+}
 
-    log.Printf("Analyzing %d emails for duplicates...", len(emails))
+// quarantineDateLayout names the dated quarantine folders.
+const quarantineDateLayout = "2006-01-02"
+
+// createMailbox creates a mailbox and its parent quarantine folder unless
+// they already exist.
+func (im *IMAPManager) createMailbox(name string) error {
+    for _, box := range []string{im.quarantineRoot, name} {
+        mailboxes := make(chan *imap.MailboxInfo, 1)
+        done := make(chan error, 1)
+        start := time.Now()
+        go func() {
+            done <- im.client.List("", box, mailboxes)
+        }()
+        exists := false
+        for range mailboxes {
+            exists = true
+        }
+        err := <-done
+        metrics.ObserveCommand(im.account, "list", start)
+        if err != nil {
+            im.recordError("list")
+            return fmt.Errorf("error listing %s: %v", box, err)
+        }
+        if exists {
+            continue
+        }
+
+        start = time.Now()
+        err = im.client.Create(box)
+        metrics.ObserveCommand(im.account, "create", start)
+        if err != nil {
+            im.recordError("create")
+            return fmt.Errorf("error creating %s: %v", box, err)
+        }
+        im.logger.Info("Created quarantine folder", "op", "create", "mailbox", box)
+    }
+    return nil
+}
+
+// quarantineEmail moves a message into a quarantine folder, with MOVE when
+// the server advertises it, else with COPY then deletion. Some servers
+// advertise MOVE but refuse it, in which case COPY is used from then on.
+// After a COPY, only the copied message is expunged, with UID EXPUNGE; a
+// plain EXPUNGE would also remove messages other clients flagged \Deleted,
+// so without UIDPLUS the original is left flagged for them to expunge.
+func (im *IMAPManager) quarantineEmail(email EmailInfo, dest string) error {
+    logger := im.logger.With("mailbox", email.Mailbox, "uid", email.Uid)
+    logger.Debug("Moving email to quarantine", "op", "move", "destination", dest)
+
+    start := time.Now()
+    _, err := im.client.Select(email.Mailbox, false)
+    metrics.ObserveCommand(im.account, "select", start)
+    if err != nil {
+        im.recordError("select")
+        return fmt.Errorf("error selecting mailbox: %v", err)
+    }
+
+    seqSet := new(imap.SeqSet)
+    seqSet.AddNum(email.Uid)
+
+    if ok, _ := im.client.Support("MOVE"); ok && !im.moveRefused {
+        start = time.Now()
+        err = im.client.UidMove(seqSet, dest)
+        metrics.ObserveCommand(im.account, "move", start)
+        if err == nil {
+            logger.Info("Successfully moved email to quarantine", "op", "move", "destination", dest)
+            return nil
+        }
+        logger.Warn("Server refused MOVE, using COPY instead", "op", "move", "error", err)
+        im.moveRefused = true
+    }
+
+    start = time.Now()
+    err = im.client.UidCopy(seqSet, dest)
+    metrics.ObserveCommand(im.account, "copy", start)
+    if err != nil {
+        im.recordError("copy")
+        return fmt.Errorf("error copying message to %s: %v", dest, err)
+    }
+
+    start = time.Now()
+    err = im.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+    metrics.ObserveCommand(im.account, "store", start)
+    if err != nil {
+        im.recordError("store")
+        return fmt.Errorf("error marking message as deleted: %v", err)
+    }
+    if ok, _ := im.client.Support("UIDPLUS"); !ok {
+        logger.Warn("Server does not support UIDPLUS, the original is only flagged \\Deleted", "op", "move", "destination", dest)
+        return nil
+    }
+
+    start = time.Now()
+    cmd := &imap.Command{Name: "UID EXPUNGE", Arguments: []interface{}{imap.RawString(seqSet.String())}}
+    status, err := im.client.Execute(&imapext.RawCommand{Cmd: cmd}, nil)
+    if err == nil {
+        err = status.Err()
+    }
+    metrics.ObserveCommand(im.account, "expunge", start)
+    if err != nil {
+        im.recordError("expunge")
+        return fmt.Errorf("error expunging message: %v", err)
+    }
+
+    logger.Info("Successfully copied email to quarantine", "op", "move", "destination", dest)
+    return nil
+}
+
+// runPurgeQuarantine deletes the dated quarantine folders older than
+// retention, with the messages they hold.
+func runPurgeQuarantine(report *RunReport, dryRun, autoMode bool, quarantineRoot string, retention time.Duration) error {
+    im, err := connectIMAP(nil)
+    if err != nil {
+        return fmt.Errorf("failed to connect to IMAP: %v", err)
+    }
+    defer im.Close()
+    im.quarantineRoot = quarantineRoot
+
+    start := time.Now()
+    infos, err := imapext.ListMailboxes(im.client)
+    metrics.ObserveCommand(im.account, "list", start)
+    if err != nil {
+        im.recordError("list")
+        return fmt.Errorf("error listing mailboxes: %v", err)
+    }
+
+    for _, info := range infos {
+        if info.Delimiter != "" {
+            im.delimiter = info.Delimiter
+            break
+        }
+    }
+    names := make([]string, len(infos))
+    for i, info := range infos {
+        names[i] = info.Name
+    }
+    expired := im.expiredQuarantineFolders(names, retention, time.Now())
+
+    if len(expired) == 0 {
+        im.logger.Info("No quarantine folders to purge", "op", "purge")
+        return nil
+    }
+
+    fmt.Fprintf(os.Stderr, "\n=== Quarantine Folders to Purge ===\n")
+    for _, name := range expired {
+        start := time.Now()
+        status, err := im.client.Status(name, []imap.StatusItem{imap.StatusMessages})
+        metrics.ObserveCommand(im.account, "status", start)
+        if err != nil {
+            im.recordError("status")
+            report.Folder(name).AddError(err)
+            continue
+        }
+        report.Folder(name).Messages = int(status.Messages)
+        fmt.Fprintf(os.Stderr, "%s (%d messages)\n", name, status.Messages)
+    }
+
+    if dryRun {
+        im.logger.Info("Dry run: nothing purged", "op", "purge", "folders", len(expired))
+        return nil
+    }
+    if !autoMode {
+        fmt.Fprint(os.Stderr, "\nDo you want to permanently delete these folders and their messages? (yes/no): ")
+        reader := bufio.NewReader(os.Stdin)
+        input, _ := reader.ReadString('\n')
+        if strings.TrimSpace(strings.ToLower(input)) != "yes" {
+            fmt.Fprintln(os.Stderr, "Operation cancelled")
+            return nil
+        }
+    }
+
+    for _, name := range expired {
+        folder := report.Folder(name)
+        if len(folder.Errors) > 0 {
+            continue
+        }
+        if err := im.purgeFolder(name); err != nil {
+            im.logger.Error("Error purging quarantine folder", "op", "purge", "mailbox", name, "error", err)
+            folder.AddError(err)
+            continue
+        }
+        folder.Deleted = folder.Messages
+        folder.Finish()
+        metrics.Add("imap_duplicates_deleted_total", float64(folder.Deleted), "account", im.account, "mailbox", name)
+    }
+
+    if report.HasErrors() {
+        im.logger.Warn("Quarantine purge completed with errors", "op", "purge")
+    } else {
+        im.logger.Info("Quarantine purged", "op", "purge", "folders", len(expired))
+    }
+    return nil
+}
+
+// expiredQuarantineFolders returns the dated quarantine folders among
+// names that are due for purging at now, sorted. A folder dated day is
+// purged once the whole day is older than retention; a retention of zero
+// purges every dated folder.
+func (im *IMAPManager) expiredQuarantineFolders(names []string, retention time.Duration, now time.Time) []string {
+    cutoff := now.Add(-retention)
+    prefix := im.quarantineRoot + im.separator()
+    var expired []string
+    for _, name := range names {
+        if !strings.HasPrefix(name, prefix) {
+            continue
+        }
+        day, err := time.ParseInLocation(quarantineDateLayout, strings.TrimPrefix(name, prefix), now.Location())
+        if err != nil {
+            im.logger.Debug("Leaving undated folder in quarantine", "op", "purge", "mailbox", name)
+            continue
+        }
+        if day.AddDate(0, 0, 1).Before(cutoff) || retention == 0 {
+            expired = append(expired, name)
+        }
+    }
+    sort.Strings(expired)
+    return expired
+}
+
+// purgeFolder expunges every message of a mailbox and deletes it. Messages
+// are expunged first, as some servers refuse to delete non-empty folders.
+func (im *IMAPManager) purgeFolder(name string) error {
+    logger := im.logger.With("mailbox", name)
+
+    start := time.Now()
+    mbox, err := im.client.Select(name, false)
+    metrics.ObserveCommand(im.account, "select", start)
+    if err != nil {
+        im.recordError("select")
+        return fmt.Errorf("error selecting mailbox: %v", err)
+    }
+
+    if mbox.Messages > 0 {
+        seqSet := new(imap.SeqSet)
+        seqSet.AddRange(1, 0)
+        item := imap.FormatFlagsOp(imap.AddFlags, true)
+        start = time.Now()
+        err = im.client.Store(seqSet, item, []interface{}{imap.DeletedFlag}, nil)
+        metrics.ObserveCommand(im.account, "store", start)
+        if err != nil {
+            im.recordError("store")
+            return fmt.Errorf("error marking messages as deleted: %v", err)
+        }
+
+        start = time.Now()
+        err = im.client.Expunge(nil)
+        metrics.ObserveCommand(im.account, "expunge", start)
+        if err != nil {
+            im.recordError("expunge")
+            return fmt.Errorf("error expunging mailbox: %v", err)
+        }
+    }
+
+    start = time.Now()
+    _, err = im.client.Select("INBOX", true)
+    metrics.ObserveCommand(im.account, "select", start)
+    if err != nil {
+        im.recordError("select")
+        return fmt.Errorf("error leaving mailbox: %v", err)
+    }
+
+    start = time.Now()
+    err = im.client.Delete(name)
+    metrics.ObserveCommand(im.account, "delete", start)
+    if err != nil {
+        im.recordError("delete")
+        return fmt.Errorf("error deleting mailbox: %v", err)
+    }
+
+    logger.Info("Purged quarantine folder", "op", "purge", "messages", mbox.Messages)
+    return nil
+}
+
+func findDuplicates(emails []EmailInfo, strategy string) []DuplicateGroup {
+    keyMap := make(map[string][]EmailInfo)
+
+    slog.Info("Analyzing emails for duplicates", "op", "analyze", "messages", len(emails), "strategy", strategy)
 
     for _, email := range emails {
-        if email.Hash != "" {
-            hashMap[email.Hash] = append(hashMap[email.Hash], email)
+        if email.Key != "" {
+            keyMap[email.Key] = append(keyMap[email.Key], email)
         }
     }
 
     var groups []DuplicateGroup
-    for hash, duplicates := range hashMap {
+    for _, key := range sortedKeys(keyMap) {
+        duplicates := keyMap[key]
         if len(duplicates) > 1 {
-            log.Printf("Found duplicate group with %d emails: %s",
-                len(duplicates),
-                duplicates[0].Subject)
+            sort.Slice(duplicates, func(i, j int) bool {
+                if duplicates[i].Mailbox != duplicates[j].Mailbox {
+                    return duplicates[i].Mailbox < duplicates[j].Mailbox
+                }
+                return duplicates[i].Uid < duplicates[j].Uid
+            })
+            slog.Debug("Found duplicate group", "op", "analyze", "copies", len(duplicates), "subject", duplicates[0].Subject)
             groups = append(groups, DuplicateGroup{
-                Emails: duplicates,
-                Hash:   hash,
+                Emails:   duplicates,
+                Key:      key,
+                Strategy: strategy,
             })
         }
     }
@@ -265,32 +1246,225 @@ func findDuplicates(emails []EmailInfo) []DuplicateGroup {
     return groups
 }
 
-func promptForChoice(group DuplicateGroup, currentGroup, totalGroups int, dryRun bool, autoMode bool) (int, bool) {
+// Keep rules, deciding which copy of a duplicate group survives.
+const (
+    keepOldest  = "oldest"
+    keepNewest  = "newest"
+    keepFolders = "folders"
+    keepFlags   = "flags"
+)
+
+// KeepPolicy chooses the copy to keep in a duplicate group. Rules are
+// applied in order, each one breaking the ties of the previous ones, and
+// mailbox name then UID break the remaining ties, so that the choice never
+// depends on listing order.
+type KeepPolicy struct {
+    Rules   []string
+    Prefer  []string
+    Protect []string
+}
+
+func parseKeepPolicy(rules, prefer, protect string) (*KeepPolicy, error) {
+    p := &KeepPolicy{Prefer: cli.ParseFolderList(prefer), Protect: cli.ParseFolderList(protect)}
+    for _, rule := range cli.ParseFolderList(strings.ToLower(rules)) {
+        switch rule {
+        case keepOldest, keepNewest, keepFolders, keepFlags:
+        default:
+            return nil, fmt.Errorf("unknown keep rule %q (expected oldest, newest, folders or flags)", rule)
+        }
+        p.Rules = append(p.Rules, rule)
+    }
+    if len(p.Prefer) > 0 && !p.has(keepFolders) {
+        // Preferred folders come first unless placed among the rules.
+        p.Rules = append([]string{keepFolders}, p.Rules...)
+    }
+    if p.has(keepFolders) && len(p.Prefer) == 0 {
+        return nil, fmt.Errorf("the folders rule needs --prefer-folders")
+    }
+    return p, nil
+}
+
+func (p *KeepPolicy) has(rule string) bool {
+    for _, r := range p.Rules {
+        if r == rule {
+            return true
+        }
+    }
+    return false
+}
+
+// IsProtected reports whether messages of a mailbox must never be deleted.
+func (p *KeepPolicy) IsProtected(mailbox string) bool {
+    for _, pattern := range p.Protect {
+        if cli.MatchFolder(pattern, mailbox) {
+            return true
+        }
+    }
+    return false
+}
+
+// folderRank returns the position of a mailbox in the preferred folders,
+// or their count if it is not one of them.
+func (p *KeepPolicy) folderRank(mailbox string) int {
+    for i, pattern := range p.Prefer {
+        if cli.MatchFolder(pattern, mailbox) {
+            return i
+        }
+    }
+    return len(p.Prefer)
+}
+
+// compare returns a negative number if a should rather be kept than b, and
+// a positive one if b should. A copy in a protected folder is always
+// preferred, as it stays anyway.
+func (p *KeepPolicy) compare(a, b EmailInfo) int {
+    if pa, pb := p.IsProtected(a.Mailbox), p.IsProtected(b.Mailbox); pa != pb {
+        if pa {
+            return -1
+        }
+        return 1
+    }
+    for _, rule := range p.Rules {
+        var c int
+        switch rule {
+        case keepOldest:
+            c = compareAge(a, b)
+        case keepNewest:
+            c = compareAge(b, a)
+        case keepFolders:
+            c = p.folderRank(a.Mailbox) - p.folderRank(b.Mailbox)
+        case keepFlags:
+            c = countFlags(b.Flags) - countFlags(a.Flags)
+        }
+        if c != 0 {
+            return c
+        }
+    }
+    if a.Mailbox != b.Mailbox {
+        return strings.Compare(a.Mailbox, b.Mailbox)
+    }
+    return compareUint(a.Uid, b.Uid)
+}
+
+// countFlags counts the flags of a message, leaving out \Recent, which only
+// tells whether the session is the first to see it.
+func countFlags(flags []string) int {
+    n := 0
+    for _, flag := range flags {
+        if flag != imap.RecentFlag {
+            n++
+        }
+    }
+    return n
+}
+
+// compareAge returns a negative number if a reached the account before b.
+// UIDs only order the messages of one mailbox, so copies in different
+// mailboxes are compared by INTERNALDATE, and by UID when it is the same.
+func compareAge(a, b EmailInfo) int {
+    if a.Mailbox != b.Mailbox && !a.InternalDate.IsZero() && !b.InternalDate.IsZero() {
+        if c := a.InternalDate.Compare(b.InternalDate); c != 0 {
+            return c
+        }
+    }
+    return compareUint(a.Uid, b.Uid)
+}
+
+// hasFlag reports whether flags hold flag, which servers may send in any
+// case.
+func hasFlag(flags []string, flag string) bool {
+    for _, f := range flags {
+        if strings.EqualFold(f, flag) {
+            return true
+        }
+    }
+    return false
+}
+
+func compareUint(a, b uint32) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
+
+// Choose returns the index of the copy to keep in a group.
+func (p *KeepPolicy) Choose(group DuplicateGroup) int {
+    keep := 0
+    for i := 1; i < len(group.Emails); i++ {
+        if p.compare(group.Emails[i], group.Emails[keep]) < 0 {
+            keep = i
+        }
+    }
+    return keep
+}
+
+// String describes the policy, as shown with each group.
+func (p *KeepPolicy) String() string {
+    var parts []string
+    for _, rule := range p.Rules {
+        if rule == keepFolders {
+            parts = append(parts, fmt.Sprintf("folders (%s)", strings.Join(p.Prefer, ", ")))
+        } else {
+            parts = append(parts, rule)
+        }
+    }
+    parts = append(parts, "mailbox name", "UID")
+    return strings.Join(parts, ", then ")
+}
+
+func promptForChoice(group DuplicateGroup, currentGroup, totalGroups int, dryRun bool, autoMode bool, policy *KeepPolicy) (int, bool) {
+    keep := policy.Choose(group)
     if autoMode {
-        return 0, false
+        return keep, false
     }
 
-    fmt.Printf("\n=== Duplicate Group (%d/%d) ===\n", currentGroup, totalGroups)
-    fmt.Printf("Subject: %s\n", group.Emails[0].Subject)
-    fmt.Printf("Date: %s\n", group.Emails[0].Date.Format("2006-01-02 15:04:05"))
-    fmt.Printf("Content preview: %s\n", group.Emails[0].Content)
-    fmt.Printf("Found %d copies:\n\n", len(group.Emails))
+    fmt.Fprintf(os.Stderr, "\n=== Duplicate Group (%d/%d) ===\n", currentGroup, totalGroups)
+    fmt.Fprintf(os.Stderr, "Subject: %s\n", group.Emails[0].Subject)
+    fmt.Fprintf(os.Stderr, "Date: %s\n", group.Emails[0].Date.Format("2006-01-02 15:04:05"))
+    fmt.Fprintf(os.Stderr, "Content preview: %s\n", group.Emails[0].Preview)
+    fmt.Fprintf(os.Stderr, "Matched by: %s\n", strategyDescriptions[group.Strategy])
+    if group.Strategy == strategyMessageID {
+        fmt.Fprintf(os.Stderr, "Message-ID: %s\n", group.Key)
+    }
+    fmt.Fprintf(os.Stderr, "Found %d copies (* kept by policy: %s):\n\n", len(group.Emails), policy)
 
     for i, email := range group.Emails {
-        fmt.Printf("%d) [%s] %s (%d KB) - %s\n",
+        mark := " "
+        if i == keep {
+            mark = "*"
+        }
+        var notes []string
+        if len(email.Flags) > 0 {
+            notes = append(notes, strings.Join(email.Flags, " "))
+        }
+        if policy.IsProtected(email.Mailbox) {
+            notes = append(notes, "protected")
+        }
+        note := ""
+        if len(notes) > 0 {
+            note = " [" + strings.Join(notes, ", ") + "]"
+        }
+        fmt.Fprintf(os.Stderr, "%s%d) [%s] UID %d %s (%d KB) - %s%s\n",
+            mark,
             i+1,
             email.Mailbox,
+            email.Uid,
             email.Subject,
             email.Size/1024,
             email.Date.Format("2006-01-02 15:04:05"),
+            note,
         )
     }
 
     if dryRun {
-        return 0, false
+        return keep, false
     }
 
-    fmt.Printf("\nEnter number to keep (1-%d), 's' to skip, or 'q' to see summary: ", len(group.Emails))
+    fmt.Fprintf(os.Stderr, "\nEnter number to keep (1-%d), 'a' to keep the * copy, 's' to skip, or 'q' to see summary: ", len(group.Emails))
 
     reader := bufio.NewReader(os.Stdin)
     input, err := reader.ReadString('\n')
@@ -305,6 +1479,9 @@ func promptForChoice(group DuplicateGroup, currentGroup, totalGroups int, dryRun
     if input == "s" || input == "S" {
         return -1, false
     }
+    if input == "a" || input == "A" {
+        return keep, false
+    }
 
     choice, err := strconv.Atoi(input)
     if err != nil || choice < 1 || choice > len(group.Emails) {
@@ -314,20 +1491,29 @@ func promptForChoice(group DuplicateGroup, currentGroup, totalGroups int, dryRun
     return choice - 1, false
 }
 
-func confirmActions(planned []EmailInfo) bool {
-    fmt.Printf("\n=== Summary of Actions ===\n")
-    fmt.Printf("Messages to delete: %d\n\n", len(planned))
+// confirmActions asks before deleting the planned messages, or moving them
+// to the quarantine folder when set.
+func confirmActions(planned []EmailInfo, quarantine string) bool {
+    fmt.Fprintf(os.Stderr, "\n=== Summary of Actions ===\n")
+    action := "Delete"
+    if quarantine != "" {
+        fmt.Fprintf(os.Stderr, "Messages to move to %s: %d\n\n", quarantine, len(planned))
+        action = "Move"
+    } else {
+        fmt.Fprintf(os.Stderr, "Messages to delete: %d\n\n", len(planned))
+    }
 
     for i, email := range planned {
-        fmt.Printf("%d) Delete: [%s] %s (%s)\n",
+        fmt.Fprintf(os.Stderr, "%d) %s: [%s] %s (%s)\n",
             i+1,
+            action,
             email.Mailbox,
             email.Subject,
             email.Date.Format("2006-01-02 15:04:05"),
         )
     }
 
-    fmt.Print("\nDo you want to proceed with these actions? (yes/no): ")
+    fmt.Fprint(os.Stderr, "\nDo you want to proceed with these actions? (yes/no): ")
     reader := bufio.NewReader(os.Stdin)
     input, _ := reader.ReadString('\n')
     return strings.TrimSpace(strings.ToLower(input)) == "yes"
@@ -335,108 +1521,339 @@ func confirmActions(planned []EmailInfo) bool {
 
 func main() {
     dryRun := flag.Bool("dry-run", false, "Show what would be done without making any changes")
-    autoMode := flag.Bool("auto", false, "Automatically select first email in each group")
+    autoMode := flag.Bool("auto", false, "Automatically keep one email in each group, chosen by --keep")
+    reportPath := flag.String("report", "", "Write a JSON run report to this file (\"-\" for stdout, stderr by default)")
+    logFormat := flag.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+    logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
+    metricsTextfile := flag.String("metrics-textfile", "", "Write Prometheus metrics to this file after the run (default $METRICS_TEXTFILE)")
+    maxMessageMemory := flag.String("max-message-memory", "", "Fetch messages larger than this in chunks of this size, e.g. 16M, 0 to disable (default $MAX_MESSAGE_MEMORY or 16M)")
+    excludeSpecialUse := flag.String("exclude-special-use", "", "Comma-separated special-use folders to leave out (default $EXCLUDE_SPECIAL_USE or trash,junk,all)")
+    strategyFlag := flag.String("strategy", "", "What makes messages duplicates: content, message-id, headers or body (default $DUPLICATE_STRATEGY or content)")
+    keepFlag := flag.String("keep", "", "Comma-separated rules choosing the copy to keep, in order: oldest, newest, folders, flags (default $DUPLICATE_KEEP or oldest)")
+    preferFolders := flag.String("prefer-folders", "", "Comma-separated folders, by priority, in which to keep copies, e.g. \"INBOX,Archive/*\" (default $DUPLICATE_PREFER_FOLDERS)")
+    quarantine := flag.Bool("quarantine", false, "Move duplicates to a dated quarantine folder instead of deleting them (default $DUPLICATE_QUARANTINE)")
+    quarantineFolder := flag.String("quarantine-folder", "", "Folder holding the dated quarantine folders (default $QUARANTINE_FOLDER or Duplicates)")
+    olderThan := flag.String("older-than", "", "purge-quarantine: only purge folders older than this, e.g. 30d, 0 for all (default $QUARANTINE_RETENTION or 30d)")
+    protectFolders := flag.String("protect-folders", "", "Comma-separated folders never deleted from, e.g. \"Legal/*\" (default $DUPLICATE_PROTECT_FOLDERS)")
     flag.Parse()
 
+    envErr := godotenv.Load()
+    if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+        cli.Fatal("Invalid logging options", "error", err)
+    }
+    if envErr != nil {
+        cli.Fatal("Error loading .env file", "error", envErr)
+    }
+    if *metricsTextfile == "" {
+        *metricsTextfile = os.Getenv("METRICS_TEXTFILE")
+    }
+    if *excludeSpecialUse == "" {
+        *excludeSpecialUse = os.Getenv("EXCLUDE_SPECIAL_USE")
+    }
+    if *excludeSpecialUse == "" {
+        // All Mail holds a copy of every message, which would all look
+        // duplicated, and deleting there deletes them everywhere.
+        *excludeSpecialUse = "trash,junk,all"
+    }
+    exclude, err := imapext.ParseSpecialUse(*excludeSpecialUse)
+    if err != nil {
+        cli.Fatal("Invalid --exclude-special-use", "error", err)
+    }
+    if *maxMessageMemory == "" {
+        *maxMessageMemory = os.Getenv("MAX_MESSAGE_MEMORY")
+    }
+    if *maxMessageMemory == "" {
+        *maxMessageMemory = "16M"
+    }
+    chunkSize, err := cli.ParseSize(*maxMessageMemory)
+    if err != nil {
+        cli.Fatal("Invalid --max-message-memory", "error", err)
+    }
+    if *strategyFlag == "" {
+        *strategyFlag = os.Getenv("DUPLICATE_STRATEGY")
+    }
+    if *strategyFlag == "" {
+        *strategyFlag = strategyContent
+    }
+    strategy, err := parseStrategy(*strategyFlag)
+    if err != nil {
+        cli.Fatal("Invalid --strategy", "error", err)
+    }
+    if *keepFlag == "" {
+        *keepFlag = os.Getenv("DUPLICATE_KEEP")
+    }
+    if *keepFlag == "" {
+        *keepFlag = keepOldest
+    }
+    if *preferFolders == "" {
+        *preferFolders = os.Getenv("DUPLICATE_PREFER_FOLDERS")
+    }
+    if *protectFolders == "" {
+        *protectFolders = os.Getenv("DUPLICATE_PROTECT_FOLDERS")
+    }
+    policy, err := parseKeepPolicy(*keepFlag, *preferFolders, *protectFolders)
+    if err != nil {
+        cli.Fatal("Invalid --keep", "error", err)
+    }
+    if v := os.Getenv("DUPLICATE_QUARANTINE"); v != "" && !*quarantine {
+        *quarantine, err = strconv.ParseBool(v)
+        if err != nil {
+            cli.Fatal("Invalid DUPLICATE_QUARANTINE", "error", err)
+        }
+    }
+    if *quarantineFolder == "" {
+        *quarantineFolder = os.Getenv("QUARANTINE_FOLDER")
+    }
+    if *quarantineFolder == "" {
+        *quarantineFolder = "Duplicates"
+    }
+    if *olderThan == "" {
+        *olderThan = os.Getenv("QUARANTINE_RETENTION")
+    }
+    if *olderThan == "" {
+        *olderThan = "30d"
+    }
+    retention, err := cli.ParseGrace(*olderThan)
+    if err != nil {
+        cli.Fatal("Invalid --older-than", "error", err)
+    }
+
+    command := "duplicates"
+    switch flag.Arg(0) {
+    case "":
+    case "purge-quarantine":
+        command = flag.Arg(0)
+    default:
+        cli.Fatal("Unknown command (expected purge-quarantine)", "command", flag.Arg(0))
+    }
+
     if *dryRun {
-        fmt.Println("Running in dry-run mode - no changes will be made")
+        slog.Info("Running in dry-run mode - no changes will be made")
     }
     if *autoMode {
-        fmt.Println("Running in auto mode - will select first email in each group")
+        slog.Info("Running in auto mode - will keep one email in each group", "keep", policy.String())
     }
 
-    if err := godotenv.Load(); err != nil {
-        log.Fatal("Error loading .env file")
+    report := NewRunReport(command, os.Getenv("IMAP_USER"))
+    report.DryRun = *dryRun
+
+    // finish writes the report and exits, once, whether the run ended or
+    // was interrupted.
+    var once sync.Once
+    finish := func() {
+        once.Do(func() {
+            code := report.Finish()
+            if err := report.Write(*reportPath); err != nil {
+                slog.Error("Error writing report", "error", err)
+            }
+            recordRunMetrics(report)
+            if *metricsTextfile != "" {
+                if err := metrics.Restore(*metricsTextfile, "imap_duplicates_last_success_timestamp_seconds"); err != nil {
+                    slog.Warn("Error reading previous metrics", "file", *metricsTextfile, "error", err)
+                }
+                if err := metrics.WriteTextfile(*metricsTextfile); err != nil {
+                    slog.Error("Error writing metrics textfile", "error", err)
+                }
+            }
+            os.Exit(code)
+        })
     }
 
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
     go func() {
-        <-sigChan
-        fmt.Println("\nInterrupted. Exiting safely...")
-        os.Exit(0)
+        sig := <-sigChan
+        slog.Warn("Interrupted, writing the report of the actions done so far", "signal", sig.String())
+        report.Fail(fmt.Errorf("interrupted: %v", sig))
+        finish()
     }()
 
-    imap, err := connectIMAP()
+    if command == "purge-quarantine" {
+        if err := runPurgeQuarantine(report, *dryRun, *autoMode, *quarantineFolder, retention); err != nil {
+            slog.Error("Quarantine purge failed", "account", os.Getenv("IMAP_USER"), "error", err)
+            report.Fail(err)
+        }
+    } else {
+        report.Strategy = strategy
+        report.Keep = policy.String()
+        if err := runDuplicates(report, *dryRun, *autoMode, exclude, chunkSize, strategy, policy, *quarantineFolder, *quarantine); err != nil {
+            slog.Error("Duplicate management failed", "account", os.Getenv("IMAP_USER"), "error", err)
+            report.Fail(err)
+        }
+    }
+
+    finish()
+}
+
+func runDuplicates(report *RunReport, dryRun, autoMode bool, excludeSpecialUse []string, maxMessageMemory int64, strategy string, policy *KeepPolicy, quarantineRoot string, quarantine bool) error {
+    imap, err := connectIMAP(excludeSpecialUse)
     if err != nil {
-        log.Fatalf("Failed to connect to IMAP: %v", err)
+        return fmt.Errorf("failed to connect to IMAP: %v", err)
     }
     defer imap.Close()
+    imap.quarantineRoot = quarantineRoot
+    imap.maxMessageMemory = maxMessageMemory
+    imap.strategy = strategy
 
     if imap.targetFolder != "" {
-        log.Printf("Using target folder: %s", imap.targetFolder)
+        imap.logger.Info("Using target folder", "mailbox", imap.targetFolder)
     }
 
     mailboxes, err := imap.listMailboxes()
     if err != nil {
-        log.Fatalf("Error listing mailboxes: %v", err)
+        return fmt.Errorf("error listing mailboxes: %v", err)
+    }
+
+    // Envelopes and sizes are listed first, and bodies downloaded only
+    // for messages that collide with another, as most messages have no
+    // duplicate at all.
+    var scanned []EmailInfo
+    for _, mailbox := range mailboxes {
+        folder := report.Folder(mailbox)
+        emails, err := imap.scanMailbox(mailbox, folder)
+        folder.Finish()
+        if err != nil {
+            imap.logger.Error("Error scanning mailbox", "op", "scan", "mailbox", mailbox, "error", err)
+            folder.AddError(err)
+            continue
+        }
+        scanned = append(scanned, emails...)
+    }
+
+    candidates := selectCandidates(scanned, strategy)
+    imap.logger.Info("Selected candidate messages", "op", "analyze", "messages", len(scanned), "candidates", len(candidates), "strategy", strategy)
+    byMailbox := make(map[string][]EmailInfo)
+    for _, email := range candidates {
+        byMailbox[email.Mailbox] = append(byMailbox[email.Mailbox], email)
     }
 
     var allEmails []EmailInfo
     for _, mailbox := range mailboxes {
-        emails, err := imap.scanMailbox(mailbox)
+        if len(byMailbox[mailbox]) == 0 {
+            continue
+        }
+        folder := report.Folder(mailbox)
+        emails, err := imap.hashMessages(mailbox, byMailbox[mailbox], folder)
+        folder.Finish()
         if err != nil {
-            log.Printf("Error scanning %s: %v", mailbox, err)
+            imap.logger.Error("Error downloading messages", "op", "fetch", "mailbox", mailbox, "error", err)
+            folder.AddError(err)
             continue
         }
         allEmails = append(allEmails, emails...)
     }
 
-    duplicateGroups := findDuplicates(allEmails)
-    fmt.Printf("\nFound %d groups of duplicates\n", len(duplicateGroups))
+    duplicateGroups := findDuplicates(allEmails, strategy)
+    report.DuplicateGroups = len(duplicateGroups)
+    redundant := 0
+    for _, group := range duplicateGroups {
+        redundant += len(group.Emails) - 1
+    }
+    metrics.Set("imap_duplicates_groups", float64(len(duplicateGroups)), "account", imap.account)
+    metrics.Set("imap_duplicates_found", float64(redundant), "account", imap.account)
+    imap.logger.Info("Found duplicates", "op", "scan", "groups", len(duplicateGroups), "redundant", redundant, "strategy", strategy)
 
     var plannedDeletes []EmailInfo
 
     for i, group := range duplicateGroups {
-        choice, quit := promptForChoice(group, i+1, len(duplicateGroups), *dryRun, *autoMode)
+        choice, quit := promptForChoice(group, i+1, len(duplicateGroups), dryRun, autoMode, policy)
 
         if choice != -1 {
             for j, email := range group.Emails {
-                if j != choice {
-                    plannedDeletes = append(plannedDeletes, email)
+                if j == choice {
+                    continue
                 }
+                if policy.IsProtected(email.Mailbox) {
+                    imap.logger.Debug("Keeping copy in protected folder", "op", "plan", "mailbox", email.Mailbox, "uid", email.Uid)
+                    continue
+                }
+                plannedDeletes = append(plannedDeletes, email)
+            }
+        } else {
+            for _, email := range group.Emails {
+                report.Folder(email.Mailbox).Skipped++
             }
         }
 
-        if quit && !*autoMode {
-            fmt.Println("\nJumping to summary...")
+        if quit && !autoMode {
+            fmt.Fprintln(os.Stderr, "\nJumping to summary...")
             break
         }
-        if choice == -1 && !quit && !*autoMode {
-            fmt.Println("Skipping this group")
+        if choice == -1 && !quit && !autoMode {
+            fmt.Fprintln(os.Stderr, "Skipping this group")
             continue
         }
     }
 
     if len(plannedDeletes) == 0 {
-        fmt.Println("\nNo actions to perform")
-        return
+        imap.logger.Info("No actions to perform")
+        return nil
     }
 
-    if *dryRun {
-        fmt.Println("\n=== Dry Run Summary ===")
+    var dest string
+    if quarantine {
+        dest = imap.quarantineFolder(time.Now())
+        report.QuarantineFolder = dest
+    }
+
+    if dryRun {
+        fmt.Fprintln(os.Stderr, "\n=== Dry Run Summary ===")
+        action := "Would delete:"
+        if quarantine {
+            action = "Would move to " + dest + ":"
+        }
         for _, email := range plannedDeletes {
-            fmt.Printf("Would delete: [%s] %s (%s)\n",
+            fmt.Fprintf(os.Stderr, "%s [%s] %s (%s)\n",
+                action,
                 email.Mailbox,
                 email.Subject,
                 email.Date.Format("2006-01-02 15:04:05"),
             )
         }
-        return
+        return nil
     }
 
-    if !confirmActions(plannedDeletes) {
-        fmt.Println("Operation cancelled")
-        return
+    if !confirmActions(plannedDeletes, dest) {
+        fmt.Fprintln(os.Stderr, "Operation cancelled")
+        return nil
     }
 
-    fmt.Println("\nDeleting messages...")
+    if quarantine {
+        if err := imap.createMailbox(dest); err != nil {
+            return fmt.Errorf("error preparing quarantine folder: %v", err)
+        }
+        imap.logger.Info("Moving messages to quarantine", "op", "move", "mailbox", dest, "messages", len(plannedDeletes))
+    } else {
+        imap.logger.Info("Deleting messages", "op", "delete", "messages", len(plannedDeletes))
+    }
     for i, email := range plannedDeletes {
-        fmt.Printf("\rProgress: %d/%d", i+1, len(plannedDeletes))
+        cli.Progress.Update("Progress: %d/%d", i+1, len(plannedDeletes))
+        folder := report.Folder(email.Mailbox)
+        if quarantine {
+            if err := imap.quarantineEmail(email, dest); err != nil {
+                imap.logger.Error("Error moving message to quarantine", "op", "move", "mailbox", email.Mailbox, "uid", email.Uid, "error", err)
+                folder.AddError(fmt.Errorf("UID %d: %v", email.Uid, err))
+                continue
+            }
+            folder.Quarantined++
+            metrics.Add("imap_duplicates_quarantined_total", 1, "account", imap.account, "mailbox", email.Mailbox)
+            continue
+        }
         if err := imap.deleteEmail(email); err != nil {
-            fmt.Printf("\nError deleting message: %v\n", err)
+            imap.logger.Error("Error deleting message", "op", "delete", "mailbox", email.Mailbox, "uid", email.Uid, "error", err)
+            folder.AddError(fmt.Errorf("UID %d: %v", email.Uid, err))
+            continue
         }
+        folder.Deleted++
+        metrics.Add("imap_duplicates_deleted_total", 1, "account", imap.account, "mailbox", email.Mailbox)
     }
 
-    fmt.Println("\nAll actions completed!")
+    cli.Progress.Done()
+
+    if report.HasErrors() {
+        imap.logger.Warn("Completed with errors")
+    } else {
+        imap.logger.Info("All actions completed")
+    }
+    return nil
 }
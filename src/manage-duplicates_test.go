@@ -0,0 +1,602 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/emersion/go-imap"
+    "github.com/emersion/go-imap/backend"
+    "github.com/emersion/go-imap/backend/memory"
+    "github.com/emersion/go-imap/client"
+    "github.com/emersion/go-imap/server"
+)
+
+// rawMessage joins header and body lines with CRLF.
+func rawMessage(lines ...string) string {
+    return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// messageKey writes a message to the key writer of a strategy in small
+// chunks, as fetched messages arrive, and returns its key.
+func messageKey(t *testing.T, strategy, msg string) string {
+    t.Helper()
+    w := newKeyWriter(strategy)
+    for len(msg) > 0 {
+        n := 3
+        if n > len(msg) {
+            n = len(msg)
+        }
+        if _, err := w.Write([]byte(msg[:n])); err != nil {
+            t.Fatal(err)
+        }
+        msg = msg[n:]
+    }
+    key, err := w.Key()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func TestDuplicateStrategies(t *testing.T) {
+    original := rawMessage(
+        "Received: from mx1.example.com",
+        "From: Alice <alice@example.com>",
+        "To: bob@example.com, carol@example.com",
+        "Date: Mon, 1 Jan 2024 10:00:00 +0000",
+        "Subject: Quarterly report",
+        "Message-ID: <report@example.com>",
+        "",
+        "Numbers attached.",
+    )
+    // The same message delivered again, through another relay.
+    redelivered := rawMessage(
+        "Received: from mx2.example.com",
+        "X-Spam-Score: 0.1",
+        "From: ALICE@example.com",
+        "To: carol@example.com, Bob <bob@example.com>",
+        "Date: Mon, 1 Jan 2024 11:00:00 +0100",
+        "Subject: =?utf-8?q?Quarterly_report?=",
+        "Message-ID: <report@example.com>",
+        "",
+        "Numbers attached.",
+    )
+    lfEndings := strings.ReplaceAll(original, "\r\n", "\n")
+    edited := strings.Replace(original, "Numbers attached.", "Numbers attached, v2.", 1)
+    resent := strings.Replace(original, "Date: Mon, 1 Jan 2024 10:00:00", "Date: Tue, 2 Jan 2024 10:00:00", 1)
+    otherID := strings.Replace(edited, "<report@example.com>", "<report-v2@example.com>", 1)
+
+    multipart := func(boundary, subject, encoding, attachment string) string {
+        return rawMessage(
+            "From: alice@example.com",
+            "Subject: "+subject,
+            "MIME-Version: 1.0",
+            "Content-Type: multipart/mixed; boundary="+boundary,
+            "",
+            "--"+boundary,
+            "Content-Type: text/plain; charset=utf-8",
+            "Content-Transfer-Encoding: "+encoding,
+            "",
+            map[string]string{"7bit": "Caf\xc3\xa9 at noon.", "quoted-printable": "Caf=C3=A9 at noon.\r\n\r\n"}[encoding],
+            "--"+boundary,
+            "Content-Type: application/pdf",
+            "Content-Transfer-Encoding: base64",
+            "",
+            attachment,
+            "--"+boundary+"--",
+        )
+    }
+    forwarded := multipart("a", "Lunch", "7bit", "JVBERi0xLjQ=")
+    reencoded := multipart("b", "Fwd: Lunch", "quoted-printable", "JVBERi0x\r\nLjQ=")
+    otherAttachment := multipart("a", "Lunch", "7bit", "JVBERi0xLjU=")
+
+    for _, tc := range []struct {
+        name     string
+        strategy string
+        a, b     string
+        same     bool
+    }{
+        {"content/identical copies", strategyContent, original, original, true},
+        {"content/other relay", strategyContent, original, redelivered, false},
+        {"content/line endings", strategyContent, original, lfEndings, false},
+
+        {"message-id/other relay", strategyMessageID, original, redelivered, true},
+        {"message-id/edited body", strategyMessageID, original, edited, true},
+        {"message-id/other Message-ID", strategyMessageID, edited, otherID, false},
+
+        {"headers/other relay", strategyHeaders, original, redelivered, true},
+        {"headers/line endings", strategyHeaders, original, lfEndings, true},
+        {"headers/edited body", strategyHeaders, original, edited, false},
+        {"headers/other date", strategyHeaders, original, resent, false},
+
+        {"body/other headers and encodings", strategyBody, forwarded, reencoded, true},
+        {"body/other attachment", strategyBody, forwarded, otherAttachment, false},
+        {"body/edited text", strategyBody, original, edited, false},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            a, b := messageKey(t, tc.strategy, tc.a), messageKey(t, tc.strategy, tc.b)
+            if a == "" || b == "" {
+                t.Fatalf("empty keys %q and %q", a, b)
+            }
+            if (a == b) != tc.same {
+                t.Errorf("keys %q and %q, want same = %v", a, b, tc.same)
+            }
+        })
+    }
+
+    // A message the strategy cannot match has no key, which never makes
+    // it a duplicate.
+    noID := strings.Replace(original, "Message-ID: <report@example.com>\r\n", "", 1)
+    if key := messageKey(t, strategyMessageID, noID); key != "" {
+        t.Errorf("message without Message-ID has key %q", key)
+    }
+}
+
+func TestFindDuplicates(t *testing.T) {
+    emails := []EmailInfo{
+        {Mailbox: "INBOX", Uid: 9, Key: "a"},
+        {Mailbox: "Archive", Uid: 4, Key: "a"},
+        {Mailbox: "INBOX", Uid: 3, Key: "a"},
+        {Mailbox: "INBOX", Uid: 5, Key: "b"},
+        {Mailbox: "INBOX", Uid: 6, Key: ""},
+        {Mailbox: "Archive", Uid: 7, Key: ""},
+    }
+    groups := findDuplicates(emails, strategyContent)
+    if len(groups) != 1 {
+        t.Fatalf("found %d groups, want 1", len(groups))
+    }
+    var got []string
+    for _, email := range groups[0].Emails {
+        got = append(got, fmt.Sprintf("%s:%d", email.Mailbox, email.Uid))
+    }
+    if want := []string{"Archive:4", "INBOX:3", "INBOX:9"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("group holds %q, want %q", got, want)
+    }
+}
+
+func TestKeepPolicyChoose(t *testing.T) {
+    jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    mar := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    for _, tc := range []struct {
+        name                   string
+        rules, prefer, protect string
+        emails                 []EmailInfo
+        want                   string
+    }{
+        {
+            name:  "oldest across mailboxes by INTERNALDATE",
+            rules: "oldest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 2, InternalDate: mar},
+                {Mailbox: "Archive", Uid: 50, InternalDate: jan},
+            },
+            want: "Archive:50",
+        },
+        {
+            name:  "newest across mailboxes by INTERNALDATE",
+            rules: "newest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 2, InternalDate: mar},
+                {Mailbox: "Archive", Uid: 50, InternalDate: jan},
+            },
+            want: "INBOX:2",
+        },
+        {
+            name:  "oldest in one mailbox by UID",
+            rules: "oldest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 3, InternalDate: mar},
+                {Mailbox: "INBOX", Uid: 5, InternalDate: jan},
+            },
+            want: "INBOX:3",
+        },
+        {
+            name:  "zero INTERNALDATE falls back to UID",
+            rules: "oldest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 2},
+                {Mailbox: "Archive", Uid: 50, InternalDate: jan},
+            },
+            want: "INBOX:2",
+        },
+        {
+            name:  "same INTERNALDATE falls back to UID",
+            rules: "oldest",
+            emails: []EmailInfo{
+                {Mailbox: "Archive", Uid: 9, InternalDate: jan},
+                {Mailbox: "INBOX", Uid: 4, InternalDate: jan},
+            },
+            want: "INBOX:4",
+        },
+        {
+            name:  "full tie broken by mailbox name",
+            rules: "oldest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 4, InternalDate: jan},
+                {Mailbox: "Archive", Uid: 4, InternalDate: jan},
+            },
+            want: "Archive:4",
+        },
+        {
+            name:   "preferred folder before age",
+            rules:  "oldest",
+            prefer: "Archive/*",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 1, InternalDate: jan},
+                {Mailbox: "Archive/2024", Uid: 7, InternalDate: mar},
+            },
+            want: "Archive/2024:7",
+        },
+        {
+            name:   "preferred folders in order",
+            rules:  "oldest",
+            prefer: "Projects,Archive",
+            emails: []EmailInfo{
+                {Mailbox: "Archive", Uid: 1, InternalDate: jan},
+                {Mailbox: "Projects", Uid: 7, InternalDate: mar},
+                {Mailbox: "INBOX", Uid: 2, InternalDate: jan},
+            },
+            want: "Projects:7",
+        },
+        {
+            name:   "age before preferred folders when placed first",
+            rules:  "oldest,folders",
+            prefer: "Archive",
+            emails: []EmailInfo{
+                {Mailbox: "Archive", Uid: 7, InternalDate: mar},
+                {Mailbox: "INBOX", Uid: 1, InternalDate: jan},
+            },
+            want: "INBOX:1",
+        },
+        {
+            name:  "most flags, \\Recent left out",
+            rules: "flags,oldest",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 1, InternalDate: jan, Flags: []string{"\\Recent", "\\Seen"}},
+                {Mailbox: "Archive", Uid: 9, InternalDate: mar, Flags: []string{"\\Seen", "\\Flagged"}},
+            },
+            want: "Archive:9",
+        },
+        {
+            name:    "protected folder first",
+            rules:   "oldest",
+            protect: "Legal",
+            emails: []EmailInfo{
+                {Mailbox: "INBOX", Uid: 1, InternalDate: jan},
+                {Mailbox: "Legal", Uid: 30, InternalDate: mar},
+            },
+            want: "Legal:30",
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            p, err := parseKeepPolicy(tc.rules, tc.prefer, tc.protect)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // The choice does not depend on the order of the group.
+            reversed := make([]EmailInfo, len(tc.emails))
+            for i, email := range tc.emails {
+                reversed[len(tc.emails)-1-i] = email
+            }
+            for _, emails := range [][]EmailInfo{tc.emails, reversed} {
+                kept := emails[p.Choose(DuplicateGroup{Emails: emails})]
+                if got := fmt.Sprintf("%s:%d", kept.Mailbox, kept.Uid); got != tc.want {
+                    t.Errorf("kept %s, want %s", got, tc.want)
+                }
+            }
+        })
+    }
+}
+
+// startTestManager serves an IMAP backend, such as memory.New() with one
+// account, username/password, with the given extensions, and returns a
+// manager logged in to it.
+func startTestManager(t *testing.T, be backend.Backend, strategy string, extensions ...server.Extension) *IMAPManager {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := server.New(be)
+    s.AllowInsecureAuth = true
+    s.Enable(extensions...)
+    go s.Serve(l)
+    t.Cleanup(func() { s.Close() })
+
+    c, err := client.Dial(l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Login("username", "password"); err != nil {
+        t.Fatal(err)
+    }
+    im := &IMAPManager{client: c, strategy: strategy, logger: slog.Default(), account: "username"}
+    t.Cleanup(im.Close)
+    return im
+}
+
+// appendRaw creates a mailbox unless it exists and appends messages to it.
+func appendRaw(t *testing.T, im *IMAPManager, mailbox string, messages ...string) {
+    t.Helper()
+    if mailbox != "INBOX" {
+        im.client.Create(mailbox)
+    }
+    for _, msg := range messages {
+        if err := im.client.Append(mailbox, nil, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), strings.NewReader(msg)); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestCandidateSelection(t *testing.T) {
+    im := startTestManager(t, memory.New(), strategyContent)
+    report := rawMessage(
+        "From: alice@example.com",
+        "Date: Mon, 1 Jan 2024 10:00:00 +0000",
+        "Subject: Report",
+        "Message-ID: <report@example.com>",
+        "",
+        "Version A",
+    )
+    // Same envelope and size, so its candidate key collides, but another
+    // body.
+    lookalike := strings.Replace(report, "Version A", "Version B", 1)
+    unrelated := strings.Replace(report, "Subject: Report", "Subject: Agenda", 1)
+    appendRaw(t, im, "INBOX", report, lookalike, unrelated)
+    appendRaw(t, im, "Archive", report)
+
+    r := NewRunReport("duplicates", "username")
+    var scanned []EmailInfo
+    for _, mailbox := range []string{"INBOX", "Archive"} {
+        emails, err := im.scanMailbox(mailbox, r.Folder(mailbox))
+        if err != nil {
+            t.Fatal(err)
+        }
+        scanned = append(scanned, emails...)
+    }
+
+    // The memory backend's INBOX starts with one message of its own.
+    candidates := selectCandidates(scanned, strategyContent)
+    var subjects []string
+    for _, email := range candidates {
+        subjects = append(subjects, email.Mailbox+":"+email.Subject)
+    }
+    if want := []string{"INBOX:Report", "INBOX:Report", "Archive:Report"}; !reflect.DeepEqual(subjects, want) {
+        t.Fatalf("candidates are %q, want %q", subjects, want)
+    }
+
+    var hashed []EmailInfo
+    for _, mailbox := range []string{"INBOX", "Archive"} {
+        var emails []EmailInfo
+        for _, email := range candidates {
+            if email.Mailbox == mailbox {
+                emails = append(emails, email)
+            }
+        }
+        emails, err := im.hashMessages(mailbox, emails, r.Folder(mailbox))
+        if err != nil {
+            t.Fatal(err)
+        }
+        hashed = append(hashed, emails...)
+    }
+    if downloaded := r.Folder("INBOX").Downloaded + r.Folder("Archive").Downloaded; downloaded != 3 {
+        t.Errorf("downloaded %d messages, want only the 3 candidates", downloaded)
+    }
+
+    // INBOX holds the report as UID 7 and the lookalike as UID 8.
+    groups := findDuplicates(hashed, strategyContent)
+    if len(groups) != 1 {
+        t.Fatalf("found %d groups, want 1", len(groups))
+    }
+    var got []string
+    for _, email := range groups[0].Emails {
+        got = append(got, fmt.Sprintf("%s:%d", email.Mailbox, email.Uid))
+    }
+    if want := []string{"Archive:1", "INBOX:7"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("group holds %q, want the report and its copy %q", got, want)
+    }
+}
+
+// uidPlus advertises UIDPLUS and implements UID EXPUNGE on top of the
+// backend's EXPUNGE.
+type uidPlus struct{}
+
+func (uidPlus) Capabilities(c server.Conn) []string {
+    return []string{"UIDPLUS"}
+}
+
+func (uidPlus) Command(name string) server.HandlerFactory {
+    if name != "EXPUNGE" {
+        return nil
+    }
+    return func() server.Handler { return &uidExpunge{} }
+}
+
+type uidExpunge struct {
+    server.Expunge
+    seqSet *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Parse(fields []interface{}) error {
+    if len(fields) == 0 {
+        return nil
+    }
+    set, err := imap.ParseString(fields[0])
+    if err != nil {
+        return err
+    }
+    cmd.seqSet, err = imap.ParseSeqSet(set)
+    return err
+}
+
+// UidHandle expunges the messages of the set flagged \Deleted, leaving the
+// other flagged messages alone by unflagging them meanwhile.
+func (cmd *uidExpunge) UidHandle(conn server.Conn) error {
+    mbox := conn.Context().Mailbox
+    if mbox == nil {
+        return server.ErrNoMailboxSelected
+    }
+    deleted, err := mbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+    if err != nil {
+        return err
+    }
+    others := new(imap.SeqSet)
+    for _, uid := range deleted {
+        if !cmd.seqSet.Contains(uid) {
+            others.AddNum(uid)
+        }
+    }
+    if !others.Empty() {
+        if err := mbox.UpdateMessagesFlags(true, others, imap.RemoveFlags, []string{imap.DeletedFlag}); err != nil {
+            return err
+        }
+        defer mbox.UpdateMessagesFlags(true, others, imap.AddFlags, []string{imap.DeletedFlag})
+    }
+    return mbox.Expunge()
+}
+
+// mailboxFlags returns the UIDs of a mailbox, and whether each is flagged
+// \Deleted.
+func mailboxFlags(t *testing.T, im *IMAPManager, mailbox string) map[uint32]bool {
+    t.Helper()
+    mbox, err := im.client.Select(mailbox, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    uids := make(map[uint32]bool)
+    if mbox.Messages == 0 {
+        return uids
+    }
+    seqSet := new(imap.SeqSet)
+    seqSet.AddRange(1, mbox.Messages)
+    messages := make(chan *imap.Message, 10)
+    done := make(chan error, 1)
+    go func() {
+        done <- im.client.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+    }()
+    for msg := range messages {
+        uids[msg.Uid] = hasFlag(msg.Flags, imap.DeletedFlag)
+    }
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    return uids
+}
+
+func TestQuarantineEmail(t *testing.T) {
+    for _, tc := range []struct {
+        name       string
+        extensions []server.Extension
+        box        map[uint32]bool
+    }{
+        // Only the quarantined message is expunged, not the one another
+        // client flagged.
+        {"UIDPLUS", []server.Extension{uidPlus{}}, map[uint32]bool{2: true, 3: false}},
+        // Nothing is expunged, the original is left flagged.
+        {"without UIDPLUS", nil, map[uint32]bool{1: true, 2: true, 3: false}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            im := startTestManager(t, memory.New(), strategyContent, tc.extensions...)
+            im.quarantineRoot = "Duplicates"
+            appendRaw(t, im, "Box", rawMessage("Subject: one", "", "1"), rawMessage("Subject: two", "", "2"), rawMessage("Subject: three", "", "3"))
+
+            if _, err := im.client.Select("Box", false); err != nil {
+                t.Fatal(err)
+            }
+            seqSet := new(imap.SeqSet)
+            seqSet.AddNum(2)
+            if err := im.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+                t.Fatal(err)
+            }
+
+            dest := im.quarantineFolder(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+            if err := im.createMailbox(dest); err != nil {
+                t.Fatal(err)
+            }
+            if err := im.quarantineEmail(EmailInfo{Mailbox: "Box", Uid: 1}, dest); err != nil {
+                t.Fatal(err)
+            }
+
+            if got := mailboxFlags(t, im, "Box"); !reflect.DeepEqual(got, tc.box) {
+                t.Errorf("Box holds %v (UID: deleted), want %v", got, tc.box)
+            }
+            if got := mailboxFlags(t, im, dest); len(got) != 1 {
+                t.Errorf("%s holds %d messages, want 1", dest, len(got))
+            }
+        })
+    }
+}
+
+func TestExpiredQuarantineFolders(t *testing.T) {
+    im := &IMAPManager{quarantineRoot: "Duplicates", delimiter: ".", logger: slog.Default()}
+    now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+    names := []string{
+        "INBOX",
+        "Duplicates",
+        "Duplicates.notes",
+        "Duplicates.2026-10-18",
+        "Duplicates.2026-10-11",
+        "Duplicates.2026-10-10",
+        "Duplicates.2026-09-30",
+        "Archive.2020-01-01",
+    }
+    for _, tc := range []struct {
+        retention time.Duration
+        want      []string
+    }{
+        // The 11th ends less than a week before now.
+        {7 * 24 * time.Hour, []string{"Duplicates.2026-09-30", "Duplicates.2026-10-10"}},
+        {30 * 24 * time.Hour, nil},
+        {0, []string{"Duplicates.2026-09-30", "Duplicates.2026-10-10", "Duplicates.2026-10-11", "Duplicates.2026-10-18"}},
+    } {
+        if got := im.expiredQuarantineFolders(names, tc.retention, now); !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("expired after %v = %q, want %q", tc.retention, got, tc.want)
+        }
+    }
+}
+
+func TestFetchRest(t *testing.T) {
+    im := startTestManager(t, memory.New(), strategyContent)
+    im.maxMessageMemory = 16
+    // 48 bytes, so the last chunk comes back empty, and 41 bytes.
+    exact := rawMessage("Subject: exact", "", strings.Repeat("x", 28))
+    uneven := rawMessage("Subject: uneven", "", strings.Repeat("y", 20))
+    if len(exact) != 48 || len(uneven) != 41 {
+        t.Fatalf("test messages have %d and %d bytes", len(exact), len(uneven))
+    }
+    appendRaw(t, im, "Box", exact, uneven)
+
+    r := NewRunReport("duplicates", "username")
+    emails, err := im.scanMailbox("Box", r.Folder("Box"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    hashed, err := im.hashMessages("Box", emails, r.Folder("Box"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(hashed) != 2 {
+        t.Fatalf("hashed %d messages, want 2", len(hashed))
+    }
+    for i, msg := range []string{exact, uneven} {
+        if want := messageKey(t, strategyContent, msg); hashed[i].Key != want {
+            t.Errorf("UID %d reassembled to key %s, want %s", hashed[i].Uid, hashed[i].Key, want)
+        }
+    }
+    if got := r.Folder("Box").DownloadedBytes; got != 89 {
+        t.Errorf("downloaded %d bytes, want 89", got)
+    }
+
+    // A message shorter than announced is rejected.
+    sm := &scannedMessage{uid: hashed[1].Uid, total: uint32(len(uneven)) + 10, key: newKeyWriter(strategyContent)}
+    sm.key.Write([]byte(uneven[:16]))
+    sm.size = 16
+    if err := im.fetchRest(sm); err == nil {
+        t.Error("fetchRest accepted 41 bytes of a 51 byte message")
+    }
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/joho/godotenv"
+
+	"imap-backup/internal/cli"
+	"imap-backup/internal/htmlsafe"
+	"imap-backup/internal/layout"
+	"imap-backup/internal/threading"
+)
+
+type ThreadMessage struct {
+	Path       string
+	Folder     string
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Subject    string
+	From       string
+	To         string
+	Date       time.Time
+	Copies     []string
+}
+
+// ThreadHeader returns the headers the message is threaded by.
+func (m *ThreadMessage) ThreadHeader() threading.Header {
+	return threading.Header{
+		MessageID:  m.MessageID,
+		InReplyTo:  m.InReplyTo,
+		References: m.References,
+		Subject:    m.Subject,
+		Date:       m.Date,
+	}
+}
+
+type Thread struct {
+	Root     *threading.Container
+	Subject  string
+	Messages int
+	First    time.Time
+	Last     time.Time
+	Folders  []string
+}
+
+// Threader builds conversations from all messages of a backup directory.
+type Threader struct {
+	backupDir string
+	names     layout.Names
+	forest    *threading.Forest
+	Threads   []*Thread
+}
+
+func NewThreader(backupDir string) *Threader {
+	return &Threader{backupDir: backupDir}
+}
+
+func (t *Threader) Load() error {
+	names, err := layout.LoadNames(t.backupDir)
+	if err != nil {
+		return err
+	}
+	t.names = names
+
+	var files []string
+	err = filepath.WalkDir(t.backupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if layout.IsSkippedDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".eml") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error walking backup directory: %v", err)
+	}
+	sort.Strings(files)
+
+	slog.Info("Reading headers", "op", "scan", "dir", t.backupDir, "messages", len(files))
+	var messages []threading.Message
+	for _, file := range files {
+		msg, err := t.readHeaders(file)
+		if err != nil {
+			slog.Error("Error reading message", "op", "read", "file", file, "error", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	t.build(messages)
+	slog.Info("Found threads", "op", "thread", "threads", len(t.Threads))
+	return nil
+}
+
+func (t *Threader) readHeaders(file string) (*ThreadMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, _ := filepath.Rel(t.backupDir, file)
+	msg := &ThreadMessage{Path: file, Folder: t.names.Mailbox(path.Dir(filepath.ToSlash(rel)))}
+	msg.MessageID, _ = mr.Header.MessageID()
+	msg.Subject, _ = mr.Header.Subject()
+	msg.Date, _ = mr.Header.Date()
+	msg.References, _ = mr.Header.MsgIDList("References")
+	if ids, _ := mr.Header.MsgIDList("In-Reply-To"); len(ids) > 0 {
+		msg.InReplyTo = ids[0]
+	}
+	if from, err := mr.Header.AddressList("From"); err == nil && len(from) > 0 {
+		msg.From = from[0].String()
+	}
+	msg.To = mr.Header.Get("To")
+	return msg, nil
+}
+
+func (t *Threader) build(messages []threading.Message) {
+	t.forest = threading.Build(messages)
+	for _, root := range t.forest.Roots {
+		t.Threads = append(t.Threads, newThread(root))
+	}
+	// The roots come in a fixed order, which a stable sort keeps for threads
+	// ending at the same time, so thread numbers are the same on every run.
+	sort.SliceStable(t.Threads, func(i, j int) bool { return t.Threads[i].Last.After(t.Threads[j].Last) })
+}
+
+func newThread(root *threading.Container) *Thread {
+	th := &Thread{Root: root, Subject: root.Subject()}
+	folders := make(map[string]bool)
+	root.Walk(0, func(c *threading.Container, depth int) {
+		msg := c.Message.(*ThreadMessage)
+		// Same message stored in several folders: one copy is shown.
+		msg.Copies = nil
+		for _, dup := range c.Copies {
+			msg.Copies = append(msg.Copies, dup.(*ThreadMessage).Folder)
+		}
+		th.Messages++
+		if th.First.IsZero() || msg.Date.Before(th.First) {
+			th.First = msg.Date
+		}
+		if msg.Date.After(th.Last) {
+			th.Last = msg.Date
+		}
+		for _, f := range append([]string{msg.Folder}, msg.Copies...) {
+			if !folders[f] {
+				folders[f] = true
+				th.Folders = append(th.Folders, f)
+			}
+		}
+	})
+	sort.Strings(th.Folders)
+	return th
+}
+
+// Find returns the thread with the given list index (starting at 1) or
+// containing the given Message-ID.
+func (t *Threader) Find(id string) (*Thread, error) {
+	if n, err := strconv.Atoi(id); err == nil {
+		if n < 1 || n > len(t.Threads) {
+			return nil, fmt.Errorf("no thread #%d (found %d threads)", n, len(t.Threads))
+		}
+		return t.Threads[n-1], nil
+	}
+
+	id = strings.Trim(strings.TrimSpace(id), "<>")
+	c := t.forest.Root(id)
+	if c == nil {
+		return nil, fmt.Errorf("message %s not found in backup", id)
+	}
+	for _, th := range t.Threads {
+		if th.Root == c {
+			return th, nil
+		}
+	}
+	return nil, fmt.Errorf("no thread found for message %s", id)
+}
+
+// ExportMbox writes all messages of the thread to w in mboxrd format.
+func ExportMbox(th *Thread, w io.Writer) error {
+	var err error
+	th.Root.Walk(0, func(c *threading.Container, depth int) {
+		msg := c.Message.(*ThreadMessage)
+		if err != nil {
+			return
+		}
+		err = writeMboxMessage(w, msg)
+	})
+	return err
+}
+
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+func writeMboxMessage(w io.Writer, msg *ThreadMessage) error {
+	f, err := os.Open(msg.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sender := "MAILER-DAEMON"
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		sender = addr.Address
+	}
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	if _, err := fmt.Fprintf(w, "From %s %s\n", sender, date.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if mboxFromLine.MatchString(line) {
+			line = ">" + line
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+type exportedAttachment struct {
+	Name string
+	Href template.URL
+}
+
+type exportedMessage struct {
+	*ThreadMessage
+	Depth       int
+	Text        string
+	HTML        string
+	Attachments []exportedAttachment
+}
+
+// ExportHTML writes the thread as a single self-contained HTML page,
+// attachments included as data URIs.
+func ExportHTML(th *Thread, w io.Writer) error {
+	var messages []exportedMessage
+	var err error
+	th.Root.Walk(0, func(c *threading.Container, depth int) {
+		msg := c.Message.(*ThreadMessage)
+		if err != nil {
+			return
+		}
+		var em exportedMessage
+		em, err = loadExportedMessage(msg)
+		em.Depth = depth
+		messages = append(messages, em)
+	})
+	if err != nil {
+		return err
+	}
+
+	return threadTemplate.Execute(w, map[string]interface{}{
+		"Thread":   th,
+		"Messages": messages,
+	})
+}
+
+func loadExportedMessage(msg *ThreadMessage) (exportedMessage, error) {
+	em := exportedMessage{ThreadMessage: msg}
+
+	f, err := os.Open(msg.Path)
+	if err != nil {
+		return em, err
+	}
+	defer f.Close()
+
+	mr, err := mail.CreateReader(f)
+	if err != nil {
+		return em, err
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			body, _ := io.ReadAll(p.Body)
+			if contentType == "text/html" && em.HTML == "" {
+				em.HTML = htmlsafe.Sanitize(string(body))
+			} else if strings.HasPrefix(contentType, "text/") && em.Text == "" {
+				em.Text = string(body)
+			}
+		case *mail.AttachmentHeader:
+			name, _ := h.Filename()
+			contentType, _, _ := h.ContentType()
+			var buf bytes.Buffer
+			enc := base64.NewEncoder(base64.StdEncoding, &buf)
+			io.Copy(enc, p.Body)
+			enc.Close()
+			em.Attachments = append(em.Attachments, exportedAttachment{
+				Name: name,
+				Href: template.URL("data:" + contentType + ";base64," + buf.String()),
+			})
+		}
+	}
+	return em, nil
+}
+
+var threadTemplate = template.Must(template.New("thread").Funcs(template.FuncMap{
+	"date":   func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"indent": func(depth int) int { return depth * 30 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Thread.Subject}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+.message { border-left: 3px solid #2d3e50; padding-left: 10px; margin: 20px 0; }
+.headers { background: #f4f4f4; padding: 8px; }
+.headers div { margin: 2px 0; }
+pre { white-space: pre-wrap; word-wrap: break-word; }
+iframe { width: 100%; height: 400px; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>{{.Thread.Subject}}</h1>
+<p>{{.Thread.Messages}} messages from {{date .Thread.First}} to {{date .Thread.Last}}</p>
+{{range .Messages}}<div class="message" style="margin-left: {{indent .Depth}}px">
+<div class="headers">
+<div><b>From:</b> {{.From}}</div>
+<div><b>To:</b> {{.To}}</div>
+<div><b>Date:</b> {{date .Date}}</div>
+<div><b>Subject:</b> {{.Subject}}</div>
+<div><b>Message-ID:</b> {{.MessageID}}</div>
+<div><b>Folder:</b> {{.Folder}}{{range .Copies}}, {{.}}{{end}}</div>
+</div>
+{{if .HTML}}<iframe sandbox srcdoc="{{.HTML}}"></iframe>{{else}}<pre>{{.Text}}</pre>{{end}}
+{{if .Attachments}}<ul>{{range .Attachments}}
+<li><a href="{{.Href}}" download="{{.Name}}">{{.Name}}</a></li>{{end}}
+</ul>{{end}}
+</div>{{end}}
+</body>
+</html>
+`))
+
+func listThreads(t *Threader) {
+	for i, th := range t.Threads {
+		fmt.Printf("%4d) [%s] %s (%d messages, %s)\n",
+			i+1,
+			th.Last.Format("2006-01-02"),
+			th.Subject,
+			th.Messages,
+			strings.Join(th.Folders, ", "),
+		)
+	}
+}
+
+func printThread(th *Thread) {
+	fmt.Printf("=== %s ===\n", th.Subject)
+	th.Root.Walk(0, func(c *threading.Container, depth int) {
+		msg := c.Message.(*ThreadMessage)
+		fmt.Printf("%s- [%s] %s: %s (%s)\n",
+			strings.Repeat("  ", depth),
+			msg.Date.Format("2006-01-02 15:04"),
+			msg.From,
+			msg.Subject,
+			msg.Folder,
+		)
+	})
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  threads list [backup_dir]
+  threads show [--dir backup_dir] <thread-number|message-id>
+  threads export [--dir backup_dir] [--format mbox|html] [--out file] <thread-number|message-id>`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+
+	envErr := godotenv.Load()
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	backupDir := flags.String("dir", os.Getenv("BACKUP_DIR"), "Backup directory")
+	format := flags.String("format", "mbox", "Export format: mbox or html")
+	output := flags.String("out", "", "Output file (default: stdout)")
+	logFormat := flags.String("log-format", "", "Log format: text or json (default $LOG_FORMAT or text)")
+	logLevel := flags.String("log-level", "", "Log level: debug, info, warn or error (default $LOG_LEVEL or info)")
+	flags.Parse(os.Args[2:])
+
+	if err := cli.SetupLogger(*logFormat, *logLevel); err != nil {
+		cli.Fatal("Invalid logging options", "error", err)
+	}
+	if envErr != nil {
+		slog.Debug("No .env file found, using defaults")
+	}
+
+	if *backupDir == "" {
+		*backupDir = "email_backup"
+	}
+
+	switch command {
+	case "list":
+		if flags.NArg() > 0 {
+			*backupDir = flags.Arg(0)
+		}
+	case "show", "export":
+		if flags.NArg() != 1 {
+			usage()
+		}
+	default:
+		usage()
+	}
+
+	threader := NewThreader(*backupDir)
+	if err := threader.Load(); err != nil {
+		cli.Fatal("Error reading backup", "error", err)
+	}
+
+	if command == "list" {
+		listThreads(threader)
+		return
+	}
+
+	thread, err := threader.Find(flags.Arg(0))
+	if err != nil {
+		cli.Fatal("Thread not found", "id", flags.Arg(0), "error", err)
+	}
+
+	if command == "show" {
+		printThread(thread)
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			cli.Fatal("Error creating output file", "file", *output, "error", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "mbox":
+		err = ExportMbox(thread, w)
+	case "html":
+		err = ExportHTML(thread, w)
+	default:
+		cli.Fatal("Unknown format (expected mbox or html)", "format", *format)
+	}
+	if err != nil {
+		cli.Fatal("Error exporting thread", "error", err)
+	}
+
+	slog.Info("Exported thread", "op", "export", "subject", thread.Subject, "messages", thread.Messages)
+}